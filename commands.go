@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+
+	"mediapipeline/internal/api"
+	"mediapipeline/internal/storage"
+)
+
+// runCommand executes a one-off maintenance command instead of the server
+func runCommand(args []string) {
+	switch args[0] {
+	case "rotate-master-key":
+		n, err := storage.RotateMasterKey()
+		if err != nil {
+			log.Fatalf("Master key rotation failed after %d keys: %v", n, err)
+		}
+		log.Printf("Rewrapped %d business data keys under the current master key", n)
+	case "migrate-uploads":
+		migrated, failed, err := api.MigrateLegacyUploads()
+		if err != nil {
+			log.Fatalf("Upload migration failed after %d uploads: %v", migrated, err)
+		}
+		log.Printf("Migrated %d legacy uploads into business namespaces, %d could not be migrated", migrated, failed)
+	default:
+		log.Fatalf("Unknown command %q", args[0])
+	}
+}
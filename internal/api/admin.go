@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/middleware"
+	"mediapipeline/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetupAdminRoutes registers operator endpoints guarded by the admin token
+func SetupAdminRoutes(r *gin.RouterGroup, cfg *config.Config) {
+	admin := r.Group("/admin")
+	admin.Use(middleware.AdminAuth(cfg.Admin.Token))
+	{
+		admin.GET("/scrub", scrubReportHandler)
+		admin.PUT("/businesses/:id/quota", setQuotaHandler)
+		admin.PUT("/businesses/:id/pin-quota", setPinQuotaHandler)
+		admin.PUT("/businesses/:id/region", setRegionHandler)
+		admin.PUT("/businesses/:id/upload-expiry", setUploadExpiryHandler)
+		admin.GET("/regions", listRegionsHandler)
+		admin.GET("/storage/roots", listRootsHandler)
+		admin.POST("/storage/roots", addRootHandler)
+		admin.POST("/storage/roots/:id/drain", drainRootHandler)
+		admin.DELETE("/storage/roots/:id", removeRootHandler)
+	}
+}
+
+func scrubReportHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+
+	findings, err := db.ListScrubFindings(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list scrub findings"})
+		return
+	}
+	corrupt, err := db.CorruptBlobs(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list corrupt blobs"})
+		return
+	}
+
+	recent := make([]gin.H, 0, len(findings))
+	for _, f := range findings {
+		recent = append(recent, gin.H{
+			"business_id": f.BusinessID,
+			"sha256":      f.SHA256,
+			"tier":        f.Tier,
+			"outcome":     f.Outcome,
+			"detail":      f.Detail,
+			"found_at":    f.CreatedAt,
+		})
+	}
+	blobs := make([]gin.H, 0, len(corrupt))
+	for _, b := range corrupt {
+		blobs = append(blobs, gin.H{
+			"business_id": b.BusinessID,
+			"sha256":      b.SHA256,
+			"tier":        b.Tier,
+			"size":        b.Size,
+			"refs":        b.Refs,
+		})
+	}
+
+	stats := storage.GetScrubStats()
+	response := gin.H{
+		"stats": gin.H{
+			"scanned":    stats.Scanned,
+			"bytes_read": stats.BytesRead,
+			"verified":   stats.Verified,
+			"repaired":   stats.Repaired,
+			"corrupt":    stats.Corrupt,
+			"errors":     stats.Errors,
+		},
+		"corrupt_blobs": blobs,
+		"findings":      recent,
+	}
+	if !stats.LastPassAt.IsZero() {
+		response["last_pass_at"] = stats.LastPassAt
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gin-gonic/gin"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// how much of an upload content types are sniffed from, as much as
+// mimetype reads
+const sniffBytes = 3072
+
+// constraintError explains why an upload breaks the constraints of its
+// business. It is a tusd.HTTPError, so tus responses carry its status.
+type constraintError struct {
+	status int
+	msg    string
+}
+
+func (e *constraintError) Error() string   { return e.msg }
+func (e *constraintError) StatusCode() int { return e.status }
+func (e *constraintError) Body() []byte    { return []byte(e.msg) }
+
+// mediaType strips the parameters off a MIME type
+func mediaType(t string) string {
+	base, _, _ := strings.Cut(t, ";")
+	return strings.ToLower(strings.TrimSpace(base))
+}
+
+// typeAllowed reports whether a MIME type is in an allowlist of types and
+// type/* wildcards
+func typeAllowed(allowed []string, t string) bool {
+	t = mediaType(t)
+	for _, pattern := range allowed {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(t, prefix+"/") {
+				return true
+			}
+		} else if pattern == t {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUploadConstraints checks the declared size and type of a new upload
+// of a business against the business's constraints
+func checkUploadConstraints(businessID int, size int64, sizeIsDeferred bool, filetype string) error {
+	c, err := db.GetUploadConstraints(businessID)
+	if err != nil {
+		return err
+	}
+	if c.MaxBytes > 0 && !sizeIsDeferred && size > c.MaxBytes {
+		return &constraintError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("upload of %d bytes is larger than the %d bytes allowed", size, c.MaxBytes)}
+	}
+	if len(c.AllowedTypes) == 0 {
+		return nil
+	}
+	if filetype == "" {
+		return &constraintError{http.StatusUnsupportedMediaType, "uploads must declare their content type"}
+	}
+	if !typeAllowed(c.AllowedTypes, filetype) {
+		return &constraintError{http.StatusUnsupportedMediaType,
+			fmt.Sprintf("content type %s is not allowed", mediaType(filetype))}
+	}
+	return nil
+}
+
+// checkUploadLength refuses to let an upload of deferred length grow past
+// the largest upload its business allows
+func checkUploadLength(meta map[string]string, length int64) error {
+	businessID, err := strconv.Atoi(meta["business_id"])
+	if err != nil {
+		return nil
+	}
+	c, err := db.GetUploadConstraints(businessID)
+	if err != nil {
+		return err
+	}
+	if c.MaxBytes > 0 && length > c.MaxBytes {
+		return &constraintError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("upload is larger than the %d bytes allowed", c.MaxBytes)}
+	}
+	return nil
+}
+
+// types clients declare when they do not know what they upload, which any
+// content matches
+var genericTypes = map[string]bool{"": true, "application/octet-stream": true, "binary/octet-stream": true}
+
+// checkContent sniffs the type of an upload from its first bytes. The
+// upload must be what it declared itself to be and, if its business allows
+// only some types, one of them.
+func checkContent(meta map[string]string, src string) error {
+	businessID, err := strconv.Atoi(meta["business_id"])
+	if err != nil {
+		return nil
+	}
+	c, err := db.GetUploadConstraints(businessID)
+	if err != nil {
+		return err
+	}
+	declared := mediaType(meta["filetype"])
+	if genericTypes[declared] && len(c.AllowedTypes) == 0 {
+		return nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, sniffBytes)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	detected := mimetype.Detect(head[:n])
+
+	// a type also counts as the types it is a kind of, such as a docx file
+	// as a zip file
+	matches, allowed := genericTypes[declared], len(c.AllowedTypes) == 0
+	for m := detected; m != nil; m = m.Parent() {
+		matches = matches || m.Is(declared)
+		allowed = allowed || typeAllowed(c.AllowedTypes, m.String())
+	}
+	if !allowed {
+		return &constraintError{http.StatusUnsupportedMediaType,
+			fmt.Sprintf("content is %s, which is not allowed", mediaType(detected.String()))}
+	}
+	if !matches {
+		return &constraintError{http.StatusUnsupportedMediaType,
+			fmt.Sprintf("content is %s, not the declared %s", mediaType(detected.String()), declared)}
+	}
+	return nil
+}
+
+// checkWritten checks an upload stored at src against its business's
+// constraints after a write of n bytes at offset. An upload of deferred
+// length reserves quota for what it has written so far. Its type is sniffed once
+// the write completes the part of the upload it is sniffed from.
+func checkWritten(info tusd.FileInfo, src string, offset, n int64) error {
+	if info.SizeIsDeferred {
+		if err := checkUploadLength(info.MetaData, offset+n); err != nil {
+			return err
+		}
+		if err := reserveLength(info.MetaData, offset+n); err != nil {
+			return err
+		}
+	}
+	want := int64(sniffBytes)
+	if !info.SizeIsDeferred && info.Size < want {
+		want = info.Size
+	}
+	if offset < want && offset+n >= want {
+		return checkContent(info.MetaData, src)
+	}
+	return nil
+}
+
+// rejectUpload removes an upload that broke its business's constraints and
+// tells its subscribers why. Its record stays for a while as failed.
+func rejectUpload(upload tusd.Upload, info tusd.FileInfo, reason error) {
+	log.Printf("Upload %s rejected: %v", info.ID, reason)
+	releaseReservation(info.MetaData)
+	forgetExpiry(info.ID)
+	_ = tusComposer.Terminater.AsTerminatableUpload(upload).Terminate(context.Background())
+	_ = db.RDB.Del(db.Ctx, uploadDigestKey(info.ID))
+	setUploadState(info.ID, uploadstate.Failed, map[string]interface{}{
+		"error":      reason.Error(),
+		"updated_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	GetConnectionManager().BroadcastProgress(info.ID, ProgressMessage{
+		Type:      "error",
+		UploadID:  info.ID,
+		TotalSize: info.Size,
+		Status:    "failed",
+		Message:   "Upload rejected: " + reason.Error(),
+	})
+}
+
+// constrainedLength checks the length declared for an upload of deferred
+// length against its business's constraints and quota
+type constrainedLength struct {
+	tusd.LengthDeclarableUpload
+	upload tusd.Upload
+}
+
+func (u constrainedLength) DeclareLength(ctx context.Context, length int64) error {
+	info, err := u.upload.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkUploadLength(info.MetaData, length); err != nil {
+		return err
+	}
+	if err := reserveLength(info.MetaData, length); err != nil {
+		return err
+	}
+	return u.LengthDeclarableUpload.DeclareLength(ctx, length)
+}
+
+type uploadConstraintsRequest struct {
+	MaxUploadBytes int64    `json:"max_upload_bytes"`
+	AllowedTypes   []string `json:"allowed_types"`
+}
+
+func constraintsJSON(c *db.UploadConstraints) gin.H {
+	types := c.AllowedTypes
+	if types == nil {
+		types = []string{}
+	}
+	return gin.H{"max_upload_bytes": c.MaxBytes, "allowed_types": types}
+}
+
+func getUploadConstraintsHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	constraints, err := db.GetUploadConstraints(business.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load upload constraints"})
+		return
+	}
+	c.JSON(http.StatusOK, constraintsJSON(constraints))
+}
+
+func setUploadConstraintsHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	var req uploadConstraintsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if req.MaxUploadBytes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_upload_bytes must be non-negative"})
+		return
+	}
+	constraints := &db.UploadConstraints{MaxBytes: req.MaxUploadBytes}
+	for _, t := range req.AllowedTypes {
+		t = mediaType(t)
+		if _, _, err := mime.ParseMediaType(strings.Replace(t, "/*", "/x", 1)); err != nil || !strings.Contains(t, "/") || strings.HasPrefix(t, "*") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid content type %q, use type/subtype or type/*", t)})
+			return
+		}
+		constraints.AllowedTypes = append(constraints.AllowedTypes, t)
+	}
+	if err := db.SetUploadConstraints(business.ID, constraints); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set upload constraints"})
+		return
+	}
+	c.JSON(http.StatusOK, constraintsJSON(constraints))
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"mediapipeline/internal/db"
+)
+
+func TestContentMustMatchDeclaredType(t *testing.T) {
+	business := newQuotaBusiness(t, 0, 0, 0)
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	check := func(declared, content string) error {
+		t.Helper()
+		src := filepath.Join(t.TempDir(), "upload")
+		if err := os.WriteFile(src, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return checkContent(map[string]string{"business_id": strconv.Itoa(business.ID), "filetype": declared}, src)
+	}
+
+	// without an allowlist the declared type still has to be right
+	for _, c := range []struct {
+		declared, content string
+		ok                bool
+	}{
+		{"image/png", png, true},
+		{"text/plain; charset=utf-8", "plain words", true},
+		{"image/png", "plain words", false},
+		{"text/plain", png, false},
+		{"", png, true},
+		{"application/octet-stream", png, true},
+		{"binary/octet-stream", "plain words", true},
+	} {
+		if err := check(c.declared, c.content); (err == nil) != c.ok {
+			t.Errorf("%q declared for %q content: %v", c.declared, c.content[:4], err)
+		}
+	}
+
+	// with one, it also has to be allowed
+	if err := db.SetUploadConstraints(business.ID, &db.UploadConstraints{AllowedTypes: []string{"image/*"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := check("image/png", png); err != nil {
+		t.Errorf("allowed type rejected: %v", err)
+	}
+	if err := check("text/plain", "plain words"); err == nil {
+		t.Error("type outside the allowlist accepted")
+	}
+	if err := check("application/octet-stream", "plain words"); err == nil {
+		t.Error("generic type let content outside the allowlist in")
+	}
+}
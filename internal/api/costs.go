@@ -0,0 +1,280 @@
+package api
+
+import (
+	"encoding/csv"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/middleware"
+	"mediapipeline/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// prices of each tier for cost reports
+var costModel config.CostConfig
+
+// longest span a cost report covers
+const maxReportMonths = 24
+
+// SetupCostRoutes registers the endpoints that report what a business's
+// storage and downloads cost, tier by tier
+func SetupCostRoutes(r *gin.RouterGroup, cfg *config.Config) {
+	costModel = cfg.Costs
+	costs := r.Group("/costs")
+	costs.Use(middleware.RateLimiter(db.RDB, 10, time.Minute, middleware.BusinessRateLimit{}))
+	{
+		costs.GET("/report", costReportHandler)
+		costs.GET("/report.csv", costReportCSVHandler)
+	}
+}
+
+func tierPricing(tier string) config.TierPricing {
+	switch tier {
+	case storage.TierS3:
+		return costModel.S3
+	case storage.TierR2:
+		return costModel.R2
+	}
+	return costModel.CDN
+}
+
+// tierCost is the usage of a tier in a month and what it costs
+type tierCost struct {
+	Tier            string
+	StorageGBMonths float64
+	Requests        int64
+	EgressGB        float64
+	StorageCost     float64
+	RequestCost     float64
+	EgressCost      float64
+}
+
+func (t *tierCost) total() float64 {
+	return t.StorageCost + t.RequestCost + t.EgressCost
+}
+
+func (t *tierCost) price(p config.TierPricing) {
+	t.StorageCost = t.StorageGBMonths * p.StorageGBMonth
+	t.RequestCost = float64(t.Requests) / 1000 * p.Per1KRequests
+	t.EgressCost = t.EgressGB * p.EgressGB
+}
+
+// monthCost is the cost report of a business for one month. AllCDN prices
+// the same storage, requests and egress as if nothing had left the CDN tier.
+type monthCost struct {
+	Month  string
+	Tiers  []tierCost
+	AllCDN tierCost
+}
+
+func (m *monthCost) total() float64 {
+	var total float64
+	for i := range m.Tiers {
+		total += m.Tiers[i].total()
+	}
+	return total
+}
+
+// monthHours is how many hours a month of the form 2006-01 has
+func monthHours(month string) float64 {
+	start, _ := time.Parse("2006-01", month)
+	return start.AddDate(0, 1, 0).Sub(start).Hours()
+}
+
+// costReport prices the metered usage of a business month by month
+func costReport(usage []db.MeteredUsage) []monthCost {
+	var months []monthCost
+	for _, u := range usage {
+		if len(months) == 0 || months[len(months)-1].Month != u.Month {
+			months = append(months, monthCost{Month: u.Month, AllCDN: tierCost{Tier: "all_cdn"}})
+		}
+		m := &months[len(months)-1]
+		hours := monthHours(u.Month)
+		t := tierCost{
+			Tier:            u.Tier,
+			StorageGBMonths: u.ByteHours / (1 << 30) / hours,
+			Requests:        u.Requests,
+			EgressGB:        float64(u.EgressBytes) / (1 << 30),
+		}
+		t.price(tierPricing(u.Tier))
+		m.Tiers = append(m.Tiers, t)
+
+		m.AllCDN.StorageGBMonths += u.LogicalByteHours / (1 << 30) / hours
+		m.AllCDN.Requests += u.Requests
+		m.AllCDN.EgressGB += t.EgressGB
+	}
+	for i := range months {
+		months[i].AllCDN.price(costModel.CDN)
+	}
+	return months
+}
+
+// money rounds dollars to a hundredth of a cent
+func money(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
+
+func tierCostJSON(t *tierCost) gin.H {
+	return gin.H{
+		"storage_gb_months": math.Round(t.StorageGBMonths*1e6) / 1e6,
+		"requests":          t.Requests,
+		"egress_gb":         math.Round(t.EgressGB*1e6) / 1e6,
+		"storage_cost":      money(t.StorageCost),
+		"request_cost":      money(t.RequestCost),
+		"egress_cost":       money(t.EgressCost),
+		"total_cost":        money(t.total()),
+	}
+}
+
+// reportMonths reads the from and to months of a report, both defaulting
+// to the current month
+func reportMonths(c *gin.Context) (string, string, bool) {
+	current := time.Now().UTC().Format("2006-01")
+	from, to := c.DefaultQuery("from", current), c.DefaultQuery("to", current)
+	start, err1 := time.Parse("2006-01", from)
+	end, err2 := time.Parse("2006-01", to)
+	if err1 != nil || err2 != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must be months like 2006-01"})
+		return "", "", false
+	}
+	if end.Before(start) || !start.AddDate(0, maxReportMonths, 0).After(end) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a report covers 1 to 24 months, from no later than to"})
+		return "", "", false
+	}
+	return from, to, true
+}
+
+// businessCostReport loads the cost report a request asks for
+func businessCostReport(c *gin.Context) (*db.Business, string, string, []monthCost, bool) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return nil, "", "", nil, false
+	}
+	from, to, ok := reportMonths(c)
+	if !ok {
+		return nil, "", "", nil, false
+	}
+	usage, err := db.MonthlyUsage(business.ID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load metered usage"})
+		return nil, "", "", nil, false
+	}
+	return business, from, to, costReport(usage), true
+}
+
+// costReportHandler reports a business's costs month by month, with what
+// the same usage would have cost had everything stayed in the CDN tier
+func costReportHandler(c *gin.Context) {
+	business, from, to, months, ok := businessCostReport(c)
+	if !ok {
+		return
+	}
+
+	current := time.Now().UTC().Format("2006-01")
+	list := make([]gin.H, 0, len(months))
+	var total, allCDN float64
+	for i := range months {
+		m := &months[i]
+		tiers := gin.H{}
+		for j := range m.Tiers {
+			tiers[m.Tiers[j].Tier] = tierCostJSON(&m.Tiers[j])
+		}
+		savings := m.AllCDN.total() - m.total()
+		month := gin.H{
+			"month":      m.Month,
+			"complete":   m.Month < current,
+			"tiers":      tiers,
+			"total_cost": money(m.total()),
+			"all_cdn":    tierCostJSON(&m.AllCDN),
+			"savings":    money(savings),
+		}
+		if m.AllCDN.total() > 0 {
+			month["savings_percent"] = math.Round(savings/m.AllCDN.total()*10000) / 100
+		}
+		list = append(list, month)
+		total += m.total()
+		allCDN += m.AllCDN.total()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"business_id":   business.ID,
+		"from":          from,
+		"to":            to,
+		"currency":      "USD",
+		"months":        list,
+		"total_cost":    money(total),
+		"all_cdn_cost":  money(allCDN),
+		"total_savings": money(allCDN - total),
+	})
+}
+
+// costReportCSVHandler exports the same report as CSV, one row per tier and
+// month followed by the month's total and all-CDN rows
+func costReportCSVHandler(c *gin.Context) {
+	business, from, to, months, ok := businessCostReport(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", contentDisposition("costs-"+strconv.Itoa(business.ID)+"-"+from+"-"+to+".csv"))
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{"month", "tier", "storage_gb_months", "requests", "egress_gb",
+		"storage_cost", "request_cost", "egress_cost", "total_cost"})
+	row := func(month string, t *tierCost) {
+		_ = w.Write([]string{
+			month,
+			t.Tier,
+			strconv.FormatFloat(t.StorageGBMonths, 'f', 6, 64),
+			strconv.FormatInt(t.Requests, 10),
+			strconv.FormatFloat(t.EgressGB, 'f', 6, 64),
+			strconv.FormatFloat(t.StorageCost, 'f', 4, 64),
+			strconv.FormatFloat(t.RequestCost, 'f', 4, 64),
+			strconv.FormatFloat(t.EgressCost, 'f', 4, 64),
+			strconv.FormatFloat(t.total(), 'f', 4, 64),
+		})
+	}
+	for i := range months {
+		m := &months[i]
+		sum := tierCost{Tier: "total"}
+		for j := range m.Tiers {
+			t := &m.Tiers[j]
+			row(m.Month, t)
+			sum.StorageGBMonths += t.StorageGBMonths
+			sum.Requests += t.Requests
+			sum.EgressGB += t.EgressGB
+			sum.StorageCost += t.StorageCost
+			sum.RequestCost += t.RequestCost
+			sum.EgressCost += t.EgressCost
+		}
+		row(m.Month, &sum)
+		row(m.Month, &m.AllCDN)
+	}
+	w.Flush()
+}
+
+// RunMetering meters what every business stores in each tier once per
+// interval. Instances share the work through Redis so each interval is
+// metered once.
+func RunMetering(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		slot := now.Truncate(interval)
+		claimed, err := db.RDB.SetNX(db.Ctx, "metering:"+strconv.FormatInt(slot.Unix(), 10), 1, 2*interval).Result()
+		if err != nil || !claimed {
+			continue
+		}
+		if err := db.AccrueStorage(slot.UTC().Format("2006-01"), interval.Hours()); err != nil {
+			log.Printf("Metering storage failed: %v", err)
+		}
+	}
+}
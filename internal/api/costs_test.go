@@ -0,0 +1,98 @@
+package api
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+)
+
+func TestCostReportPricesEachTier(t *testing.T) {
+	costModel = config.CostConfig{
+		CDN: config.TierPricing{StorageGBMonth: 0.10, Per1KRequests: 0.01, EgressGB: 0.05},
+		S3:  config.TierPricing{StorageGBMonth: 0.02, Per1KRequests: 0.005, EgressGB: 0.09},
+		R2:  config.TierPricing{StorageGBMonth: 0.01, Per1KRequests: 0.36},
+	}
+	t.Cleanup(func() { costModel = config.CostConfig{} })
+	const gib = 1 << 30
+	hours := monthHours("2026-02")
+	if hours != 28*24 {
+		t.Fatalf("February 2026 has %v hours", hours)
+	}
+
+	months := costReport([]db.MeteredUsage{
+		{Month: "2026-02", Tier: "cdn", ByteHours: 2 * gib * hours, LogicalByteHours: 2 * gib * hours, Requests: 3000, EgressBytes: 4 * gib},
+		// a GB-month compressed to half
+		{Month: "2026-02", Tier: "r2", ByteHours: gib * hours / 2, LogicalByteHours: gib * hours, Requests: 1000},
+		{Month: "2026-03", Tier: "s3", ByteHours: gib * monthHours("2026-03"), LogicalByteHours: gib * monthHours("2026-03")},
+	})
+	if len(months) != 2 || len(months[0].Tiers) != 2 || len(months[1].Tiers) != 1 {
+		t.Fatalf("report = %+v, want two months of two and one tiers", months)
+	}
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-9 }
+
+	cdn, r2 := months[0].Tiers[0], months[0].Tiers[1]
+	if !near(cdn.StorageCost, 0.20) || !near(cdn.RequestCost, 0.03) || !near(cdn.EgressCost, 0.20) {
+		t.Errorf("CDN tier costs %+v", cdn)
+	}
+	if !near(r2.StorageGBMonths, 0.5) || !near(r2.StorageCost, 0.005) || !near(r2.RequestCost, 0.36) {
+		t.Errorf("R2 tier costs %+v", r2)
+	}
+	// the same usage in the CDN tier stores the content uncompressed
+	all := months[0].AllCDN
+	if !near(all.StorageGBMonths, 3) || all.Requests != 4000 || !near(all.total(), 0.30+0.04+0.20) {
+		t.Errorf("all-CDN costs %+v", all)
+	}
+	if !near(months[0].total(), 0.20+0.03+0.20+0.005+0.36) {
+		t.Errorf("February costs %v", months[0].total())
+	}
+	if s3 := months[1].Tiers[0]; !near(s3.StorageCost, 0.02) {
+		t.Errorf("S3 tier costs %+v in March", s3)
+	}
+}
+
+func TestCostReportCoversOnlyItsBusiness(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	other, err := db.CreateBusiness("other", "other@example.com", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordRequest(business.ID, "2026-01", "cdn", 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordRequest(other.ID, "2026-01", "cdn", 5<<30); err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := apiJSON(t, srv, http.MethodGet, "/api/v1/costs/report?from=2026-01&to=2026-02", business, nil)
+	months, _ := body["months"].([]interface{})
+	if status != http.StatusOK || len(months) != 1 {
+		t.Fatalf("report = %d, %v, want one month", status, body)
+	}
+	cdn := months[0].(map[string]interface{})["tiers"].(map[string]interface{})["cdn"].(map[string]interface{})
+	if cdn["requests"] != 1.0 || cdn["egress_gb"] != 1.0 {
+		t.Fatalf("CDN tier reports %v, want only the business's own download", cdn)
+	}
+
+	if status, _ := apiJSON(t, srv, http.MethodGet, "/api/v1/costs/report?from=2026-03&to=2026-01", business, nil); status != http.StatusBadRequest {
+		t.Fatalf("report ending before it starts = %d, want 400", status)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/costs/report.csv?from=2026-01&to=2026-01", nil)
+	req.Header.Set("X-API-KEY", business.APIKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	csv, _ := io.ReadAll(resp.Body)
+	lines := strings.Split(strings.TrimSpace(string(csv)), "\n")
+	// header, the CDN tier, the month's total and the all-CDN row
+	if resp.StatusCode != http.StatusOK || len(lines) != 4 || !strings.HasPrefix(lines[1], "2026-01,cdn,") {
+		t.Fatalf("CSV report = %d:\n%s", resp.StatusCode, csv)
+	}
+}
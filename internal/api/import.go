@@ -0,0 +1,283 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/uploadstate"
+
+	"github.com/gin-gonic/gin"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// importer of uploads from remote URLs, set up with the tus handler
+var urlImports = newImporter(config.ImportConfig{MaxBytes: 1 << 30, Timeout: 10 * time.Minute, MaxRedirects: 5})
+
+// importError explains why a remote URL could not be imported. It is a
+// tusd.HTTPError, so it is answered like the errors of other uploads.
+type importError struct {
+	status int
+	msg    string
+}
+
+func (e *importError) Error() string   { return e.msg }
+func (e *importError) StatusCode() int { return e.status }
+func (e *importError) Body() []byte    { return []byte(e.msg) }
+
+var (
+	errAddressBlocked   = errors.New("address is not allowed")
+	errTooManyRedirects = errors.New("too many redirects")
+	errImportTruncated  = &importError{http.StatusBadGateway, "source ended before all of its content was sent"}
+	errImportTimeout    = &importError{http.StatusGatewayTimeout, "source took longer to send than allowed"}
+)
+
+// internal networks the IP package does not classify, which imports stay
+// out of as well
+var reservedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",     // this network
+		"100.64.0.0/10", // carrier-grade NAT
+		"192.0.0.0/24",  // IETF protocol assignments
+		"198.18.0.0/15", // benchmarking
+		"240.0.0.0/4",   // reserved
+		"64:ff9b::/96",  // NAT64, which reaches IPv4 addresses
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// addressAllowed reports whether imports may connect to ip. Public
+// addresses are allowed; internal ones only if they are in allowed.
+func addressAllowed(ip net.IP, allowed []*net.IPNet) bool {
+	for _, n := range allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// importer fetches remote URLs for imports. Addresses are checked as they
+// are connected to, after names are resolved, so neither redirects nor DNS
+// can lead an import to an internal address.
+type importer struct {
+	client   *http.Client
+	maxBytes int64
+	timeout  time.Duration
+}
+
+func newImporter(cfg config.ImportConfig) *importer {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !addressAllowed(ip, cfg.AllowedNets) {
+				return fmt.Errorf("%w: %s", errAddressBlocked, host)
+			}
+			return nil
+		},
+	}
+	return &importer{
+		client: &http.Client{
+			Transport: &http.Transport{
+				// a proxy would connect on our behalf, past the checks
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   30 * time.Second,
+				ResponseHeaderTimeout: time.Minute,
+				MaxIdleConns:          16,
+				IdleConnTimeout:       time.Minute,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > cfg.MaxRedirects {
+					return errTooManyRedirects
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+				}
+				return nil
+			},
+		},
+		maxBytes: cfg.MaxBytes,
+		timeout:  cfg.Timeout,
+	}
+}
+
+// open requests a remote URL. The body of the response it returns ends in
+// an error rather than grow past the largest import allowed.
+func (im *importer) open(ctx context.Context, rawURL string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, &importError{http.StatusBadRequest, "url must be an absolute http or https URL"}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, &importError{http.StatusBadRequest, "invalid url"}
+	}
+	req.Header.Set("User-Agent", "mediapipeline-import/1.0")
+
+	resp, err := im.client.Do(req)
+	switch {
+	case errors.Is(err, errAddressBlocked):
+		return nil, &importError{http.StatusForbidden, "source address is not allowed"}
+	case errors.Is(err, errTooManyRedirects):
+		return nil, &importError{http.StatusBadGateway, "source redirected too many times"}
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil, &importError{http.StatusGatewayTimeout, "source did not answer in time"}
+	case err != nil:
+		log.Printf("Failed to fetch %s for import: %v", u.Redacted(), err)
+		return nil, &importError{http.StatusBadGateway, "failed to fetch source"}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &importError{http.StatusBadGateway, fmt.Sprintf("source answered %s", resp.Status)}
+	}
+	if resp.ContentLength > im.maxBytes {
+		resp.Body.Close()
+		return nil, im.tooLarge()
+	}
+	resp.Body = &importBody{ReadCloser: resp.Body, left: im.maxBytes, tooLarge: im.tooLarge()}
+	return resp, nil
+}
+
+func (im *importer) tooLarge() error {
+	return &importError{http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("source is larger than the %d bytes allowed", im.maxBytes)}
+}
+
+// importBody is the body of a remote URL, which fails once it passes the
+// largest import allowed, ends early or takes too long
+type importBody struct {
+	io.ReadCloser
+	left     int64
+	tooLarge error
+}
+
+func (b *importBody) Read(p []byte) (int, error) {
+	// one byte past the limit shows whether there is more
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if b.left -= int64(n); b.left < 0 {
+		return n, b.tooLarge
+	}
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		err = errImportTruncated
+	case errors.Is(err, context.DeadlineExceeded):
+		err = errImportTimeout
+	}
+	return n, err
+}
+
+type importRequest struct {
+	URL      string            `json:"url" binding:"required"`
+	Filename string            `json:"filename"`
+	Filetype string            `json:"filetype"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// importUploadHandler creates an upload from a remote URL. The source is
+// requested before it answers, so clients hear right away of sources that
+// cannot be imported; its content is then imported in the background.
+// Subscribers of the upload get its progress over WebSocket as of a tus
+// upload, and it is completed the same way.
+func importUploadHandler(c *gin.Context) {
+	var req importRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), urlImports.timeout)
+	resp, err := urlImports.open(ctx, req.URL)
+	if err != nil {
+		cancel()
+		writeUploadError(c, err)
+		return
+	}
+
+	meta := make(tusd.MetaData)
+	for key, value := range req.Metadata {
+		meta[key] = value
+	}
+	meta["filename"] = req.Filename
+	if meta["filename"] == "" {
+		meta["filename"] = sourceFilename(resp)
+	}
+	meta["filetype"] = req.Filetype
+	if meta["filetype"] == "" {
+		meta["filetype"] = resp.Header.Get("Content-Type")
+	}
+	info := tusd.FileInfo{Size: resp.ContentLength, MetaData: meta}
+	if info.Size < 0 {
+		info.Size, info.SizeIsDeferred = 0, true
+	}
+
+	abort := func(err error) {
+		resp.Body.Close()
+		cancel()
+		writeUploadError(c, err)
+	}
+	if err := prepareUpload(c.Request.Header, &info); err != nil {
+		abort(err)
+		return
+	}
+	upload, info, err := createUpload(ctx, info, c.GetHeader("X-Upload-Token"))
+	if err != nil {
+		abort(err)
+		return
+	}
+	log.Printf("Upload %s importing from %s", info.ID, resp.Request.URL.Redacted())
+
+	go func() {
+		defer cancel()
+		defer resp.Body.Close()
+		// a failed import is rejected like any other upload
+		_ = completeUpload(ctx, upload, info, resp.Body)
+	}()
+
+	body := gin.H{"upload_id": info.ID, "status": string(uploadstate.Created)}
+	if !info.SizeIsDeferred {
+		body["size"] = info.Size
+	}
+	c.JSON(http.StatusAccepted, body)
+}
+
+// sourceFilename names an import after its source, by the filename it was
+// sent with or else the last element of its URL
+func sourceFilename(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return ""
+}
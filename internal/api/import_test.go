@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/config"
+)
+
+// newTestOrigin serves content to import, with /redirect/{n} redirecting n
+// times before it gets there
+func newTestOrigin(t *testing.T, content string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/file.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		io.WriteString(w, content)
+	})
+	mux.HandleFunc("/chunked", func(w http.ResponseWriter, r *http.Request) {
+		// flushing before the end leaves the length unknown
+		io.WriteString(w, content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		io.WriteString(w, content[len(content)/2:])
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/redirect/", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if n == 0 {
+			http.Redirect(w, r, "/file.txt", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/redirect/"+strconv.Itoa(n-1), http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func loopbackAllowed() config.ImportConfig {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	return config.ImportConfig{MaxBytes: 1 << 20, Timeout: time.Minute, MaxRedirects: 2, AllowedNets: []*net.IPNet{loopback}}
+}
+
+func importStatus(err error) int {
+	var ierr *importError
+	if errors.As(err, &ierr) {
+		return ierr.status
+	}
+	return 0
+}
+
+func TestImportBlocksInternalAddresses(t *testing.T) {
+	for addr, allowed := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+		"64:ff9b::a00:1":  false,
+	} {
+		if got := addressAllowed(net.ParseIP(addr), nil); got != allowed {
+			t.Errorf("addressAllowed(%s) = %v, want %v", addr, got, allowed)
+		}
+	}
+
+	origin := newTestOrigin(t, "hello")
+	im := newImporter(config.ImportConfig{MaxBytes: 1 << 20, Timeout: time.Minute, MaxRedirects: 2})
+	_, err := im.open(context.Background(), origin.URL+"/file.txt")
+	if importStatus(err) != http.StatusForbidden {
+		t.Fatalf("import of a loopback origin: got %v, want it blocked", err)
+	}
+	// names are checked by the addresses they resolve to
+	_, err = im.open(context.Background(), strings.Replace(origin.URL, "127.0.0.1", "localhost", 1)+"/file.txt")
+	if importStatus(err) != http.StatusForbidden {
+		t.Fatalf("import by name of a loopback origin: got %v, want it blocked", err)
+	}
+}
+
+func TestImportFetchesAllowedOrigin(t *testing.T) {
+	content := strings.Repeat("imported content ", 100)
+	origin := newTestOrigin(t, content)
+	im := newImporter(loopbackAllowed())
+
+	for _, path := range []string{"/file.txt", "/chunked", "/redirect/1"} {
+		resp, err := im.open(context.Background(), origin.URL+path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(got) != content {
+			t.Fatalf("%s: read %d bytes, %v", path, len(got), err)
+		}
+	}
+}
+
+func TestImportLimits(t *testing.T) {
+	origin := newTestOrigin(t, strings.Repeat("x", 4096))
+	cfg := loopbackAllowed()
+	cfg.MaxBytes = 1000
+	im := newImporter(cfg)
+
+	// too large by its declared length
+	if _, err := im.open(context.Background(), origin.URL+"/file.txt"); importStatus(err) != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %v, want it too large", err)
+	}
+	// too large once read, without a declared length
+	resp, err := im.open(context.Background(), origin.URL+"/chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if importStatus(err) != http.StatusRequestEntityTooLarge || n > cfg.MaxBytes+1 {
+		t.Fatalf("read %d bytes, %v; want it too large", n, err)
+	}
+
+	im = newImporter(loopbackAllowed())
+	if _, err := im.open(context.Background(), origin.URL+"/redirect/3"); importStatus(err) != http.StatusBadGateway {
+		t.Fatalf("got %v, want too many redirects", err)
+	}
+	if _, err := im.open(context.Background(), origin.URL+"/missing"); importStatus(err) != http.StatusBadGateway {
+		t.Fatalf("got %v, want the source's error", err)
+	}
+	if _, err := im.open(context.Background(), "file:///etc/passwd"); importStatus(err) != http.StatusBadRequest {
+		t.Fatalf("got %v, want the scheme refused", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+	if _, err := im.open(ctx, origin.URL+"/file.txt"); importStatus(err) != http.StatusGatewayTimeout {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,527 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/middleware"
+	"mediapipeline/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis list the lifecycle evaluator queues jobs on
+const lifecycleQueue = "lifecycle:jobs"
+
+// A worker moves the job it runs onto its own processing list and removes
+// it once the job has run. It keeps a heartbeat key alive meanwhile, so the
+// jobs of a worker that stopped halfway can be told apart and queued again.
+const (
+	lifecycleProcessingPrefix = "lifecycle:processing:"
+	lifecycleHeartbeatPrefix  = "lifecycle:worker:"
+	lifecycleHeartbeatTTL     = 30 * time.Second
+)
+
+// SetupLifecycleRoutes registers the endpoints that manage a business's
+// lifecycle rules
+func SetupLifecycleRoutes(r *gin.RouterGroup) {
+	lifecycle := r.Group("/lifecycle")
+	lifecycle.Use(middleware.RateLimiter(db.RDB, 10, time.Minute, middleware.BusinessRateLimit{}))
+	{
+		lifecycle.GET("/rules", listLifecycleRulesHandler)
+		lifecycle.POST("/rules", createLifecycleRuleHandler)
+		lifecycle.GET("/rules/:id", getLifecycleRuleHandler)
+		lifecycle.PATCH("/rules/:id", updateLifecycleRuleHandler)
+		lifecycle.DELETE("/rules/:id", deleteLifecycleRuleHandler)
+		lifecycle.GET("/rules/:id/dry-run", ruleDryRunHandler)
+		lifecycle.POST("/dry-run", dryRunHandler)
+	}
+}
+
+// parseTags reads tags in the URL query form S3 uses for x-amz-tagging,
+// "key1=value1&key2=value2"
+func parseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	if s == "" {
+		return tags, nil
+	}
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, fmt.Errorf("tags must be URL query encoded: %w", err)
+	}
+	for key, v := range values {
+		if len(v) > 1 {
+			return nil, fmt.Errorf("tag %q is given more than once", key)
+		}
+		tags[key] = v[0]
+	}
+	return tags, validTags(tags)
+}
+
+// validTags applies the S3 limits on object tags
+func validTags(tags map[string]string) error {
+	if len(tags) > 10 {
+		return errors.New("an object can have at most 10 tags")
+	}
+	for key, value := range tags {
+		if key == "" || utf8.RuneCountInString(key) > 128 || !utf8.ValidString(key) {
+			return fmt.Errorf("tag key %q must be 1 to 128 characters", key)
+		}
+		if utf8.RuneCountInString(value) > 256 || !utf8.ValidString(value) {
+			return fmt.Errorf("value of tag %q must be at most 256 characters", key)
+		}
+	}
+	return nil
+}
+
+type lifecycleRuleRequest struct {
+	Name        string            `json:"name"`
+	Action      string            `json:"action" binding:"required"`
+	TargetTier  string            `json:"target_tier"`
+	Tags        map[string]string `json:"tags"`
+	Username    string            `json:"username"`
+	ContentType string            `json:"content_type"`
+	AgeDays     int               `json:"age_days"`
+	IdleDays    int               `json:"idle_days"`
+	Enabled     *bool             `json:"enabled"`
+}
+
+// lifecycleRule validates a rule request of a business
+func lifecycleRule(business *db.Business, req *lifecycleRuleRequest) (*db.LifecycleRule, error) {
+	switch req.Action {
+	case db.LifecycleDelete:
+		if req.TargetTier != "" {
+			return nil, errors.New("target_tier only applies to transition rules")
+		}
+	case db.LifecycleTransition:
+		switch req.TargetTier {
+		case storage.TierCDN, storage.TierS3, storage.TierR2:
+		default:
+			return nil, errors.New("target_tier must be one of cdn, s3 or r2")
+		}
+	default:
+		return nil, errors.New("action must be delete or transition")
+	}
+	if req.AgeDays < 0 || req.IdleDays < 0 {
+		return nil, errors.New("age_days and idle_days cannot be negative")
+	}
+	if req.AgeDays == 0 && req.IdleDays == 0 {
+		return nil, errors.New("a rule needs age_days or idle_days")
+	}
+	if req.ContentType != "" && !strings.Contains(req.ContentType, "/") {
+		return nil, errors.New(`content_type must be a media type such as "image/png" or "image/*"`)
+	}
+	if err := validTags(req.Tags); err != nil {
+		return nil, err
+	}
+
+	rule := &db.LifecycleRule{
+		BusinessID:  business.ID,
+		Name:        req.Name,
+		Action:      req.Action,
+		TargetTier:  req.TargetTier,
+		Tags:        req.Tags,
+		Username:    req.Username,
+		ContentType: strings.ToLower(req.ContentType),
+		AgeDays:     req.AgeDays,
+		IdleDays:    req.IdleDays,
+		Enabled:     req.Enabled == nil || *req.Enabled,
+	}
+	if rule.Tags == nil {
+		rule.Tags = map[string]string{}
+	}
+	return rule, nil
+}
+
+func lifecycleRuleJSON(r *db.LifecycleRule) gin.H {
+	rule := gin.H{
+		"name":    r.Name,
+		"action":  r.Action,
+		"enabled": r.Enabled,
+		"filter": gin.H{
+			"tags":         r.Tags,
+			"username":     r.Username,
+			"content_type": r.ContentType,
+			"age_days":     r.AgeDays,
+			"idle_days":    r.IdleDays,
+		},
+	}
+	if r.Action == db.LifecycleTransition {
+		rule["target_tier"] = r.TargetTier
+	}
+	// rules given to a dry run are not saved
+	if r.ID != 0 {
+		rule["id"] = r.ID
+		rule["created_at"] = r.CreatedAt
+	}
+	return rule
+}
+
+// businessRule loads the rule named by the id parameter
+func businessRule(c *gin.Context, business *db.Business) (*db.LifecycleRule, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return nil, false
+	}
+	rule, err := db.GetLifecycleRule(business.ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load rule"})
+		return nil, false
+	}
+	return rule, true
+}
+
+func listLifecycleRulesHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	rules, err := db.ListLifecycleRules(business.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list rules"})
+		return
+	}
+	list := make([]gin.H, 0, len(rules))
+	for i := range rules {
+		list = append(list, lifecycleRuleJSON(&rules[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": list})
+}
+
+func createLifecycleRuleHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	var req lifecycleRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	rule, err := lifecycleRule(business, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.CreateLifecycleRule(rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create rule"})
+		return
+	}
+	c.JSON(http.StatusCreated, lifecycleRuleJSON(rule))
+}
+
+func getLifecycleRuleHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	rule, ok := businessRule(c, business)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, lifecycleRuleJSON(rule))
+}
+
+type updateLifecycleRuleRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// updateLifecycleRuleHandler enables or disables a rule. Rules are otherwise
+// replaced by deleting and recreating them.
+func updateLifecycleRuleHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	rule, ok := businessRule(c, business)
+	if !ok {
+		return
+	}
+	var req updateLifecycleRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if err := db.SetLifecycleRuleEnabled(business.ID, rule.ID, *req.Enabled); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update rule"})
+		return
+	}
+	rule.Enabled = *req.Enabled
+	c.JSON(http.StatusOK, lifecycleRuleJSON(rule))
+}
+
+func deleteLifecycleRuleHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	rule, ok := businessRule(c, business)
+	if !ok {
+		return
+	}
+	if err := db.DeleteLifecycleRule(business.ID, rule.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete rule"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "rule deleted", "id": rule.ID})
+}
+
+func ruleDryRunHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	rule, ok := businessRule(c, business)
+	if !ok {
+		return
+	}
+	dryRun(c, rule)
+}
+
+// dryRunHandler shows what a rule would do without saving it
+func dryRunHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	var req lifecycleRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	rule, err := lifecycleRule(business, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dryRun(c, rule)
+}
+
+// dryRun lists the uploads a rule would delete or move if it ran now
+func dryRun(c *gin.Context, rule *db.LifecycleRule) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+	found, err := db.LifecycleCandidates(rule, time.Now(), limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to evaluate rule"})
+		return
+	}
+	truncated := len(found) > limit
+	if truncated {
+		found = found[:limit]
+	}
+
+	objects := make([]gin.H, 0, len(found))
+	var bytes int64
+	for _, f := range found {
+		object := gin.H{
+			"upload_id":        f.Upload.ID,
+			"filename":         f.Upload.Filename,
+			"username":         f.Upload.Username,
+			"content_type":     f.Upload.ContentType,
+			"size":             f.Upload.Size,
+			"tier":             f.Tier,
+			"created_at":       f.Upload.CreatedAt,
+			"last_accessed_at": f.LastAccessedAt,
+		}
+		if v, err := db.GetObjectVersionByUpload(f.Upload.ID); err == nil {
+			object["path"] = v.Path
+			object["version"] = v.Version
+		}
+		objects = append(objects, object)
+		bytes += f.Upload.Size
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"rule":      lifecycleRuleJSON(rule),
+		"objects":   objects,
+		"count":     len(objects),
+		"bytes":     bytes,
+		"truncated": truncated,
+	})
+}
+
+// lifecycleJob applies a rule to one upload
+type lifecycleJob struct {
+	BusinessID int    `json:"business_id"`
+	RuleID     int64  `json:"rule_id"`
+	UploadID   string `json:"upload_id"`
+}
+
+func (j *lifecycleJob) key() string {
+	return fmt.Sprintf("lifecycle:queued:%d:%s", j.RuleID, j.UploadID)
+}
+
+// EvaluateLifecycle queues a job for every upload an enabled rule applies to
+// and returns how many it queued. Uploads already queued for a rule are not
+// queued again until their job has run, or a day has passed.
+func EvaluateLifecycle(limit int) (int, error) {
+	rules, err := db.EnabledLifecycleRules()
+	if err != nil {
+		return 0, err
+	}
+	queued := 0
+	for i := range rules {
+		found, err := db.LifecycleCandidates(&rules[i], time.Now(), limit)
+		if err != nil {
+			return queued, err
+		}
+		for _, f := range found {
+			job := lifecycleJob{BusinessID: rules[i].BusinessID, RuleID: rules[i].ID, UploadID: f.Upload.ID}
+			fresh, err := db.RDB.SetNX(db.Ctx, job.key(), 1, 24*time.Hour).Result()
+			if err != nil {
+				return queued, err
+			}
+			if !fresh {
+				continue
+			}
+			data, _ := json.Marshal(job)
+			if err := db.RDB.LPush(db.Ctx, lifecycleQueue, data).Err(); err != nil {
+				db.RDB.Del(db.Ctx, job.key())
+				return queued, err
+			}
+			queued++
+		}
+	}
+	return queued, nil
+}
+
+// runLifecycleJob applies a queued job if its rule still exists, is enabled
+// and still applies to the upload
+func runLifecycleJob(job *lifecycleJob) error {
+	defer db.RDB.Del(db.Ctx, job.key())
+
+	rule, err := db.GetLifecycleRule(job.BusinessID, job.RuleID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !rule.Enabled {
+		return nil
+	}
+	if ok, err := db.LifecycleRuleMatches(rule, job.UploadID, time.Now()); err != nil || !ok {
+		return err
+	}
+
+	switch rule.Action {
+	case db.LifecycleDelete:
+		if _, err := removeUpload(job.UploadID); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		log.Printf("Lifecycle rule %d deleted upload %s", rule.ID, job.UploadID)
+	case db.LifecycleTransition:
+		rec, err := db.GetUploadRecord(job.UploadID)
+		if err != nil {
+			return err
+		}
+		if err := storage.Transition(rec.BusinessID, rec.BlobSHA256, rule.TargetTier); err != nil {
+			return err
+		}
+		log.Printf("Lifecycle rule %d moved upload %s to the %s tier", rule.ID, job.UploadID, rule.TargetTier)
+	}
+	return nil
+}
+
+// runLifecycleWorker runs queued lifecycle jobs as they arrive. A job stays
+// on the worker's processing list until it has run.
+func runLifecycleWorker() {
+	worker := processName()
+	processing := lifecycleProcessingPrefix + worker
+	heartbeat := lifecycleHeartbeatPrefix + worker
+	db.RDB.Set(db.Ctx, heartbeat, 1, lifecycleHeartbeatTTL)
+	go func() {
+		for range time.Tick(lifecycleHeartbeatTTL / 3) {
+			db.RDB.Set(db.Ctx, heartbeat, 1, lifecycleHeartbeatTTL)
+		}
+	}()
+
+	for {
+		data, err := db.RDB.BLMove(db.Ctx, lifecycleQueue, processing, "RIGHT", "LEFT", 5*time.Second).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			log.Printf("Lifecycle worker failed to read the queue: %v", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		var job lifecycleJob
+		if err := json.Unmarshal([]byte(data), &job); err != nil {
+			log.Printf("Lifecycle worker dropped malformed job %q", data)
+		} else if err := runLifecycleJob(&job); err != nil {
+			log.Printf("Lifecycle rule %d failed on upload %s: %v", job.RuleID, job.UploadID, err)
+		}
+		db.RDB.LRem(db.Ctx, processing, 1, data)
+	}
+}
+
+// requeueOrphanedLifecycleJobs queues the jobs of workers that stopped
+// before they finished them again, to run next, and returns how many it
+// queued
+func requeueOrphanedLifecycleJobs() (int, error) {
+	requeued := 0
+	var cursor uint64
+	for {
+		keys, next, err := db.RDB.Scan(db.Ctx, cursor, lifecycleProcessingPrefix+"*", 100).Result()
+		if err != nil {
+			return requeued, err
+		}
+		for _, key := range keys {
+			worker := strings.TrimPrefix(key, lifecycleProcessingPrefix)
+			if alive, err := db.RDB.Exists(db.Ctx, lifecycleHeartbeatPrefix+worker).Result(); err != nil {
+				return requeued, err
+			} else if alive > 0 {
+				continue
+			}
+			for {
+				err := db.RDB.LMove(db.Ctx, key, lifecycleQueue, "RIGHT", "RIGHT").Err()
+				if errors.Is(err, redis.Nil) {
+					break
+				} else if err != nil {
+					return requeued, err
+				}
+				requeued++
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return requeued, nil
+		}
+	}
+}
+
+// RunLifecycle evaluates lifecycle rules every interval and runs the jobs
+// they queue. Jobs left unfinished by stopped workers are queued again first.
+func RunLifecycle(interval time.Duration) {
+	go runLifecycleWorker()
+	for {
+		if n, err := requeueOrphanedLifecycleJobs(); err != nil {
+			log.Printf("Failed to queue lifecycle jobs of stopped workers again: %v", err)
+		} else if n > 0 {
+			log.Printf("Queued %d lifecycle jobs of stopped workers again", n)
+		}
+		if n, err := EvaluateLifecycle(1000); err != nil {
+			log.Printf("Lifecycle evaluation failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Lifecycle evaluation queued %d jobs", n)
+		}
+		time.Sleep(interval)
+	}
+}
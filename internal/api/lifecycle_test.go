@@ -0,0 +1,35 @@
+package api
+
+import (
+	"testing"
+
+	"mediapipeline/internal/db"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestJobsOfStoppedLifecycleWorkersAreQueuedAgain(t *testing.T) {
+	mr := miniredis.RunT(t)
+	db.RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.RDB.Close() })
+
+	mr.Lpush(lifecycleQueue, "queued")
+	mr.Lpush(lifecycleProcessingPrefix+"stopped", "orphaned")
+	mr.Lpush(lifecycleProcessingPrefix+"running", "in progress")
+	mr.Set(lifecycleHeartbeatPrefix+"running", "1")
+
+	if n, err := requeueOrphanedLifecycleJobs(); err != nil || n != 1 {
+		t.Fatalf("requeueOrphanedLifecycleJobs = %d, %v, want 1", n, err)
+	}
+	// the orphaned job runs next, ahead of those queued since
+	if next, _ := db.RDB.RPop(db.Ctx, lifecycleQueue).Result(); next != "orphaned" {
+		t.Errorf("next job is %q, want the orphaned one", next)
+	}
+	if jobs, _ := mr.List(lifecycleProcessingPrefix + "running"); len(jobs) != 1 {
+		t.Errorf("job of a running worker was taken from it: %v", jobs)
+	}
+	if mr.Exists(lifecycleProcessingPrefix + "stopped") {
+		t.Error("processing list of the stopped worker is left")
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metricsHandler exposes operational counters in the Prometheus text format
+func metricsHandler(c *gin.Context) {
+	stats := storage.GetScrubStats()
+	corrupt, err := db.CountCorruptBlobs()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "failed to count corrupt blobs\n")
+		return
+	}
+
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	w := c.Writer
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge := func(name, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+	counter("mediapipeline_scrub_blobs_scanned_total", "Blobs read back by the scrubber.", stats.Scanned)
+	counter("mediapipeline_scrub_bytes_read_total", "Bytes read back by the scrubber.", stats.BytesRead)
+	counter("mediapipeline_scrub_blobs_verified_total", "Blobs that matched their recorded SHA-256.", stats.Verified)
+	counter("mediapipeline_scrub_blobs_repaired_total", "Damaged blobs repaired from an intact replica.", stats.Repaired)
+	counter("mediapipeline_scrub_blobs_corrupt_total", "Damaged blobs found without a replica and quarantined.", stats.Corrupt)
+	counter("mediapipeline_scrub_errors_total", "Blobs the scrubber could not read for reasons other than damage.", stats.Errors)
+	gauge("mediapipeline_blobs_corrupt", "Blobs currently flagged corrupt.", int64(corrupt))
+	hot := storage.GetHotCacheStats()
+	gauge("mediapipeline_hot_cache_bytes", "Bytes held in this instance's hot cache.", hot.Bytes)
+	gauge("mediapipeline_hot_cache_objects", "Blobs held in this instance's hot cache.", hot.Objects)
+	counter("mediapipeline_hot_cache_hits_total", "Reads served from the hot cache.", hot.Hits)
+	counter("mediapipeline_hot_cache_misses_total", "Cacheable reads that missed the hot cache.", hot.Misses)
+	counter("mediapipeline_hot_cache_evictions_total", "Blobs evicted from the hot cache.", hot.Evictions)
+	counter("mediapipeline_upload_events_total", "tus notifications handled by the event workers.", uploadEventStats.handled.Load())
+	counter("mediapipeline_upload_progress_coalesced_total", "Progress events superseded by a newer one before they were written.", uploadEventStats.coalesced.Load())
+	counter("mediapipeline_upload_progress_dropped_total", "Progress events dropped because their worker's queue was full.", uploadEventStats.dropped.Load())
+	counter("mediapipeline_upload_event_stalls_total", "Events tus notifications waited on because their worker's queue was full.", uploadEventStats.stalled.Load())
+	if tusEvents != nil {
+		gauge("mediapipeline_upload_event_queue_depth", "tus notifications waiting for an event worker.", tusEvents.queued())
+	}
+	if !stats.LastPassAt.IsZero() {
+		gauge("mediapipeline_scrub_last_pass_timestamp_seconds", "When the scrubber last caught up.", stats.LastPassAt.Unix())
+	}
+}
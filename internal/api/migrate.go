@@ -0,0 +1,104 @@
+package api
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"mediapipeline/internal/db"
+
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// MigrateLegacyUploads moves uploads finished before the blob store existed
+// out of the shared tus directory, where they were renamed to their client
+// filename, into their business's namespace. Uploads still in progress are
+// left alone. Their data is hashed from the file, so no Redis is needed. It
+// returns how many uploads were migrated and how many could not be.
+func MigrateLegacyUploads() (migrated, failed int, err error) {
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// uploads whose data was renamed to the same filename overwrote each
+	// other; group them so the data goes to the most recent one only
+	type legacy struct {
+		info    *tusd.FileInfo
+		created int64
+	}
+	byFile := map[string][]legacy{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok || !uploadIDPattern.MatchString(id) {
+			continue
+		}
+		if _, err := db.GetUploadRecord(id); err == nil {
+			continue
+		}
+		info, err := readTusInfo(id)
+		if err != nil {
+			log.Printf("Skipping upload %s: unreadable info file: %v", id, err)
+			failed++
+			continue
+		}
+		if info.SizeIsDeferred || info.Offset < info.Size {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			return migrated, failed, err
+		}
+
+		// finished uploads that were never renamed still sit under their ID
+		src := id
+		if _, err := os.Stat(filepath.Join(uploadDir, id)); err != nil {
+			src = legacyFilename(info.MetaData["filename"])
+		}
+		byFile[src] = append(byFile[src], legacy{info: info, created: stat.ModTime().UnixNano()})
+	}
+
+	for src, uploads := range byFile {
+		sort.Slice(uploads, func(i, j int) bool { return uploads[i].created > uploads[j].created })
+		data := filepath.Join(uploadDir, src)
+		stat, err := os.Stat(data)
+		for i, u := range uploads {
+			if src == "" || err != nil || !stat.Mode().IsRegular() || i > 0 || stat.Size() != u.info.Size {
+				log.Printf("Cannot migrate upload %s: its data is missing or was overwritten by another upload", u.info.ID)
+				failed++
+				continue
+			}
+
+			meta := u.info.MetaData
+			if meta == nil {
+				meta = map[string]string{}
+			}
+			meta["filename"] = sanitizeFilename(meta["filename"])
+			if p := meta["path"]; p != "" {
+				meta["path"] = logicalPath(p)
+			} else {
+				meta["path"] = logicalPath(meta["filename"])
+			}
+			if _, _, err := storeUpload(u.info.ID, data, "", meta, stat.ModTime().UTC()); err != nil {
+				log.Printf("Cannot migrate upload %s: %v", u.info.ID, err)
+				failed++
+				continue
+			}
+			os.Remove(filepath.Join(uploadDir, u.info.ID+".info"))
+			migrated++
+		}
+	}
+	return migrated, failed, nil
+}
+
+// legacyFilename maps the filename metadata of a legacy upload to the name
+// its data was renamed to, or "" if that name could not have been inside the
+// upload directory
+func legacyFilename(name string) string {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." || strings.HasSuffix(name, ".info") {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// writeLegacyUpload leaves a finished upload in the upload directory the way
+// uploads were kept before the blob store, its data under name
+func writeLegacyUpload(t *testing.T, business *db.Business, id, name, filename, content string) {
+	t.Helper()
+	info := tusd.FileInfo{
+		ID:     id,
+		Size:   int64(len(content)),
+		Offset: int64(len(content)),
+		MetaData: tusd.MetaData{
+			"business_id": strconv.Itoa(business.ID),
+			"filename":    filename,
+		},
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(uploadDir, id+".info"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(uploadDir, name), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateLegacyUploadsWithoutRedis(t *testing.T) {
+	dir := t.TempDir()
+	if err := db.OpenSQLite(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.SQLDB.Close() })
+	// the migrate-uploads command only sets up SQLite and the blob store
+	rdb := db.RDB
+	db.RDB = nil
+	t.Cleanup(func() { db.RDB = rdb })
+
+	err := storage.Init(&config.Config{
+		Environment: "test",
+		Storage: config.StorageConfig{
+			CDNPath:        filepath.Join(dir, "cdn"),
+			S3Path:         filepath.Join(dir, "s3"),
+			R2Path:         filepath.Join(dir, "r2"),
+			DefaultRegion:  "default",
+			InstanceRegion: "default",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	business, err := db.CreateBusiness("test", "test@example.com", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := uploadDir
+	uploadDir = filepath.Join(dir, "uploads")
+	t.Cleanup(func() { uploadDir = saved })
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := "0123456789abcdef0123456789abcdef"
+	unrenamed := "fedcba9876543210fedcba9876543210"
+	writeLegacyUpload(t, business, renamed, "report.txt", "report.txt", "renamed to its filename")
+	writeLegacyUpload(t, business, unrenamed, unrenamed, "notes.txt", "still under its ID")
+
+	migrated, failed, err := MigrateLegacyUploads()
+	if err != nil || migrated != 2 || failed != 0 {
+		t.Fatalf("MigrateLegacyUploads = %d, %d, %v, want 2 migrated", migrated, failed, err)
+	}
+	for id, want := range map[string]string{renamed: "renamed to its filename", unrenamed: "still under its ID"} {
+		rec, err := db.GetUploadRecord(id)
+		if err != nil {
+			t.Fatalf("upload %s was not recorded: %v", id, err)
+		}
+		r, err := storage.Open(business.ID, rec.BlobSHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != want {
+			t.Errorf("upload %s reads %q, %v", id, data, err)
+		}
+		if _, err := os.Stat(filepath.Join(uploadDir, id+".info")); !os.IsNotExist(err) {
+			t.Errorf("info file of upload %s was left behind", id)
+		}
+	}
+	if v, err := db.GetObjectVersion(business.ID, "report.txt", 0); err != nil || v.UploadID != renamed {
+		t.Errorf("report.txt is %+v, %v", v, err)
+	}
+}
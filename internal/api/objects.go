@@ -0,0 +1,207 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetupObjectRoutes registers the endpoints that address uploads by their
+// logical path within a business, with every upload to a path kept as a
+// version
+func SetupObjectRoutes(r *gin.RouterGroup) {
+	objects := r.Group("/objects")
+	objects.Use(middleware.RateLimiter(db.RDB, 10, time.Minute, middleware.UserRateLimit{}))
+	{
+		objects.GET("/", listObjectsAPIHandler)
+		objects.GET("/versions", listVersionsHandler)
+		objects.GET("/content", downloadVersionHandler)
+		objects.POST("/restore", restoreVersionHandler)
+	}
+}
+
+// logicalPath normalises a client-supplied path into the form versions are
+// stored under: slash separated valid UTF-8, without control characters,
+// leading slash or dot segments. It is only ever a database key.
+func logicalPath(p string) string {
+	p = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(p, ""))
+	p = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+	if p == "." {
+		return ""
+	}
+	return p
+}
+
+// requireBusiness authenticates the request by its X-API-KEY header
+func requireBusiness(c *gin.Context) (*db.Business, bool) {
+	apiKey := c.GetHeader("X-API-KEY")
+	if apiKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing X-API-KEY header"})
+		return nil, false
+	}
+	business, err := db.GetBusinessByAPIKey(apiKey)
+	if err != nil || business == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+		return nil, false
+	}
+	return business, true
+}
+
+func versionJSON(v *db.ObjectVersion) gin.H {
+	return gin.H{
+		"path":         v.Path,
+		"version":      v.Version,
+		"upload_id":    v.UploadID,
+		"size":         v.Size,
+		"content_type": v.ContentType,
+		"current":      v.Current,
+		"created_at":   v.CreatedAt,
+	}
+}
+
+func listObjectsAPIHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+
+	objects := []gin.H{}
+	next := ""
+	err = db.ListObjects(business.ID, c.Query("prefix"), c.Query("after"), func(v *db.ObjectVersion) bool {
+		if len(objects) == limit {
+			next = objects[limit-1]["path"].(string)
+			return false
+		}
+		objects = append(objects, versionJSON(v))
+		return true
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list objects"})
+		return
+	}
+	response := gin.H{"objects": objects}
+	if next != "" {
+		response["next_after"] = next
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func listVersionsHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	p := logicalPath(c.Query("path"))
+	if p == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing path parameter"})
+		return
+	}
+
+	versions, err := db.ListObjectVersions(business.ID, p)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list versions"})
+		return
+	}
+	if len(versions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "object not found"})
+		return
+	}
+	list := make([]gin.H, 0, len(versions))
+	for i := range versions {
+		list = append(list, versionJSON(&versions[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"path": p, "versions": list})
+}
+
+// lookupVersion resolves the path and optional version query parameters
+func lookupVersion(c *gin.Context, business *db.Business, p, version string) (*db.ObjectVersion, bool) {
+	p = logicalPath(p)
+	if p == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing path parameter"})
+		return nil, false
+	}
+	n := 0
+	if version != "" {
+		var err error
+		if n, err = strconv.Atoi(version); err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "version must be a positive integer"})
+			return nil, false
+		}
+	}
+	v, err := db.GetObjectVersion(business.ID, p, n)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "object version not found"})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load object"})
+		return nil, false
+	}
+	return v, true
+}
+
+func downloadVersionHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	v, ok := lookupVersion(c, business, c.Query("path"), c.Query("version"))
+	if !ok {
+		return
+	}
+	rec, err := db.GetUploadRecord(v.UploadID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load object"})
+		return
+	}
+	c.Header("X-Object-Version", strconv.Itoa(v.Version))
+	serveUpload(c, rec)
+}
+
+type restoreVersionRequest struct {
+	Path    string `json:"path" binding:"required"`
+	Version int    `json:"version" binding:"required"`
+}
+
+// restoreVersionHandler makes an older version of a path current again. The
+// versions in between are kept.
+func restoreVersionHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	var req restoreVersionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	v, ok := lookupVersion(c, business, req.Path, strconv.Itoa(req.Version))
+	if !ok {
+		return
+	}
+	if err := db.SetCurrentVersion(business.ID, v.Path, v.Version); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore version"})
+		return
+	}
+	v.Current = true
+	c.JSON(http.StatusOK, gin.H{"message": "version restored", "object": versionJSON(v)})
+}
@@ -0,0 +1,298 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/middleware"
+	"mediapipeline/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// longest a single pin can last
+const maxPinDuration = 90 * 24 * time.Hour
+
+// most uploads a single pin or prewarm request can name
+const maxBulkIDs = 1000
+
+// serialises pin quota checks with the pins they admit
+var pinMu sync.Mutex
+
+// SetupCDNRoutes registers the endpoints that keep uploads hot in the CDN
+// tier ahead of demand
+func SetupCDNRoutes(r *gin.RouterGroup) {
+	cdn := r.Group("/cdn")
+	cdn.Use(middleware.RateLimiter(db.RDB, 10, time.Minute, middleware.BusinessRateLimit{}))
+	{
+		cdn.GET("/pins", listPinsHandler)
+		cdn.POST("/pins", pinHandler)
+		cdn.DELETE("/pins/:id", unpinHandler)
+		cdn.POST("/prewarm", prewarmHandler)
+	}
+}
+
+// pinQuota returns the pin quota of a business, zero if unlimited
+func pinQuota(businessID int) (int64, error) {
+	quota, err := db.GetPinQuota(businessID)
+	if err != nil || quota != 0 {
+		return quota, err
+	}
+	return quotaDefaults.PinBytes, nil
+}
+
+// bulkUploads loads the uploads named in a bulk request, which all have to
+// belong to the business
+func bulkUploads(c *gin.Context, business *db.Business, ids []string) ([]*db.UploadRecord, bool) {
+	if len(ids) == 0 || len(ids) > maxBulkIDs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ids must name 1 to %d uploads", maxBulkIDs)})
+		return nil, false
+	}
+	seen := make(map[string]bool, len(ids))
+	recs := make([]*db.UploadRecord, 0, len(ids))
+	missing := []string{}
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if !uploadIDPattern.MatchString(id) {
+			missing = append(missing, id)
+			continue
+		}
+		rec, err := db.GetUploadRecord(id)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && rec.BusinessID != business.ID) {
+			missing = append(missing, id)
+			continue
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load uploads"})
+			return nil, false
+		}
+		recs = append(recs, rec)
+	}
+	if len(missing) > 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "files not found", "ids": missing})
+		return nil, false
+	}
+	return recs, true
+}
+
+// prewarmUploads promotes uploads to the CDN tier in the background
+func prewarmUploads(recs []*db.UploadRecord) {
+	for _, rec := range recs {
+		if err := storage.Prewarm(rec.BusinessID, rec.BlobSHA256); err != nil {
+			log.Printf("Failed to prewarm upload %s: %v", rec.ID, err)
+		}
+	}
+}
+
+func pinJSON(p *db.Pin) gin.H {
+	pin := gin.H{
+		"file_id":      p.UploadID,
+		"size":         p.Size,
+		"pinned_until": p.PinnedUntil,
+	}
+	if !p.CreatedAt.IsZero() {
+		pin["pinned_at"] = p.CreatedAt
+	}
+	return pin
+}
+
+func listPinsHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	pins, err := db.ActivePins(business.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list pins"})
+		return
+	}
+	quota, err := pinQuota(business.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load pin quota"})
+		return
+	}
+
+	list := make([]gin.H, 0, len(pins))
+	var pinned int64
+	for i := range pins {
+		list = append(list, pinJSON(&pins[i]))
+		pinned += pins[i].Size
+	}
+	response := gin.H{"pins": list, "pinned_bytes": pinned, "quota_bytes": quota}
+	if quota > 0 {
+		response["remaining_bytes"] = max(quota-pinned, 0)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+type pinRequest struct {
+	IDs       []string  `json:"ids" binding:"required"`
+	ExpiresAt time.Time `json:"expires_at" binding:"required"`
+}
+
+// pinHandler pins uploads to the CDN tier until expires_at, promoting them
+// there in the background. Pinning an upload again replaces its expiry.
+func pinHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	var req pinRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if until := time.Until(req.ExpiresAt); until <= 0 || until > maxPinDuration {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future and at most 90 days away"})
+		return
+	}
+	recs, ok := bulkUploads(c, business, req.IDs)
+	if !ok {
+		return
+	}
+
+	pinMu.Lock()
+	defer pinMu.Unlock()
+
+	quota, err := pinQuota(business.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load pin quota"})
+		return
+	}
+	active, err := db.ActivePins(business.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list pins"})
+		return
+	}
+
+	// uploads pinned again only have their expiry changed
+	pins := make([]db.Pin, 0, len(recs))
+	requested := make(map[string]bool, len(recs))
+	var total int64
+	for _, rec := range recs {
+		requested[rec.ID] = true
+		total += rec.Size
+		pins = append(pins, db.Pin{
+			UploadID:    rec.ID,
+			BusinessID:  business.ID,
+			BlobSHA256:  rec.BlobSHA256,
+			Size:        rec.Size,
+			PinnedUntil: req.ExpiresAt,
+		})
+	}
+	var current int64
+	for _, p := range active {
+		current += p.Size
+		if !requested[p.UploadID] {
+			total += p.Size
+		}
+	}
+	if quota > 0 && total > quota {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":        fmt.Sprintf("pin quota exceeded: pinning these files would pin %d of %d bytes", total, quota),
+			"pinned_bytes": current,
+			"quota_bytes":  quota,
+		})
+		return
+	}
+	if err := db.PinUploads(pins); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to pin files"})
+		return
+	}
+	go prewarmUploads(recs)
+
+	list := make([]gin.H, 0, len(pins))
+	for i := range pins {
+		list = append(list, pinJSON(&pins[i]))
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":      "files pinned, promotion to the CDN tier started",
+		"pins":         list,
+		"pinned_bytes": total,
+		"quota_bytes":  quota,
+	})
+}
+
+func unpinHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	id := c.Param("id")
+	if err := db.Unpin(business.ID, id); errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "pin not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unpin file"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "file unpinned", "file_id": id})
+}
+
+type prewarmRequest struct {
+	IDs []string `json:"ids" binding:"required"`
+}
+
+// prewarmHandler promotes uploads to the CDN tier in bulk without pinning
+// them, so they are demoted again once they go unread
+func prewarmHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	var req prewarmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	recs, ok := bulkUploads(c, business, req.IDs)
+	if !ok {
+		return
+	}
+	go prewarmUploads(recs)
+
+	ids := make([]string, 0, len(recs))
+	for _, rec := range recs {
+		ids = append(ids, rec.ID)
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "prewarm started", "ids": ids, "count": len(ids)})
+}
+
+type setPinQuotaRequest struct {
+	PinBytes int64 `json:"pin_bytes"`
+}
+
+func setPinQuotaHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid business id"})
+		return
+	}
+	if _, err := db.GetBusinessByID(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "business not found"})
+		return
+	}
+	var req setPinQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if req.PinBytes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pin_bytes must be non-negative"})
+		return
+	}
+	if err := db.SetPinQuota(id, req.PinBytes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set pin quota"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"business_id": id, "pin_bytes": req.PinBytes})
+}
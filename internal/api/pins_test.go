@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+)
+
+// storeContent stores content as a finished upload of a business
+func storeContent(t *testing.T, business *db.Business, content string) *db.UploadRecord {
+	t.Helper()
+	id := make([]byte, 16)
+	rand.Read(id)
+	src := filepath.Join(t.TempDir(), "content")
+	if err := os.WriteFile(src, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rec := &db.UploadRecord{ID: hex.EncodeToString(id), BusinessID: business.ID, ContentType: "text/plain", CreatedAt: time.Now()}
+	if err := storage.Ingest(src, rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+// apiJSON sends body as JSON with the API key of a business and returns the
+// status and JSON body of the response
+func apiJSON(t *testing.T, srv *httptest.Server, method, path string, business *db.Business, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, srv.URL+path, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range businessHeader(business) {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+// jsonBody is the body of a JSON request
+type jsonBody map[string]interface{}
+
+// waitTier waits for the blob of an upload to reach a tier
+func waitTier(t *testing.T, rec *db.UploadRecord, tier string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, err := db.GetBlob(rec.BusinessID, rec.BlobSHA256)
+		if err == nil && b.Tier == tier {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("blob of upload %s did not reach the %s tier", rec.ID, tier)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPinsCountAgainstPinQuota(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	a := storeContent(t, business, "0123456789")
+	b := storeContent(t, business, "abcdefghij")
+	for _, rec := range []*db.UploadRecord{a, b} {
+		if err := storage.Transition(business.ID, rec.BlobSHA256, storage.TierS3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetPinQuota(business.ID, 15); err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(24 * time.Hour)
+
+	status, body := apiJSON(t, srv, http.MethodPost, "/api/v1/cdn/pins", business, jsonBody{"ids": []string{a.ID}, "expires_at": until})
+	if status != http.StatusAccepted || body["pinned_bytes"] != 10.0 {
+		t.Fatalf("pin = %d, %v, want 10 bytes pinned", status, body)
+	}
+	waitTier(t, a, storage.TierCDN)
+
+	// pinning an upload again changes its expiry and counts it once
+	status, body = apiJSON(t, srv, http.MethodPost, "/api/v1/cdn/pins", business, jsonBody{"ids": []string{a.ID}, "expires_at": until.Add(time.Hour)})
+	if status != http.StatusAccepted || body["pinned_bytes"] != 10.0 {
+		t.Fatalf("repin = %d, %v, want 10 bytes pinned", status, body)
+	}
+	if status, body = apiJSON(t, srv, http.MethodPost, "/api/v1/cdn/pins", business, jsonBody{"ids": []string{b.ID}, "expires_at": until}); status != http.StatusForbidden {
+		t.Fatalf("pin over the quota = %d, %v, want 403", status, body)
+	}
+
+	if status, _ = apiJSON(t, srv, http.MethodDelete, "/api/v1/cdn/pins/"+a.ID, business, nil); status != http.StatusOK {
+		t.Fatalf("unpin = %d", status)
+	}
+	if status, _ = apiJSON(t, srv, http.MethodDelete, "/api/v1/cdn/pins/"+a.ID, business, nil); status != http.StatusNotFound {
+		t.Fatalf("second unpin = %d, want 404", status)
+	}
+	if status, body = apiJSON(t, srv, http.MethodPost, "/api/v1/cdn/pins", business, jsonBody{"ids": []string{b.ID}, "expires_at": until}); status != http.StatusAccepted {
+		t.Fatalf("pin after unpinning = %d, %v", status, body)
+	}
+	waitTier(t, b, storage.TierCDN)
+}
+
+func TestPrewarmOnlyTakesOwnUploads(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	other, err := db.CreateBusiness("other", "other@example.com", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	own := storeContent(t, business, "own content")
+	foreign := storeContent(t, other, "foreign content")
+	for _, rec := range []*db.UploadRecord{own, foreign} {
+		if err := storage.Transition(rec.BusinessID, rec.BlobSHA256, storage.TierS3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, body := apiJSON(t, srv, http.MethodPost, "/api/v1/cdn/prewarm", business, jsonBody{"ids": []string{own.ID, foreign.ID}})
+	if status != http.StatusNotFound {
+		t.Fatalf("prewarm of another business's upload = %d, %v, want 404", status, body)
+	}
+	if status, body = apiJSON(t, srv, http.MethodPost, "/api/v1/cdn/prewarm", business, jsonBody{"ids": []string{own.ID}}); status != http.StatusAccepted {
+		t.Fatalf("prewarm = %d, %v", status, body)
+	}
+	waitTier(t, own, storage.TierCDN)
+	if b, _ := db.GetBlob(other.ID, foreign.BlobSHA256); b.Tier != storage.TierS3 {
+		t.Fatalf("blob of the other business moved to %s", b.Tier)
+	}
+}
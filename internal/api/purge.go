@@ -0,0 +1,277 @@
+package api
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/middleware"
+	"mediapipeline/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Redis channel purges are announced on to every instance
+const purgeChannel = "purges"
+
+// how long purge statuses are kept
+const purgeTTL = 7 * 24 * time.Hour
+
+// SetupPurgeRoutes registers the endpoints that invalidate cached copies of
+// uploads
+func SetupPurgeRoutes(r *gin.RouterGroup) {
+	purges := r.Group("/purges")
+	purges.Use(middleware.RateLimiter(db.RDB, 10, time.Minute, middleware.BusinessRateLimit{}))
+	{
+		purges.POST("/", createPurgeHandler)
+		purges.GET("/:id", purgeStatusHandler)
+	}
+}
+
+func purgeKey(id string) string {
+	return "purge:" + id
+}
+
+// purgeMessage tells every instance which blobs to drop from its hot cache
+type purgeMessage struct {
+	PurgeID    string   `json:"purge_id"`
+	BusinessID int      `json:"business_id"`
+	Blobs      []string `json:"blobs"`
+}
+
+type purgeRequest struct {
+	IDs      []string          `json:"ids"`
+	Prefixes []string          `json:"prefixes"`
+	Tags     map[string]string `json:"tags"`
+}
+
+// createPurgeHandler starts a purge of the uploads named by ID, by a prefix
+// of their logical path or by tags. The purge runs in the background; its
+// status is polled by purge ID.
+func createPurgeHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	var req purgeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if len(req.IDs) == 0 && len(req.Prefixes) == 0 && len(req.Tags) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a purge needs ids, prefixes or tags"})
+		return
+	}
+	if len(req.IDs) > maxBulkIDs || len(req.Prefixes) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a purge can name at most %d ids and 100 prefixes", maxBulkIDs)})
+		return
+	}
+	// prefixes match logical paths as the object listing does
+	for i, p := range req.Prefixes {
+		if req.Prefixes[i] = strings.TrimLeft(p, "/"); req.Prefixes[i] == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "prefixes cannot be empty"})
+			return
+		}
+	}
+	if err := validTags(req.Tags); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id := hex.EncodeToString(b)
+	now := time.Now().UTC().Format(time.RFC3339)
+	err := db.RDB.HSet(db.Ctx, purgeKey(id), map[string]interface{}{
+		"business_id": business.ID,
+		"status":      "pending",
+		"created_at":  now,
+	}).Err()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create purge"})
+		return
+	}
+	_ = db.RDB.Expire(db.Ctx, purgeKey(id), purgeTTL)
+
+	go runPurge(id, business.ID, &req)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"purge_id":   id,
+		"status":     "pending",
+		"created_at": now,
+		"status_url": "/api/v1/purges/" + id,
+	})
+}
+
+// purgeUploads resolves the uploads a purge request names within a business
+func purgeUploads(businessID int, req *purgeRequest) ([]*db.UploadRecord, error) {
+	ids := append([]string{}, req.IDs...)
+	for _, prefix := range req.Prefixes {
+		found, err := db.UploadsUnderPrefix(businessID, prefix)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, found...)
+	}
+	if len(req.Tags) > 0 {
+		found, err := db.UploadsWithTags(businessID, req.Tags)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, found...)
+	}
+
+	seen := make(map[string]bool, len(ids))
+	var recs []*db.UploadRecord
+	for _, id := range ids {
+		if seen[id] || !uploadIDPattern.MatchString(id) {
+			continue
+		}
+		seen[id] = true
+		rec, err := db.GetUploadRecord(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if rec.BusinessID == businessID {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+// runPurge unpins the uploads of a purge, moves their blobs out of the CDN
+// tier and announces the blobs to every instance so they leave the hot
+// caches too
+func runPurge(id string, businessID int, req *purgeRequest) {
+	key := purgeKey(id)
+	fail := func(err error) {
+		log.Printf("Purge %s failed: %v", id, err)
+		_ = db.RDB.HSet(db.Ctx, key, "status", "failed", "error", err.Error(),
+			"completed_at", time.Now().UTC().Format(time.RFC3339))
+	}
+	_ = db.RDB.HSet(db.Ctx, key, "status", "in_progress")
+
+	recs, err := purgeUploads(businessID, req)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	var blobs []string
+	seen := map[string]bool{}
+	demoted := 0
+	for _, rec := range recs {
+		if err := db.Unpin(businessID, rec.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			fail(err)
+			return
+		}
+		if seen[rec.BlobSHA256] {
+			continue
+		}
+		seen[rec.BlobSHA256] = true
+		blobs = append(blobs, rec.BlobSHA256)
+
+		b, err := db.GetBlob(businessID, rec.BlobSHA256)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if b.Tier == storage.TierCDN {
+			if err := storage.Transition(businessID, b.SHA256, storage.TierS3); err != nil {
+				fail(err)
+				return
+			}
+			demoted++
+		}
+	}
+
+	data, _ := json.Marshal(purgeMessage{PurgeID: id, BusinessID: businessID, Blobs: blobs})
+	instances, err := db.RDB.Publish(db.Ctx, purgeChannel, data).Result()
+	if err != nil {
+		fail(err)
+		return
+	}
+	_ = db.RDB.HSet(db.Ctx, key, map[string]interface{}{
+		"status":       "completed",
+		"uploads":      len(recs),
+		"blobs":        len(blobs),
+		"demoted":      demoted,
+		"instances":    instances,
+		"completed_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	log.Printf("Purge %s invalidated %d uploads on %d instances", id, len(recs), instances)
+}
+
+// RunPurgeListener drops the blobs of purges announced by any instance from
+// this instance's hot cache and acknowledges each purge
+func RunPurgeListener() {
+	sub := db.RDB.Subscribe(db.Ctx, purgeChannel)
+	defer sub.Close()
+	for msg := range sub.Channel() {
+		var purge purgeMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &purge); err != nil {
+			log.Printf("Ignoring malformed purge message: %v", err)
+			continue
+		}
+		evicted := 0
+		for _, sha := range purge.Blobs {
+			if storage.Evict(purge.BusinessID, sha) {
+				evicted++
+			}
+		}
+		key := purgeKey(purge.PurgeID)
+		if n, err := db.RDB.Exists(db.Ctx, key).Result(); err != nil || n == 0 {
+			continue
+		}
+		_ = db.RDB.HIncrBy(db.Ctx, key, "acks", 1)
+		_ = db.RDB.HIncrBy(db.Ctx, key, "evicted", int64(evicted))
+	}
+}
+
+func purgeStatusHandler(c *gin.Context) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return
+	}
+	id := c.Param("id")
+	purge, err := db.RDB.HGetAll(db.Ctx, purgeKey(id)).Result()
+	if err != nil || len(purge) == 0 || purge["business_id"] != strconv.Itoa(business.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "purge not found"})
+		return
+	}
+
+	count := func(field string) int64 {
+		n, _ := strconv.ParseInt(purge[field], 10, 64)
+		return n
+	}
+	response := gin.H{
+		"purge_id":   id,
+		"status":     purge["status"],
+		"created_at": purge["created_at"],
+	}
+	if purge["status"] == "completed" {
+		response["completed_at"] = purge["completed_at"]
+		response["uploads"] = count("uploads")
+		response["blobs"] = count("blobs")
+		response["demoted"] = count("demoted")
+		response["instances"] = count("instances")
+		response["acknowledged"] = count("acks")
+		response["evicted"] = count("evicted")
+		response["propagated"] = count("acks") >= count("instances")
+	} else if purge["status"] == "failed" {
+		response["completed_at"] = purge["completed_at"]
+		response["error"] = purge["error"]
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// listenForPurges runs the purge listeners of n instances and waits until
+// all of them are subscribed
+func listenForPurges(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		go RunPurgeListener()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		subs, err := db.RDB.PubSubNumSub(db.Ctx, purgeChannel).Result()
+		if err == nil && subs[purgeChannel] >= int64(n) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d purge listeners did not subscribe", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readThrough reads a blob as a download does, which caches it
+func readThrough(t *testing.T, rec *db.UploadRecord) {
+	t.Helper()
+	r, err := storage.Open(rec.BusinessID, rec.BlobSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitPurge polls a purge until pred holds for its status
+func waitPurge(t *testing.T, id string, pred func(map[string]string) bool) map[string]string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		purge, err := db.RDB.HGetAll(db.Ctx, purgeKey(id)).Result()
+		if err == nil && pred(purge) {
+			return purge
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("purge %s is %v", id, purge)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPurgeMessageEvictsOnOtherInstances(t *testing.T) {
+	_, business, mr := newTestPipeline(t)
+	rec := storeContent(t, business, "cached content")
+	readThrough(t, rec)
+	listenForPurges(t, 1)
+
+	// another instance announces a purge it ran on its own cache
+	other := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { other.Close() })
+	other.HSet(db.Ctx, purgeKey("elsewhere"), "status", "completed")
+	data, _ := json.Marshal(purgeMessage{PurgeID: "elsewhere", BusinessID: business.ID, Blobs: []string{rec.BlobSHA256}})
+	if err := other.Publish(db.Ctx, purgeChannel, data).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	purge := waitPurge(t, "elsewhere", func(p map[string]string) bool { return p["acks"] == "1" && p["evicted"] != "" })
+	if purge["evicted"] != "1" {
+		t.Fatalf("purge evicted %s blobs here, want 1", purge["evicted"])
+	}
+	if storage.Evict(business.ID, rec.BlobSHA256) {
+		t.Fatal("purged blob is still in the hot cache")
+	}
+}
+
+func TestPurgeIsAcknowledgedByEveryInstance(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	purged := storeContent(t, business, "purged content")
+	kept := storeContent(t, business, "kept content")
+	until := time.Now().Add(time.Hour)
+	err := db.PinUploads([]db.Pin{{UploadID: purged.ID, BusinessID: business.ID, BlobSHA256: purged.BlobSHA256, Size: purged.Size, PinnedUntil: until}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listenForPurges(t, 2)
+
+	status, body := apiJSON(t, srv, http.MethodPost, "/api/v1/purges/", business, jsonBody{"ids": []string{purged.ID}})
+	if status != http.StatusAccepted {
+		t.Fatalf("purge = %d, %v", status, body)
+	}
+	id := body["purge_id"].(string)
+	waitPurge(t, id, func(p map[string]string) bool { return p["status"] == "completed" && p["acks"] == p["instances"] && p["evicted"] != "" })
+
+	status, body = apiJSON(t, srv, http.MethodGet, "/api/v1/purges/"+id, business, nil)
+	if status != http.StatusOK || body["demoted"] != 1.0 || body["instances"] != 2.0 || body["propagated"] != true {
+		t.Fatalf("purge status = %d, %v, want one blob demoted and two instances acknowledging", status, body)
+	}
+	for rec, want := range map[*db.UploadRecord]string{purged: storage.TierS3, kept: storage.TierCDN} {
+		if b, _ := db.GetBlob(business.ID, rec.BlobSHA256); b.Tier != want {
+			t.Errorf("blob of upload %s is in %s, want %s", rec.ID, b.Tier, want)
+		}
+	}
+	if pins, _ := db.ActivePins(business.ID); len(pins) != 0 {
+		t.Errorf("purged upload is still pinned: %v", pins)
+	}
+
+	// other businesses cannot see the purge
+	other, err := db.CreateBusiness("other", "other@example.com", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := apiJSON(t, srv, http.MethodGet, "/api/v1/purges/"+id, other, nil); status != http.StatusNotFound {
+		t.Fatalf("purge status for another business = %d, want 404", status)
+	}
+}
@@ -0,0 +1,236 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// default quotas for businesses without their own
+var quotaDefaults config.QuotaConfig
+
+// quotaError explains why an upload would not fit in a business's quota
+type quotaError struct {
+	used, reserved, size, quota int64
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("storage quota exceeded: %d bytes stored and %d bytes in progress, "+
+		"an upload of %d bytes would pass the hard quota of %d bytes", e.used, e.reserved, e.size, e.quota)
+}
+
+// bytes reserved by each business's unfinished uploads, by reservation
+const reservedKeyPrefix = "quota:reserved:"
+
+func reservedKey(businessID int) string {
+	return reservedKeyPrefix + strconv.Itoa(businessID)
+}
+
+// newReservation names the reservation of an unfinished upload. The upload
+// carries it in its metadata, since tusd only assigns the upload ID after
+// the creation hook has run.
+func newReservation() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setReservationScript sets a reservation to ARGV[2] bytes, unless that
+// grows it and the business's stored bytes (ARGV[3]) plus all of its
+// reservations would then pass its hard quota (ARGV[4], 0 for none). It
+// returns whether the reservation was set and the bytes of the business's
+// other reservations.
+var setReservationScript = redis.NewScript(`
+local current = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+local others = -current
+for _, v in ipairs(redis.call('HVALS', KEYS[1])) do others = others + tonumber(v) end
+local size, hard = tonumber(ARGV[2]), tonumber(ARGV[4])
+if size > current and hard > 0 and tonumber(ARGV[3]) + others + size > hard then
+	return {0, others}
+end
+redis.call('HSET', KEYS[1], ARGV[1], size)
+return {1, others}`)
+
+// reserveUpload counts the declared size of an unfinished upload against its
+// business until it finishes or is terminated, and returns the reservation
+func reserveUpload(businessID int, size int64) (string, error) {
+	reservation := newReservation()
+	if err := setReservation(businessID, reservation, size); err != nil {
+		return "", err
+	}
+	return reservation, nil
+}
+
+// setReservation sets a reservation of a business to size bytes. A
+// reservation that grows returns a *quotaError, and is left as it was, if
+// the extra bytes would take the business past its hard quota. The check
+// and the reservation are one step, so concurrent uploads cannot both fit
+// in the same remaining bytes. Passing the soft quota is only logged.
+func setReservation(businessID int, reservation string, size int64) error {
+	soft, hard, err := businessQuota(businessID)
+	if err != nil {
+		return err
+	}
+	usage, err := db.GetUsage(businessID)
+	if err != nil {
+		return err
+	}
+	res, err := setReservationScript.Run(db.Ctx, db.RDB, []string{reservedKey(businessID)},
+		reservation, size, usage.Bytes, hard).Int64Slice()
+	if err != nil {
+		return fmt.Errorf("reserve quota: %w", err)
+	}
+	reserved := res[1]
+	if res[0] == 0 {
+		return &quotaError{used: usage.Bytes, reserved: reserved, size: size, quota: hard}
+	}
+	if total := usage.Bytes + reserved + size; soft > 0 && total > soft {
+		log.Printf("Business %d is over its soft quota: %d of %d bytes", businessID, total, soft)
+	}
+	return nil
+}
+
+// reserveLength grows the reservation of an upload of deferred length to
+// the length it has reached, refusing to let it pass its business's hard
+// quota
+func reserveLength(meta map[string]string, length int64) error {
+	businessID, err := strconv.Atoi(meta["business_id"])
+	if err != nil || meta["reservation"] == "" {
+		return nil
+	}
+	err = setReservation(businessID, meta["reservation"], length)
+	if qerr, ok := err.(*quotaError); ok {
+		return &constraintError{http.StatusRequestEntityTooLarge, qerr.Error()}
+	}
+	return err
+}
+
+// releaseReservation drops the reservation recorded in an upload's metadata
+func releaseReservation(meta map[string]string) {
+	businessID, err := strconv.Atoi(meta["business_id"])
+	if err != nil || meta["reservation"] == "" {
+		return
+	}
+	_ = db.RDB.HDel(db.Ctx, reservedKey(businessID), meta["reservation"])
+}
+
+func reservedBytes(businessID int) (int64, error) {
+	sizes, err := db.RDB.HVals(db.Ctx, reservedKey(businessID)).Result()
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, s := range sizes {
+		n, _ := strconv.ParseInt(s, 10, 64)
+		total += n
+	}
+	return total, nil
+}
+
+// businessQuota returns the soft and hard quota of a business
+func businessQuota(businessID int) (soft, hard int64, err error) {
+	soft, hard, err = db.GetBusinessQuota(businessID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if soft == 0 {
+		soft = quotaDefaults.SoftBytes
+	}
+	if hard == 0 {
+		hard = quotaDefaults.HardBytes
+	}
+	return soft, hard, nil
+}
+
+func businessUsageHandler(c *gin.Context) {
+	apiKey := c.GetHeader("X-API-KEY")
+	if apiKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing X-API-KEY header"})
+		return
+	}
+	business, err := db.GetBusinessByAPIKey(apiKey)
+	if err != nil || business == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+		return
+	}
+
+	usage, err := db.GetUsage(business.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to compute usage"})
+		return
+	}
+	reserved, err := reservedBytes(business.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to compute usage"})
+		return
+	}
+	soft, hard, err := businessQuota(business.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load quota"})
+		return
+	}
+
+	tiers := gin.H{}
+	for tier, t := range usage.Tiers {
+		tiers[tier] = gin.H{"blobs": t.Blobs, "stored_bytes": t.StoredBytes}
+	}
+	quota := gin.H{
+		"soft_bytes": soft,
+		"hard_bytes": hard,
+		"over_soft":  soft > 0 && usage.Bytes+reserved > soft,
+		"over_hard":  hard > 0 && usage.Bytes+reserved > hard,
+		"unlimited":  hard == 0,
+	}
+	if hard > 0 {
+		quota["remaining_bytes"] = max(hard-usage.Bytes-reserved, 0)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"business_id":    business.ID,
+		"region":         business.Region,
+		"objects":        usage.Objects,
+		"bytes":          usage.Bytes,
+		"reserved_bytes": reserved,
+		"tiers":          tiers,
+		"quota":          quota,
+	})
+}
+
+type setQuotaRequest struct {
+	SoftBytes int64 `json:"soft_bytes"`
+	HardBytes int64 `json:"hard_bytes"`
+}
+
+func setQuotaHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid business id"})
+		return
+	}
+	if _, err := db.GetBusinessByID(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "business not found"})
+		return
+	}
+	var req setQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if req.SoftBytes < 0 || req.HardBytes < 0 || (req.HardBytes > 0 && req.SoftBytes > req.HardBytes) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quotas must be non-negative and the soft quota no larger than the hard quota"})
+		return
+	}
+	if err := db.SetBusinessQuota(id, req.SoftBytes, req.HardBytes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set quota"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"business_id": id, "soft_bytes": req.SoftBytes, "hard_bytes": req.HardBytes})
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// newQuotaBusiness registers a business with the given quotas on a fresh
+// database and Redis, with stored bytes of finished uploads already counted
+func newQuotaBusiness(t *testing.T, soft, hard, stored int64) *db.Business {
+	t.Helper()
+	if err := db.OpenSQLite(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.SQLDB.Close() })
+	mr := miniredis.RunT(t)
+	db.RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.RDB.Close() })
+	quotaDefaults = config.QuotaConfig{}
+
+	business, err := db.CreateBusiness("test", "test@example.com", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetBusinessQuota(business.ID, soft, hard); err != nil {
+		t.Fatal(err)
+	}
+	if stored > 0 {
+		_, err := db.SQLDB.Exec("INSERT INTO uploads (id, business_id, size, blob_sha256) VALUES ('stored', ?, ?, '')",
+			business.ID, stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return business
+}
+
+func TestHardQuotaCountsStoredAndReservedBytes(t *testing.T) {
+	business := newQuotaBusiness(t, 0, 100, 30)
+
+	first, err := reserveUpload(business.ID, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var qerr *quotaError
+	if _, err := reserveUpload(business.ID, 21); !errors.As(err, &qerr) {
+		t.Fatalf("upload of 21 bytes with 80 of 100 used: %v, want a quota error", err)
+	}
+	if qerr.used != 30 || qerr.reserved != 50 || qerr.quota != 100 {
+		t.Errorf("quota error = %+v", qerr)
+	}
+	if _, err := reserveUpload(business.ID, 20); err != nil {
+		t.Fatalf("upload that exactly fills the quota: %v", err)
+	}
+
+	// shrinking never fails, and frees the bytes for other uploads
+	if err := setReservation(business.ID, first, 40); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserveUpload(business.ID, 10); err != nil {
+		t.Fatalf("upload into freed bytes: %v", err)
+	}
+	releaseReservation(map[string]string{"business_id": strconv.Itoa(business.ID), "reservation": first})
+	if reserved, _ := reservedBytes(business.ID); reserved != 30 {
+		t.Errorf("reserved %d bytes after a release, want 30", reserved)
+	}
+}
+
+func TestConcurrentReservationsStayWithinHardQuota(t *testing.T) {
+	business := newQuotaBusiness(t, 0, 100, 0)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := reserveUpload(business.ID, 10); err == nil {
+				mu.Lock()
+				granted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if granted != 10 {
+		t.Errorf("%d uploads of 10 bytes fit in a quota of 100", granted)
+	}
+}
+
+func TestSoftQuotaOnlyWarns(t *testing.T) {
+	business := newQuotaBusiness(t, 50, 0, 40)
+	if _, err := reserveUpload(business.ID, 1000); err != nil {
+		t.Fatalf("upload past the soft quota: %v", err)
+	}
+
+	business = newQuotaBusiness(t, 50, 100, 40)
+	if _, err := reserveUpload(business.ID, 30); err != nil {
+		t.Fatalf("upload between the soft and hard quota: %v", err)
+	}
+	if _, err := reserveUpload(business.ID, 31); err == nil {
+		t.Error("upload past the hard quota was reserved")
+	}
+}
+
+func TestDeferredLengthUploadReservesWrittenBytes(t *testing.T) {
+	business := newQuotaBusiness(t, 0, 100, 0)
+	reservation, err := reserveUpload(business.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := tusd.FileInfo{
+		ID:             "deferred",
+		SizeIsDeferred: true,
+		MetaData:       map[string]string{"business_id": strconv.Itoa(business.ID), "reservation": reservation},
+	}
+	src := filepath.Join(t.TempDir(), "deferred")
+
+	if err := checkWritten(info, src, 0, 60); err != nil {
+		t.Fatal(err)
+	}
+	if reserved, _ := reservedBytes(business.ID); reserved != 60 {
+		t.Errorf("reserved %d bytes after 60 were written", reserved)
+	}
+	if _, err := reserveUpload(business.ID, 50); err == nil {
+		t.Error("another upload was given bytes the deferred upload has written")
+	}
+
+	err = checkWritten(info, src, 60, 50)
+	var cerr *constraintError
+	if !errors.As(err, &cerr) || cerr.StatusCode() != http.StatusRequestEntityTooLarge {
+		t.Fatalf("write past the hard quota: %v, want a 413 constraint error", err)
+	}
+	if reserved, _ := reservedBytes(business.ID); reserved != 60 {
+		t.Errorf("reserved %d bytes after a refused write, want 60", reserved)
+	}
+	if err := reserveLength(info.MetaData, 100); err != nil {
+		t.Errorf("declaring a length that fills the quota: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+type setRegionRequest struct {
+	Region string `json:"region" binding:"required"`
+}
+
+// setRegionHandler answers attempts to move a business to another region.
+// Data is pinned to the region a business registered in, so anything but
+// its current region is refused and audited.
+func setRegionHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid business id"})
+		return
+	}
+	business, err := db.GetBusinessByID(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "business not found"})
+		return
+	}
+	var req setRegionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	switch err := storage.ChangeRegion(business, req.Region); {
+	case errors.Is(err, storage.ErrUnknownRegion):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown region", "regions": storage.Regions()})
+	case errors.Is(err, storage.ErrCrossRegion):
+		c.JSON(http.StatusConflict, gin.H{"error": "business data cannot leave its region", "business_id": id, "region": business.Region})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change region"})
+	default:
+		c.JSON(http.StatusOK, gin.H{"business_id": id, "region": business.Region})
+	}
+}
+
+// listRegionsHandler lists the regions and the most recent refused attempts
+// to move data between them
+func listRegionsHandler(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+	violations, err := db.ListRegionViolations(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list region violations"})
+		return
+	}
+
+	list := make([]gin.H, 0, len(violations))
+	for _, v := range violations {
+		list = append(list, gin.H{
+			"business_id":   v.BusinessID,
+			"region":        v.Region,
+			"target_region": v.TargetRegion,
+			"action":        v.Action,
+			"detail":        v.Detail,
+			"refused_at":    v.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"regions":        storage.Regions(),
+		"default_region": storage.DefaultRegion(),
+		"violations":     list,
+	})
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// restoreJSON describes whether a blob can be read
+func restoreJSON(b *db.Blob) gin.H {
+	state, until := storage.RestoreState(b)
+	restore := gin.H{"status": state, "tier": b.Tier}
+	if state == storage.RestoreRestored {
+		restore["expires_at"] = until
+	}
+	return restore
+}
+
+type restoreRequest struct {
+	Days int `json:"days"`
+}
+
+// restoreHandler starts an asynchronous restore of an archived upload. The
+// upload's WebSocket subscribers get a "restored" event once it is readable.
+func restoreHandler(c *gin.Context) {
+	rec, ok := businessUpload(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	req := restoreRequest{Days: 1}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+	}
+	if req.Days < 1 || req.Days > 30 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 30"})
+		return
+	}
+
+	b, started, err := storage.StartRestore(rec.BusinessID, rec.BlobSHA256, req.Days)
+	if errors.Is(err, storage.ErrNotArchived) {
+		c.JSON(http.StatusConflict, gin.H{"error": "file is not archived", "restore": restoreJSON(b)})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start restore"})
+		return
+	}
+
+	if started {
+		go thawUpload(rec, req.Days)
+		c.JSON(http.StatusAccepted, gin.H{"message": "restore started", "file_id": rec.ID, "restore": restoreJSON(b)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"file_id": rec.ID, "restore": restoreJSON(b)})
+}
+
+func restoreStatusHandler(c *gin.Context) {
+	rec, ok := businessUpload(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	b, err := db.GetBlob(rec.BusinessID, rec.BlobSHA256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load restore status"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"file_id": rec.ID, "restore": restoreJSON(b)})
+}
+
+// thawUpload restores the blob of an upload and tells its subscribers how
+// it went
+func thawUpload(rec *db.UploadRecord, days int) {
+	if _, err := storage.Thaw(rec.BusinessID, rec.BlobSHA256, days); err != nil {
+		log.Printf("Restore of upload %s failed: %v", rec.ID, err)
+		GetConnectionManager().BroadcastProgress(rec.ID, ProgressMessage{
+			Type:      "error",
+			UploadID:  rec.ID,
+			TotalSize: rec.Size,
+			Status:    "restore_failed",
+			Message:   "Restore failed",
+		})
+		return
+	}
+	GetConnectionManager().BroadcastProgress(rec.ID, ProgressMessage{
+		Type:      "restored",
+		UploadID:  rec.ID,
+		Progress:  100.0,
+		BytesSent: rec.Size,
+		TotalSize: rec.Size,
+		Status:    storage.RestoreRestored,
+		Message:   "Restore completed, the file can be downloaded",
+	})
+}
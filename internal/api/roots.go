@@ -0,0 +1,152 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func rootJSON(r *db.StorageRoot) gin.H {
+	return gin.H{
+		"id":         r.ID,
+		"region":     r.Region,
+		"tier":       r.Tier,
+		"path":       r.Path,
+		"state":      r.State,
+		"created_at": r.CreatedAt,
+	}
+}
+
+func listRootsHandler(c *gin.Context) {
+	roots, err := storage.ListRoots()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list storage roots"})
+		return
+	}
+	list := make([]gin.H, 0, len(roots))
+	for i := range roots {
+		root := rootJSON(&roots[i].StorageRoot)
+		root["blobs"] = roots[i].Blobs
+		root["stored_bytes"] = roots[i].StoredBytes
+		root["restored_copies"] = roots[i].RestoredCopies
+		root["configured"] = roots[i].Configured
+		if roots[i].FreeBytes >= 0 {
+			root["free_bytes"] = roots[i].FreeBytes
+		}
+		list = append(list, root)
+	}
+	c.JSON(http.StatusOK, gin.H{"roots": list})
+}
+
+type addRootRequest struct {
+	Region string `json:"region"`
+	Tier   string `json:"tier" binding:"required"`
+	Path   string `json:"path" binding:"required"`
+}
+
+// addRootHandler adds a root directory to a tier of a region, the default
+// one unless given, and moves its share of the tier's blobs there in the
+// background
+func addRootHandler(c *gin.Context) {
+	var req addRootRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if req.Tier != storage.TierCDN && req.Tier != storage.TierS3 && req.Tier != storage.TierR2 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tier must be cdn, s3 or r2"})
+		return
+	}
+
+	if req.Region == "" {
+		req.Region = storage.DefaultRegion()
+	}
+	if !storage.ValidRegion(req.Region) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown region", "regions": storage.Regions()})
+		return
+	}
+
+	root, added, err := storage.AddRoot(req.Region, req.Tier, req.Path)
+	if errors.Is(err, storage.ErrCrossRegion) {
+		c.JSON(http.StatusConflict, gin.H{"error": "storage root belongs to another region", "root": rootJSON(root)})
+		return
+	} else if errors.Is(err, storage.ErrRootDraining) {
+		c.JSON(http.StatusConflict, gin.H{"error": "storage root is draining", "root": rootJSON(root)})
+		return
+	} else if err != nil {
+		log.Printf("Failed to add storage root %s: %v", req.Path, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add storage root"})
+		return
+	}
+	if !added {
+		c.JSON(http.StatusOK, gin.H{"message": "storage root already in use", "root": rootJSON(root)})
+		return
+	}
+
+	go func() {
+		if err := storage.Rebalance(root.ID); err != nil {
+			log.Printf("Rebalancing onto %s failed: %v", root.Path, err)
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"message": "storage root added, rebalancing started", "root": rootJSON(root)})
+}
+
+// drainRootHandler stops placing blobs on a root and moves the ones it holds
+// to the other roots of its tier in its region in the background
+func drainRootHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storage root id"})
+		return
+	}
+	root, err := storage.StartDrain(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "storage root not found"})
+		return
+	} else if errors.Is(err, storage.ErrLastRoot) {
+		c.JSON(http.StatusConflict, gin.H{"error": "the tier has no other root in its region to move blobs to", "root": rootJSON(root)})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to drain storage root"})
+		return
+	}
+	if root.State == storage.RootDrained {
+		c.JSON(http.StatusOK, gin.H{"message": "storage root already drained", "root": rootJSON(root)})
+		return
+	}
+
+	go func() {
+		if err := storage.Drain(root.ID); err != nil {
+			log.Printf("Draining %s failed: %v", root.Path, err)
+		}
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"message": "draining started", "root": rootJSON(root)})
+}
+
+// removeRootHandler forgets a drained root
+func removeRootHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid storage root id"})
+		return
+	}
+	switch err := storage.RemoveRoot(id); {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "storage root not found"})
+	case errors.Is(err, storage.ErrRootNotDrained):
+		c.JSON(http.StatusConflict, gin.H{"error": "storage root has to be drained first"})
+	case errors.Is(err, storage.ErrRootConfigured):
+		c.JSON(http.StatusConflict, gin.H{"error": "storage root is still in the storage path settings"})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove storage root"})
+	default:
+		c.JSON(http.StatusOK, gin.H{"message": "storage root removed", "id": id})
+	}
+}
@@ -4,13 +4,14 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"mediapipeline/internal/config"
 	"mediapipeline/internal/db"
 	"mediapipeline/internal/middleware"
+	"mediapipeline/internal/uploadstate"
 
 	"github.com/gin-gonic/gin"
 )
@@ -18,6 +19,7 @@ import (
 func SetupRoutes(r *gin.Engine, cfg *config.Config) {
 	r.Use(corsMiddleware())
 	r.GET("/health", healthCheck)
+	r.GET("/metrics", metricsHandler)
 
 	v1 := r.Group("/api/v1")
 	{
@@ -36,11 +38,13 @@ func SetupRoutes(r *gin.Engine, cfg *config.Config) {
 
 		uploads := v1.Group("/uploads")
 		{
-			uploads.POST("/", gin.WrapF(tusHandler.PostFile))
-			uploads.HEAD("/:id", gin.WrapF(tusHandler.HeadFile))
-			uploads.PATCH("/:id", gin.WrapF(tusHandler.PatchFile))
+			uploads.POST("/", gin.WrapF(tusExpiring(tusConcat(tusHandler))))
+			uploads.POST("/simple", simpleUploadHandler)
+			uploads.POST("/import", importUploadHandler)
+			uploads.HEAD("/:id", gin.WrapF(tusExpiring(tusHandler.HeadFile)))
+			uploads.PATCH("/:id", gin.WrapF(tusExpiring(tusPatch(tusHandler))))
 			uploads.GET("/:id", gin.WrapF(tusHandler.GetFile))
-			uploads.DELETE("/:id", gin.WrapF(tusHandler.DelFile))
+			uploads.DELETE("/:id", gin.WrapF(terminateTusUpload(tusHandler)))
 		}
 
 		uploadsMeta := v1.Group("/uploads/meta")
@@ -52,6 +56,9 @@ func SetupRoutes(r *gin.Engine, cfg *config.Config) {
 		business.Use(middleware.RateLimiter(db.RDB, 10, time.Minute, middleware.BusinessRateLimit{}))
 		{
 			business.GET("/uploads", listBusinessUploadsHandler)
+			business.GET("/usage", businessUsageHandler)
+			business.GET("/upload-constraints", getUploadConstraintsHandler)
+			business.PUT("/upload-constraints", setUploadConstraintsHandler)
 		}
 
 		storage := v1.Group("/storage")
@@ -59,6 +66,8 @@ func SetupRoutes(r *gin.Engine, cfg *config.Config) {
 		{
 			storage.GET("/:id", downloadHandler)
 			storage.DELETE("/:id", deleteHandler)
+			storage.POST("/:id/restore", restoreHandler)
+			storage.GET("/:id/restore", restoreStatusHandler)
 		}
 
 		ws := v1.Group("/ws")
@@ -74,6 +83,12 @@ func SetupRoutes(r *gin.Engine, cfg *config.Config) {
 		}
 
 		SetupBusinessRoutes(v1)
+		SetupObjectRoutes(v1)
+		SetupLifecycleRoutes(v1)
+		SetupCDNRoutes(v1)
+		SetupPurgeRoutes(v1)
+		SetupCostRoutes(v1, cfg)
+		SetupAdminRoutes(v1, cfg)
 	}
 }
 
@@ -81,10 +96,17 @@ func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS, HEAD")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-KEY, X-Upload-Token, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Concat")
-		c.Header("Access-Control-Expose-Headers", "Location, Upload-Offset")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-KEY, X-Upload-Token, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Concat, Upload-Checksum")
+		c.Header("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Expires")
 
 		if c.Request.Method == "OPTIONS" {
+			// tus clients discover what the upload endpoint supports here
+			if strings.HasPrefix(c.Request.URL.Path, "/api/v1/uploads") {
+				c.Header("Tus-Resumable", "1.0.0")
+				c.Header("Tus-Version", "1.0.0")
+				c.Header("Tus-Extension", tusExtensions)
+				c.Header("Tus-Checksum-Algorithm", checksumAlgorithmList)
+			}
 			c.AbortWithStatus(204)
 			return
 		}
@@ -107,9 +129,13 @@ func statusHandler(c *gin.Context) {
 		return
 	}
 
-	// Check if it's a TUS upload ID (starts with upload:)
-	uploadKey := "upload:" + token
-	uploadData, err := db.RDB.HGetAll(db.Ctx, uploadKey).Result()
+	// Check if it's a TUS upload ID (starts with upload:), or an upload
+	// token that was used for one
+	id := token
+	if tokenID, ok := tokenUpload(token); ok {
+		id = tokenID
+	}
+	uploadData, err := db.RDB.HGetAll(db.Ctx, uploadstate.Key(id)).Result()
 	if err != nil || len(uploadData) == 0 {
 		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
 		return
@@ -139,11 +165,12 @@ func statusHandler(c *gin.Context) {
 	}
 
 	response := gin.H{
-		"token":    token,
-		"status":   status,
-		"progress": progress,
-		"offset":   offset,
-		"size":     size,
+		"token":     token,
+		"upload_id": id,
+		"status":    status,
+		"progress":  progress,
+		"offset":    offset,
+		"size":      size,
 	}
 
 	// Add timestamps if available
@@ -156,60 +183,43 @@ func statusHandler(c *gin.Context) {
 	if completedAt, ok := uploadData["completed_at"]; ok {
 		response["completed_at"] = completedAt
 	}
+	if expires, ok := uploadExpiresAt(id); ok {
+		response["expires_at"] = expires.UTC().Format(time.RFC3339)
+	}
+	if reason, ok := uploadData["error"]; ok {
+		response["error"] = reason
+	}
+
+	// how the upload got to its status
+	history, err := uploadstate.History(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load upload history"})
+		return
+	}
+	response["history"] = history
 
 	c.JSON(http.StatusOK, response)
 }
 
 func deleteHandler(c *gin.Context) {
-	id := c.Param("id")
-	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing file ID parameter"})
+	rec, ok := businessUpload(c, c.Param("id"))
+	if !ok {
 		return
 	}
 
-	// Check if file exists
-	filePath := "./uploads_data/" + id
-	if _, err := os.Stat(filePath); err != nil {
+	filename, err := removeUpload(rec.ID)
+	if err != nil {
 		if os.IsNotExist(err) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot access file"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete file"})
 		}
 		return
 	}
 
-	// Try to get filename from TUS info
-	info, err := readTusInfo(id)
-	filename := id
-	if err == nil {
-		if fn, ok := info.MetaData["filename"]; ok && fn != "" {
-			filename = fn
-			realPath := filepath.Join("./uploads_data", filename)
-			if _, err := os.Stat(realPath); err == nil {
-				filePath = realPath
-			}
-		}
-	}
-
-	// Delete the file
-	if err := os.Remove(filePath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete file"})
-		return
-	}
-
-	// Delete the .info file if it exists
-	infoPath := filepath.Join("./uploads_data", id+".info")
-	if _, err := os.Stat(infoPath); err == nil {
-		os.Remove(infoPath)
-	}
-
-	// Remove from Redis
-	uploadKey := "upload:" + id
-	db.RDB.Del(db.Ctx, uploadKey)
-
 	c.JSON(http.StatusOK, gin.H{
 		"message":  "file deleted successfully",
-		"file_id":  id,
+		"file_id":  rec.ID,
 		"filename": filename,
 	})
 }
@@ -0,0 +1,993 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+const (
+	s3XMLNamespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3DefaultMaxKeys   = 1000
+	s3MinPartSize      = 5 << 20
+	s3MaxPartNumber    = 10000
+	s3MultipartTTL     = 7 * 24 * time.Hour
+	s3DefaultMediaType = "binary/octet-stream"
+)
+
+// directory holding the parts of in-flight multipart uploads
+var s3MultipartDir = filepath.Join(uploadDir, ".multipart")
+
+// s3Error is an S3 protocol error rendered as an XML error document
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func s3ErrAccessDenied(message string) *s3Error {
+	return &s3Error{http.StatusForbidden, "AccessDenied", message}
+}
+
+func s3ErrInternal() *s3Error {
+	return &s3Error{http.StatusInternalServerError, "InternalError", "we encountered an internal error, please try again"}
+}
+
+// s3ConstraintError reports an object that breaks its business's upload
+// constraints
+func s3ConstraintError(err *constraintError) *s3Error {
+	if err.status == http.StatusRequestEntityTooLarge {
+		return &s3Error{http.StatusBadRequest, "EntityTooLarge", err.msg}
+	}
+	return &s3Error{http.StatusBadRequest, "InvalidArgument", err.msg}
+}
+
+// s3QuotaError reports an object that does not fit in its business's quota
+func s3QuotaError(err error) *s3Error {
+	if qerr, ok := err.(*quotaError); ok {
+		return &s3Error{http.StatusForbidden, "QuotaExceeded", qerr.Error()}
+	}
+	return s3ErrInternal()
+}
+
+var (
+	s3ErrNoSuchKey    = &s3Error{http.StatusNotFound, "NoSuchKey", "the specified key does not exist"}
+	s3ErrNoSuchUpload = &s3Error{http.StatusNotFound, "NoSuchUpload", "the specified multipart upload does not exist"}
+)
+
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// SetupS3Routes mounts the S3-compatible API at the root of its own engine,
+// since S3 clients expect buckets directly under the endpoint. Buckets map to
+// businesses and requests are authenticated with SigV4 using the business
+// credentials. SetupRoutes must run first so the upload store exists.
+func SetupS3Routes(r *gin.Engine) {
+	r.Use(s3AuthMiddleware())
+	r.GET("/", listBucketsHandler)
+	r.Any("/:bucket", s3BucketHandler)
+	r.Any("/:bucket/*key", s3ObjectHandler)
+}
+
+func s3AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := make([]byte, 8)
+		rand.Read(requestID)
+		c.Set("s3_request_id", strings.ToUpper(hex.EncodeToString(requestID)))
+		c.Header("x-amz-request-id", c.GetString("s3_request_id"))
+
+		cred, s3err := authenticateS3(c.Request)
+		if s3err != nil {
+			writeS3Error(c, s3err)
+			c.Abort()
+			return
+		}
+		c.Set("s3_credential", cred)
+		c.Next()
+	}
+}
+
+func writeS3Error(c *gin.Context, s3err *s3Error) {
+	if c.Request.Method == http.MethodHead {
+		c.Status(s3err.status)
+		return
+	}
+	c.XML(s3err.status, s3ErrorResponse{
+		Code:      s3err.code,
+		Message:   s3err.message,
+		Resource:  c.Request.URL.Path,
+		RequestID: c.GetString("s3_request_id"),
+	})
+}
+
+// s3BucketName is the single bucket a business owns
+func s3BucketName(business *db.Business) string {
+	return fmt.Sprintf("business-%d", business.ID)
+}
+
+// s3Business returns the authenticated business after checking it owns the
+// bucket in the request path
+func s3Business(c *gin.Context) (*db.Business, bool) {
+	cred := c.MustGet("s3_credential").(*s3Credential)
+	if c.Param("bucket") != s3BucketName(cred.business) {
+		writeS3Error(c, s3ErrAccessDenied("access to this bucket is denied"))
+		return nil, false
+	}
+	return cred.business, true
+}
+
+func listBucketsHandler(c *gin.Context) {
+	cred := c.MustGet("s3_credential").(*s3Credential)
+	created, err := time.Parse("2006-01-02 15:04:05", cred.business.CreatedAt)
+	if err != nil {
+		created = time.Now().UTC()
+	}
+
+	type bucket struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	}
+	c.XML(http.StatusOK, struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID          string `xml:"ID"`
+			DisplayName string `xml:"DisplayName"`
+		} `xml:"Owner"`
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{
+		Xmlns: s3XMLNamespace,
+		Owner: struct {
+			ID          string `xml:"ID"`
+			DisplayName string `xml:"DisplayName"`
+		}{strconv.Itoa(cred.business.ID), cred.business.Name},
+		Buckets: []bucket{{s3BucketName(cred.business), created.Format(time.RFC3339)}},
+	})
+}
+
+func s3BucketHandler(c *gin.Context) {
+	business, ok := s3Business(c)
+	if !ok {
+		return
+	}
+
+	switch c.Request.Method {
+	case http.MethodHead:
+		c.Status(http.StatusOK)
+	case http.MethodGet:
+		q := c.Request.URL.Query()
+		switch {
+		case q.Has("location"):
+			c.XML(http.StatusOK, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3XMLNamespace})
+		case q.Has("uploads"), q.Has("versioning"), q.Has("policy"), q.Has("acl"):
+			writeS3Error(c, &s3Error{http.StatusNotImplemented, "NotImplemented", "this bucket operation is not supported"})
+		default:
+			listObjectsHandler(c, business)
+		}
+	default:
+		writeS3Error(c, &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "buckets are managed through business registration"})
+	}
+}
+
+func s3ObjectHandler(c *gin.Context) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" {
+		s3BucketHandler(c)
+		return
+	}
+	business, ok := s3Business(c)
+	if !ok {
+		return
+	}
+
+	q := c.Request.URL.Query()
+	uploadID := q.Get("uploadId")
+	switch c.Request.Method {
+	case http.MethodPut:
+		if c.GetHeader("X-Amz-Copy-Source") != "" {
+			writeS3Error(c, &s3Error{http.StatusNotImplemented, "NotImplemented", "server-side copy is not supported"})
+		} else if uploadID != "" {
+			uploadPartHandler(c, business, key, uploadID)
+		} else {
+			putObjectHandler(c, business, key)
+		}
+	case http.MethodGet, http.MethodHead:
+		if uploadID != "" {
+			listPartsHandler(c, business, key, uploadID)
+		} else {
+			getObjectHandler(c, business, key)
+		}
+	case http.MethodDelete:
+		if uploadID != "" {
+			abortMultipartHandler(c, business, key, uploadID)
+		} else {
+			deleteObjectHandler(c, business, key)
+		}
+	case http.MethodPost:
+		if q.Has("uploads") {
+			createMultipartHandler(c, business, key)
+		} else if uploadID != "" {
+			completeMultipartHandler(c, business, key, uploadID)
+		} else {
+			writeS3Error(c, &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "unsupported POST operation"})
+		}
+	default:
+		writeS3Error(c, &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "the specified method is not allowed against this resource"})
+	}
+}
+
+// s3UserMeta collects x-amz-meta-* headers as a JSON object
+func s3UserMeta(h http.Header) string {
+	meta := map[string]string{}
+	for name, values := range h {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-meta-") && len(values) > 0 {
+			meta[strings.TrimPrefix(lower, "x-amz-meta-")] = values[0]
+		}
+	}
+	data, _ := json.Marshal(meta)
+	return string(data)
+}
+
+func putObjectHandler(c *gin.Context, business *db.Business, key string) {
+	cred := c.MustGet("s3_credential").(*s3Credential)
+	body, size, s3err := s3PayloadReader(c.Request, cred)
+	if s3err != nil {
+		writeS3Error(c, s3err)
+		return
+	}
+
+	var expectedMD5 []byte
+	if contentMD5 := c.GetHeader("Content-MD5"); contentMD5 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(decoded) != md5.Size {
+			writeS3Error(c, &s3Error{http.StatusBadRequest, "InvalidDigest", "the Content-MD5 you specified is not valid"})
+			return
+		}
+		expectedMD5 = decoded
+	}
+
+	contentType := c.GetHeader("Content-Type")
+	if contentType == "" {
+		contentType = s3DefaultMediaType
+	}
+	if _, err := parseTags(c.GetHeader("X-Amz-Tagging")); err != nil {
+		writeS3Error(c, &s3Error{http.StatusBadRequest, "InvalidTag", err.Error()})
+		return
+	}
+
+	meta := tusd.MetaData{
+		"filetype":  contentType,
+		"tags":      c.GetHeader("X-Amz-Tagging"),
+		"user_meta": s3UserMeta(c.Request.Header),
+	}
+	obj, s3err := writeS3Upload(c.Request.Context(), business, key, meta, body, size, expectedMD5, newReservation())
+	if s3err != nil {
+		writeS3Error(c, s3err)
+		return
+	}
+
+	c.Header("ETag", strconv.Quote(obj.ETag))
+	c.Header("x-amz-version-id", strconv.Itoa(obj.Version))
+	c.Status(http.StatusOK)
+}
+
+// writeS3Upload streams an object body into a new upload in the tus store
+// and runs the same completion path as a finished tus upload, which stores
+// it as the next version of key. meta carries the object's filetype,
+// user_meta and tags, and its etag if that is not the MD5 of the data. The
+// object takes over the given quota reservation, if any, which is released
+// once it is stored. It returns the stored version.
+func writeS3Upload(ctx context.Context, business *db.Business, key string, meta tusd.MetaData, body io.Reader, size int64, expectedMD5 []byte, reservation string) (*db.ObjectVersion, *s3Error) {
+	meta["business_id"] = strconv.Itoa(business.ID)
+	meta["username"] = "s3"
+	meta["key"] = key
+	meta["path"] = key
+	meta["filename"] = sanitizeFilename(path.Base(key))
+	if err := checkUploadConstraints(business.ID, size, false, meta["filetype"]); err != nil {
+		if cerr, ok := err.(*constraintError); ok {
+			return nil, s3ConstraintError(cerr)
+		}
+		return nil, s3ErrInternal()
+	}
+	if reservation != "" {
+		if err := setReservation(business.ID, reservation, size); err != nil {
+			return nil, s3QuotaError(err)
+		}
+		meta["reservation"] = reservation
+	}
+	upload, err := tusComposer.Core.NewUpload(ctx, tusd.FileInfo{Size: size, MetaData: meta})
+	if err != nil {
+		releaseReservation(meta)
+		return nil, s3ErrInternal()
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return nil, s3ErrInternal()
+	}
+
+	discard := func() {
+		releaseReservation(meta)
+		if tusComposer.UsesTerminater {
+			_ = tusComposer.Terminater.AsTerminatableUpload(upload).Terminate(ctx)
+		}
+	}
+
+	hash := md5.New()
+	n, err := upload.WriteChunk(ctx, 0, io.TeeReader(body, hash))
+	if err != nil {
+		discard()
+		var mismatch errPayloadMismatch
+		if errors.As(err, &mismatch) {
+			return nil, &s3Error{http.StatusBadRequest, mismatch.code, "the provided payload does not match its signature"}
+		}
+		if cerr, ok := err.(*constraintError); ok {
+			return nil, s3ConstraintError(cerr)
+		}
+		return nil, &s3Error{http.StatusBadRequest, "IncompleteBody", "you did not provide the number of bytes specified by the Content-Length HTTP header"}
+	}
+	if n != size {
+		discard()
+		return nil, &s3Error{http.StatusBadRequest, "IncompleteBody", "you did not provide the number of bytes specified by the Content-Length HTTP header"}
+	}
+	sum := hash.Sum(nil)
+	if expectedMD5 != nil && !bytes.Equal(sum, expectedMD5) {
+		discard()
+		return nil, &s3Error{http.StatusBadRequest, "BadDigest", "the Content-MD5 you specified did not match what we received"}
+	}
+
+	if err := upload.FinishUpload(ctx); err != nil {
+		discard()
+		return nil, s3ErrInternal()
+	}
+	if meta["etag"] == "" {
+		meta["etag"] = hex.EncodeToString(sum)
+	}
+	if err := finalizeUpload(info.ID, meta, size); err != nil {
+		discard()
+		return nil, s3ErrInternal()
+	}
+	announceCompletion(info.ID, size)
+
+	obj, err := db.GetObjectVersionByUpload(info.ID)
+	if err != nil {
+		return nil, s3ErrInternal()
+	}
+	return obj, nil
+}
+
+func getObjectHandler(c *gin.Context, business *db.Business, key string) {
+	version := 0
+	if v := c.Query("versionId"); v != "" && v != "null" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeS3Error(c, &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid version id specified"})
+			return
+		}
+		version = n
+	}
+	obj, err := db.GetObjectVersion(business.ID, key, version)
+	if err != nil {
+		if version != 0 {
+			writeS3Error(c, &s3Error{http.StatusNotFound, "NoSuchVersion", "the specified version does not exist"})
+		} else {
+			writeS3Error(c, s3ErrNoSuchKey)
+		}
+		return
+	}
+	rec, err := db.GetUploadRecord(obj.UploadID)
+	if err != nil {
+		writeS3Error(c, s3ErrNoSuchKey)
+		return
+	}
+	content, err := openUpload(rec)
+	if err != nil {
+		if errors.Is(err, storage.ErrArchived) {
+			writeS3Error(c, &s3Error{http.StatusForbidden, "InvalidObjectState", "the object is archived and must be restored before it can be read"})
+		} else if os.IsNotExist(err) {
+			writeS3Error(c, s3ErrNoSuchKey)
+		} else {
+			writeS3Error(c, s3ErrInternal())
+		}
+		return
+	}
+	defer content.Close()
+
+	meta := map[string]string{}
+	_ = json.Unmarshal([]byte(obj.UserMeta), &meta)
+	for name, value := range meta {
+		c.Header("x-amz-meta-"+name, value)
+	}
+	c.Header("ETag", strconv.Quote(obj.ETag))
+	c.Header("Content-Type", obj.ContentType)
+	c.Header("x-amz-version-id", strconv.Itoa(obj.Version))
+
+	// ServeContent takes care of Range, HEAD and conditional requests
+	http.ServeContent(c.Writer, c.Request, key, obj.CreatedAt, content)
+}
+
+// deleteObjectHandler removes the version named by versionId. Without one,
+// the key gets a delete marker as in a versioned bucket: it is gone from
+// reads and listings, but its versions are kept.
+func deleteObjectHandler(c *gin.Context, business *db.Business, key string) {
+	if v := c.Query("versionId"); v != "" && v != "null" {
+		version, err := strconv.Atoi(v)
+		if err != nil || version <= 0 {
+			writeS3Error(c, &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid version id specified"})
+			return
+		}
+		// Deleting a missing version succeeds in S3
+		if obj, err := db.GetObjectVersion(business.ID, key, version); err == nil {
+			if _, err := removeUpload(obj.UploadID); err != nil && !os.IsNotExist(err) {
+				writeS3Error(c, s3ErrInternal())
+				return
+			}
+		}
+		c.Header("x-amz-version-id", v)
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	if err := db.AddDeleteMarker(business.ID, key); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		writeS3Error(c, s3ErrInternal())
+		return
+	}
+	c.Header("x-amz-delete-marker", "true")
+	c.Status(http.StatusNoContent)
+}
+
+type s3ListEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	EncodingType          string           `xml:"EncodingType,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	Marker                *string          `xml:"Marker,omitempty"`
+	NextMarker            string           `xml:"NextMarker,omitempty"`
+	KeyCount              *int             `xml:"KeyCount,omitempty"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3ListEntry    `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// listObjectsHandler serves ListObjectsV2 and the legacy ListObjects call
+func listObjectsHandler(c *gin.Context, business *db.Business) {
+	q := c.Request.URL.Query()
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	encode := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		encode = func(s string) string { return sigV4Escape(s, false) }
+	}
+
+	maxKeys := s3DefaultMaxKeys
+	if v := q.Get("max-keys"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			writeS3Error(c, &s3Error{http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer"})
+			return
+		}
+		if parsed < maxKeys {
+			maxKeys = parsed
+		}
+	}
+
+	v2 := q.Get("list-type") == "2"
+	after, skipPrefix := "", ""
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil || len(decoded) < 2 {
+				writeS3Error(c, &s3Error{http.StatusBadRequest, "InvalidArgument", "the continuation token provided is incorrect"})
+				return
+			}
+			after = string(decoded[2:])
+			if decoded[0] == 'p' {
+				skipPrefix = after
+			}
+		}
+	} else {
+		after = q.Get("marker")
+		if delimiter != "" && strings.HasSuffix(after, delimiter) {
+			skipPrefix = after
+		}
+	}
+
+	result := listBucketResult{
+		Xmlns:        s3XMLNamespace,
+		Name:         c.Param("bucket"),
+		Prefix:       encode(prefix),
+		Delimiter:    encode(delimiter),
+		MaxKeys:      maxKeys,
+		EncodingType: q.Get("encoding-type"),
+	}
+
+	count, lastPrefix, next := 0, skipPrefix, ""
+	err := db.ListObjects(business.ID, prefix, after, func(o *db.ObjectVersion) bool {
+		if delimiter != "" {
+			if i := strings.Index(o.Path[len(prefix):], delimiter); i >= 0 {
+				common := o.Path[:len(prefix)+i+len(delimiter)]
+				if common == lastPrefix {
+					return true
+				}
+				if count == maxKeys {
+					result.IsTruncated = true
+					return false
+				}
+				result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{encode(common)})
+				lastPrefix, next = common, "p:"+common
+				count++
+				return true
+			}
+		}
+		if count == maxKeys {
+			result.IsTruncated = true
+			return false
+		}
+		result.Contents = append(result.Contents, s3ListEntry{
+			Key:          encode(o.Path),
+			LastModified: o.CreatedAt.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         strconv.Quote(o.ETag),
+			Size:         o.Size,
+			StorageClass: "STANDARD",
+		})
+		next = "k:" + o.Path
+		count++
+		return true
+	})
+	if err != nil {
+		writeS3Error(c, s3ErrInternal())
+		return
+	}
+
+	if v2 {
+		result.KeyCount = &count
+		result.ContinuationToken = q.Get("continuation-token")
+		result.StartAfter = encode(q.Get("start-after"))
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(next))
+		}
+	} else {
+		marker := encode(q.Get("marker"))
+		result.Marker = &marker
+		if result.IsTruncated && delimiter != "" {
+			result.NextMarker = encode(next[2:])
+		}
+	}
+
+	c.XML(http.StatusOK, result)
+}
+
+// multipart upload sessions live in Redis while their parts sit on disk
+func multipartKey(uploadID string) string {
+	return "s3:multipart:" + uploadID
+}
+
+func multipartPartsKey(uploadID string) string {
+	return "s3:multipart:" + uploadID + ":parts"
+}
+
+// partReservation names the quota reservation of a part of a multipart
+// upload. Each part has its own, so parts written at the same time do not
+// overwrite each other's.
+func partReservation(uploadID string, partNumber int) string {
+	return "s3:" + uploadID + ":" + strconv.Itoa(partNumber)
+}
+
+// releaseParts drops the part reservations of multipart uploads under a
+// reservations hash
+func releaseParts(key string, uploadIDs ...string) error {
+	var fields []string
+	iter := db.RDB.HScan(db.Ctx, key, 0, "s3:*", 100).Iterator()
+	for i := 0; iter.Next(db.Ctx); i++ {
+		// the iterator yields field names and values in turn
+		if i%2 == 1 {
+			continue
+		}
+		for _, id := range uploadIDs {
+			if strings.HasPrefix(iter.Val(), "s3:"+id+":") {
+				fields = append(fields, iter.Val())
+			}
+		}
+	}
+	if err := iter.Err(); err != nil || len(fields) == 0 {
+		return err
+	}
+	return db.RDB.HDel(db.Ctx, key, fields...).Err()
+}
+
+// loadMultipart returns the session fields after checking it belongs to the
+// business and key
+func loadMultipart(c *gin.Context, business *db.Business, key, uploadID string) (map[string]string, bool) {
+	session, err := db.RDB.HGetAll(db.Ctx, multipartKey(uploadID)).Result()
+	if err != nil || len(session) == 0 || session["business_id"] != strconv.Itoa(business.ID) || session["key"] != key {
+		writeS3Error(c, s3ErrNoSuchUpload)
+		return nil, false
+	}
+	return session, true
+}
+
+func createMultipartHandler(c *gin.Context, business *db.Business, key string) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		writeS3Error(c, s3ErrInternal())
+		return
+	}
+	uploadID := hex.EncodeToString(id)
+
+	contentType := c.GetHeader("Content-Type")
+	if contentType == "" {
+		contentType = s3DefaultMediaType
+	}
+	fields := map[string]interface{}{
+		"business_id":  business.ID,
+		"key":          key,
+		"content_type": contentType,
+		"user_meta":    s3UserMeta(c.Request.Header),
+		"created_at":   time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := os.MkdirAll(filepath.Join(s3MultipartDir, uploadID), 0o755); err != nil {
+		writeS3Error(c, s3ErrInternal())
+		return
+	}
+	if err := db.RDB.HSet(db.Ctx, multipartKey(uploadID), fields).Err(); err != nil {
+		writeS3Error(c, s3ErrInternal())
+		return
+	}
+	db.RDB.Expire(db.Ctx, multipartKey(uploadID), s3MultipartTTL)
+
+	c.XML(http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Xmlns: s3XMLNamespace, Bucket: c.Param("bucket"), Key: key, UploadID: uploadID})
+}
+
+func uploadPartHandler(c *gin.Context, business *db.Business, key, uploadID string) {
+	partNumber, err := strconv.Atoi(c.Query("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		writeS3Error(c, &s3Error{http.StatusBadRequest, "InvalidArgument", "part number must be an integer between 1 and 10000"})
+		return
+	}
+	if _, ok := loadMultipart(c, business, key, uploadID); !ok {
+		return
+	}
+
+	cred := c.MustGet("s3_credential").(*s3Credential)
+	body, size, s3err := s3PayloadReader(c.Request, cred)
+	if s3err != nil {
+		writeS3Error(c, s3err)
+		return
+	}
+
+	// parts count against the quota as they are written, not only once
+	// the upload is completed. A part that fails to be written leaves the
+	// reservation of the part it would have replaced, if any.
+	reservation := partReservation(uploadID, partNumber)
+	if err := setReservation(business.ID, reservation, size); err != nil {
+		writeS3Error(c, s3QuotaError(err))
+		return
+	}
+	stored := false
+	defer func() {
+		if stored {
+			return
+		}
+		if part, ok := loadPart(uploadID, partNumber); ok {
+			_ = setReservation(business.ID, reservation, part.size)
+		} else {
+			db.RDB.HDel(db.Ctx, reservedKey(business.ID), reservation)
+		}
+	}()
+
+	dir := filepath.Join(s3MultipartDir, uploadID)
+	tmp, err := os.CreateTemp(dir, "part-*")
+	if err != nil {
+		writeS3Error(c, s3ErrNoSuchUpload)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), body)
+	tmp.Close()
+	if err != nil || n != size {
+		var mismatch errPayloadMismatch
+		if errors.As(err, &mismatch) {
+			writeS3Error(c, &s3Error{http.StatusBadRequest, mismatch.code, "the provided payload does not match its signature"})
+		} else {
+			writeS3Error(c, &s3Error{http.StatusBadRequest, "IncompleteBody", "you did not provide the number of bytes specified by the Content-Length HTTP header"})
+		}
+		return
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, strconv.Itoa(partNumber))); err != nil {
+		writeS3Error(c, s3ErrInternal())
+		return
+	}
+
+	etag := hex.EncodeToString(hash.Sum(nil))
+	partsKey := multipartPartsKey(uploadID)
+	value := fmt.Sprintf("%s %d %s", etag, size, time.Now().UTC().Format(time.RFC3339))
+	if err := db.RDB.HSet(db.Ctx, partsKey, strconv.Itoa(partNumber), value).Err(); err != nil {
+		writeS3Error(c, s3ErrInternal())
+		return
+	}
+	db.RDB.Expire(db.Ctx, partsKey, s3MultipartTTL)
+	stored = true
+
+	c.Header("ETag", strconv.Quote(etag))
+	c.Status(http.StatusOK)
+}
+
+// s3Part is a stored part as recorded in the session parts hash
+type s3Part struct {
+	number   int
+	etag     string
+	size     int64
+	uploaded string
+}
+
+// loadPart returns one stored part of a multipart upload
+func loadPart(uploadID string, number int) (s3Part, bool) {
+	p := s3Part{number: number}
+	value, err := db.RDB.HGet(db.Ctx, multipartPartsKey(uploadID), strconv.Itoa(number)).Result()
+	if err != nil {
+		return p, false
+	}
+	_, err = fmt.Sscanf(value, "%s %d %s", &p.etag, &p.size, &p.uploaded)
+	return p, err == nil
+}
+
+func loadParts(uploadID string) (map[int]s3Part, error) {
+	raw, err := db.RDB.HGetAll(db.Ctx, multipartPartsKey(uploadID)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	parts := make(map[int]s3Part, len(raw))
+	for field, value := range raw {
+		number, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		var p s3Part
+		if _, err := fmt.Sscanf(value, "%s %d %s", &p.etag, &p.size, &p.uploaded); err != nil {
+			continue
+		}
+		p.number = number
+		parts[number] = p
+	}
+	return parts, nil
+}
+
+func listPartsHandler(c *gin.Context, business *db.Business, key, uploadID string) {
+	if _, ok := loadMultipart(c, business, key, uploadID); !ok {
+		return
+	}
+	parts, err := loadParts(uploadID)
+	if err != nil {
+		writeS3Error(c, s3ErrInternal())
+		return
+	}
+
+	type part struct {
+		PartNumber   int    `xml:"PartNumber"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+	}
+	listed := make([]part, 0, len(parts))
+	for _, p := range parts {
+		listed = append(listed, part{p.number, p.uploaded, strconv.Quote(p.etag), p.size})
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].PartNumber < listed[j].PartNumber })
+
+	c.XML(http.StatusOK, struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		Xmlns       string   `xml:"xmlns,attr"`
+		Bucket      string   `xml:"Bucket"`
+		Key         string   `xml:"Key"`
+		UploadID    string   `xml:"UploadId"`
+		IsTruncated bool     `xml:"IsTruncated"`
+		Parts       []part   `xml:"Part"`
+	}{Xmlns: s3XMLNamespace, Bucket: c.Param("bucket"), Key: key, UploadID: uploadID, Parts: listed})
+}
+
+func abortMultipartHandler(c *gin.Context, business *db.Business, key, uploadID string) {
+	if _, ok := loadMultipart(c, business, key, uploadID); !ok {
+		return
+	}
+	discardMultipart(business.ID, uploadID)
+	c.Status(http.StatusNoContent)
+}
+
+func discardMultipart(businessID int, uploadID string) {
+	db.RDB.Del(db.Ctx, multipartKey(uploadID), multipartPartsKey(uploadID))
+	os.RemoveAll(filepath.Join(s3MultipartDir, uploadID))
+	_ = releaseParts(reservedKey(businessID), uploadID)
+}
+
+// sweepMultipartUploads removes the parts and quota reservations of
+// multipart uploads whose session expired without being completed or
+// aborted, and returns how many it removed
+func sweepMultipartUploads(now time.Time) (int, error) {
+	entries, err := os.ReadDir(s3MultipartDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var abandoned []string
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() || now.Sub(info.ModTime()) < s3MultipartTTL {
+			continue
+		}
+		if n, err := db.RDB.Exists(db.Ctx, multipartKey(entry.Name())).Result(); err != nil || n > 0 {
+			continue
+		}
+		abandoned = append(abandoned, entry.Name())
+	}
+	if len(abandoned) == 0 {
+		return 0, nil
+	}
+
+	// the parts go before their reservations. The sessions that named their
+	// business are gone, so the reservations are looked for under every
+	// business.
+	for _, id := range abandoned {
+		db.RDB.Del(db.Ctx, multipartPartsKey(id))
+		os.RemoveAll(filepath.Join(s3MultipartDir, id))
+	}
+	iter := db.RDB.Scan(db.Ctx, 0, reservedKeyPrefix+"*", 100).Iterator()
+	for iter.Next(db.Ctx) {
+		if err := releaseParts(iter.Val(), abandoned...); err != nil {
+			return 0, err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	return len(abandoned), nil
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+func completeMultipartHandler(c *gin.Context, business *db.Business, key, uploadID string) {
+	session, ok := loadMultipart(c, business, key, uploadID)
+	if !ok {
+		return
+	}
+
+	var req completeMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(c.Request.Body, 1<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		writeS3Error(c, &s3Error{http.StatusBadRequest, "MalformedXML", "the XML you provided was not well-formed"})
+		return
+	}
+	stored, err := loadParts(uploadID)
+	if err != nil {
+		writeS3Error(c, s3ErrInternal())
+		return
+	}
+
+	var (
+		size    int64
+		digests []byte
+		readers []io.Reader
+	)
+	dir := filepath.Join(s3MultipartDir, uploadID)
+	for i, requested := range req.Parts {
+		if i > 0 && requested.PartNumber <= req.Parts[i-1].PartNumber {
+			writeS3Error(c, &s3Error{http.StatusBadRequest, "InvalidPartOrder", "the list of parts was not in ascending order"})
+			return
+		}
+		part, ok := stored[requested.PartNumber]
+		if !ok || strings.Trim(requested.ETag, `"`) != part.etag {
+			writeS3Error(c, &s3Error{http.StatusBadRequest, "InvalidPart", "one or more of the specified parts could not be found"})
+			return
+		}
+		if i < len(req.Parts)-1 && part.size < s3MinPartSize {
+			writeS3Error(c, &s3Error{http.StatusBadRequest, "EntityTooSmall", "your proposed upload is smaller than the minimum allowed object size"})
+			return
+		}
+		f, err := os.Open(filepath.Join(dir, strconv.Itoa(part.number)))
+		if err != nil {
+			writeS3Error(c, &s3Error{http.StatusBadRequest, "InvalidPart", "one or more of the specified parts could not be found"})
+			return
+		}
+		defer f.Close()
+		digest, _ := hex.DecodeString(part.etag)
+		digests = append(digests, digest...)
+		readers = append(readers, f)
+		size += part.size
+	}
+
+	// the parts keep their reservations until they are removed, so the
+	// object takes none of its own
+	sum := md5.Sum(digests)
+	meta := tusd.MetaData{
+		"filetype":  session["content_type"],
+		"user_meta": session["user_meta"],
+		"etag":      fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(req.Parts)),
+	}
+	obj, s3err := writeS3Upload(c.Request.Context(), business, key, meta, io.MultiReader(readers...), size, nil, "")
+	if s3err != nil {
+		writeS3Error(c, s3err)
+		return
+	}
+	discardMultipart(business.ID, uploadID)
+	c.Header("x-amz-version-id", strconv.Itoa(obj.Version))
+
+	c.XML(http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{
+		Xmlns:    s3XMLNamespace,
+		Location: c.Request.URL.Path,
+		Bucket:   c.Param("bucket"),
+		Key:      key,
+		ETag:     strconv.Quote(obj.ETag),
+	})
+}
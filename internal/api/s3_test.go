@@ -0,0 +1,43 @@
+package api
+
+import (
+	"testing"
+
+	"mediapipeline/internal/db"
+)
+
+func TestMultipartPartsAreReservedSeparately(t *testing.T) {
+	business := newQuotaBusiness(t, 0, 100, 0)
+	other, err := reserveUpload(business.ID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []struct {
+		upload string
+		number int
+		size   int64
+	}{{"a", 1, 40}, {"a", 2, 40}, {"a", 1, 30}, {"b", 1, 20}} {
+		if err := setReservation(business.ID, partReservation(p.upload, p.number), p.size); err != nil {
+			t.Fatalf("part %d of %s: %v", p.number, p.upload, err)
+		}
+	}
+	// the rewritten part 1 replaced its own reservation only
+	if reserved, _ := reservedBytes(business.ID); reserved != 100 {
+		t.Fatalf("reserved %d bytes, want 100", reserved)
+	}
+	if err := setReservation(business.ID, partReservation("b", 2), 1); err == nil {
+		t.Error("part past the hard quota was reserved")
+	}
+
+	if err := releaseParts(reservedKey(business.ID), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if reserved, _ := reservedBytes(business.ID); reserved != 30 {
+		t.Errorf("reserved %d bytes after releasing the parts of a, want 30", reserved)
+	}
+	fields, _ := db.RDB.HKeys(db.Ctx, reservedKey(business.ID)).Result()
+	if len(fields) != 2 {
+		t.Errorf("reservations left: %v, want part 1 of b and %s", fields, other)
+	}
+}
@@ -0,0 +1,389 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediapipeline/internal/db"
+)
+
+// SigV4 constants understood by the S3 facade
+const (
+	sigV4Algorithm        = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat       = "20060102T150405Z"
+	sigV4MaxSkew          = 15 * time.Minute
+	unsignedPayload       = "UNSIGNED-PAYLOAD"
+	streamingPayload      = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedBody = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256           = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Credential is the outcome of a successful signature check
+type s3Credential struct {
+	business  *db.Business
+	amzDate   string
+	scope     string
+	signature string
+	key       []byte
+}
+
+// parsed parameters of either header or query string authentication
+type sigV4Params struct {
+	accessKey     string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	presigned     bool
+	expires       time.Duration
+}
+
+// authenticateS3 verifies the SigV4 signature of an S3 request. The access
+// key ID is the business ID and the secret access key is its API key.
+func authenticateS3(r *http.Request) (*s3Credential, *s3Error) {
+	params, s3err := parseSigV4(r)
+	if s3err != nil {
+		return nil, s3err
+	}
+	businessID, err := strconv.Atoi(params.accessKey)
+	if err != nil {
+		return nil, &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "the access key ID does not exist"}
+	}
+	business, err := db.GetBusinessByID(businessID)
+	if err != nil || business == nil {
+		return nil, &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "the access key ID does not exist"}
+	}
+	cred, s3err := verifySigV4(r, params, business.APIKey, time.Now().UTC())
+	if s3err != nil {
+		return nil, s3err
+	}
+	cred.business = business
+	return cred, nil
+}
+
+// verifySigV4 checks the signature of a request signed with secret, and
+// whether it is still valid at now
+func verifySigV4(r *http.Request, params *sigV4Params, secret string, now time.Time) (*s3Credential, *s3Error) {
+	ts, err := time.Parse(sigV4TimeFormat, params.amzDate)
+	if err != nil {
+		return nil, s3ErrAccessDenied("invalid X-Amz-Date")
+	}
+	if !strings.HasPrefix(params.amzDate, params.date) {
+		return nil, s3ErrAccessDenied("credential date does not match X-Amz-Date")
+	}
+	if params.presigned {
+		if now.After(ts.Add(params.expires)) {
+			return nil, s3ErrAccessDenied("request has expired")
+		}
+	} else if now.Sub(ts) > sigV4MaxSkew || ts.Sub(now) > sigV4MaxSkew {
+		return nil, &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "the difference between the request time and the server's time is too large"}
+	}
+	if params.service != "s3" {
+		return nil, s3ErrAccessDenied("credential scope must target the s3 service")
+	}
+
+	payloadHash := unsignedPayload
+	if !params.presigned {
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return nil, &s3Error{http.StatusBadRequest, "InvalidRequest", "missing x-amz-content-sha256 header"}
+		}
+	}
+
+	scope := strings.Join([]string{params.date, params.region, params.service, "aws4_request"}, "/")
+	canonical := canonicalRequest(r, params, payloadHash)
+	stringToSign := strings.Join([]string{sigV4Algorithm, params.amzDate, scope, hexSHA256([]byte(canonical))}, "\n")
+
+	key := sigV4SigningKey(secret, params.date, params.region, params.service)
+	expected := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+	if !hmac.Equal([]byte(expected), []byte(params.signature)) {
+		return nil, &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "the request signature we calculated does not match the signature you provided"}
+	}
+
+	return &s3Credential{
+		amzDate:   params.amzDate,
+		scope:     scope,
+		signature: params.signature,
+		key:       key,
+	}, nil
+}
+
+func parseSigV4(r *http.Request) (*sigV4Params, *s3Error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != "" {
+		if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return nil, s3ErrAccessDenied("unsupported signing algorithm")
+		}
+		p := &sigV4Params{
+			signature: q.Get("X-Amz-Signature"),
+			amzDate:   q.Get("X-Amz-Date"),
+			presigned: true,
+		}
+		if err := p.setCredential(q.Get("X-Amz-Credential")); err != nil {
+			return nil, s3ErrAccessDenied(err.Error())
+		}
+		p.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+		expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || expires < 1 || expires > 604800 {
+			return nil, s3ErrAccessDenied("invalid X-Amz-Expires")
+		}
+		p.expires = time.Duration(expires) * time.Second
+		return p, nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, s3ErrAccessDenied("missing authentication")
+	}
+	if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+		return nil, s3ErrAccessDenied("unsupported signing algorithm")
+	}
+
+	p := &sigV4Params{amzDate: r.Header.Get("X-Amz-Date")}
+	if p.amzDate == "" {
+		p.amzDate = r.Header.Get("Date")
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(auth, sigV4Algorithm+" "), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "Credential":
+			if err := p.setCredential(value); err != nil {
+				return nil, s3ErrAccessDenied(err.Error())
+			}
+		case "SignedHeaders":
+			p.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			p.signature = value
+		}
+	}
+	if p.accessKey == "" || p.signature == "" || len(p.signedHeaders) == 0 {
+		return nil, s3ErrAccessDenied("malformed Authorization header")
+	}
+	return p, nil
+}
+
+func (p *sigV4Params) setCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return errors.New("malformed credential scope")
+	}
+	p.accessKey, p.date, p.region, p.service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+func canonicalRequest(r *http.Request, p *sigV4Params, payloadHash string) string {
+	var headers strings.Builder
+	for _, name := range p.signedHeaders {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			values := r.Header.Values(name)
+			trimmed := make([]string, len(values))
+			for i, v := range values {
+				trimmed[i] = strings.Join(strings.Fields(v), " ")
+			}
+			value = strings.Join(trimmed, ",")
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		sigV4Escape(r.URL.Path, false),
+		canonicalQuery(r, p.presigned),
+		headers.String(),
+		strings.Join(p.signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func canonicalQuery(r *http.Request, presigned bool) string {
+	var pairs []string
+	for name, values := range r.URL.Query() {
+		if presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range values {
+			pairs = append(pairs, sigV4Escape(name, true)+"="+sigV4Escape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// sigV4Escape URI-encodes every byte except the unreserved characters and,
+// for paths, the slash separators
+func sigV4Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func sigV4SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	key = hmacSHA256(key, []byte(region))
+	key = hmacSHA256(key, []byte(service))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3PayloadReader returns the decoded request body along with its length,
+// verifying the payload against the signed x-amz-content-sha256 value
+func s3PayloadReader(r *http.Request, cred *s3Credential) (io.Reader, int64, *s3Error) {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	switch payloadHash {
+	case streamingPayload, streamingUnsignedBody:
+		length, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || length < 0 {
+			return nil, 0, &s3Error{http.StatusLengthRequired, "MissingContentLength", "missing x-amz-decoded-content-length header"}
+		}
+		chunked := &awsChunkedReader{src: bufio.NewReader(r.Body), cred: cred, signed: payloadHash == streamingPayload, prevSig: cred.signature}
+		return chunked, length, nil
+	}
+
+	if r.ContentLength < 0 {
+		return nil, 0, &s3Error{http.StatusLengthRequired, "MissingContentLength", "you must provide the Content-Length HTTP header"}
+	}
+	if payloadHash == "" || payloadHash == unsignedPayload {
+		return r.Body, r.ContentLength, nil
+	}
+	expected, err := hex.DecodeString(payloadHash)
+	if err != nil || len(expected) != sha256.Size {
+		return nil, 0, &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid x-amz-content-sha256 header"}
+	}
+	return &verifyingReader{src: r.Body, hash: sha256.New(), expected: expected, code: "XAmzContentSHA256Mismatch"}, r.ContentLength, nil
+}
+
+// verifyingReader fails the final read if the digest of everything read does
+// not match the expected value
+type verifyingReader struct {
+	src      io.Reader
+	hash     hash.Hash
+	expected []byte
+	code     string
+}
+
+// errPayloadMismatch wraps digest mismatches so handlers can report them
+type errPayloadMismatch struct{ code string }
+
+func (e errPayloadMismatch) Error() string { return e.code }
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.src.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(v.hash.Sum(nil), v.expected) {
+		return n, errPayloadMismatch{v.code}
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes aws-chunked bodies, checking each chunk signature
+// when the payload is signed
+type awsChunkedReader struct {
+	src     *bufio.Reader
+	cred    *s3Credential
+	signed  bool
+	prevSig string
+	chunk   []byte
+	done    bool
+}
+
+func (a *awsChunkedReader) Read(p []byte) (int, error) {
+	for len(a.chunk) == 0 {
+		if a.done {
+			return 0, io.EOF
+		}
+		if err := a.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, a.chunk)
+	a.chunk = a.chunk[n:]
+	return n, nil
+}
+
+func (a *awsChunkedReader) nextChunk() error {
+	line, err := a.src.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	header := strings.TrimRight(line, "\r\n")
+	sizeHex, ext, _ := strings.Cut(header, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > 64<<20 {
+		return errPayloadMismatch{"IncompleteBody"}
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(a.src, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	if a.signed {
+		sig := strings.TrimPrefix(ext, "chunk-signature=")
+		stringToSign := strings.Join([]string{
+			sigV4Algorithm + "-PAYLOAD", a.cred.amzDate, a.cred.scope, a.prevSig, emptySHA256, hexSHA256(data),
+		}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(a.cred.key, []byte(stringToSign)))
+		if !hmac.Equal([]byte(expected), []byte(sig)) {
+			return errPayloadMismatch{"SignatureDoesNotMatch"}
+		}
+		a.prevSig = sig
+	}
+
+	if size == 0 {
+		// Drain trailing headers up to the terminating blank line
+		a.done = true
+		for {
+			line, err := a.src.ReadString('\n')
+			if err != nil || strings.TrimRight(line, "\r\n") == "" {
+				return nil
+			}
+		}
+	}
+
+	if _, err := a.src.Discard(2); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	a.chunk = data
+	return nil
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"mediapipeline/internal/uploadstate"
+
+	"github.com/gin-gonic/gin"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+const (
+	// how much of a multipart form is held in memory; larger files are
+	// spooled to temporary files
+	simpleFormMemory = 8 << 20
+	// how often the data written of an upload is passed on as progress
+	progressChunk = 256 << 10
+)
+
+// largest request the multipart form endpoint accepts
+var simpleUploadLimit int64 = 64 << 20
+
+// form fields that are not upload metadata
+var simpleFormFields = map[string]bool{"file": true, "upload_token": true}
+
+type simpleUpload struct {
+	UploadID string `json:"upload_id"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size"`
+}
+
+// simpleUploadHandler stores the files of a multipart form, for clients to
+// whom tus is overkill. Files are sent in "file" fields and the other fields
+// are their metadata, as tus metadata would be; each file's own name and
+// content type take precedence. They pass the same checks as tus uploads
+// and are written through the tus store, so every file either is stored and
+// completed or none is.
+//
+// Besides the headers of tus uploads, an upload token can be sent in the
+// upload_token field, for plain HTML forms. A token creates one upload, so
+// it only takes a single file.
+func simpleUploadHandler(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, simpleUploadLimit)
+	if err := c.Request.ParseMultipartForm(simpleFormMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("form is larger than the %d bytes allowed", simpleUploadLimit)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid multipart form: " + err.Error()})
+		return
+	}
+	defer c.Request.MultipartForm.RemoveAll()
+
+	form := c.Request.MultipartForm
+	files := form.File["file"]
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "form has no file fields"})
+		return
+	}
+	header := c.Request.Header.Clone()
+	if token := form.Value["upload_token"]; len(token) > 0 && header.Get("X-Upload-Token") == "" {
+		header.Set("X-Upload-Token", token[0])
+	}
+	if header.Get("X-Upload-Token") != "" && len(files) > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "an upload token takes a single file"})
+		return
+	}
+	if len(form.Value["path"]) > 0 && len(files) > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path can only be given for a single file"})
+		return
+	}
+
+	// every file is checked and reserved before any is stored
+	infos := make([]tusd.FileInfo, 0, len(files))
+	release := func(infos []tusd.FileInfo) {
+		for _, info := range infos {
+			releaseReservation(info.MetaData)
+		}
+	}
+	for _, file := range files {
+		meta := make(tusd.MetaData)
+		for field, values := range form.Value {
+			if !simpleFormFields[field] && len(values) > 0 {
+				meta[field] = values[0]
+			}
+		}
+		if file.Filename != "" {
+			meta["filename"] = file.Filename
+		}
+		if t := file.Header.Get("Content-Type"); t != "" {
+			meta["filetype"] = t
+		}
+		info := tusd.FileInfo{Size: file.Size, MetaData: meta}
+		if err := prepareUpload(header, &info); err != nil {
+			release(infos)
+			writeUploadError(c, err)
+			return
+		}
+		infos = append(infos, info)
+	}
+
+	uploads := make([]simpleUpload, 0, len(files))
+	for i, file := range files {
+		id, err := storeFormFile(c.Request.Context(), infos[i], header.Get("X-Upload-Token"), file)
+		if err != nil {
+			release(infos[i+1:])
+			for _, stored := range uploads {
+				if _, rerr := removeUpload(stored.UploadID); rerr != nil {
+					log.Printf("Failed to remove upload %s of a failed form: %v", stored.UploadID, rerr)
+				}
+			}
+			writeUploadError(c, err)
+			return
+		}
+		uploads = append(uploads, simpleUpload{UploadID: id, Filename: infos[i].MetaData["filename"], Size: file.Size})
+	}
+	c.JSON(http.StatusCreated, gin.H{"uploads": uploads})
+}
+
+func storeFormFile(ctx context.Context, info tusd.FileInfo, token string, file *multipart.FileHeader) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		releaseReservation(info.MetaData)
+		return "", err
+	}
+	defer src.Close()
+	return ingestUpload(ctx, info, token, src)
+}
+
+// ingestUpload creates an upload in the tus store from info, as prepared by
+// prepareUpload, writes body to it and runs it through the same completion
+// path as a finished tus upload. It returns the ID of the completed upload.
+func ingestUpload(ctx context.Context, info tusd.FileInfo, token string, body io.Reader) (string, error) {
+	upload, info, err := createUpload(ctx, info, token)
+	if err != nil {
+		return "", err
+	}
+	return info.ID, completeUpload(ctx, upload, info, body)
+}
+
+// createUpload creates an upload in the tus store from info, as prepared by
+// prepareUpload, and binds the token it was created with, if any.
+// Subscribers hear of it as of a tus upload.
+func createUpload(ctx context.Context, info tusd.FileInfo, token string) (tusd.Upload, tusd.FileInfo, error) {
+	upload, err := tusComposer.Core.NewUpload(ctx, info)
+	if err != nil {
+		releaseReservation(info.MetaData)
+		return nil, info, err
+	}
+	if info, err = upload.GetInfo(ctx); err != nil {
+		discardUpload(upload, info)
+		return nil, info, err
+	}
+
+	log.Printf("Upload %s created (size: %d)", info.ID, info.Size)
+	setUploadState(info.ID, uploadstate.Created, map[string]interface{}{
+		"size":       info.Size,
+		"offset":     0,
+		"progress":   0.0,
+		"created_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	bindUploadToken(token, info.ID)
+	GetConnectionManager().BroadcastProgress(info.ID, ProgressMessage{
+		Type:      "created",
+		UploadID:  info.ID,
+		TotalSize: info.Size,
+		Status:    "created",
+		Message:   "Upload created",
+	})
+	return upload, info, nil
+}
+
+// completeUpload writes body to an upload made by createUpload, reporting
+// progress as it goes, and runs it through the same completion path as a
+// finished tus upload. An upload of deferred length is as long as body. An
+// upload that fails is removed, and its record kept for a while as failed.
+func completeUpload(ctx context.Context, upload tusd.Upload, info tusd.FileInfo, body io.Reader) error {
+	n, err := upload.WriteChunk(ctx, 0, &progressReader{r: body, info: info})
+	if err != nil {
+		// uploads that broke their business's constraints were already
+		// rejected by the store
+		if _, ok := err.(*constraintError); !ok {
+			rejectUpload(upload, info, err)
+		}
+		return err
+	}
+	if info.SizeIsDeferred {
+		if err := declareLength(ctx, upload, &info, n); err != nil {
+			return err
+		}
+	} else if n != info.Size {
+		err := tusd.NewHTTPError(fmt.Errorf("upload ended after %d of %d bytes", n, info.Size), http.StatusBadRequest)
+		rejectUpload(upload, info, err)
+		return err
+	}
+	if err := upload.FinishUpload(ctx); err != nil {
+		rejectUpload(upload, info, err)
+		return err
+	}
+	if err := finalizeUpload(info.ID, info.MetaData, info.Size); err != nil {
+		rejectUpload(upload, info, err)
+		return err
+	}
+	log.Printf("Upload %s completed (%d bytes)", info.ID, info.Size)
+	announceCompletion(info.ID, info.Size)
+	return nil
+}
+
+// declareLength sets the length of an upload of deferred length once all of
+// it is written, and checks what could not be checked without it. An upload
+// that fails the checks is rejected.
+func declareLength(ctx context.Context, upload tusd.Upload, info *tusd.FileInfo, length int64) error {
+	fail := func(err error) error {
+		rejectUpload(upload, *info, err)
+		return err
+	}
+	if err := tusComposer.LengthDeferrer.AsLengthDeclarableUpload(upload).DeclareLength(ctx, length); err != nil {
+		return fail(err)
+	}
+	info.Size, info.SizeIsDeferred = length, false
+
+	// uploads shorter than what is sniffed were not sniffed as they arrived
+	if length < sniffBytes {
+		if err := checkContent(info.MetaData, filepath.Join(uploadDir, info.ID)); err != nil {
+			return fail(err)
+		}
+	}
+	return nil
+}
+
+// progressReader passes on how much of an upload was read as progress
+// events, which the event pipeline coalesces as those of tus uploads
+type progressReader struct {
+	r        io.Reader
+	info     tusd.FileInfo
+	reported int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.info.Offset += int64(n)
+	if p.info.Offset-p.reported >= progressChunk || (err == io.EOF && p.info.Offset > p.reported) {
+		p.reported = p.info.Offset
+		tusEvents.dispatch(uploadEvent{eventProgress, tusd.HookEvent{Upload: p.info}})
+	}
+	return n, err
+}
+
+// writeUploadError responds with the status of an error of the upload
+// pipeline, which reports what clients did wrong as tusd.HTTPErrors
+func writeUploadError(c *gin.Context, err error) {
+	var herr tusd.HTTPError
+	if errors.As(err, &herr) {
+		c.JSON(herr.StatusCode(), gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Failed to store upload: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store upload"})
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+)
+
+// formFile is a file field of a multipart form
+type formFile struct {
+	name, contentType, content string
+}
+
+// postForm sends files and fields as a multipart form to the simple upload
+// endpoint and returns the status and JSON body of the response
+func postForm(t *testing.T, srv *httptest.Server, header map[string]string, fields map[string]string, files ...formFile) (int, map[string]interface{}) {
+	t.Helper()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		w.WriteField(k, v)
+	}
+	for _, f := range files {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="file"; filename="`+f.name+`"`)
+		h.Set("Content-Type", f.contentType)
+		part, err := w.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, f.content)
+	}
+	w.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/uploads/simple", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var out map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out
+}
+
+// formUploads returns the IDs of the uploads a form created
+func formUploads(body map[string]interface{}) []string {
+	var ids []string
+	uploads, _ := body["uploads"].([]interface{})
+	for _, u := range uploads {
+		if m, ok := u.(map[string]interface{}); ok {
+			ids = append(ids, m["upload_id"].(string))
+		}
+	}
+	return ids
+}
+
+// storedContent reads back the content of a finished upload
+func storedContent(t *testing.T, id string) string {
+	t.Helper()
+	rec, err := db.GetUploadRecord(id)
+	if err != nil {
+		t.Fatalf("upload %s has no record: %v", id, err)
+	}
+	r, err := storage.Open(rec.BusinessID, rec.BlobSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestSimpleUploadStoresEveryFile(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	status, body := postForm(t, srv, businessHeader(business), map[string]string{"note": "holiday"},
+		formFile{"a.txt", "text/plain", "first file"},
+		formFile{"b.txt", "text/plain", "second file"})
+	if status != http.StatusCreated {
+		t.Fatalf("form upload = %d, %v", status, body)
+	}
+	ids := formUploads(body)
+	if len(ids) != 2 {
+		t.Fatalf("form of two files created %d uploads", len(ids))
+	}
+	for i, want := range []string{"first file", "second file"} {
+		if got := storedContent(t, ids[i]); got != want {
+			t.Errorf("upload %s holds %q, want %q", ids[i], got, want)
+		}
+	}
+	if rec, _ := db.GetUploadRecord(ids[0]); rec.Filename != "a.txt" || rec.Username != "alice" {
+		t.Errorf("upload is %q of %q, want a.txt of alice", rec.Filename, rec.Username)
+	}
+
+	if status, _ := postForm(t, srv, nil, nil, formFile{"a.txt", "text/plain", "no credentials"}); status != http.StatusBadRequest {
+		t.Fatalf("form without credentials = %d, want 400", status)
+	}
+	if status, _ := postForm(t, srv, businessHeader(business), nil); status != http.StatusBadRequest {
+		t.Fatalf("form without files = %d, want 400", status)
+	}
+}
+
+func TestSimpleUploadLimits(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	big := strings.Repeat("x", 1<<20)
+	if status, body := postForm(t, srv, businessHeader(business), nil, formFile{"big.txt", "text/plain", big}); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("form over the limit = %d, %v, want 413", status, body)
+	}
+
+	// a file the business does not accept stores none of the form
+	if err := db.SetUploadConstraints(business.ID, &db.UploadConstraints{MaxBytes: 10}); err != nil {
+		t.Fatal(err)
+	}
+	status, body := postForm(t, srv, businessHeader(business), nil,
+		formFile{"small.txt", "text/plain", "small"},
+		formFile{"large.txt", "text/plain", "larger than ten bytes"})
+	if status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("form with a file over the size limit = %d, %v, want 413", status, body)
+	}
+	var stored int
+	if err := db.SQLDB.QueryRow("SELECT COUNT(*) FROM uploads WHERE business_id = ?", business.ID).Scan(&stored); err != nil || stored != 0 {
+		t.Fatalf("%d uploads stored of a rejected form, %v", stored, err)
+	}
+}
+
+func TestSimpleUploadToken(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	token := issueUploadToken(t, srv, business)
+
+	// a token takes one file
+	status, _ := postForm(t, srv, nil, map[string]string{"upload_token": token},
+		formFile{"a.txt", "text/plain", "first"},
+		formFile{"b.txt", "text/plain", "second"})
+	if status != http.StatusBadRequest {
+		t.Fatalf("two files with a token = %d, want 400", status)
+	}
+	if status := tokenStatus(t, token); status != "issued" {
+		t.Fatalf("token is %s after a rejected form, want issued", status)
+	}
+
+	status, body := postForm(t, srv, nil, map[string]string{"upload_token": token}, formFile{"a.txt", "text/plain", "first"})
+	if status != http.StatusCreated {
+		t.Fatalf("form with a token = %d, %v", status, body)
+	}
+	ids := formUploads(body)
+	if len(ids) != 1 || storedContent(t, ids[0]) != "first" {
+		t.Fatalf("form with a token created %v", ids)
+	}
+	if bound, ok := tokenUpload(token); !ok || bound != ids[0] {
+		t.Fatalf("token is bound to %q, want upload %s", bound, ids[0])
+	}
+	if status, _ := postForm(t, srv, nil, map[string]string{"upload_token": token}, formFile{"b.txt", "text/plain", "second"}); status != http.StatusConflict {
+		t.Fatalf("second form with the token = %d, want 409", status)
+	}
+}
@@ -1,39 +1,175 @@
-package api
-
-import (
-	"fmt"
-	"net/http"
-	"os"
-	"path/filepath"
-
-	"github.com/gin-gonic/gin"
-)
-
-func downloadHandler(c *gin.Context) {
-	id := c.Param("id")
-	filePath := "./uploads_data/" + id
-
-	if _, err := os.Stat(filePath); err != nil {
-		if os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot access file"})
-		}
-		return
-	}
-
-	info, err := readTusInfo(id)
-	filename := id
-	if err == nil {
-		if fn, ok := info.MetaData["filename"]; ok && fn != "" {
-			filename = fn
-			realPath := filepath.Join("./uploads_data", filename)
-			if _, err := os.Stat(realPath); err == nil {
-				filePath = realPath
-			}
-		}
-	}
-
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
-	c.File(filePath)
-}
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+	"mediapipeline/internal/uploadstate"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upload IDs are generated by the tus store as 32 hex characters
+var uploadIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func downloadHandler(c *gin.Context) {
+	rec, ok := businessUpload(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	serveUpload(c, rec)
+}
+
+// businessUpload loads a finished upload of the business authenticating the
+// request. Uploads of other businesses are reported as missing.
+func businessUpload(c *gin.Context, id string) (*db.UploadRecord, bool) {
+	business, ok := requireBusiness(c)
+	if !ok {
+		return nil, false
+	}
+	if !uploadIDPattern.MatchString(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return nil, false
+	}
+	rec, err := db.GetUploadRecord(id)
+	if err != nil || rec.BusinessID != business.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		return nil, false
+	}
+	return rec, true
+}
+
+// serveUpload streams a finished upload as an attachment
+func serveUpload(c *gin.Context, rec *db.UploadRecord) {
+	content, err := openUpload(rec)
+	if err != nil {
+		if errors.Is(err, storage.ErrArchived) {
+			response := gin.H{
+				"error": "file is archived in the cold tier",
+				"hint":  "POST /api/v1/storage/" + rec.ID + "/restore to make it readable again",
+			}
+			if b, err := db.GetBlob(rec.BusinessID, rec.BlobSHA256); err == nil {
+				response["restore"] = restoreJSON(b)
+			}
+			c.JSON(http.StatusConflict, response)
+		} else if os.IsNotExist(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "cannot access file"})
+		}
+		return
+	}
+	defer content.Close()
+
+	filename := rec.Filename
+	if filename == "" {
+		filename = rec.ID
+	}
+	c.Header("Content-Disposition", contentDisposition(filename))
+	if rec.ContentType != "" {
+		c.Header("Content-Type", rec.ContentType)
+	}
+	http.ServeContent(c.Writer, c.Request, filename, rec.CreatedAt, content)
+}
+
+// openUpload opens the content of a finished upload for reading. The read
+// is metered for cost reports when the content is closed.
+func openUpload(rec *db.UploadRecord) (io.ReadSeekCloser, error) {
+	content, err := storage.Open(rec.BusinessID, rec.BlobSHA256)
+	if err != nil {
+		return nil, err
+	}
+	storage.Touch(rec.BusinessID, rec.BlobSHA256)
+	return storage.Meter(rec.BusinessID, rec.BlobSHA256, content), nil
+}
+
+// removeUpload deletes a finished upload: its version, blob reference, tus
+// info file and Redis record. The blob stays on disk while other uploads
+// reference it.
+func removeUpload(id string) (string, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return "", os.ErrNotExist
+	}
+	if err := db.RemoveObjectVersion(id); err != nil {
+		return "", err
+	}
+	rec, err := storage.Release(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", os.ErrNotExist
+	} else if err != nil {
+		return "", err
+	}
+
+	// Delete the .info file if it exists
+	os.Remove(filepath.Join(uploadDir, id+".info"))
+
+	// Remove from Redis
+	_ = uploadstate.Forget(id)
+
+	if rec.Filename != "" {
+		return rec.Filename, nil
+	}
+	return id, nil
+}
+
+// sanitizeFilename reduces a client-supplied filename to display metadata:
+// its last path element as valid UTF-8, without control characters and at
+// most 255 bytes long. It never names a location on disk.
+func sanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// contentDisposition builds an attachment header carrying the filename both
+// as an ASCII fallback and RFC 5987 encoded for clients that understand it
+func contentDisposition(filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '%' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	var encoded strings.Builder
+	for _, b := range []byte(filename) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, encoded.String())
+}
+
+// isAttrChar reports whether b may appear unescaped in an RFC 5987 value
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
@@ -1,221 +1,348 @@
-package api
-
-import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
-	"time"
-
-	"mediapipeline/internal/config"
-	"mediapipeline/internal/db"
-
-	"github.com/tus/tusd/pkg/filestore"
-	tusd "github.com/tus/tusd/pkg/handler"
-	"github.com/tus/tusd/pkg/memorylocker"
-)
-
-// read tusd .info file for metadata
-func readTusInfo(id string) (*tusd.FileInfo, error) {
-	infoPath := filepath.Join("./uploads_data", id+".info")
-	data, err := os.ReadFile(infoPath)
-	if err != nil {
-		return nil, err
-	}
-	var info tusd.FileInfo
-	if err := json.Unmarshal(data, &info); err != nil {
-		return nil, err
-	}
-	return &info, nil
-}
-
-// initialize tusd handler
-func initTusHandler(_ *config.Config) (*tusd.UnroutedHandler, error) {
-	uploadDir := "./uploads_data"
-	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
-		return nil, fmt.Errorf("failed to create upload dir: %w", err)
-	}
-
-	store := filestore.New(uploadDir)
-	locker := memorylocker.New()
-	composer := tusd.NewStoreComposer()
-	store.UseIn(composer)
-	locker.UseIn(composer)
-
-	config := tusd.Config{
-		StoreComposer:           composer,
-		BasePath:                "/api/v1/uploads/",
-		DisableDownload:         false,
-		DisableTermination:      false,
-		NotifyCreatedUploads:    true,
-		NotifyCompleteUploads:   true,
-		NotifyUploadProgress:    true,
-		RespectForwardedHeaders: true,
-	}
-
-	// pre upload create callback
-	config.PreUploadCreateCallback = func(hook tusd.HookEvent) error {
-		h := hook.HTTPRequest
-		apiKey := h.Header.Get("X-API-KEY")
-		username := h.Header.Get("X-Username")
-		if apiKey == "" || username == "" {
-			return tusd.NewHTTPError(fmt.Errorf("missing auth headers"), http.StatusBadRequest)
-		}
-		business, err := db.GetBusinessByAPIKey(apiKey)
-		if err != nil || business == nil {
-			return tusd.NewHTTPError(fmt.Errorf("invalid api key"), http.StatusUnauthorized)
-		}
-		if hook.Upload.MetaData == nil {
-			hook.Upload.MetaData = make(map[string]string)
-		}
-		hook.Upload.MetaData["business_id"] = fmt.Sprintf("%d", business.ID)
-		hook.Upload.MetaData["username"] = username
-		return nil
-	}
-
-	// pre finish response callback
-	config.PreFinishResponseCallback = func(hook tusd.HookEvent) error {
-		id := hook.Upload.ID
-		meta := hook.Upload.MetaData
-		uploadKey := "upload:" + id
-		fields := map[string]interface{}{
-			"business_id": meta["business_id"],
-			"username":    meta["username"],
-			"status":      "uploaded",
-			"size":        hook.Upload.Size,
-			"created_at":  time.Now().UTC().Format(time.RFC3339),
-		}
-		if fn, ok := meta["filename"]; ok && fn != "" {
-			fields["filename"] = fn
-			src := filepath.Join("./uploads_data", id)
-			dst := filepath.Join("./uploads_data", fn)
-			if _, err := os.Stat(src); err == nil {
-				if err := os.Rename(src, dst); err != nil {
-					in, _ := os.Open(src)
-					out, _ := os.Create(dst)
-					io.Copy(out, in)
-					in.Close()
-					out.Close()
-				}
-			}
-		}
-		_ = db.RDB.HSet(db.Ctx, uploadKey, fields)
-		_ = db.RDB.Expire(db.Ctx, uploadKey, 24*time.Hour)
-		return nil
-	}
-
-	// initialize tusd handler
-	h, err := tusd.NewUnroutedHandler(config)
-	if err != nil {
-		return nil, err
-	}
-
-	// go routine to handle upload progress and broadcast updates
-	go func() {
-		for {
-			select {
-			case info := <-h.CreatedUploads:
-				log.Printf("Upload %s created (size: %d)", info.Upload.ID, info.Upload.Size)
-
-				// Store initial upload info in Redis
-				uploadKey := "upload:" + info.Upload.ID
-				fields := map[string]interface{}{
-					"status":     "created",
-					"size":       info.Upload.Size,
-					"offset":     0,
-					"progress":   0.0,
-					"created_at": time.Now().UTC().Format(time.RFC3339),
-				}
-				_ = db.RDB.HSet(db.Ctx, uploadKey, fields)
-				_ = db.RDB.Expire(db.Ctx, uploadKey, 24*time.Hour)
-
-				// Broadcast upload created event
-				GetConnectionManager().BroadcastProgress(info.Upload.ID, ProgressMessage{
-					Type:      "created",
-					UploadID:  info.Upload.ID,
-					Progress:  0.0,
-					BytesSent: 0,
-					TotalSize: info.Upload.Size,
-					Status:    "created",
-					Message:   "Upload created",
-				})
-
-			case info := <-h.UploadProgress:
-				if info.Upload.Size > 0 {
-					percent := float64(info.Upload.Offset) / float64(info.Upload.Size) * 100
-
-					// Update progress in Redis
-					uploadKey := "upload:" + info.Upload.ID
-					fields := map[string]interface{}{
-						"status":     "uploading",
-						"offset":     info.Upload.Offset,
-						"progress":   percent,
-						"updated_at": time.Now().UTC().Format(time.RFC3339),
-					}
-					_ = db.RDB.HSet(db.Ctx, uploadKey, fields)
-
-					// Print progress bar to console
-					barWidth := 50
-					filled := int(percent / 100 * float64(barWidth))
-					bar := fmt.Sprintf("\r[%s%s] %.2f%%",
-						strings.Repeat("=", filled),
-						strings.Repeat(" ", barWidth-filled),
-						percent,
-					)
-					fmt.Print(bar)
-
-					// Broadcast progress update
-					GetConnectionManager().BroadcastProgress(info.Upload.ID, ProgressMessage{
-						Type:      "progress",
-						UploadID:  info.Upload.ID,
-						Progress:  percent,
-						BytesSent: info.Upload.Offset,
-						TotalSize: info.Upload.Size,
-						Status:    "uploading",
-					})
-				}
-
-			case info := <-h.CompleteUploads:
-				fmt.Printf("\r[==================================================] 100.00%%\n")
-				log.Printf("Upload %s completed (%d bytes)", info.Upload.ID, info.Upload.Size)
-
-				// Update final status in Redis
-				uploadKey := "upload:" + info.Upload.ID
-				fields := map[string]interface{}{
-					"status":       "completed",
-					"offset":       info.Upload.Size,
-					"progress":     100.0,
-					"completed_at": time.Now().UTC().Format(time.RFC3339),
-				}
-				_ = db.RDB.HSet(db.Ctx, uploadKey, fields)
-
-				// Broadcast a final 100% progress frame to ensure clients see the last chunk
-				GetConnectionManager().BroadcastProgress(info.Upload.ID, ProgressMessage{
-					Type:      "progress",
-					UploadID:  info.Upload.ID,
-					Progress:  100.0,
-					BytesSent: info.Upload.Size,
-					TotalSize: info.Upload.Size,
-					Status:    "uploading",
-				})
-
-				// Broadcast completion event
-				GetConnectionManager().BroadcastProgress(info.Upload.ID, ProgressMessage{
-					Type:      "complete",
-					UploadID:  info.Upload.ID,
-					Progress:  100.0,
-					BytesSent: info.Upload.Size,
-					TotalSize: info.Upload.Size,
-					Status:    "completed",
-					Message:   "Upload completed successfully",
-				})
-			}
-		}
-	}()
-
-	return h, nil
-}
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+	"mediapipeline/internal/uploadstate"
+
+	"github.com/tus/tusd/pkg/filestore"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// directory shared by the tusd filestore and finished uploads, and by every
+// instance
+var uploadDir = "./uploads_data"
+
+// composer backing the tus handler, shared with the other upload surfaces
+var tusComposer *tusd.StoreComposer
+
+// tus extensions the upload endpoint supports, for OPTIONS requests
+var tusExtensions string
+
+// read tusd .info file for metadata
+func readTusInfo(id string) (*tusd.FileInfo, error) {
+	infoPath := filepath.Join(uploadDir, id+".info")
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return nil, err
+	}
+	var info tusd.FileInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// initialize tusd handler
+func initTusHandler(cfg *config.Config) (*tusd.UnroutedHandler, error) {
+	uploadDir = cfg.Uploads.Dir
+	s3MultipartDir = filepath.Join(uploadDir, ".multipart")
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create upload dir: %w", err)
+	}
+
+	// instances share uploads through the directory and lock them in Redis
+	locker := newRedisLocker(db.RDB, cfg.Uploads.LockTTL)
+	store := fencedStore{FileStore: filestore.New(uploadDir), locker: locker}
+	composer := tusd.NewStoreComposer()
+	store.UseIn(composer)
+	locker.UseIn(composer)
+	tusComposer = composer
+	tusLocker = locker
+	defaultUploadExpiry = cfg.Uploads.ExpireAfter
+	simpleUploadLimit = cfg.Uploads.SimpleMaxBytes
+	urlImports = newImporter(cfg.Imports)
+	quotaDefaults = cfg.Quota
+
+	config := tusd.Config{
+		StoreComposer:           composer,
+		BasePath:                "/api/v1/uploads/",
+		DisableDownload:         false,
+		DisableTermination:      false,
+		NotifyCreatedUploads:    true,
+		NotifyCompleteUploads:   true,
+		NotifyUploadProgress:    true,
+		NotifyTerminatedUploads: true,
+		RespectForwardedHeaders: true,
+	}
+
+	// pre upload create callback
+	config.PreUploadCreateCallback = func(hook tusd.HookEvent) error {
+		return prepareUpload(hook.HTTPRequest.Header, &hook.Upload)
+	}
+
+	// pre finish response callback; partial uploads only count once their
+	// final upload is assembled
+	config.PreFinishResponseCallback = func(hook tusd.HookEvent) error {
+		if hook.Upload.IsPartial {
+			return assembleFinalOf(hook.Upload.ID)
+		}
+		return finalizeUpload(hook.Upload.ID, hook.Upload.MetaData, hook.Upload.Size)
+	}
+
+	// initialize tusd handler
+	h, err := tusd.NewUnroutedHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	tusExtensions = h.SupportedExtensions() + ",concatenation-unfinished,checksum,expiration"
+
+	// notifications are handled on workers, so tusd never waits on Redis
+	// or slow WebSocket subscribers
+	tusEvents = newEventPipeline(cfg.Uploads)
+	go tusEvents.consume(h)
+
+	return h, nil
+}
+
+// uploadCredentials authenticates the creation of an upload, either by a
+// single-use upload token, so browsers never see the API key, or by the API
+// key of the business and a username
+func uploadCredentials(header http.Header) (*db.Business, string, error) {
+	if token := header.Get("X-Upload-Token"); token != "" {
+		return tokenCredentials(token)
+	}
+	apiKey := header.Get("X-API-KEY")
+	username := header.Get("X-Username")
+	if apiKey == "" || username == "" {
+		return nil, "", tusd.NewHTTPError(fmt.Errorf("missing auth headers"), http.StatusBadRequest)
+	}
+	business, err := db.GetBusinessByAPIKey(apiKey)
+	if err != nil || business == nil {
+		return nil, "", tusd.NewHTTPError(fmt.Errorf("invalid api key"), http.StatusUnauthorized)
+	}
+	return business, username, nil
+}
+
+// prepareUpload authenticates the creation of an upload and fills in the
+// metadata the rest of the pipeline relies on. Partial uploads only need
+// valid credentials; quotas and metadata are checked on their final upload,
+// which is also the one that uses up an upload token.
+func prepareUpload(header http.Header, upload *tusd.FileInfo) error {
+	if err := checkNewUpload(header, upload); err != nil {
+		return err
+	}
+	// a token is only used up by an upload that passed every check, so the
+	// client can fix a rejected upload and try again with the same token
+	if token := header.Get("X-Upload-Token"); token != "" && !upload.IsPartial {
+		if err := consumeUploadToken(token); err != nil {
+			releaseReservation(upload.MetaData)
+			return err
+		}
+	}
+	return nil
+}
+
+// checkNewUpload does the checks of prepareUpload without using up the
+// upload token, for callers with checks of their own to run first
+func checkNewUpload(header http.Header, upload *tusd.FileInfo) error {
+	business, username, err := uploadCredentials(header)
+	if err != nil {
+		return err
+	}
+	if upload.MetaData == nil {
+		upload.MetaData = make(map[string]string)
+	}
+	upload.MetaData["business_id"] = fmt.Sprintf("%d", business.ID)
+	upload.MetaData["username"] = username
+	if upload.IsPartial {
+		return nil
+	}
+
+	if err := checkUploadConstraints(business.ID, upload.Size, upload.SizeIsDeferred, upload.MetaData["filetype"]); err != nil {
+		if cerr, ok := err.(*constraintError); ok {
+			return cerr
+		}
+		return tusd.NewHTTPError(fmt.Errorf("failed to check upload constraints"), http.StatusInternalServerError)
+	}
+	// filenames are display metadata only
+	if fn, ok := upload.MetaData["filename"]; ok {
+		upload.MetaData["filename"] = sanitizeFilename(fn)
+	}
+	// the logical path this upload becomes a new version of
+	if p := upload.MetaData["path"]; p != "" {
+		upload.MetaData["path"] = logicalPath(p)
+	} else {
+		upload.MetaData["path"] = logicalPath(upload.MetaData["filename"])
+	}
+	// tags in the same form as S3's x-amz-tagging header
+	if _, err := parseTags(upload.MetaData["tags"]); err != nil {
+		return tusd.NewHTTPError(err, http.StatusBadRequest)
+	}
+	// an upload of deferred length reserves its bytes as they are written
+	reservation, err := reserveUpload(business.ID, upload.Size)
+	if err != nil {
+		if qerr, ok := err.(*quotaError); ok {
+			return tusd.NewHTTPError(qerr, http.StatusRequestEntityTooLarge)
+		}
+		return tusd.NewHTTPError(fmt.Errorf("failed to check quota"), http.StatusInternalServerError)
+	}
+	upload.MetaData["reservation"] = reservation
+	return nil
+}
+
+// terminateTusUpload handles tus termination. Uploads still in progress are
+// left to tusd; finished ones have already moved into the blob store, so
+// they are deleted the same way as through the storage API, by their own
+// business only.
+func terminateTusUpload(h *tusd.UnroutedHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := path.Base(r.URL.Path)
+		rec, err := db.GetUploadRecord(id)
+		if err != nil {
+			h.DelFile(w, r)
+			return
+		}
+		business, err := db.GetBusinessByAPIKey(r.Header.Get("X-API-KEY"))
+		if err != nil || business.ID != rec.BusinessID {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		if _, err := removeUpload(id); err != nil {
+			http.Error(w, "failed to delete upload", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Tus-Resumable", "1.0.0")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// finalizeUpload moves a finished upload into the blob store and records it
+// in Redis. Every upload surface runs this before acknowledging completion.
+func finalizeUpload(id string, meta map[string]string, size int64) error {
+	src := filepath.Join(uploadDir, id)
+	rec, version, err := storeUpload(id, src, uploadDigest(id, src), meta, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_ = db.RDB.Del(db.Ctx, uploadDigestKey(id))
+	releaseReservation(meta)
+
+	// the record of the upload stays until the upload is deleted
+	fields := map[string]interface{}{
+		"business_id": meta["business_id"],
+		"username":    meta["username"],
+		"size":        size,
+		"blob":        rec.BlobSHA256,
+		"stored_at":   rec.CreatedAt.Format(time.RFC3339),
+	}
+	if fn, ok := meta["filename"]; ok && fn != "" {
+		fields["filename"] = fn
+	}
+	if version != nil {
+		fields["path"] = version.Path
+		fields["version"] = version.Version
+	}
+	setUploadState(id, uploadstate.Uploaded, fields)
+	return nil
+}
+
+// setUploadState moves an upload to a state and updates its record along
+// with it. It reports false if the upload cannot move there, as when an
+// event about it arrives after a newer one.
+func setUploadState(id string, state uploadstate.State, fields map[string]interface{}) bool {
+	_, err := uploadstate.Transition(id, state, fields)
+	if err != nil && !errors.Is(err, uploadstate.ErrIllegal) {
+		log.Printf("Failed to move upload %s to %s: %v", id, state, err)
+	}
+	return err == nil
+}
+
+// storeUpload ingests the data of a finished upload from src into its
+// business's namespace in the blob store, records it and, when it has a
+// logical path, adds it as the path's next version. digest is the SHA-256
+// of the data if it is already known, or "" to hash the file.
+func storeUpload(id, src, digest string, meta map[string]string, createdAt time.Time) (*db.UploadRecord, *db.ObjectVersion, error) {
+	businessID, err := strconv.Atoi(meta["business_id"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("upload %s has no business", id)
+	}
+	rec := &db.UploadRecord{
+		ID:          id,
+		BusinessID:  businessID,
+		Username:    meta["username"],
+		Filename:    sanitizeFilename(meta["filename"]),
+		ContentType: meta["filetype"],
+		CreatedAt:   createdAt,
+		BlobSHA256:  digest,
+	}
+	if err := storage.Ingest(src, rec); err != nil {
+		return nil, nil, fmt.Errorf("store upload %s: %w", id, err)
+	}
+
+	// an upload that cannot be tagged or versioned is not kept half stored
+	fail := func(err error) (*db.UploadRecord, *db.ObjectVersion, error) {
+		if _, rerr := storage.Release(id); rerr != nil {
+			log.Printf("Failed to release upload %s: %v", id, rerr)
+		}
+		return nil, nil, err
+	}
+	if tags, err := parseTags(meta["tags"]); err == nil && len(tags) > 0 {
+		if err := db.SetUploadTags(id, tags); err != nil {
+			return fail(fmt.Errorf("tag upload %s: %w", id, err))
+		}
+	}
+
+	var version *db.ObjectVersion
+	if p := meta["path"]; p != "" {
+		version = &db.ObjectVersion{
+			BusinessID: businessID,
+			Path:       p,
+			UploadID:   id,
+			ETag:       rec.BlobSHA256,
+			UserMeta:   meta["user_meta"],
+			CreatedAt:  createdAt,
+		}
+		// S3 objects carry their MD5-based ETag
+		if etag := meta["etag"]; etag != "" {
+			version.ETag = etag
+		}
+		if _, err := db.AddObjectVersion(version); err != nil {
+			return fail(fmt.Errorf("version upload %s: %w", id, err))
+		}
+	}
+	return rec, version, nil
+}
+
+// announceCompletion marks an upload completed and notifies subscribers
+func announceCompletion(id string, size int64) {
+	// Update final status in Redis
+	setUploadState(id, uploadstate.Completed, map[string]interface{}{
+		"offset":       size,
+		"progress":     100.0,
+		"completed_at": time.Now().UTC().Format(time.RFC3339),
+	})
+
+	// Broadcast a final 100% progress frame to ensure clients see the last chunk
+	GetConnectionManager().BroadcastProgress(id, ProgressMessage{
+		Type:      "progress",
+		UploadID:  id,
+		Progress:  100.0,
+		BytesSent: size,
+		TotalSize: size,
+		Status:    "uploading",
+	})
+
+	// Broadcast completion event
+	GetConnectionManager().BroadcastProgress(id, ProgressMessage{
+		Type:      "complete",
+		UploadID:  id,
+		Progress:  100.0,
+		BytesSent: size,
+		TotalSize: size,
+		Status:    "completed",
+		Message:   "Upload completed successfully",
+	})
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
+	"mediapipeline/internal/uploadstate"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestPipeline serves the API as SetupRoutes mounts it, on a fresh
+// database, Redis, blob store and upload directory, and registers a business
+// to upload for
+func newTestPipeline(t *testing.T) (*httptest.Server, *db.Business, *miniredis.Miniredis) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := db.OpenSQLite(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.SQLDB.Close() })
+	mr := miniredis.RunT(t)
+	db.RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.RDB.Close() })
+
+	cfg := &config.Config{
+		Environment: "test",
+		Storage: config.StorageConfig{
+			CDNPath:        filepath.Join(dir, "cdn"),
+			S3Path:         filepath.Join(dir, "s3"),
+			R2Path:         filepath.Join(dir, "r2"),
+			DefaultRegion:  "default",
+			InstanceRegion: "default",
+
+			HotCacheBytes:       1 << 20,
+			HotCacheObjectBytes: 1 << 16,
+		},
+		Uploads: config.UploadConfig{
+			Dir:            filepath.Join(dir, "uploads"),
+			LockTTL:        time.Minute,
+			ExpireAfter:    time.Hour,
+			EventWorkers:   2,
+			EventQueue:     16,
+			SimpleMaxBytes: 1 << 20,
+		},
+	}
+	if err := storage.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	business, err := db.CreateBusiness("test", "test@example.com", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	SetupRoutes(r, cfg)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv, business, mr
+}
+
+// businessHeader authenticates a request with the API key of a business
+func businessHeader(business *db.Business) map[string]string {
+	return map[string]string{"X-API-KEY": business.APIKey, "X-Username": "alice"}
+}
+
+// postUpload creates a tus upload of size bytes and returns the response,
+// which locates the upload if it was created
+func postUpload(t *testing.T, srv *httptest.Server, size int, header map[string]string) *http.Response {
+	t.Helper()
+	h := map[string]string{"Upload-Length": strconv.Itoa(size)}
+	for k, v := range header {
+		h[k] = v
+	}
+	return tusRequest(t, http.MethodPost, srv.URL+"/api/v1/uploads/", nil, h)
+}
+
+// issueUploadToken has the pipeline issue an upload token for a business
+func issueUploadToken(t *testing.T, srv *httptest.Server, business *db.Business) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/uploads/meta/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range businessHeader(business) {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("issuing a token = %d, %v", resp.StatusCode, err)
+	}
+	return body.Token
+}
+
+// tokenStatus returns the status of an upload token, issued or used
+func tokenStatus(t *testing.T, token string) string {
+	t.Helper()
+	status, err := db.RDB.HGet(db.Ctx, uploadTokenKey(token), "status").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// waitUploadState waits for the event workers to move an upload to a state
+func waitUploadState(t *testing.T, id string, state uploadstate.State) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		current, err := uploadstate.Current(id)
+		if err == nil && current == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upload %s is %s, want %s", id, current, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
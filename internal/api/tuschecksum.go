@@ -0,0 +1,263 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediapipeline/internal/db"
+
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// errChecksumMismatch means a chunk does not match its Upload-Checksum,
+// which the tus checksum extension answers with 460
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksum algorithms a PATCH may name in Upload-Checksum
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+const checksumAlgorithmList = "md5,sha1,sha256"
+
+// chunkChecksum is the checksum a PATCH expects its chunk to have
+type chunkChecksum struct {
+	algorithm string
+	sum       []byte
+}
+
+// parseUploadChecksum reads an Upload-Checksum header of the form
+// "<algorithm> <base64 digest>"
+func parseUploadChecksum(header string) (*chunkChecksum, error) {
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return nil, errors.New("Upload-Checksum must be an algorithm and a base64 digest")
+	}
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q, use one of %s", algorithm, checksumAlgorithmList)
+	}
+	sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(sum) != newHash().Size() {
+		return nil, errors.New("Upload-Checksum digest is not a base64 " + algorithm + " digest")
+	}
+	return &chunkChecksum{algorithm: algorithm, sum: sum}, nil
+}
+
+// tusPatch verifies the chunk of a PATCH that names an Upload-Checksum
+// before tusd sees it: the body is staged next to the upload and handed on
+// only if it matches, so no byte of a damaged chunk reaches the upload and
+// its offset stays where it was
+func tusPatch(h *tusd.UnroutedHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Upload-Checksum")
+		if header == "" {
+			h.PatchFile(w, r)
+			return
+		}
+		check, err := parseUploadChecksum(header)
+		if err != nil {
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		id := path.Base(r.URL.Path)
+		staged, err := stageVerifiedChunk(id, r, check)
+		if staged != nil {
+			defer func() {
+				staged.Close()
+				os.Remove(staged.Name())
+			}()
+		}
+		switch {
+		case errors.Is(err, errChecksumMismatch):
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			http.Error(w, "checksum mismatch", 460)
+			return
+		case err != nil:
+			w.Header().Set("Tus-Resumable", "1.0.0")
+			http.Error(w, "failed to read chunk", http.StatusInternalServerError)
+			return
+		case staged != nil:
+			r.Body = io.NopCloser(staged)
+		}
+		h.PatchFile(w, r)
+	}
+}
+
+// stageVerifiedChunk copies the body of a PATCH to a temporary file and
+// checks it against the checksum, returning the file rewound to its start.
+// It returns no file when tusd is to turn the request away by itself, as
+// for an unknown upload or a chunk longer than what is left of it.
+func stageVerifiedChunk(id string, r *http.Request, check *chunkChecksum) (*os.File, error) {
+	if !uploadIDPattern.MatchString(id) {
+		return nil, nil
+	}
+	info, err := readTusInfo(id)
+	if err != nil {
+		return nil, nil
+	}
+	remaining := info.Size - info.Offset
+	if !info.SizeIsDeferred && r.ContentLength > remaining {
+		return nil, nil
+	}
+	body := io.Reader(r.Body)
+	if !info.SizeIsDeferred {
+		body = io.LimitReader(r.Body, remaining)
+	}
+
+	staged, err := os.CreateTemp(uploadDir, "."+id+".chunk-*")
+	if err != nil {
+		return nil, err
+	}
+	sum := checksumAlgorithms[check.algorithm]()
+	size, err := io.Copy(staged, io.TeeReader(body, sum))
+	if err == nil && !bytes.Equal(sum.Sum(nil), check.sum) {
+		err = errChecksumMismatch
+	}
+	if err == nil {
+		_, err = staged.Seek(0, io.SeekStart)
+	}
+	r.ContentLength = size
+	return staged, err
+}
+
+// the running SHA-256 of an upload, kept in Redis so the PATCH requests of
+// an upload can go to any instance
+func uploadDigestKey(id string) string { return "upload_digest:" + id }
+
+// runningDigest resumes the SHA-256 of the first offset bytes of an upload.
+// If the saved state is missing or at another offset, the bytes already
+// stored are hashed again.
+func runningDigest(id, src string, offset int64) (hash.Hash, error) {
+	h := sha256.New()
+	saved, err := db.RDB.HGetAll(db.Ctx, uploadDigestKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if saved["offset"] == strconv.FormatInt(offset, 10) {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary([]byte(saved["state"])); err == nil {
+			return h, nil
+		}
+		h.Reset()
+	}
+	if offset == 0 {
+		return h, nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(h, f, offset); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// saveDigest stores the running SHA-256 of an upload after offset bytes
+func saveDigest(id string, h hash.Hash, offset int64) error {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	key := uploadDigestKey(id)
+	if err := db.RDB.HSet(db.Ctx, key, "offset", offset, "state", state).Err(); err != nil {
+		return err
+	}
+	return db.RDB.Expire(db.Ctx, key, 24*time.Hour).Err()
+}
+
+// uploadDigest returns the hex SHA-256 of a finished upload if it was
+// computed while the data came in, or "" if the file has to be hashed
+func uploadDigest(id, src string) string {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return ""
+	}
+	saved, err := db.RDB.HGetAll(db.Ctx, uploadDigestKey(id)).Result()
+	if err != nil || saved["offset"] != strconv.FormatInt(stat.Size(), 10) {
+		return ""
+	}
+	h := sha256.New()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary([]byte(saved["state"])); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// stagedChunkPattern matches the chunks of an upload staged in the upload
+// directory before they are appended
+func stagedChunkPattern(id string) string {
+	return filepath.Join(uploadDir, "."+id+".chunk-*")
+}
+
+// discardStagedChunks removes chunks of an upload left staged by an instance
+// that stopped before appending them
+func discardStagedChunks(id string) {
+	staged, _ := filepath.Glob(stagedChunkPattern(id))
+	for _, path := range staged {
+		os.Remove(path)
+	}
+}
+
+// writeChecked writes a chunk to an upload stored at src, hashing it on the
+// way for the upload's running SHA-256. The chunk is staged next to the
+// upload first and only appended once fence still allows writing, so a
+// chunk whose upload lock lapsed meanwhile never reaches the upload file,
+// which the next holder of the lock may be writing by then.
+func writeChecked(ctx context.Context, upload tusd.Upload, id, src string, offset int64, data io.Reader, fence func() error) (int64, error) {
+	digest, err := runningDigest(id, src, offset)
+	if err != nil {
+		return 0, fmt.Errorf("resume digest of upload %s: %w", id, err)
+	}
+
+	staged, err := os.CreateTemp(filepath.Dir(src), "."+id+".chunk-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		staged.Close()
+		os.Remove(staged.Name())
+	}()
+	size, err := io.Copy(staged, io.TeeReader(data, digest))
+	if err != nil || size == 0 {
+		return 0, err
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	if err := fence(); err != nil {
+		return 0, err
+	}
+	n, err := upload.WriteChunk(ctx, offset, staged)
+	if err != nil {
+		return n, err
+	}
+	if err := saveDigest(id, digest, offset+n); err != nil {
+		log.Printf("Failed to save digest of upload %s: %v", id, err)
+	}
+	return n, nil
+}
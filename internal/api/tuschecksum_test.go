@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/tus/tusd/pkg/filestore"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// newChecksumInstance serves tus uploads from dir with PATCH requests going
+// through tusPatch, as the API routes them
+func newChecksumInstance(t *testing.T, mr *miniredis.Miniredis, dir string) *httptest.Server {
+	locker := newTestLocker(t, mr, time.Minute)
+	composer := tusd.NewStoreComposer()
+	fencedStore{FileStore: filestore.New(dir), locker: locker}.UseIn(composer)
+	locker.UseIn(composer)
+	h, err := tusd.NewUnroutedHandler(tusd.Config{StoreComposer: composer, BasePath: "/files/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := uploadDir
+	uploadDir = dir
+	t.Cleanup(func() { uploadDir = saved })
+
+	patch := tusPatch(h)
+	srv := httptest.NewServer(h.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			h.PostFile(w, r)
+		case http.MethodHead:
+			h.HeadFile(w, r)
+		case http.MethodPatch:
+			patch(w, r)
+		}
+	})))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func sha256Checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func patchChecked(t *testing.T, url string, offset int, chunk []byte, checksum string) *http.Response {
+	return tusRequest(t, http.MethodPatch, url, bytes.NewReader(chunk), map[string]string{
+		"Upload-Offset":   strconv.Itoa(offset),
+		"Content-Type":    "application/offset+octet-stream",
+		"Upload-Checksum": checksum,
+	})
+}
+
+func TestChunkNotMatchingChecksumIsRejected(t *testing.T) {
+	mr := miniredis.RunT(t)
+	dir := t.TempDir()
+	srv := newChecksumInstance(t, mr, dir)
+
+	resp := tusRequest(t, http.MethodPost, srv.URL+"/files/", nil, map[string]string{"Upload-Length": "10"})
+	url := resp.Header.Get("Location")
+	id := filepath.Base(url)
+
+	data := []byte("0123456789")
+	if resp := patchChecked(t, url, 0, data, sha256Checksum([]byte("9876543210"))); resp.StatusCode != 460 {
+		t.Fatalf("chunk with the wrong checksum: %d, want 460", resp.StatusCode)
+	}
+	if resp := tusRequest(t, http.MethodHead, url, nil, nil); resp.Header.Get("Upload-Offset") != "0" {
+		t.Fatalf("offset %s after a rejected chunk, want 0", resp.Header.Get("Upload-Offset"))
+	}
+	if staged, _ := filepath.Glob(filepath.Join(dir, "."+id+".chunk-*")); len(staged) != 0 {
+		t.Errorf("rejected chunk left staged: %v", staged)
+	}
+	if resp := patchChecked(t, url, 0, data, "crc32 AAAAAA=="); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unsupported checksum algorithm: %d, want 400", resp.StatusCode)
+	}
+
+	if resp := patchChecked(t, url, 0, data, sha256Checksum(data)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("chunk with its checksum: %d", resp.StatusCode)
+	}
+	if resp := tusRequest(t, http.MethodHead, url, nil, nil); resp.Header.Get("Upload-Offset") != "10" {
+		t.Errorf("offset %s after the chunk, want 10", resp.Header.Get("Upload-Offset"))
+	}
+}
+
+func TestRunningDigestResumesAcrossInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+	dir := t.TempDir()
+	one, _ := newTestInstance(t, mr, dir)
+	two, _ := newTestInstance(t, mr, dir)
+
+	data := bytes.Repeat([]byte("digest me "), 300)
+	resp := tusRequest(t, http.MethodPost, one.URL+"/files/", nil, map[string]string{"Upload-Length": strconv.Itoa(len(data))})
+	id := filepath.Base(resp.Header.Get("Location"))
+	src := filepath.Join(dir, id)
+
+	for i, c := range []struct {
+		srv      *httptest.Server
+		from, to int
+	}{{one, 0, 1000}, {two, 1000, 2000}, {one, 2000, len(data)}} {
+		if i == 2 {
+			// without the saved state the bytes already written are hashed again
+			mr.Del(uploadDigestKey(id))
+		}
+		if resp := patchChunk(t, c.srv.URL+"/files/"+id, c.from, bytes.NewReader(data[c.from:c.to])); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("chunk %d: %d", i, resp.StatusCode)
+		}
+	}
+
+	want := sha256.Sum256(data)
+	if got := uploadDigest(id, src); got != hex.EncodeToString(want[:]) {
+		t.Errorf("running digest %q, want %x", got, want)
+	}
+}
@@ -0,0 +1,343 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// the final upload a partial upload is assembled into
+func uploadFinalKey(partialID string) string { return "upload_final:" + partialID }
+
+// tusConcat creates final uploads itself and leaves every other creation to
+// tusd. tusd only concatenates partial uploads that are already finished,
+// while final uploads created here may come before their partials are, as
+// in the concatenation-unfinished extension. That lets clients subscribe to
+// the final upload and follow the progress of all its partials in one
+// stream.
+func tusConcat(h *tusd.UnroutedHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		concat := r.Header.Get("Upload-Concat")
+		if !strings.HasPrefix(concat, "final;") {
+			h.PostFile(w, r)
+			return
+		}
+		w.Header().Set("Tus-Resumable", "1.0.0")
+		id, err := createFinalUpload(r, strings.TrimPrefix(concat, "final;"))
+		if id != "" {
+			w.Header().Set("Location", uploadURL(r, id))
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			if herr, ok := err.(tusd.HTTPError); ok {
+				status = herr.StatusCode()
+			} else {
+				log.Printf("Failed to create final upload: %v", err)
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// uploadURL is the URL of an upload on the tus endpoint that served r
+func uploadURL(r *http.Request, id string) string {
+	proto, host := "http", r.Host
+	if r.TLS != nil {
+		proto = "https"
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p == "http" || p == "https" {
+		proto = p
+	}
+	if h := r.Header.Get("X-Forwarded-Host"); h != "" {
+		host = h
+	}
+	return proto + "://" + host + "/api/v1/uploads/" + id
+}
+
+// createFinalUpload creates the final upload of the partial uploads listed in
+// an Upload-Concat header and assembles it right away if they are finished.
+// Auth, quota and metadata checks apply to it as to any other upload.
+func createFinalUpload(r *http.Request, list string) (string, error) {
+	ctx := context.Background()
+	var partialIDs []string
+	var partials []tusd.FileInfo
+	var size int64
+	seen := map[string]bool{}
+	for _, u := range strings.Fields(list) {
+		id := path.Base(u)
+		if !uploadIDPattern.MatchString(id) || seen[id] {
+			return "", tusd.NewHTTPError(fmt.Errorf("invalid partial upload %q", u), http.StatusBadRequest)
+		}
+		seen[id] = true
+		upload, err := tusComposer.Core.GetUpload(ctx, id)
+		if err != nil {
+			return "", tusd.NewHTTPError(fmt.Errorf("partial upload %s not found", id), http.StatusNotFound)
+		}
+		info, err := upload.GetInfo(ctx)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsPartial {
+			return "", tusd.NewHTTPError(fmt.Errorf("upload %s is not a partial upload", id), http.StatusBadRequest)
+		}
+		if info.SizeIsDeferred {
+			return "", tusd.NewHTTPError(fmt.Errorf("partial upload %s has no length yet", id), http.StatusBadRequest)
+		}
+		partialIDs = append(partialIDs, id)
+		partials = append(partials, info)
+		size += info.Size
+	}
+	if len(partialIDs) == 0 {
+		return "", tusd.NewHTTPError(errors.New("a final upload needs partial uploads"), http.StatusBadRequest)
+	}
+
+	info := tusd.FileInfo{
+		Size:           size,
+		MetaData:       tusd.ParseMetadataHeader(r.Header.Get("Upload-Metadata")),
+		IsFinal:        true,
+		PartialUploads: partialIDs,
+	}
+	// the token is used up only once the partial uploads are known to be
+	// the business's and claimed for this final upload
+	if err := checkNewUpload(r.Header, &info); err != nil {
+		return "", err
+	}
+	for _, p := range partials {
+		if p.MetaData["business_id"] != info.MetaData["business_id"] {
+			releaseReservation(info.MetaData)
+			return "", tusd.NewHTTPError(fmt.Errorf("partial upload %s not found", p.ID), http.StatusNotFound)
+		}
+	}
+
+	upload, err := tusComposer.Core.NewUpload(ctx, info)
+	if err != nil {
+		releaseReservation(info.MetaData)
+		return "", err
+	}
+	if info, err = upload.GetInfo(ctx); err != nil {
+		return "", err
+	}
+
+	// each partial upload goes into one final upload only
+	for i, id := range partialIDs {
+		claimed, err := db.RDB.SetNX(db.Ctx, uploadFinalKey(id), info.ID, 0).Result()
+		if err != nil || !claimed {
+			for _, claimedID := range partialIDs[:i] {
+				_ = db.RDB.Del(db.Ctx, uploadFinalKey(claimedID))
+			}
+			discardUpload(upload, info)
+			if err != nil {
+				return "", err
+			}
+			return "", tusd.NewHTTPError(fmt.Errorf("partial upload %s already belongs to a final upload", id), http.StatusConflict)
+		}
+	}
+	if token := r.Header.Get("X-Upload-Token"); token != "" {
+		if err := consumeUploadToken(token); err != nil {
+			for _, id := range partialIDs {
+				_ = db.RDB.Del(db.Ctx, uploadFinalKey(id))
+			}
+			discardUpload(upload, info)
+			return "", err
+		}
+	}
+
+	log.Printf("Upload %s created from %d partial uploads (size: %d)", info.ID, len(partialIDs), size)
+	setUploadState(info.ID, uploadstate.Created, map[string]interface{}{
+		"size":       size,
+		"offset":     0,
+		"progress":   0.0,
+		"created_at": time.Now().UTC().Format(time.RFC3339),
+	})
+	bindUploadToken(r.Header.Get("X-Upload-Token"), info.ID)
+	GetConnectionManager().BroadcastProgress(info.ID, ProgressMessage{
+		Type:      "created",
+		UploadID:  info.ID,
+		TotalSize: size,
+		Status:    "created",
+		Message:   "Upload created",
+	})
+	reportFinalProgress(info.ID)
+	return info.ID, assembleFinal(info.ID)
+}
+
+// discardUpload removes an upload that was created but cannot be used
+func discardUpload(upload tusd.Upload, info tusd.FileInfo) {
+	releaseReservation(info.MetaData)
+	forgetExpiry(info.ID)
+	_ = tusComposer.Terminater.AsTerminatableUpload(upload).Terminate(context.Background())
+	_ = uploadstate.Forget(info.ID)
+	_ = db.RDB.Del(db.Ctx, uploadDigestKey(info.ID))
+}
+
+// assembleFinalOf assembles the final upload a partial upload belongs to,
+// if the partial upload was the last one it waited for
+func assembleFinalOf(partialID string) error {
+	finalID, err := db.RDB.Get(db.Ctx, uploadFinalKey(partialID)).Result()
+	if err != nil {
+		return nil
+	}
+	return assembleFinal(finalID)
+}
+
+// assembleFinal concatenates the partial uploads of a final upload once all
+// of them are finished, runs the final upload through the same completion
+// path as any other upload and removes the partial uploads
+func assembleFinal(finalID string) error {
+	// partial uploads finishing at the same time each try to assemble; the
+	// lock lets the first to see them all finished do it
+	lock, err := lockUpload(finalID, tusLocker.ttl)
+	if err != nil {
+		return fmt.Errorf("lock final upload %s: %w", finalID, err)
+	}
+	defer lock.Unlock()
+
+	ctx := context.Background()
+	upload, err := tusComposer.Core.GetUpload(ctx, finalID)
+	if errors.Is(err, tusd.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := db.GetUploadRecord(finalID); err == nil {
+		return nil
+	}
+
+	partials := make([]tusd.Upload, 0, len(info.PartialUploads))
+	for _, id := range info.PartialUploads {
+		partial, err := tusComposer.Core.GetUpload(ctx, id)
+		if err != nil {
+			return fmt.Errorf("partial upload %s of %s: %w", id, finalID, err)
+		}
+		p, err := partial.GetInfo(ctx)
+		if err != nil {
+			return err
+		}
+		if p.Offset < p.Size {
+			return nil
+		}
+		partials = append(partials, partial)
+	}
+
+	// start over if an earlier attempt failed halfway
+	if err := os.Truncate(filepath.Join(uploadDir, finalID), 0); err != nil {
+		return err
+	}
+	if err := tusComposer.Concater.AsConcatableUpload(upload).ConcatUploads(ctx, partials); err != nil {
+		return fmt.Errorf("concatenate upload %s: %w", finalID, err)
+	}
+	if err := checkContent(info.MetaData, filepath.Join(uploadDir, finalID)); err != nil {
+		if _, ok := err.(*constraintError); ok {
+			rejectUpload(upload, info, err)
+			removePartials(partials)
+		}
+		return err
+	}
+	if err := finalizeUpload(finalID, info.MetaData, info.Size); err != nil {
+		return err
+	}
+	forgetExpiry(finalID)
+	log.Printf("Upload %s assembled from %d partial uploads (%d bytes)", finalID, len(partials), info.Size)
+
+	removePartials(partials)
+	announceCompletion(finalID, info.Size)
+	return nil
+}
+
+// removePartials removes the partial uploads of a final upload once it no
+// longer needs them
+func removePartials(partials []tusd.Upload) {
+	ctx := context.Background()
+	for _, partial := range partials {
+		p, _ := partial.GetInfo(ctx)
+		if err := tusComposer.Terminater.AsTerminatableUpload(partial).Terminate(ctx); err != nil {
+			log.Printf("Failed to remove partial upload %s: %v", p.ID, err)
+		}
+		_ = uploadstate.Forget(p.ID)
+		_ = db.RDB.Del(db.Ctx, uploadDigestKey(p.ID), uploadFinalKey(p.ID))
+		forgetExpiry(p.ID)
+	}
+}
+
+// lockUpload takes the lock of an upload, waiting up to timeout for other
+// holders to release it
+func lockUpload(id string, timeout time.Duration) (tusd.Lock, error) {
+	lock, _ := tusLocker.NewLock(id)
+	deadline := time.Now().Add(timeout)
+	for {
+		err := lock.Lock()
+		if !errors.Is(err, tusd.ErrFileLocked) || time.Now().After(deadline) {
+			return lock, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// reportPartialProgress reports the progress of a partial upload as part of
+// its final upload, if it has one yet
+func reportPartialProgress(partialID string) {
+	if finalID, err := db.RDB.Get(db.Ctx, uploadFinalKey(partialID)).Result(); err == nil {
+		reportFinalProgress(finalID)
+	}
+}
+
+// reportFinalProgress reports the progress of all partial uploads of a
+// final upload as that of the final upload. Progress keeps the final upload
+// from expiring.
+func reportFinalProgress(finalID string) {
+	upload, err := tusComposer.Core.GetUpload(context.Background(), finalID)
+	if err != nil {
+		return
+	}
+	info, err := upload.GetInfo(context.Background())
+	if err != nil || info.Size == 0 {
+		return
+	}
+	if _, err := db.GetUploadRecord(finalID); err == nil {
+		return
+	}
+	var offset int64
+	for _, id := range info.PartialUploads {
+		if stat, err := os.Stat(filepath.Join(uploadDir, id)); err == nil {
+			offset += stat.Size()
+		}
+	}
+	if offset == 0 {
+		return
+	}
+	percent := float64(offset) / float64(info.Size) * 100
+	if !setUploadState(finalID, uploadstate.Uploading, map[string]interface{}{
+		"offset":     offset,
+		"progress":   percent,
+		"updated_at": time.Now().UTC().Format(time.RFC3339),
+	}) {
+		return
+	}
+	extendExpiry(finalID, info.MetaData)
+	GetConnectionManager().BroadcastProgress(finalID, ProgressMessage{
+		Type:      "progress",
+		UploadID:  finalID,
+		Progress:  percent,
+		BytesSent: offset,
+		TotalSize: info.Size,
+		Status:    "uploading",
+	})
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"mediapipeline/internal/db"
+)
+
+func TestRejectedFinalUploadLeavesTokenUnused(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	other, err := db.CreateBusiness("other", "other@example.com", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := func(b *db.Business) string {
+		h := businessHeader(b)
+		h["Upload-Concat"] = "partial"
+		resp := postUpload(t, srv, 5, h)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("creating a partial upload = %d", resp.StatusCode)
+		}
+		return resp.Header.Get("Location")
+	}
+	final := func(token string, partials string) *http.Response {
+		return tusRequest(t, http.MethodPost, srv.URL+"/api/v1/uploads/", nil, map[string]string{
+			"X-Upload-Token": token,
+			"Upload-Concat":  "final;" + partials,
+		})
+	}
+	own, foreign := partial(business), partial(other)
+	token := issueUploadToken(t, srv, business)
+
+	// a partial upload of another business is not found
+	if resp := final(token, own+" "+foreign); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("final upload of another business's partial = %d, want 404", resp.StatusCode)
+	}
+	if status := tokenStatus(t, token); status != "issued" {
+		t.Fatalf("token is %s after a rejected final upload, want issued", status)
+	}
+
+	if resp := final(token, own); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("final upload = %d, want 201", resp.StatusCode)
+	}
+	if status := tokenStatus(t, token); status != "used" {
+		t.Fatalf("token is %s after a final upload, want used", status)
+	}
+
+	// a partial upload claimed by one final upload is not another's
+	second := issueUploadToken(t, srv, business)
+	if resp := final(second, own); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("final upload of a claimed partial = %d, want 409", resp.StatusCode)
+	}
+	if status := tokenStatus(t, second); status != "issued" {
+		t.Fatalf("token is %s after a rejected final upload, want issued", status)
+	}
+}
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+
+	"github.com/redis/go-redis/v9"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// most events a worker writes to Redis in one round trip
+const maxEventBatch = 64
+
+type eventKind int
+
+const (
+	eventCreated eventKind = iota
+	eventProgress
+	eventComplete
+	eventTerminated
+)
+
+type uploadEvent struct {
+	kind eventKind
+	hook tusd.HookEvent
+}
+
+// counters of the event pipeline since startup, for the metrics endpoint
+var uploadEventStats struct {
+	handled, coalesced, dropped, stalled atomic.Int64
+}
+
+// pipeline of the tus handler, for the metrics endpoint
+var tusEvents *eventPipeline
+
+// eventPipeline handles the notifications of the tus handler. tusd blocks
+// on its notification channels until they are read, so they are only read
+// here and the Redis writes and WebSocket broadcasts they lead to happen on
+// workers. All events of an upload go to the same worker, in the order tusd
+// sent them.
+//
+// Most events report progress. A worker reports the progress of an upload
+// at most once per interval, unless it grew by step percent, and writes the
+// progress of all its uploads in one Redis pipeline. Progress events that
+// find the queue of their worker full are dropped, as the next one has the
+// same and newer news.
+//
+// Other events cannot be dropped, so one that finds its queue full waits
+// for the worker to take the next batch. Until then tusd sends no
+// notifications at all, and every request sending one waits with it. That
+// backpressure is bounded by a single batch: its Redis round trips, which
+// time out like any other, and its WebSocket writes, which time out after
+// wsWriteTimeout.
+type eventPipeline struct {
+	workers  []*eventWorker
+	interval time.Duration
+	step     float64
+}
+
+func newEventPipeline(cfg config.UploadConfig) *eventPipeline {
+	p := &eventPipeline{interval: cfg.ProgressInterval, step: cfg.ProgressStep}
+	if p.interval <= 0 {
+		// a ticker needs an interval; a tiny one reports all progress
+		p.interval = time.Millisecond
+	}
+	for i := 0; i < max(cfg.EventWorkers, 1); i++ {
+		w := &eventWorker{
+			p:        p,
+			queue:    make(chan uploadEvent, max(cfg.EventQueue, 1)),
+			pending:  make(map[string]tusd.FileInfo),
+			reported: make(map[string]progressReport),
+		}
+		p.workers = append(p.workers, w)
+		go w.run()
+	}
+	return p
+}
+
+// consume reads the notifications of a tus handler. A single reader keeps
+// the events of each upload in order.
+func (p *eventPipeline) consume(h *tusd.UnroutedHandler) {
+	for {
+		select {
+		case hook := <-h.CreatedUploads:
+			p.dispatch(uploadEvent{eventCreated, hook})
+		case hook := <-h.UploadProgress:
+			p.dispatch(uploadEvent{eventProgress, hook})
+		case hook := <-h.CompleteUploads:
+			p.dispatch(uploadEvent{eventComplete, hook})
+		case hook := <-h.TerminatedUploads:
+			p.dispatch(uploadEvent{eventTerminated, hook})
+		}
+	}
+}
+
+// dispatch queues an event on the worker of its upload. Only progress is
+// ever dropped; other events wait for room in the queue.
+func (p *eventPipeline) dispatch(ev uploadEvent) {
+	w := p.worker(ev.hook.Upload.ID)
+	select {
+	case w.queue <- ev:
+	default:
+		if ev.kind == eventProgress {
+			uploadEventStats.dropped.Add(1)
+			return
+		}
+		uploadEventStats.stalled.Add(1)
+		w.queue <- ev
+	}
+}
+
+// worker returns the worker that handles the events of an upload
+func (p *eventPipeline) worker(id string) *eventWorker {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return p.workers[hash.Sum32()%uint32(len(p.workers))]
+}
+
+// queued returns how many events wait for a worker
+func (p *eventPipeline) queued() int64 {
+	var n int64
+	for _, w := range p.workers {
+		n += int64(len(w.queue))
+	}
+	return n
+}
+
+type eventWorker struct {
+	p     *eventPipeline
+	queue chan uploadEvent
+
+	// latest progress of each upload that was not reported yet
+	pending map[string]tusd.FileInfo
+	// progress last reported of each upload, while it holds back the next
+	reported map[string]progressReport
+}
+
+type progressReport struct {
+	at      time.Time
+	percent float64
+}
+
+func (w *eventWorker) run() {
+	ticker := time.NewTicker(w.p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-w.queue:
+			batch := []uploadEvent{ev}
+			for len(batch) < maxEventBatch && len(w.queue) > 0 {
+				batch = append(batch, <-w.queue)
+			}
+			w.handle(batch, time.Now())
+		case now := <-ticker.C:
+			w.handle(nil, now)
+		}
+	}
+}
+
+// handle handles a batch of events and reports the progress that is due.
+// Writes go out in one pipeline, and WebSocket subscribers hear of them
+// once they are done. Completion and termination run through the same
+// paths as elsewhere, after whatever the batch wrote before them.
+func (w *eventWorker) handle(batch []uploadEvent, now time.Time) {
+	// idle ticks need no round trip to Redis
+	if len(batch) == 0 && len(w.pending) == 0 {
+		w.expireReports(now)
+		return
+	}
+	pipe := db.RDB.Pipeline()
+	var broadcasts []func()
+	flush := func() {
+		if pipe.Len() > 0 {
+			if _, err := pipe.Exec(db.Ctx); err != nil {
+				log.Printf("Failed to write upload events: %v", err)
+			}
+		}
+		for _, broadcast := range broadcasts {
+			broadcast()
+		}
+		broadcasts = nil
+	}
+
+	for _, ev := range batch {
+		uploadEventStats.handled.Add(1)
+		info := ev.hook.Upload
+		switch ev.kind {
+		case eventCreated:
+			log.Printf("Upload %s created (size: %d)", info.ID, info.Size)
+			created := uploadstate.Queue(pipe, info.ID, uploadstate.Created, map[string]interface{}{
+				"size":       info.Size,
+				"offset":     0,
+				"progress":   0.0,
+				"created_at": now.UTC().Format(time.RFC3339),
+			})
+			if token := ev.hook.HTTPRequest.Header.Get("X-Upload-Token"); token != "" && !info.IsPartial {
+				pipe.HSet(db.Ctx, uploadTokenKey(token), "upload_id", info.ID)
+			}
+			broadcasts = append(broadcasts, func() {
+				if !moved(created) {
+					return
+				}
+				GetConnectionManager().BroadcastProgress(info.ID, ProgressMessage{
+					Type:      "created",
+					UploadID:  info.ID,
+					TotalSize: info.Size,
+					Status:    "created",
+					Message:   "Upload created",
+				})
+			})
+
+		case eventProgress:
+			// partial uploads report progress under their final upload
+			if info.IsPartial {
+				flush()
+				reportPartialProgress(info.ID)
+			} else if info.Size > 0 {
+				if _, ok := w.pending[info.ID]; ok {
+					uploadEventStats.coalesced.Add(1)
+				}
+				w.pending[info.ID] = info
+			}
+
+		case eventComplete:
+			w.forget(info.ID)
+			flush()
+			if info.IsPartial {
+				reportPartialProgress(info.ID)
+				break
+			}
+			log.Printf("Upload %s completed (%d bytes)", info.ID, info.Size)
+			announceCompletion(info.ID, info.Size)
+
+		case eventTerminated:
+			w.forget(info.ID)
+			flush()
+			log.Printf("Upload %s terminated", info.ID)
+			releaseReservation(info.MetaData)
+			_ = uploadstate.Forget(info.ID)
+			_ = db.RDB.Del(db.Ctx, uploadDigestKey(info.ID))
+			forgetExpiry(info.ID)
+		}
+	}
+
+	broadcasts = append(broadcasts, w.reportProgress(pipe, now)...)
+	flush()
+}
+
+// reportProgress queues the progress that is due on pipe and returns the
+// broadcasts that follow it
+func (w *eventWorker) reportProgress(pipe redis.Pipeliner, now time.Time) []func() {
+	var broadcasts []func()
+	for id, info := range w.pending {
+		info := info
+		percent := float64(info.Offset) / float64(info.Size) * 100
+		last, ok := w.reported[id]
+		if ok && now.Sub(last.at) < w.p.interval && percent-last.percent < w.p.step && percent < 100 {
+			continue
+		}
+		delete(w.pending, id)
+		w.reported[id] = progressReport{at: now, percent: percent}
+
+		// progress that comes after the upload finished does not count
+		progress := uploadstate.Queue(pipe, id, uploadstate.Uploading, map[string]interface{}{
+			"offset":     info.Offset,
+			"progress":   percent,
+			"updated_at": now.UTC().Format(time.RFC3339),
+		})
+		broadcasts = append(broadcasts, func() {
+			if !moved(progress) {
+				return
+			}
+			GetConnectionManager().BroadcastProgress(info.ID, ProgressMessage{
+				Type:      "progress",
+				UploadID:  info.ID,
+				Progress:  percent,
+				BytesSent: info.Offset,
+				TotalSize: info.Size,
+				Status:    "uploading",
+			})
+		})
+	}
+	w.expireReports(now)
+	return broadcasts
+}
+
+// expireReports forgets the reports older than the interval, which no
+// longer hold anything back
+func (w *eventWorker) expireReports(now time.Time) {
+	for id, last := range w.reported {
+		if now.Sub(last.at) >= w.p.interval {
+			delete(w.reported, id)
+		}
+	}
+}
+
+// forget drops the progress of an upload that finished or is gone
+func (w *eventWorker) forget(id string) {
+	delete(w.pending, id)
+	delete(w.reported, id)
+}
+
+// moved reports whether a queued transition went through. Uploads that
+// moved on before it are no failure.
+func moved(q *uploadstate.Queued) bool {
+	_, err := q.Result()
+	if err != nil && !errors.Is(err, uploadstate.ErrIllegal) {
+		log.Printf("Failed to record upload event: %v", err)
+	}
+	return err == nil
+}
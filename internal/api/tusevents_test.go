@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// roundTrips counts the commands and pipelines a Redis client sends
+type roundTrips struct {
+	commands, pipelines atomic.Int64
+}
+
+func (h *roundTrips) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *roundTrips) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.commands.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *roundTrips) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.pipelines.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+func newEventRedis(t *testing.T) *roundTrips {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	db.RDB = rdb
+	// a connection is set up with commands of its own, before any counted
+	if err := rdb.Ping(db.Ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+	trips := &roundTrips{}
+	rdb.AddHook(trips)
+	return trips
+}
+
+// newStoppedWorker returns a pipeline of one worker that handles events
+// only when the test has it do so
+func newStoppedWorker(queue int, interval time.Duration, step float64) *eventWorker {
+	p := &eventPipeline{interval: interval, step: step}
+	w := &eventWorker{
+		p:        p,
+		queue:    make(chan uploadEvent, queue),
+		pending:  make(map[string]tusd.FileInfo),
+		reported: make(map[string]progressReport),
+	}
+	p.workers = []*eventWorker{w}
+	return w
+}
+
+func progressEvent(id string, offset, size int64) uploadEvent {
+	return uploadEvent{eventProgress, tusd.HookEvent{Upload: tusd.FileInfo{ID: id, Offset: offset, Size: size}}}
+}
+
+func reportedOffset(t *testing.T, id string) string {
+	t.Helper()
+	offset, _ := db.RDB.HGet(db.Ctx, uploadstate.Key(id), "offset").Result()
+	return offset
+}
+
+func TestEventWorkersAreBounded(t *testing.T) {
+	newEventRedis(t)
+	p := newEventPipeline(config.UploadConfig{EventWorkers: 3, EventQueue: 2, ProgressInterval: time.Hour})
+	if len(p.workers) != 3 {
+		t.Fatalf("%d workers, want 3", len(p.workers))
+	}
+	for _, w := range p.workers {
+		if cap(w.queue) != 2 {
+			t.Fatalf("queue of %d events, want 2", cap(w.queue))
+		}
+	}
+	if p := newEventPipeline(config.UploadConfig{ProgressInterval: time.Hour}); len(p.workers) != 1 || cap(p.workers[0].queue) != 1 {
+		t.Fatalf("unconfigured pipeline has %d workers, want 1 with a queue of 1", len(p.workers))
+	}
+
+	// all events of an upload go to one worker, and uploads spread over all
+	used := map[*eventWorker]bool{}
+	for i := 0; i < 64; i++ {
+		id := fmt.Sprintf("upload-%d", i)
+		if p.worker(id) != p.worker(id) {
+			t.Fatalf("events of %s go to different workers", id)
+		}
+		used[p.worker(id)] = true
+	}
+	if len(used) != 3 {
+		t.Fatalf("64 uploads went to %d of 3 workers", len(used))
+	}
+}
+
+func TestFullQueueDropsProgressAndStallsOtherEvents(t *testing.T) {
+	newEventRedis(t)
+	w := newStoppedWorker(1, time.Hour, 5)
+	created := uploadEvent{eventCreated, tusd.HookEvent{Upload: tusd.FileInfo{ID: "upload", Size: 100}}}
+	w.p.dispatch(created)
+
+	dropped := uploadEventStats.dropped.Load()
+	w.p.dispatch(progressEvent("upload", 10, 100))
+	if uploadEventStats.dropped.Load() != dropped+1 {
+		t.Fatal("progress that found the queue full was not dropped")
+	}
+
+	stalled := uploadEventStats.stalled.Load()
+	done := make(chan struct{})
+	go func() {
+		w.p.dispatch(uploadEvent{eventComplete, created.hook})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("completion was dispatched past a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if first := <-w.queue; first.kind != eventCreated {
+		t.Fatalf("first event is %v, want the creation", first.kind)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("completion still waits after the queue made room")
+	}
+	if uploadEventStats.stalled.Load() != stalled+1 {
+		t.Fatal("the wait for room was not counted")
+	}
+	if next := <-w.queue; next.kind != eventComplete {
+		t.Fatalf("next event is %v, want the completion", next.kind)
+	}
+}
+
+func TestProgressIsCoalesced(t *testing.T) {
+	newEventRedis(t)
+	if _, err := uploadstate.Transition("upload", uploadstate.Created, nil); err != nil {
+		t.Fatal(err)
+	}
+	w := newStoppedWorker(16, time.Second, 5)
+	start := time.Now()
+
+	// a batch reports only the latest progress
+	coalesced := uploadEventStats.coalesced.Load()
+	w.handle([]uploadEvent{progressEvent("upload", 1, 100), progressEvent("upload", 2, 100), progressEvent("upload", 3, 100)}, start)
+	if offset := reportedOffset(t, "upload"); offset != "3" {
+		t.Fatalf("reported offset %s, want 3", offset)
+	}
+	if uploadEventStats.coalesced.Load() != coalesced+2 {
+		t.Fatalf("%d events coalesced, want 2", uploadEventStats.coalesced.Load()-coalesced)
+	}
+
+	// less than a step within the interval waits for the interval
+	w.handle([]uploadEvent{progressEvent("upload", 4, 100)}, start.Add(100*time.Millisecond))
+	if offset := reportedOffset(t, "upload"); offset != "3" {
+		t.Fatalf("progress of one percent was reported within the interval, offset %s", offset)
+	}
+	w.handle(nil, start.Add(time.Second))
+	if offset := reportedOffset(t, "upload"); offset != "4" {
+		t.Fatalf("held back progress was not reported after the interval, offset %s", offset)
+	}
+
+	// a step is reported right away, and so is the end
+	w.handle([]uploadEvent{progressEvent("upload", 10, 100)}, start.Add(1100*time.Millisecond))
+	if offset := reportedOffset(t, "upload"); offset != "10" {
+		t.Fatalf("progress of a step was held back, offset %s", offset)
+	}
+	w.handle([]uploadEvent{progressEvent("upload", 100, 100)}, start.Add(1200*time.Millisecond))
+	if offset := reportedOffset(t, "upload"); offset != "100" {
+		t.Fatalf("progress to 100%% was held back, offset %s", offset)
+	}
+}
+
+func TestEventBatchIsOnePipeline(t *testing.T) {
+	trips := newEventRedis(t)
+	w := newStoppedWorker(64, time.Second, 5)
+	var batch []uploadEvent
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("upload-%d", i)
+		batch = append(batch,
+			uploadEvent{eventCreated, tusd.HookEvent{Upload: tusd.FileInfo{ID: id, Size: 100}}},
+			progressEvent(id, 50, 100))
+	}
+
+	w.handle(batch, time.Now())
+	if n := trips.pipelines.Load(); n != 1 {
+		t.Fatalf("batch took %d pipelines, want 1", n)
+	}
+	if n := trips.commands.Load(); n != 0 {
+		t.Fatalf("batch sent %d commands outside the pipeline, want 0", n)
+	}
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("upload-%d", i)
+		state, err := uploadstate.Current(id)
+		if err != nil || state != uploadstate.Uploading || reportedOffset(t, id) != "50" {
+			t.Fatalf("upload %s is %s at offset %s, %v, want uploading at 50", id, state, reportedOffset(t, id), err)
+		}
+	}
+}
+
+func TestIdleTickLeavesRedisAlone(t *testing.T) {
+	trips := newEventRedis(t)
+	w := newStoppedWorker(1, time.Second, 5)
+	w.reported["upload"] = progressReport{at: time.Now().Add(-time.Minute)}
+	w.handle(nil, time.Now())
+	if trips.pipelines.Load() != 0 || trips.commands.Load() != 0 {
+		t.Fatal("a tick without pending progress went to Redis")
+	}
+	if len(w.reported) != 0 {
+		t.Fatal("a report older than the interval was kept")
+	}
+}
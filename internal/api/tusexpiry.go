@@ -0,0 +1,293 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// unfinished uploads, scored by the Unix time they expire at
+const expiringUploadsKey = "uploads:expiring"
+
+var (
+	// how long unfinished uploads of businesses without their own expiry
+	// may sit idle
+	defaultUploadExpiry = 24 * time.Hour
+
+	// locker of the tus store, which the janitor takes uploads from
+	tusLocker *redisLocker
+)
+
+// uploadExpiry returns how long an unfinished upload with the given metadata
+// may sit idle before it expires
+func uploadExpiry(meta map[string]string) time.Duration {
+	if businessID, err := strconv.Atoi(meta["business_id"]); err == nil {
+		if expiry, err := db.GetUploadExpiry(businessID); err == nil && expiry > 0 {
+			return expiry
+		}
+	}
+	return defaultUploadExpiry
+}
+
+// extendExpiry lets an unfinished upload sit idle for its full expiry again,
+// counting from now
+func extendExpiry(id string, meta map[string]string) {
+	expires := time.Now().Add(uploadExpiry(meta))
+	err := db.RDB.ZAdd(db.Ctx, expiringUploadsKey, redis.Z{Score: float64(expires.Unix()), Member: id}).Err()
+	if err != nil {
+		log.Printf("Failed to set expiry of upload %s: %v", id, err)
+	}
+}
+
+// forgetExpiry stops an upload from expiring once it is finished or gone
+func forgetExpiry(id string) {
+	_ = db.RDB.ZRem(db.Ctx, expiringUploadsKey, id)
+}
+
+// uploadExpiresAt returns when an unfinished upload expires, or false if it
+// does not
+func uploadExpiresAt(id string) (time.Time, bool) {
+	score, err := db.RDB.ZScore(db.Ctx, expiringUploadsKey, id).Result()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(score), 0), true
+}
+
+// tusExpiring implements the tus expiration extension around a tus request
+// handler. Requests for an expired upload get 410 Gone, even before the
+// janitor removes it, and responses tell clients when the upload they
+// created or wrote to expires.
+func tusExpiring(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			if expires, ok := uploadExpiresAt(path.Base(r.URL.Path)); ok && !expires.After(time.Now()) {
+				w.Header().Set("Tus-Resumable", "1.0.0")
+				http.Error(w, "upload expired", http.StatusGone)
+				return
+			}
+		}
+		next(&expiresWriter{ResponseWriter: w, r: r}, r)
+	}
+}
+
+// expiresWriter adds Upload-Expires to successful tus responses for uploads
+// that are still unfinished
+type expiresWriter struct {
+	http.ResponseWriter
+	r *http.Request
+}
+
+func (w *expiresWriter) WriteHeader(code int) {
+	if code < http.StatusMultipleChoices {
+		id := path.Base(w.r.URL.Path)
+		if location := w.Header().Get("Location"); location != "" {
+			id = path.Base(location)
+		}
+		if expires, ok := uploadExpiresAt(id); ok {
+			w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// RunUploadJanitor removes expired uploads, and abandoned S3 multipart
+// uploads, once per interval. Instances can all run it, since uploads are
+// locked while they are removed.
+func RunUploadJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if n, err := ExpireUploads(now); err != nil {
+			log.Printf("Upload janitor failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Upload janitor removed %d expired uploads", n)
+		}
+		if n, err := sweepMultipartUploads(now); err != nil {
+			log.Printf("Upload janitor failed to sweep multipart uploads: %v", err)
+		} else if n > 0 {
+			log.Printf("Upload janitor removed %d abandoned multipart uploads", n)
+		}
+	}
+}
+
+// ExpireUploads removes the unfinished uploads that expired before now, and
+// returns how many it removed
+func ExpireUploads(now time.Time) (int, error) {
+	if tusLocker == nil {
+		return 0, errors.New("tus store is not initialized")
+	}
+	if err := trackIdleUploads(); err != nil {
+		return 0, err
+	}
+	ids, err := db.RDB.ZRangeByScore(db.Ctx, expiringUploadsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, id := range ids {
+		removed, err := expireUpload(id, now)
+		if err != nil {
+			log.Printf("Failed to remove expired upload %s: %v", id, err)
+			continue
+		}
+		if removed {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+// trackIdleUploads gives unfinished uploads in the upload directory, and
+// partial uploads not yet assembled, that have no expiry, such as those
+// created before uploads expired, one that counts from their last write
+func trackIdleUploads() error {
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok || !uploadIDPattern.MatchString(id) {
+			continue
+		}
+		if _, ok := uploadExpiresAt(id); ok {
+			continue
+		}
+		if _, err := db.GetUploadRecord(id); err == nil {
+			continue
+		}
+		upload, err := tusComposer.Core.GetUpload(context.Background(), id)
+		if err != nil {
+			continue
+		}
+		info, err := upload.GetInfo(context.Background())
+		if err != nil || (!info.SizeIsDeferred && !info.IsPartial && info.Offset >= info.Size) {
+			continue
+		}
+
+		lastWrite := time.Now()
+		if stat, err := os.Stat(info.Storage["Path"]); err == nil {
+			lastWrite = stat.ModTime()
+		}
+		expires := lastWrite.Add(uploadExpiry(info.MetaData))
+		_ = db.RDB.ZAddNX(db.Ctx, expiringUploadsKey, redis.Z{Score: float64(expires.Unix()), Member: id})
+	}
+	return nil
+}
+
+// expireUpload removes an expired upload from disk and Redis and tells its
+// subscribers. Uploads being written to, or written to, finished or removed
+// since they were found expired, are left alone.
+func expireUpload(id string, now time.Time) (bool, error) {
+	lock, _ := tusLocker.NewLock(id)
+	if err := lock.Lock(); err != nil {
+		if errors.Is(err, tusd.ErrFileLocked) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer lock.Unlock()
+
+	if expires, ok := uploadExpiresAt(id); !ok || expires.After(now) {
+		return false, nil
+	}
+	ctx := context.Background()
+	upload, err := tusComposer.Core.GetUpload(ctx, id)
+	if errors.Is(err, tusd.ErrNotFound) {
+		forgetExpiry(id)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	info, err := upload.GetInfo(ctx)
+	if err != nil {
+		return false, err
+	}
+	if _, err := db.GetUploadRecord(id); err == nil {
+		forgetExpiry(id)
+		return false, nil
+	}
+
+	if err := tusComposer.Terminater.AsTerminatableUpload(upload).Terminate(ctx); err != nil {
+		return false, err
+	}
+	releaseReservation(info.MetaData)
+	discardStagedChunks(id)
+	keys := []string{uploadDigestKey(id), uploadFinalKey(id)}
+	for _, partialID := range info.PartialUploads {
+		keys = append(keys, uploadFinalKey(partialID))
+	}
+	_ = db.RDB.Del(db.Ctx, keys...)
+	forgetExpiry(id)
+	log.Printf("Upload %s expired after %d of %d bytes", id, info.Offset, info.Size)
+
+	progress := 0.0
+	if info.Size > 0 {
+		progress = float64(info.Offset) / float64(info.Size) * 100
+	}
+	// partial uploads and uploads from before states were recorded have no
+	// state to expire from
+	if !setUploadState(id, uploadstate.Expired, map[string]interface{}{
+		"updated_at": now.UTC().Format(time.RFC3339),
+	}) {
+		_ = uploadstate.Forget(id)
+	}
+	GetConnectionManager().BroadcastProgress(id, ProgressMessage{
+		Type:      "expired",
+		UploadID:  id,
+		Progress:  progress,
+		BytesSent: info.Offset,
+		TotalSize: info.Size,
+		Status:    "expired",
+		Message:   "Upload expired before it was finished",
+	})
+	return true, nil
+}
+
+type setUploadExpiryRequest struct {
+	ExpireAfterSeconds int64 `json:"expire_after_seconds"`
+}
+
+func setUploadExpiryHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid business id"})
+		return
+	}
+	if _, err := db.GetBusinessByID(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "business not found"})
+		return
+	}
+	var req setUploadExpiryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	if req.ExpireAfterSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expire_after_seconds must be non-negative"})
+		return
+	}
+	if err := db.SetUploadExpiry(id, time.Duration(req.ExpireAfterSeconds)*time.Second); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set upload expiry"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"business_id": id, "expire_after_seconds": req.ExpireAfterSeconds})
+}
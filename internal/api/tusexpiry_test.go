@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestExpiredUploadIsGoneBeforeTheJanitorRemovesIt(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	if err := db.SetUploadExpiry(business.ID, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	resp := postUpload(t, srv, 10, businessHeader(business))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating an upload = %d", resp.StatusCode)
+	}
+	url := resp.Header.Get("Location")
+	id := path.Base(url)
+	if expires, err := http.ParseTime(resp.Header.Get("Upload-Expires")); err != nil || time.Until(expires) > time.Minute || time.Until(expires) < 50*time.Second {
+		t.Fatalf("Upload-Expires = %q, want a minute from now", resp.Header.Get("Upload-Expires"))
+	}
+	if resp := patchChunk(t, url, 0, bytes.NewReader([]byte("half"))); resp.StatusCode != http.StatusNoContent || resp.Header.Get("Upload-Expires") == "" {
+		t.Fatalf("PATCH = %d with Upload-Expires %q", resp.StatusCode, resp.Header.Get("Upload-Expires"))
+	}
+	waitUploadState(t, id, uploadstate.Uploading)
+	deadline, ok := uploadExpiresAt(id)
+	if !ok {
+		t.Fatal("unfinished upload does not expire")
+	}
+
+	// the janitor leaves uploads alone until their deadline
+	if n, err := ExpireUploads(deadline.Add(-time.Second)); err != nil || n != 0 {
+		t.Fatalf("ExpireUploads before the deadline = %d, %v", n, err)
+	}
+
+	// once it passed, the upload is gone to clients though still on disk
+	err := db.RDB.ZAdd(db.Ctx, expiringUploadsKey, redis.Z{Score: float64(time.Now().Add(-time.Second).Unix()), Member: id}).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := tusRequest(t, http.MethodHead, url, nil, nil); resp.StatusCode != http.StatusGone {
+		t.Fatalf("HEAD of an expired upload = %d, want 410", resp.StatusCode)
+	}
+	if resp := patchChunk(t, url, 4, bytes.NewReader([]byte("rest!!"))); resp.StatusCode != http.StatusGone {
+		t.Fatalf("PATCH of an expired upload = %d, want 410", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(uploadDir, id)); err != nil {
+		t.Fatalf("expired upload was removed before the janitor ran: %v", err)
+	}
+
+	if n, err := ExpireUploads(time.Now()); err != nil || n != 1 {
+		t.Fatalf("ExpireUploads after the deadline = %d, %v, want 1", n, err)
+	}
+	for _, name := range []string{id, id + ".info"} {
+		if _, err := os.Stat(filepath.Join(uploadDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s of the expired upload is left: %v", name, err)
+		}
+	}
+	if state, _ := uploadstate.Current(id); state != uploadstate.Expired {
+		t.Errorf("expired upload is %s", state)
+	}
+	reserved, _ := db.RDB.HGetAll(db.Ctx, reservedKeyPrefix+strconv.Itoa(business.ID)).Result()
+	if len(reserved) != 0 {
+		t.Errorf("expired upload still reserves quota: %v", reserved)
+	}
+	if resp := tusRequest(t, http.MethodHead, url, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("HEAD of a removed upload = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestFinishedUploadDoesNotExpire(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	resp := postUpload(t, srv, 5, businessHeader(business))
+	url := resp.Header.Get("Location")
+	if resp := patchChunk(t, url, 0, bytes.NewReader([]byte("hello"))); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PATCH = %d", resp.StatusCode)
+	}
+	if _, ok := uploadExpiresAt(path.Base(url)); ok {
+		t.Fatal("finished upload still expires")
+	}
+	if n, err := ExpireUploads(time.Now().Add(48 * time.Hour)); err != nil || n != 0 {
+		t.Fatalf("ExpireUploads = %d, %v, want the finished upload kept", n, err)
+	}
+	if _, err := db.GetUploadRecord(path.Base(url)); err != nil {
+		t.Fatalf("finished upload is gone: %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tus/tusd/pkg/filestore"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// errLockLost means an upload lock lapsed before its holder was done, and
+// the upload may be locked by another instance by now
+var errLockLost = tusd.NewHTTPError(errors.New("upload lock lost"), 423)
+
+// fencing tokens only ever grow, across all uploads
+const tusFenceKey = "tuslock:fence"
+
+func tusLockKey(id string) string { return "tuslock:" + id }
+
+// tusAcquire takes a free lock with the next fencing token, or returns 0
+var tusAcquire = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then return 0 end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], token .. ':' .. ARGV[1], 'PX', ARGV[2])
+return token`)
+
+// tusRenew extends a lock still held with the given value
+var tusRenew = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then return 0 end
+return redis.call('PEXPIRE', KEYS[1], ARGV[2])`)
+
+// tusRelease frees a lock still held with the given value
+var tusRelease = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then return 0 end
+return redis.call('DEL', KEYS[1])`)
+
+// redisLocker is a tusd Locker shared by every instance through Redis, so
+// only one of them at a time writes to an upload. Locks are leases: their
+// holder renews them while it works, and those of a crashed instance lapse
+// after ttl. Each lock carries a fencing token, and writes check it so an
+// instance whose lease lapsed cannot write over the next holder.
+type redisLocker struct {
+	rdb   *redis.Client
+	ttl   time.Duration
+	owner string
+
+	mu   sync.Mutex
+	held map[string]*redisLock
+}
+
+// processName names this process apart from every other one sharing Redis
+func processName() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	host, _ := os.Hostname()
+	return host + "/" + strconv.Itoa(os.Getpid()) + "/" + hex.EncodeToString(b)
+}
+
+func newRedisLocker(rdb *redis.Client, ttl time.Duration) *redisLocker {
+	return &redisLocker{
+		rdb:   rdb,
+		ttl:   ttl,
+		owner: processName(),
+		held:  make(map[string]*redisLock),
+	}
+}
+
+// UseIn adds this locker to the passed composer
+func (l *redisLocker) UseIn(composer *tusd.StoreComposer) {
+	composer.UseLocker(l)
+}
+
+func (l *redisLocker) NewLock(id string) (tusd.Lock, error) {
+	return &redisLock{locker: l, id: id}, nil
+}
+
+// fence reports whether this instance may still write to an upload: either
+// it holds no lock on it, as when writing an upload it just created, or
+// the lock it holds is still the current one
+func (l *redisLocker) fence(id string) error {
+	l.mu.Lock()
+	lock := l.held[id]
+	l.mu.Unlock()
+	if lock == nil {
+		return nil
+	}
+	current, err := l.rdb.Get(context.Background(), tusLockKey(id)).Result()
+	if errors.Is(err, redis.Nil) || (err == nil && current != lock.value) {
+		return errLockLost
+	}
+	return err
+}
+
+type redisLock struct {
+	locker *redisLocker
+	id     string
+	token  int64
+	value  string
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Lock takes the lock, or fails with tusd.ErrFileLocked if another request
+// on any instance holds it
+func (lock *redisLock) Lock() error {
+	l := lock.locker
+	token, err := tusAcquire.Run(context.Background(), l.rdb, []string{tusLockKey(lock.id), tusFenceKey},
+		l.owner, l.ttl.Milliseconds()).Int64()
+	if err != nil {
+		return fmt.Errorf("acquire upload lock: %w", err)
+	}
+	if token == 0 {
+		return tusd.ErrFileLocked
+	}
+	lock.token = token
+	lock.value = strconv.FormatInt(token, 10) + ":" + l.owner
+	lock.stop, lock.done = make(chan struct{}), make(chan struct{})
+	lock.stopOnce = sync.Once{}
+
+	l.mu.Lock()
+	l.held[lock.id] = lock
+	l.mu.Unlock()
+	go lock.renew()
+	return nil
+}
+
+// renew extends the lease every third of its length until the lock is
+// released or lost
+func (lock *redisLock) renew() {
+	defer close(lock.done)
+	l := lock.locker
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lock.stop:
+			return
+		case <-ticker.C:
+			ok, err := tusRenew.Run(context.Background(), l.rdb, []string{tusLockKey(lock.id)},
+				lock.value, l.ttl.Milliseconds()).Int()
+			if err != nil {
+				log.Printf("Failed to renew lock on upload %s: %v", lock.id, err)
+				continue
+			}
+			if ok == 0 {
+				log.Printf("Lock on upload %s lapsed (fencing token %d)", lock.id, lock.token)
+				return
+			}
+		}
+	}
+}
+
+// stopRenewal stops extending the lease and waits for the renewal to end
+func (lock *redisLock) stopRenewal() {
+	lock.stopOnce.Do(func() { close(lock.stop) })
+	<-lock.done
+}
+
+// Unlock releases the lock unless it already lapsed and was taken by
+// someone else
+func (lock *redisLock) Unlock() error {
+	if lock.stop == nil {
+		return nil
+	}
+	lock.stopRenewal()
+
+	l := lock.locker
+	l.mu.Lock()
+	if l.held[lock.id] == lock {
+		delete(l.held, lock.id)
+	}
+	l.mu.Unlock()
+
+	err := tusRelease.Run(context.Background(), l.rdb, []string{tusLockKey(lock.id)}, lock.value).Err()
+	lock.stop = nil
+	return err
+}
+
+// fencedStore is the tusd filestore with writes checked against the upload
+// lock, so instances sharing its directory cannot corrupt each other's
+// uploads, and against the checksums clients send with their chunks
+type fencedStore struct {
+	filestore.FileStore
+	locker *redisLocker
+}
+
+// UseIn adds this store and the extensions of the filestore to the passed
+// composer
+func (s fencedStore) UseIn(composer *tusd.StoreComposer) {
+	composer.UseCore(s)
+	composer.UseTerminater(s)
+	composer.UseConcater(s)
+	composer.UseLengthDeferrer(s)
+}
+
+func (s fencedStore) NewUpload(ctx context.Context, info tusd.FileInfo) (tusd.Upload, error) {
+	upload, err := s.FileStore.NewUpload(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := upload.GetInfo(ctx); err == nil {
+		extendExpiry(info.ID, info.MetaData)
+	}
+	return &fencedUpload{Upload: upload, store: s}, nil
+}
+
+func (s fencedStore) GetUpload(ctx context.Context, id string) (tusd.Upload, error) {
+	upload, err := s.FileStore.GetUpload(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &fencedUpload{Upload: upload, store: s}, nil
+}
+
+// unfenced returns the filestore upload a fenced one wraps
+func unfenced(upload tusd.Upload) tusd.Upload {
+	if f, ok := upload.(*fencedUpload); ok {
+		return f.Upload
+	}
+	return upload
+}
+
+func (s fencedStore) AsTerminatableUpload(upload tusd.Upload) tusd.TerminatableUpload {
+	return s.FileStore.AsTerminatableUpload(unfenced(upload))
+}
+
+func (s fencedStore) AsLengthDeclarableUpload(upload tusd.Upload) tusd.LengthDeclarableUpload {
+	return constrainedLength{s.FileStore.AsLengthDeclarableUpload(unfenced(upload)), upload}
+}
+
+func (s fencedStore) AsConcatableUpload(upload tusd.Upload) tusd.ConcatableUpload {
+	return fencedConcat{s.FileStore.AsConcatableUpload(unfenced(upload))}
+}
+
+// fencedReader checks the upload lock again every so often while a chunk
+// streams in, so an instance whose lock lapsed stops writing soon after
+type fencedReader struct {
+	r       io.Reader
+	fence   func() error
+	every   time.Duration
+	checked time.Time
+}
+
+func (f *fencedReader) Read(p []byte) (int, error) {
+	if time.Since(f.checked) >= f.every {
+		if err := f.fence(); err != nil {
+			return 0, err
+		}
+		f.checked = time.Now()
+	}
+	return f.r.Read(p)
+}
+
+type fencedUpload struct {
+	tusd.Upload
+	store fencedStore
+}
+
+// WriteChunk writes a chunk if this instance still holds the upload lock
+// throughout and the chunk matches its checksum. Every write restarts the
+// upload's expiry. Uploads that turn out to break their business's
+// constraints are removed.
+func (u *fencedUpload) WriteChunk(ctx context.Context, offset int64, src io.Reader) (int64, error) {
+	info, err := u.Upload.GetInfo(ctx)
+	if err != nil {
+		return 0, err
+	}
+	fence := func() error { return u.store.locker.fence(info.ID) }
+	if err := fence(); err != nil {
+		return 0, err
+	}
+	path := filepath.Join(u.store.Path, info.ID)
+	fenced := &fencedReader{
+		r:       src,
+		fence:   fence,
+		every:   u.store.locker.ttl / 3,
+		checked: time.Now(),
+	}
+	n, err := writeChecked(ctx, u.Upload, info.ID, path, offset, fenced, fence)
+	if n == 0 || err != nil {
+		return n, err
+	}
+
+	// partial uploads are checked once they are assembled
+	if !info.IsPartial {
+		if err := checkWritten(info, path, offset, n); err != nil {
+			if _, ok := err.(*constraintError); ok {
+				rejectUpload(u, info, err)
+			}
+			return 0, err
+		}
+	}
+	extendExpiry(info.ID, info.MetaData)
+	return n, nil
+}
+
+// FinishUpload finishes an upload if this instance still holds its lock. A
+// finished upload no longer expires, unless it is a partial upload that
+// still has to be assembled.
+func (u *fencedUpload) FinishUpload(ctx context.Context) error {
+	info, err := u.Upload.GetInfo(ctx)
+	if err != nil {
+		return err
+	}
+	if err := u.store.locker.fence(info.ID); err != nil {
+		return err
+	}
+	if err := u.Upload.FinishUpload(ctx); err != nil {
+		return err
+	}
+	if !info.IsPartial {
+		forgetExpiry(info.ID)
+	}
+	return nil
+}
+
+// fencedConcat hands the filestore the uploads it created when
+// concatenating
+type fencedConcat struct {
+	tusd.ConcatableUpload
+}
+
+func (c fencedConcat) ConcatUploads(ctx context.Context, partials []tusd.Upload) error {
+	uploads := make([]tusd.Upload, len(partials))
+	for i, p := range partials {
+		uploads[i] = unfenced(p)
+	}
+	return c.ConcatableUpload.ConcatUploads(ctx, uploads)
+}
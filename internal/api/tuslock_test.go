@@ -0,0 +1,292 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/db"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/tus/tusd/pkg/filestore"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+func newTestLocker(t *testing.T, mr *miniredis.Miniredis, ttl time.Duration) *redisLocker {
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	db.RDB = rdb
+	return newRedisLocker(rdb, ttl)
+}
+
+// newTestInstance serves a tus handler the way an API instance does, on an
+// upload directory and Redis shared with the other instances
+func newTestInstance(t *testing.T, mr *miniredis.Miniredis, dir string) (*httptest.Server, *redisLocker) {
+	locker := newTestLocker(t, mr, time.Minute)
+	composer := tusd.NewStoreComposer()
+	fencedStore{FileStore: filestore.New(dir), locker: locker}.UseIn(composer)
+	locker.UseIn(composer)
+	h, err := tusd.NewHandler(tusd.Config{StoreComposer: composer, BasePath: "/files/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.StripPrefix("/files/", h))
+	t.Cleanup(srv.Close)
+	return srv, locker
+}
+
+func tusRequest(t *testing.T, method, url string, body io.Reader, header map[string]string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func patchChunk(t *testing.T, url string, offset int, chunk io.Reader) *http.Response {
+	return tusRequest(t, http.MethodPatch, url, chunk, map[string]string{
+		"Upload-Offset": strconv.Itoa(offset),
+		"Content-Type":  "application/offset+octet-stream",
+	})
+}
+
+func TestRedisLockIsExclusiveAcrossInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, b := newTestLocker(t, mr, time.Minute), newTestLocker(t, mr, time.Minute)
+
+	first, _ := a.NewLock("upload")
+	if err := first.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := b.NewLock("upload")
+	if err := second.Lock(); !errors.Is(err, tusd.ErrFileLocked) {
+		t.Fatalf("second instance got %v, want ErrFileLocked", err)
+	}
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Lock(); err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	if first.(*redisLock).token >= second.(*redisLock).token {
+		t.Fatal("fencing tokens must grow")
+	}
+	second.Unlock()
+}
+
+func TestRedisLockIsRenewedWhileHeld(t *testing.T) {
+	mr := miniredis.RunT(t)
+	locker := newTestLocker(t, mr, 300*time.Millisecond)
+	lock, _ := locker.NewLock("upload")
+	if err := lock.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	mr.FastForward(250 * time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	if ttl := mr.TTL(tusLockKey("upload")); ttl < 200*time.Millisecond {
+		t.Fatalf("lease was not renewed, %v left", ttl)
+	}
+	mr.FastForward(250 * time.Millisecond)
+	if !mr.Exists(tusLockKey("upload")) {
+		t.Fatal("renewed lock lapsed")
+	}
+}
+
+func TestRedisLockOfCrashedInstanceLapses(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, b := newTestLocker(t, mr, time.Second), newTestLocker(t, mr, time.Second)
+
+	crashed, _ := a.NewLock("upload")
+	if err := crashed.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	// the instance stops renewing without unlocking, as if it died
+	crashed.(*redisLock).stopRenewal()
+	mr.FastForward(2 * time.Second)
+
+	next, _ := b.NewLock("upload")
+	if err := next.Lock(); err != nil {
+		t.Fatalf("lock of crashed instance was not released: %v", err)
+	}
+	if err := a.fence("upload"); !errors.Is(err, errLockLost) {
+		t.Fatalf("stale holder may still write: %v", err)
+	}
+	if err := b.fence("upload"); err != nil {
+		t.Fatalf("new holder may not write: %v", err)
+	}
+
+	// releasing the stale lock must not free the new holder's
+	crashed.Unlock()
+	if !mr.Exists(tusLockKey("upload")) {
+		t.Fatal("stale holder released the new lock")
+	}
+	next.Unlock()
+}
+
+func TestInstancesShareUploads(t *testing.T) {
+	mr := miniredis.RunT(t)
+	dir := t.TempDir()
+	one, _ := newTestInstance(t, mr, dir)
+	two, _ := newTestInstance(t, mr, dir)
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	resp := tusRequest(t, http.MethodPost, one.URL+"/files/", nil, map[string]string{"Upload-Length": strconv.Itoa(len(data))})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: %d", resp.StatusCode)
+	}
+	id := filepath.Base(resp.Header.Get("Location"))
+
+	// a PATCH on one instance holds the upload while its body streams in
+	body, feed := io.Pipe()
+	done := make(chan *http.Response)
+	go func() { done <- patchChunk(t, one.URL+"/files/"+id, 0, body) }()
+	feed.Write(data[:4000])
+	for !mr.Exists(tusLockKey(id)) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// meanwhile the other instance turns away writes to the same upload
+	if resp := patchChunk(t, two.URL+"/files/"+id, 0, bytes.NewReader(data[:4000])); resp.StatusCode != http.StatusLocked {
+		t.Fatalf("concurrent PATCH on the other instance: %d, want 423", resp.StatusCode)
+	}
+	feed.Close()
+	if resp := <-done; resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("first PATCH: %d", resp.StatusCode)
+	}
+
+	// and picks up where the first one stopped once it is done
+	if resp := patchChunk(t, two.URL+"/files/"+id, 4000, bytes.NewReader(data[4000:7000])); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PATCH on the other instance: %d", resp.StatusCode)
+	}
+	if resp := patchChunk(t, one.URL+"/files/"+id, 7000, bytes.NewReader(data[7000:])); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("last PATCH: %d", resp.StatusCode)
+	}
+
+	resp = tusRequest(t, http.MethodHead, two.URL+"/files/"+id, nil, nil)
+	if resp.Header.Get("Upload-Offset") != strconv.Itoa(len(data)) {
+		t.Fatalf("offset %s, want %d", resp.Header.Get("Upload-Offset"), len(data))
+	}
+	stored, err := os.ReadFile(filepath.Join(dir, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, data) {
+		t.Fatal("upload data corrupted")
+	}
+	if mr.Exists(tusLockKey(id)) {
+		t.Fatal("lock still held after the requests finished")
+	}
+}
+
+func TestStaleHolderCannotWrite(t *testing.T) {
+	mr := miniredis.RunT(t)
+	dir := t.TempDir()
+	srv, locker := newTestInstance(t, mr, dir)
+
+	resp := tusRequest(t, http.MethodPost, srv.URL+"/files/", nil, map[string]string{"Upload-Length": "10"})
+	id := filepath.Base(resp.Header.Get("Location"))
+
+	// the lease lapses and another instance takes the upload over before
+	// the write reaches the store
+	lock, _ := locker.NewLock(id)
+	if err := lock.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	mr.Del(tusLockKey(id))
+	other := newTestLocker(t, mr, time.Minute)
+	takeover, _ := other.NewLock(id)
+	if err := takeover.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := fencedStore{FileStore: filestore.New(dir), locker: locker}.GetUpload(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upload.WriteChunk(context.Background(), 0, bytes.NewReader([]byte("0123456789"))); !errors.Is(err, errLockLost) {
+		t.Fatalf("stale write got %v, want errLockLost", err)
+	}
+	lock.Unlock()
+	takeover.Unlock()
+}
+
+// takeoverReader hands over the upload lock to another instance once part
+// of a chunk has been read
+type takeoverReader struct {
+	r        io.Reader
+	takeover func()
+	done     bool
+}
+
+func (t *takeoverReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p[:min(len(p), 4)])
+	if !t.done {
+		t.done = true
+		t.takeover()
+	}
+	return n, err
+}
+
+func TestLockLostMidWriteLeavesNextHolderData(t *testing.T) {
+	mr := miniredis.RunT(t)
+	dir := t.TempDir()
+	srv, locker := newTestInstance(t, mr, dir)
+
+	resp := tusRequest(t, http.MethodPost, srv.URL+"/files/", nil, map[string]string{"Upload-Length": "10"})
+	id := filepath.Base(resp.Header.Get("Location"))
+	lock, _ := locker.NewLock(id)
+	if err := lock.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	other := newTestLocker(t, mr, time.Minute)
+	takeover, _ := other.NewLock(id)
+
+	upload, err := fencedStore{FileStore: filestore.New(dir), locker: locker}.GetUpload(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the next holder takes the upload over and writes to it while the
+	// stale chunk is still streaming in
+	src := &takeoverReader{r: bytes.NewReader([]byte("0123456789")), takeover: func() {
+		mr.Del(tusLockKey(id))
+		if err := takeover.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, id), []byte("abc"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	if _, err := upload.WriteChunk(context.Background(), 0, src); !errors.Is(err, errLockLost) {
+		t.Fatalf("write that lost its lock got %v, want errLockLost", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, id)); err != nil || string(data) != "abc" {
+		t.Errorf("upload holds %q after the stale write, want the next holder's bytes only (%v)", data, err)
+	}
+	if staged, _ := filepath.Glob(filepath.Join(dir, "."+id+".chunk-*")); len(staged) != 0 {
+		t.Errorf("staged chunk left behind: %v", staged)
+	}
+	lock.Unlock()
+	takeover.Unlock()
+}
@@ -1,96 +1,176 @@
-package api
-
-import (
-	"mediapipeline/internal/db"
-	"net/http"
-	"time"
-
-	"github.com/gin-gonic/gin"
-)
-
-func uploadHandler(c *gin.Context) {
-	apiKey := c.GetHeader("X-API-KEY")
-	username := c.GetHeader("X-Username")
-
-	if apiKey == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing X-API-KEY header"})
-		return
-	}
-	if username == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing X-Username header"})
-		return
-	}
-
-	business, err := db.GetBusinessByAPIKey(apiKey)
-	if err != nil || business == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
-		return
-	}
-
-	token, err := db.GenerateAPIKey()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
-		return
-	}
-
-	uploadKey := "upload:" + token
-	fields := map[string]interface{}{
-		"business_id": business.ID,
-		"username":    username,
-		"status":      "in_progress",
-		"created_at":  time.Now().UTC().Format(time.RFC3339),
-	}
-	if err := db.RDB.HSet(db.Ctx, uploadKey, fields).Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to persist upload"})
-		return
-	}
-
-	tokenKey := "upload_token:" + token
-	tokenFields := map[string]interface{}{
-		"business_id": business.ID,
-		"username":    username,
-		"status":      "used",
-		"created_at":  time.Now().UTC().Format(time.RFC3339),
-		"used_at":     time.Now().UTC().Format(time.RFC3339),
-	}
-	if err := db.RDB.HSet(db.Ctx, tokenKey, tokenFields).Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store token"})
-		return
-	}
-
-	if err := db.RDB.Expire(db.Ctx, tokenKey, 15*time.Minute).Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set token expiration"})
-		return
-	}
-
-	c.JSON(http.StatusCreated, gin.H{
-		"token":      token,
-		"expires_in": 900,
-	})
-}
-
-func resumeUploadHandler(c *gin.Context) {
-	token := c.Param("token")
-	if token == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "missing token parameter"})
-		return
-	}
-
-	uploadKey := "upload:" + token
-	uploadData, err := db.RDB.HGetAll(db.Ctx, uploadKey).Result()
-	if err != nil || len(uploadData) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
-		return
-	}
-
-	if status, ok := uploadData["status"]; !ok || status != "in_progress" {
-		c.JSON(http.StatusConflict, gin.H{"error": "upload not in progress"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"token":      token,
-		"status":     uploadData["status"],
-		"created_at": uploadData["created_at"],
-	})
-}
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	tusd "github.com/tus/tusd/pkg/handler"
+)
+
+// how long an upload token can be used to create an upload
+const uploadTokenTTL = 15 * time.Minute
+
+func uploadTokenKey(token string) string { return "upload_token:" + token }
+
+// useUploadToken marks an issued token used. It returns 1 if it did, -1 for
+// a token already used and 0 for one that does not exist.
+var useUploadToken = redis.NewScript(`
+local status = redis.call('HGET', KEYS[1], 'status')
+if not status then return 0 end
+if status ~= 'issued' then return -1 end
+redis.call('HSET', KEYS[1], 'status', 'used', 'used_at', ARGV[1])
+return 1`)
+
+// uploadHandler issues a single-use token that lets a client, such as a
+// browser, create one upload for a business without seeing its API key
+func uploadHandler(c *gin.Context) {
+	apiKey := c.GetHeader("X-API-KEY")
+	username := c.GetHeader("X-Username")
+
+	if apiKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing X-API-KEY header"})
+		return
+	}
+	if username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing X-Username header"})
+		return
+	}
+
+	business, err := db.GetBusinessByAPIKey(apiKey)
+	if err != nil || business == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid api key"})
+		return
+	}
+
+	token, err := db.GenerateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
+	}
+
+	tokenKey := uploadTokenKey(token)
+	tokenFields := map[string]interface{}{
+		"business_id": business.ID,
+		"username":    username,
+		"status":      "issued",
+		"created_at":  time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := db.RDB.HSet(db.Ctx, tokenKey, tokenFields).Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store token"})
+		return
+	}
+
+	if err := db.RDB.Expire(db.Ctx, tokenKey, uploadTokenTTL).Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to set token expiration"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":      token,
+		"expires_in": int(uploadTokenTTL.Seconds()),
+	})
+}
+
+// tokenCredentials returns the business and username an upload token was
+// issued for, as long as it has not been used
+func tokenCredentials(token string) (*db.Business, string, error) {
+	data, err := db.RDB.HGetAll(db.Ctx, uploadTokenKey(token)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) == 0 {
+		return nil, "", tusd.NewHTTPError(errors.New("invalid upload token"), http.StatusUnauthorized)
+	}
+	if data["status"] != "issued" {
+		return nil, "", tusd.NewHTTPError(errors.New("upload token already used"), http.StatusConflict)
+	}
+	businessID, err := strconv.Atoi(data["business_id"])
+	if err != nil {
+		return nil, "", fmt.Errorf("upload token %s has no business", token)
+	}
+	business, err := db.GetBusinessByID(businessID)
+	if err != nil {
+		return nil, "", tusd.NewHTTPError(errors.New("invalid upload token"), http.StatusUnauthorized)
+	}
+	return business, data["username"], nil
+}
+
+// consumeUploadToken uses up an upload token. Of several requests racing
+// with the same token, one wins.
+func consumeUploadToken(token string) error {
+	used, err := useUploadToken.Run(db.Ctx, db.RDB, []string{uploadTokenKey(token)},
+		time.Now().UTC().Format(time.RFC3339)).Int()
+	if err != nil {
+		return err
+	}
+	switch used {
+	case 0:
+		return tusd.NewHTTPError(errors.New("invalid upload token"), http.StatusUnauthorized)
+	case -1:
+		return tusd.NewHTTPError(errors.New("upload token already used"), http.StatusConflict)
+	}
+	return nil
+}
+
+// bindUploadToken records which upload a token was used for
+func bindUploadToken(token, uploadID string) {
+	if token == "" {
+		return
+	}
+	if err := db.RDB.HSet(db.Ctx, uploadTokenKey(token), "upload_id", uploadID).Err(); err != nil {
+		log.Printf("Failed to bind upload token to upload %s: %v", uploadID, err)
+	}
+}
+
+// tokenUpload returns the upload a token was used for, if any
+func tokenUpload(token string) (string, bool) {
+	id, err := db.RDB.HGet(db.Ctx, uploadTokenKey(token), "upload_id").Result()
+	return id, err == nil && id != ""
+}
+
+func resumeUploadHandler(c *gin.Context) {
+	token := c.Param("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing token parameter"})
+		return
+	}
+
+	tokenData, err := db.RDB.HGetAll(db.Ctx, uploadTokenKey(token)).Result()
+	if err != nil || len(tokenData) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+	uploadID := tokenData["upload_id"]
+	if uploadID == "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload not started"})
+		return
+	}
+
+	uploadData, err := db.RDB.HGetAll(db.Ctx, uploadstate.Key(uploadID)).Result()
+	if err != nil || len(uploadData) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload not found"})
+		return
+	}
+	if state := uploadstate.State(uploadData["status"]); state != uploadstate.Created && state != uploadstate.Uploading {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload not in progress"})
+		return
+	}
+
+	offset, _ := strconv.ParseInt(uploadData["offset"], 10, 64)
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"upload_id":  uploadID,
+		"location":   "/api/v1/uploads/" + uploadID,
+		"status":     uploadData["status"],
+		"offset":     offset,
+		"created_at": uploadData["created_at"],
+	})
+}
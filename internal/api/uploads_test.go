@@ -0,0 +1,104 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+)
+
+func TestUploadTokenCreatesOneUpload(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	token := issueUploadToken(t, srv, business)
+	withToken := func(token string) map[string]string {
+		return map[string]string{"X-Upload-Token": token}
+	}
+
+	if resp := postUpload(t, srv, 10, withToken("unknown")); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("upload with an unknown token = %d, want 401", resp.StatusCode)
+	}
+
+	// an upload the business does not accept leaves the token to try again
+	if err := db.SetUploadConstraints(business.ID, &db.UploadConstraints{MaxBytes: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := postUpload(t, srv, 10, withToken(token)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload over the size limit = %d, want 413", resp.StatusCode)
+	}
+	if status := tokenStatus(t, token); status != "issued" {
+		t.Fatalf("token is %s after a rejected upload, want issued", status)
+	}
+	if err := db.SetUploadConstraints(business.ID, &db.UploadConstraints{}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := postUpload(t, srv, 10, withToken(token))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload with the token = %d, want 201", resp.StatusCode)
+	}
+	id := path.Base(resp.Header.Get("Location"))
+	if status := tokenStatus(t, token); status != "used" {
+		t.Fatalf("token is %s after its upload, want used", status)
+	}
+	if resp := postUpload(t, srv, 10, withToken(token)); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("second upload with the token = %d, want 409", resp.StatusCode)
+	}
+
+	// the token finds its upload to resume
+	waitUploadState(t, id, uploadstate.Created)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if bound, ok := tokenUpload(token); ok {
+			if bound != id {
+				t.Fatalf("token is bound to upload %s, want %s", bound, id)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("token was not bound to its upload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status, body := apiJSON(t, srv, http.MethodPut, "/api/v1/uploads/meta/"+token, business, nil)
+	if status != http.StatusOK || body["upload_id"] != id || body["location"] != "/api/v1/uploads/"+id {
+		t.Fatalf("resume = %d, %v, want upload %s", status, body, id)
+	}
+	if status, _ := apiJSON(t, srv, http.MethodPut, "/api/v1/uploads/meta/unknown", business, nil); status != http.StatusNotFound {
+		t.Fatalf("resume with an unknown token = %d, want 404", status)
+	}
+}
+
+func TestRacingUploadsShareNoToken(t *testing.T) {
+	srv, business, _ := newTestPipeline(t)
+	token := issueUploadToken(t, srv, business)
+
+	codes := make(chan int, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- postUpload(t, srv, 10, map[string]string{"X-Upload-Token": token}).StatusCode
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("racing upload = %d, want 201 or 409", code)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d uploads were created with one token, want 1", created)
+	}
+}
@@ -1,69 +1,346 @@
-package config
-
-import (
-	"os"
-)
-
-// Config holds all configuration for the application
-type Config struct {
-	Environment string
-	Port        string
-	Redis       RedisConfig
-	Storage     StorageConfig
-	AI          AIConfig
-}
-
-// RedisConfig holds Redis configuration
-type RedisConfig struct {
-	Host     string
-	Port     string
-	Password string
-	DB       int
-}
-
-// StorageConfig holds storage configuration
-type StorageConfig struct {
-	CDNPath string
-	S3Path  string
-	R2Path  string
-}
-
-// AIConfig holds AI service configuration
-type AIConfig struct {
-	BaseURL string
-	Timeout int
-}
-
-// Load loads configuration from environment variables
-func Load() (*Config, error) {
-	cfg := &Config{
-		Environment: getEnv("ENVIRONMENT", "development"),
-		Port:        getEnv("PORT", "8080"),
-		Redis: RedisConfig{
-			Host:     getEnv("REDIS_HOST", "localhost"),
-			Port:     getEnv("REDIS_PORT", "6379"),
-			Password: getEnv("REDIS_PASSWORD", ""),
-			DB:       0, // Default to DB 0
-		},
-		Storage: StorageConfig{
-			CDNPath: getEnv("CDN_PATH", "./storage/cdn"),
-			S3Path:  getEnv("S3_PATH", "./storage/s3"),
-			R2Path:  getEnv("R2_PATH", "./storage/r2"),
-		},
-		AI: AIConfig{
-			BaseURL: getEnv("AI_SERVICE_URL", "http://localhost:8000"),
-			Timeout: 30, // 30 seconds timeout
-		},
-	}
-
-	return cfg, nil
-}
-
-// getEnv gets an environment variable with a fallback value
-func getEnv(key, fallback string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return fallback
-}
-
+package config
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds all configuration for the application
+type Config struct {
+	Environment string
+	Port        string
+	Redis       RedisConfig
+	Storage     StorageConfig
+	AI          AIConfig
+	S3Gateway   S3GatewayConfig
+	Encryption  EncryptionConfig
+	Admin       AdminConfig
+	Quota       QuotaConfig
+	Costs       CostConfig
+	Uploads     UploadConfig
+	Imports     ImportConfig
+}
+
+// RedisConfig holds Redis configuration
+type RedisConfig struct {
+	Host     string
+	Port     string
+	Password string
+	DB       int
+}
+
+// StorageConfig holds storage configuration
+type StorageConfig struct {
+	// Root directories of each tier, separated like PATH, in DefaultRegion
+	CDNPath string
+	S3Path  string
+	R2Path  string
+
+	// Businesses are assigned a region at registration and their data only
+	// ever lives under that region's roots. DefaultRegion has the paths above
+	// and takes businesses that do not pick a region; Regions has the tier
+	// paths of the other regions.
+	DefaultRegion string
+	Regions       map[string]RegionPaths
+
+	// Region this instance serves from; its hot cache only holds data of
+	// businesses in this region
+	InstanceRegion string
+
+	// Blobs idle for longer than these move down to the S3 and R2 tiers
+	WarmAfter time.Duration
+	ColdAfter time.Duration
+
+	// The scrubber re-verifies every blob once per interval, reading at
+	// most ScrubRate bytes per second
+	ScrubInterval time.Duration
+	ScrubRate     int64
+
+	// Lifecycle rules are evaluated once per interval
+	LifecycleInterval time.Duration
+
+	// Each instance keeps CDN tier blobs of up to HotCacheObjectBytes in
+	// memory, HotCacheBytes in total; zero disables the cache
+	HotCacheBytes       int64
+	HotCacheObjectBytes int64
+}
+
+// RegionPaths are the root directories of each tier in a region
+type RegionPaths struct {
+	CDNPath string
+	S3Path  string
+	R2Path  string
+}
+
+// S3GatewayConfig holds configuration for the S3-compatible API, which is
+// only served when Port is set
+type S3GatewayConfig struct {
+	Port string
+}
+
+// EncryptionConfig holds the master keys that wrap per-business data keys.
+// Keys are base64-encoded 32-byte AES keys identified by an ID.
+type EncryptionConfig struct {
+	MasterKeyID  string
+	MasterKey    string
+	PreviousKeys map[string]string
+}
+
+// AdminConfig holds the token that guards the admin API; the admin API is
+// disabled when it is empty
+type AdminConfig struct {
+	Token string
+}
+
+// QuotaConfig holds the default storage quotas of a business in bytes; zero
+// means unlimited. Businesses can be given their own through the admin API.
+type QuotaConfig struct {
+	SoftBytes int64
+	HardBytes int64
+
+	// PinBytes limits how much a business can pin to the CDN tier
+	PinBytes int64
+}
+
+// UploadConfig holds settings of the tus upload endpoint
+type UploadConfig struct {
+	// Directory of uploads in progress. Instances behind the same load
+	// balancer must share it, e.g. on a network filesystem.
+	Dir string
+	// An upload lock lapses when its holder has not renewed it for this
+	// long, so the locks of a crashed instance are released
+	LockTTL time.Duration
+	// Unfinished uploads expire after sitting idle this long, unless their
+	// business has its own expiry. The janitor removes expired uploads once
+	// per JanitorInterval.
+	ExpireAfter     time.Duration
+	JanitorInterval time.Duration
+	// tus notifications are handled by EventWorkers workers, each with a
+	// queue of up to EventQueue events. Progress of an upload is reported
+	// at most once per ProgressInterval, unless it grew by ProgressStep
+	// percent.
+	EventWorkers     int
+	EventQueue       int
+	ProgressInterval time.Duration
+	ProgressStep     float64
+	// Largest request the multipart form endpoint accepts, all of its
+	// files and fields together
+	SimpleMaxBytes int64
+}
+
+// ImportConfig holds settings of imports of uploads from remote URLs
+type ImportConfig struct {
+	// An import may be at most MaxBytes long and take at most Timeout, and
+	// follows at most MaxRedirects redirects
+	MaxBytes     int64
+	Timeout      time.Duration
+	MaxRedirects int
+	// Imports never connect to loopback, private, link-local or other
+	// internal addresses, unless they are in one of these networks
+	AllowedNets []*net.IPNet
+}
+
+// CostConfig holds the prices cost reports charge for each tier, in US
+// dollars. Stored bytes are metered once per MeteringInterval.
+type CostConfig struct {
+	CDN TierPricing
+	S3  TierPricing
+	R2  TierPricing
+
+	MeteringInterval time.Duration
+}
+
+// TierPricing is what a tier charges for storage, requests and egress
+type TierPricing struct {
+	StorageGBMonth float64
+	Per1KRequests  float64
+	EgressGB       float64
+}
+
+// AIConfig holds AI service configuration
+type AIConfig struct {
+	BaseURL string
+	Timeout int
+}
+
+// Load loads configuration from environment variables
+func Load() (*Config, error) {
+	cfg := &Config{
+		Environment: getEnv("ENVIRONMENT", "development"),
+		Port:        getEnv("PORT", "8080"),
+		Redis: RedisConfig{
+			Host:     getEnv("REDIS_HOST", "localhost"),
+			Port:     getEnv("REDIS_PORT", "6379"),
+			Password: getEnv("REDIS_PASSWORD", ""),
+			DB:       0, // Default to DB 0
+		},
+		Storage: StorageConfig{
+			CDNPath: getEnv("CDN_PATH", "./storage/cdn"),
+			S3Path:  getEnv("S3_PATH", "./storage/s3"),
+			R2Path:  getEnv("R2_PATH", "./storage/r2"),
+
+			WarmAfter: getDuration("TIER_WARM_AFTER", 24*time.Hour),
+			ColdAfter: getDuration("TIER_COLD_AFTER", 7*24*time.Hour),
+
+			ScrubInterval: getDuration("SCRUB_INTERVAL", 24*time.Hour),
+			ScrubRate:     getInt64("SCRUB_BYTES_PER_SEC", 8<<20),
+
+			LifecycleInterval: getDuration("LIFECYCLE_INTERVAL", time.Hour),
+
+			HotCacheBytes:       getInt64("HOT_CACHE_BYTES", 64<<20),
+			HotCacheObjectBytes: getInt64("HOT_CACHE_MAX_OBJECT_BYTES", 1<<20),
+
+			DefaultRegion: getEnv("DEFAULT_REGION", "default"),
+			Regions:       parseRegions(getEnv("REGIONS", "")),
+		},
+		AI: AIConfig{
+			BaseURL: getEnv("AI_SERVICE_URL", "http://localhost:8000"),
+			Timeout: 30, // 30 seconds timeout
+		},
+		S3Gateway: S3GatewayConfig{
+			Port: getEnv("S3_GATEWAY_PORT", ""),
+		},
+		Encryption: EncryptionConfig{
+			MasterKeyID:  getEnv("MASTER_KEY_ID", "primary"),
+			MasterKey:    getEnv("MASTER_KEY", ""),
+			PreviousKeys: parseKeyList(getEnv("PREVIOUS_MASTER_KEYS", "")),
+		},
+		Admin: AdminConfig{
+			Token: getEnv("ADMIN_TOKEN", ""),
+		},
+		Quota: QuotaConfig{
+			SoftBytes: getInt64("QUOTA_SOFT_BYTES", 0),
+			HardBytes: getInt64("QUOTA_HARD_BYTES", 0),
+			PinBytes:  getInt64("PIN_QUOTA_BYTES", 1<<30),
+		},
+		Costs: CostConfig{
+			CDN: getPricing("CDN", TierPricing{StorageGBMonth: 0.10, Per1KRequests: 0.001, EgressGB: 0.08}),
+			S3:  getPricing("S3", TierPricing{StorageGBMonth: 0.023, Per1KRequests: 0.0004, EgressGB: 0.09}),
+			R2:  getPricing("R2", TierPricing{StorageGBMonth: 0.004, Per1KRequests: 0.05, EgressGB: 0.09}),
+
+			MeteringInterval: getDuration("METERING_INTERVAL", time.Hour),
+		},
+		Uploads: UploadConfig{
+			Dir:     getEnv("UPLOAD_DIR", "./uploads_data"),
+			LockTTL: getDuration("UPLOAD_LOCK_TTL", 30*time.Second),
+
+			ExpireAfter:     getDuration("UPLOAD_EXPIRE_AFTER", 24*time.Hour),
+			JanitorInterval: getDuration("UPLOAD_JANITOR_INTERVAL", 5*time.Minute),
+
+			EventWorkers:     int(getInt64("UPLOAD_EVENT_WORKERS", 4)),
+			EventQueue:       int(getInt64("UPLOAD_EVENT_QUEUE", 1024)),
+			ProgressInterval: getDuration("UPLOAD_PROGRESS_INTERVAL", 500*time.Millisecond),
+			ProgressStep:     getFloat("UPLOAD_PROGRESS_STEP", 5),
+
+			SimpleMaxBytes: getInt64("UPLOAD_SIMPLE_MAX_BYTES", 64<<20),
+		},
+		Imports: ImportConfig{
+			MaxBytes:     getInt64("IMPORT_MAX_BYTES", 1<<30),
+			Timeout:      getDuration("IMPORT_TIMEOUT", 10*time.Minute),
+			MaxRedirects: int(getInt64("IMPORT_MAX_REDIRECTS", 5)),
+			AllowedNets:  parseNets(getEnv("IMPORT_ALLOWED_NETS", "")),
+		},
+	}
+
+	cfg.Storage.InstanceRegion = getEnv("INSTANCE_REGION", cfg.Storage.DefaultRegion)
+	return cfg, nil
+}
+
+// getEnv gets an environment variable with a fallback value
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getDuration parses a duration environment variable with a fallback value
+func getDuration(key string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
+
+// getInt64 parses an integer environment variable with a fallback value
+func getInt64(key string, fallback int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	}
+	return fallback
+}
+
+// getFloat parses a decimal environment variable with a fallback value
+func getFloat(key string, fallback float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return fallback
+}
+
+// getPricing reads the COST_<TIER>_* prices of a tier
+func getPricing(tier string, fallback TierPricing) TierPricing {
+	return TierPricing{
+		StorageGBMonth: getFloat("COST_"+tier+"_STORAGE_GB_MONTH", fallback.StorageGBMonth),
+		Per1KRequests:  getFloat("COST_"+tier+"_PER_1K_REQUESTS", fallback.Per1KRequests),
+		EgressGB:       getFloat("COST_"+tier+"_EGRESS_GB", fallback.EgressGB),
+	}
+}
+
+// parseRegions reads the tier paths of each region in a comma-separated
+// list from REGION_<NAME>_CDN_PATH, _S3_PATH and _R2_PATH
+func parseRegions(value string) map[string]RegionPaths {
+	regions := make(map[string]RegionPaths)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		prefix := "REGION_" + strings.ToUpper(name) + "_"
+		regions[name] = RegionPaths{
+			CDNPath: getEnv(prefix+"CDN_PATH", "./storage/"+name+"/cdn"),
+			S3Path:  getEnv(prefix+"S3_PATH", "./storage/"+name+"/s3"),
+			R2Path:  getEnv(prefix+"R2_PATH", "./storage/"+name+"/r2"),
+		}
+	}
+	return regions
+}
+
+// parseNets parses a comma-separated list of CIDR networks and addresses,
+// skipping entries that are neither
+func parseNets(value string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else if _, n, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// parseKeyList parses "id=key,id=key" into a map
+func parseKeyList(value string) map[string]string {
+	keys := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		id, key, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && id != "" && key != "" {
+			keys[id] = key
+		}
+	}
+	return keys
+}
@@ -0,0 +1,236 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Blob is a content-addressed file shared by every upload of a business
+// with the same SHA-256
+type Blob struct {
+	BusinessID     int
+	SHA256         string
+	Size           int64
+	Refs           int
+	Tier           string
+	ContentType    string
+	StoredSize     int64
+	Compressed     bool
+	Encrypted      bool
+	KeyID          string
+	AccessCount    int64
+	LastAccessedAt time.Time
+	Corrupt        bool
+	RestoreStatus  string
+	RestoredUntil  time.Time
+	Root           string
+	RestoreRoot    string
+}
+
+const blobColumns = `business_id, sha256, size, refs, tier, content_type, stored_size, compressed,
+	access_count, COALESCE(last_accessed_at, created_at), corrupt, restore_status, COALESCE(restored_until, ''),
+	root, restore_root, encrypted, key_id`
+
+func scanBlob(row interface{ Scan(...interface{}) error }) (*Blob, error) {
+	b := &Blob{}
+	var accessed, restoredUntil string
+	err := row.Scan(&b.BusinessID, &b.SHA256, &b.Size, &b.Refs, &b.Tier, &b.ContentType, &b.StoredSize, &b.Compressed,
+		&b.AccessCount, &accessed, &b.Corrupt, &b.RestoreStatus, &restoredUntil,
+		&b.Root, &b.RestoreRoot, &b.Encrypted, &b.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	b.LastAccessedAt = parseTime(accessed)
+	b.RestoredUntil = parseTime(restoredUntil)
+	return b, nil
+}
+
+// parseTime reads timestamps written either by Go or by CURRENT_TIMESTAMP
+func parseTime(value string) time.Time {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t
+	}
+	t, _ := time.Parse("2006-01-02 15:04:05", value)
+	return t
+}
+
+// UploadRecord is the durable record of a finished upload
+type UploadRecord struct {
+	ID          string
+	BusinessID  int
+	Username    string
+	Filename    string
+	ContentType string
+	Size        int64
+	BlobSHA256  string
+	CreatedAt   time.Time
+}
+
+// CreateUploadRecord stores an upload record and takes a reference on its
+// blob in one transaction, creating the blob row from placed if it is new.
+// It returns the blob's reference count afterwards.
+func CreateUploadRecord(u *UploadRecord, placed *Blob) (int, error) {
+	tx, err := SQLDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO blobs (business_id, sha256, size, refs, tier, root, content_type, stored_size, encrypted, key_id)
+		VALUES (?, ?, ?, 1, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (business_id, sha256) DO UPDATE SET refs = refs + 1, unreferenced_at = NULL`,
+		u.BusinessID, u.BlobSHA256, u.Size, placed.Tier, placed.Root, placed.ContentType, placed.StoredSize,
+		placed.Encrypted, placed.KeyID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`INSERT INTO uploads (id, business_id, username, filename, content_type, size, blob_sha256, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.ID, u.BusinessID, u.Username, u.Filename, u.ContentType, u.Size, u.BlobSHA256, u.CreatedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+
+	var refs int
+	if err := tx.QueryRow("SELECT refs FROM blobs WHERE business_id = ? AND sha256 = ?", u.BusinessID, u.BlobSHA256).Scan(&refs); err != nil {
+		return 0, err
+	}
+	return refs, tx.Commit()
+}
+
+// GetUploadRecord fetches the record of a finished upload, or sql.ErrNoRows
+func GetUploadRecord(id string) (*UploadRecord, error) {
+	row := SQLDB.QueryRow(`SELECT id, business_id, username, filename, content_type, size, blob_sha256, created_at
+		FROM uploads WHERE id = ?`, id)
+	u := &UploadRecord{}
+	var created string
+	if err := row.Scan(&u.ID, &u.BusinessID, &u.Username, &u.Filename, &u.ContentType, &u.Size, &u.BlobSHA256, &created); err != nil {
+		return nil, err
+	}
+	u.CreatedAt, _ = time.Parse(time.RFC3339, created)
+	return u, nil
+}
+
+// DeleteUploadRecord removes an upload record and drops its reference on the
+// blob. A blob whose last reference goes away is left for the garbage
+// collector rather than deleted here.
+func DeleteUploadRecord(id string) (*UploadRecord, error) {
+	u, err := GetUploadRecord(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := SQLDB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM uploads WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	if _, err := tx.Exec("DELETE FROM upload_tags WHERE upload_id = ?", id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM upload_pins WHERE upload_id = ?", id); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`UPDATE blobs SET refs = refs - 1,
+		unreferenced_at = CASE WHEN refs - 1 <= 0 THEN ? ELSE NULL END
+		WHERE business_id = ? AND sha256 = ?`,
+		time.Now().UTC().Format(time.RFC3339), u.BusinessID, u.BlobSHA256)
+	if err != nil {
+		return nil, err
+	}
+	return u, tx.Commit()
+}
+
+// GetBlob fetches a blob row, or sql.ErrNoRows
+func GetBlob(businessID int, sha string) (*Blob, error) {
+	row := SQLDB.QueryRow("SELECT "+blobColumns+" FROM blobs WHERE business_id = ? AND sha256 = ?", businessID, sha)
+	return scanBlob(row)
+}
+
+// UploadsOfBlob lists the uploads of a business that share a blob
+func UploadsOfBlob(businessID int, sha string) ([]string, error) {
+	return queryStrings("SELECT id FROM uploads WHERE business_id = ? AND blob_sha256 = ?", businessID, sha)
+}
+
+func queryBlobs(query string, args ...interface{}) ([]Blob, error) {
+	rows, err := SQLDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []Blob
+	for rows.Next() {
+		b, err := scanBlob(rows)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, *b)
+	}
+	return blobs, rows.Err()
+}
+
+// UnreferencedBlobs lists blobs that have had no references since before
+// the cutoff
+func UnreferencedBlobs(cutoff time.Time, limit int) ([]Blob, error) {
+	return queryBlobs(`SELECT `+blobColumns+` FROM blobs
+		WHERE refs <= 0 AND unreferenced_at IS NOT NULL AND unreferenced_at < ?
+		LIMIT ?`, cutoff.UTC().Format(time.RFC3339), limit)
+}
+
+// IdleBlobs lists referenced blobs in a tier that have not been read since
+// the cutoff, least recently used first. Blobs of pinned uploads are left
+// out.
+func IdleBlobs(tier string, cutoff time.Time, limit int) ([]Blob, error) {
+	return queryBlobs(`SELECT `+blobColumns+` FROM blobs
+		WHERE tier = ? AND refs > 0 AND COALESCE(last_accessed_at, created_at) < ?
+		AND NOT EXISTS (SELECT 1 FROM upload_pins p WHERE p.business_id = blobs.business_id
+			AND p.blob_sha256 = blobs.sha256 AND p.pinned_until > ?)
+		ORDER BY COALESCE(last_accessed_at, created_at) LIMIT ?`,
+		tier, cutoff.UTC().Format("2006-01-02 15:04:05"), time.Now().UTC().Format("2006-01-02 15:04:05"), limit)
+}
+
+// SetBlobPlacement records that a blob moved from one tier to another, into
+// the given root directory of the tier, and how it is stored there. It
+// reports false if the blob was no longer in the expected tier. Moving a
+// blob to another tier ends any restore of it.
+func SetBlobPlacement(businessID int, sha, fromTier, toTier, root string, storedSize int64, compressed, encrypted bool, keyID string) (bool, error) {
+	res, err := SQLDB.Exec(`UPDATE blobs SET tier = ?, root = ?, stored_size = ?, compressed = ?, encrypted = ?, key_id = ?,
+		restore_status = CASE WHEN tier = ? THEN restore_status ELSE '' END,
+		restored_until = CASE WHEN tier = ? THEN restored_until ELSE NULL END,
+		restore_root = CASE WHEN tier = ? THEN restore_root ELSE '' END
+		WHERE business_id = ? AND sha256 = ? AND tier = ?`,
+		toTier, root, storedSize, compressed, encrypted, keyID, toTier, toTier, toTier, businessID, sha, fromTier)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// TouchBlob records a read of a blob
+func TouchBlob(businessID int, sha string) error {
+	_, err := SQLDB.Exec(`UPDATE blobs SET access_count = access_count + 1, last_accessed_at = ?
+		WHERE business_id = ? AND sha256 = ?`,
+		time.Now().UTC().Format("2006-01-02 15:04:05"), businessID, sha)
+	return err
+}
+
+// DeleteBlobIfUnreferenced removes a blob row only if nothing references it
+// anymore. It reports whether the row was removed.
+func DeleteBlobIfUnreferenced(businessID int, sha string) (bool, error) {
+	res, err := SQLDB.Exec("DELETE FROM blobs WHERE business_id = ? AND sha256 = ? AND refs <= 0", businessID, sha)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
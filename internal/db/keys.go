@@ -0,0 +1,60 @@
+package db
+
+import "time"
+
+// BusinessKey is a business data key wrapped by a master key
+type BusinessKey struct {
+	BusinessID  int
+	WrappedKey  []byte
+	MasterKeyID string
+}
+
+// GetBusinessKey fetches the wrapped data key of a business, or sql.ErrNoRows
+func GetBusinessKey(businessID int) (*BusinessKey, error) {
+	k := &BusinessKey{}
+	row := SQLDB.QueryRow("SELECT business_id, wrapped_key, master_key_id FROM business_keys WHERE business_id = ?", businessID)
+	if err := row.Scan(&k.BusinessID, &k.WrappedKey, &k.MasterKeyID); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// CreateBusinessKey stores a wrapped data key unless the business already
+// has one, and returns whichever key is stored afterwards
+func CreateBusinessKey(k *BusinessKey) (*BusinessKey, error) {
+	_, err := SQLDB.Exec(`INSERT INTO business_keys (business_id, wrapped_key, master_key_id) VALUES (?, ?, ?)
+		ON CONFLICT (business_id) DO NOTHING`, k.BusinessID, k.WrappedKey, k.MasterKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return GetBusinessKey(k.BusinessID)
+}
+
+// BusinessKeysNotWrappedWith lists data keys wrapped by any master key other
+// than the given one
+func BusinessKeysNotWrappedWith(masterKeyID string) ([]BusinessKey, error) {
+	rows, err := SQLDB.Query("SELECT business_id, wrapped_key, master_key_id FROM business_keys WHERE master_key_id != ?", masterKeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []BusinessKey
+	for rows.Next() {
+		var k BusinessKey
+		if err := rows.Scan(&k.BusinessID, &k.WrappedKey, &k.MasterKeyID); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RewrapBusinessKey replaces a wrapped data key, provided it is still wrapped
+// by the master key it was read with
+func RewrapBusinessKey(businessID int, oldMasterKeyID string, wrapped []byte, masterKeyID string) error {
+	_, err := SQLDB.Exec(`UPDATE business_keys SET wrapped_key = ?, master_key_id = ?, rotated_at = ?
+		WHERE business_id = ? AND master_key_id = ?`,
+		wrapped, masterKeyID, time.Now().UTC().Format(time.RFC3339), businessID, oldMasterKeyID)
+	return err
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Lifecycle rule actions
+const (
+	LifecycleDelete     = "delete"
+	LifecycleTransition = "transition"
+)
+
+// LifecycleRule deletes or moves to another tier the uploads of a business
+// that match all of its filters. Empty filters match everything, but every
+// rule has an age or idle time.
+type LifecycleRule struct {
+	ID         int64
+	BusinessID int
+	Name       string
+	Action     string
+	TargetTier string
+
+	// Tags all have to be set on an upload with the same values; an empty
+	// value only requires the tag to be present
+	Tags     map[string]string
+	Username string
+	// ContentType is either exact, ignoring parameters, or a "type/*" prefix
+	ContentType string
+	// AgeDays counts from the upload, IdleDays from the last read of its data
+	AgeDays  int
+	IdleDays int
+
+	Enabled   bool
+	CreatedAt time.Time
+}
+
+// LifecycleCandidate is an upload a lifecycle rule applies to
+type LifecycleCandidate struct {
+	Upload         UploadRecord
+	Tier           string
+	LastAccessedAt time.Time
+}
+
+const lifecycleColumns = `id, business_id, name, action, target_tier, tags, username, content_type,
+	age_days, idle_days, enabled, created_at`
+
+func scanLifecycleRule(row interface{ Scan(...interface{}) error }) (*LifecycleRule, error) {
+	r := &LifecycleRule{}
+	var tags, created string
+	err := row.Scan(&r.ID, &r.BusinessID, &r.Name, &r.Action, &r.TargetTier, &tags, &r.Username, &r.ContentType,
+		&r.AgeDays, &r.IdleDays, &r.Enabled, &created)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(tags), &r.Tags); err != nil {
+		return nil, err
+	}
+	r.CreatedAt = parseTime(created)
+	return r, nil
+}
+
+func queryLifecycleRules(query string, args ...interface{}) ([]LifecycleRule, error) {
+	rows, err := SQLDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []LifecycleRule
+	for rows.Next() {
+		r, err := scanLifecycleRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, *r)
+	}
+	return rules, rows.Err()
+}
+
+// CreateLifecycleRule stores a new rule and sets its ID
+func CreateLifecycleRule(r *LifecycleRule) error {
+	tags, err := json.Marshal(r.Tags)
+	if err != nil {
+		return err
+	}
+	r.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	res, err := SQLDB.Exec(`INSERT INTO lifecycle_rules (business_id, name, action, target_tier, tags, username,
+		content_type, age_days, idle_days, enabled, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.BusinessID, r.Name, r.Action, r.TargetTier, string(tags), r.Username, r.ContentType,
+		r.AgeDays, r.IdleDays, r.Enabled, r.CreatedAt.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	r.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetLifecycleRule fetches a rule of a business, or sql.ErrNoRows
+func GetLifecycleRule(businessID int, id int64) (*LifecycleRule, error) {
+	row := SQLDB.QueryRow("SELECT "+lifecycleColumns+" FROM lifecycle_rules WHERE business_id = ? AND id = ?", businessID, id)
+	return scanLifecycleRule(row)
+}
+
+// ListLifecycleRules lists the rules of a business
+func ListLifecycleRules(businessID int) ([]LifecycleRule, error) {
+	return queryLifecycleRules("SELECT "+lifecycleColumns+" FROM lifecycle_rules WHERE business_id = ? ORDER BY id", businessID)
+}
+
+// EnabledLifecycleRules lists the enabled rules of every business
+func EnabledLifecycleRules() ([]LifecycleRule, error) {
+	return queryLifecycleRules("SELECT " + lifecycleColumns + " FROM lifecycle_rules WHERE enabled = 1 ORDER BY id")
+}
+
+// SetLifecycleRuleEnabled enables or disables a rule of a business
+func SetLifecycleRuleEnabled(businessID int, id int64, enabled bool) error {
+	res, err := SQLDB.Exec("UPDATE lifecycle_rules SET enabled = ? WHERE business_id = ? AND id = ?", enabled, businessID, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteLifecycleRule removes a rule of a business
+func DeleteLifecycleRule(businessID int, id int64) error {
+	res, err := SQLDB.Exec("DELETE FROM lifecycle_rules WHERE business_id = ? AND id = ?", businessID, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// LifecycleCandidates lists up to limit uploads a rule applies to at now,
+// oldest first. Uploads already in a transition rule's target tier are left
+// out, as are uploads sharing a blob with a pinned upload.
+func LifecycleCandidates(r *LifecycleRule, now time.Time, limit int) ([]LifecycleCandidate, error) {
+	return lifecycleCandidates(r, now, "", limit)
+}
+
+// LifecycleRuleMatches reports whether a rule still applies to an upload
+func LifecycleRuleMatches(r *LifecycleRule, uploadID string, now time.Time) (bool, error) {
+	found, err := lifecycleCandidates(r, now, uploadID, 1)
+	return len(found) > 0, err
+}
+
+func lifecycleCandidates(r *LifecycleRule, now time.Time, uploadID string, limit int) ([]LifecycleCandidate, error) {
+	query := `SELECT u.id, u.business_id, u.username, u.filename, u.content_type, u.size, u.blob_sha256, u.created_at,
+		b.tier, COALESCE(b.last_accessed_at, b.created_at)
+		FROM uploads u JOIN blobs b ON b.business_id = u.business_id AND b.sha256 = u.blob_sha256
+		WHERE u.business_id = ?`
+	args := []interface{}{r.BusinessID}
+
+	if uploadID != "" {
+		query += " AND u.id = ?"
+		args = append(args, uploadID)
+	}
+	if r.Username != "" {
+		query += " AND u.username = ?"
+		args = append(args, r.Username)
+	}
+	if prefix, ok := strings.CutSuffix(r.ContentType, "*"); ok {
+		query += ` AND u.content_type LIKE ? ESCAPE '\'`
+		args = append(args, escapeLike(prefix)+"%")
+	} else if r.ContentType != "" {
+		query += ` AND (u.content_type = ? OR u.content_type LIKE ? ESCAPE '\')`
+		args = append(args, r.ContentType, escapeLike(r.ContentType)+";%")
+	}
+	conditions, tagArgs := tagConditions(r.Tags)
+	query += conditions
+	args = append(args, tagArgs...)
+	if r.AgeDays > 0 {
+		query += " AND u.created_at <= ?"
+		args = append(args, now.AddDate(0, 0, -r.AgeDays).UTC().Format(time.RFC3339))
+	}
+	if r.IdleDays > 0 {
+		query += " AND COALESCE(b.last_accessed_at, b.created_at) <= ?"
+		args = append(args, now.AddDate(0, 0, -r.IdleDays).UTC().Format("2006-01-02 15:04:05"))
+	}
+	if r.Action == LifecycleTransition {
+		query += " AND b.tier != ?"
+		args = append(args, r.TargetTier)
+		// pins keep blobs in the CDN tier
+		query += ` AND NOT EXISTS (SELECT 1 FROM upload_pins p WHERE p.business_id = b.business_id
+			AND p.blob_sha256 = b.sha256 AND p.pinned_until > ?)`
+		args = append(args, now.UTC().Format("2006-01-02 15:04:05"))
+	}
+	query += " ORDER BY u.created_at LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := SQLDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []LifecycleCandidate
+	for rows.Next() {
+		var c LifecycleCandidate
+		var created, accessed string
+		u := &c.Upload
+		err := rows.Scan(&u.ID, &u.BusinessID, &u.Username, &u.Filename, &u.ContentType, &u.Size, &u.BlobSHA256, &created,
+			&c.Tier, &accessed)
+		if err != nil {
+			return nil, err
+		}
+		u.CreatedAt = parseTime(created)
+		c.LastAccessedAt = parseTime(accessed)
+		found = append(found, c)
+	}
+	return found, rows.Err()
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,74 @@
+package db
+
+// MeteredUsage is what a business used of one tier in a month. Byte hours
+// are stored bytes times the hours they were kept; logical byte hours count
+// the original size of compressed blobs instead.
+type MeteredUsage struct {
+	BusinessID       int
+	Month            string
+	Tier             string
+	ByteHours        float64
+	LogicalByteHours float64
+	Requests         int64
+	EgressBytes      int64
+}
+
+// RecordRequest meters one read from a tier and the bytes it sent
+func RecordRequest(businessID int, month, tier string, egress int64) error {
+	_, err := SQLDB.Exec(`INSERT INTO usage_monthly (business_id, month, tier, requests, egress_bytes) VALUES (?, ?, ?, 1, ?)
+		ON CONFLICT (business_id, month, tier) DO UPDATE SET requests = requests + 1,
+		egress_bytes = egress_bytes + excluded.egress_bytes`,
+		businessID, month, tier, egress)
+	return err
+}
+
+// AccrueStorage meters what every business keeps in each tier for a number
+// of hours. Restored copies of archived blobs are kept in the S3 tier.
+func AccrueStorage(month string, hours float64) error {
+	tx, err := SQLDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO usage_monthly (business_id, month, tier, byte_hours, logical_byte_hours)
+		SELECT business_id, ?, tier, SUM(stored_size) * ?, SUM(size) * ? FROM blobs
+		WHERE refs > 0 GROUP BY business_id, tier
+		ON CONFLICT (business_id, month, tier) DO UPDATE SET byte_hours = byte_hours + excluded.byte_hours,
+		logical_byte_hours = logical_byte_hours + excluded.logical_byte_hours`,
+		month, hours, hours)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO usage_monthly (business_id, month, tier, byte_hours)
+		SELECT business_id, ?, 's3', SUM(size) * ? FROM blobs
+		WHERE restore_root != '' GROUP BY business_id
+		ON CONFLICT (business_id, month, tier) DO UPDATE SET byte_hours = byte_hours + excluded.byte_hours`,
+		month, hours)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MonthlyUsage lists the metered usage of a business from one month to
+// another, both included, by month and tier
+func MonthlyUsage(businessID int, from, to string) ([]MeteredUsage, error) {
+	rows, err := SQLDB.Query(`SELECT business_id, month, tier, byte_hours, logical_byte_hours, requests, egress_bytes
+		FROM usage_monthly WHERE business_id = ? AND month >= ? AND month <= ? ORDER BY month, tier`,
+		businessID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []MeteredUsage
+	for rows.Next() {
+		var u MeteredUsage
+		if err := rows.Scan(&u.BusinessID, &u.Month, &u.Tier, &u.ByteHours, &u.LogicalByteHours, &u.Requests, &u.EgressBytes); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
@@ -0,0 +1,242 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ObjectVersion is one version of a logical path in a business namespace,
+// backed by the upload holding its data. Versions are numbered from 1 and
+// never change once written; the object's current version is what a plain
+// read of the path returns.
+type ObjectVersion struct {
+	BusinessID  int
+	Path        string
+	Version     int
+	UploadID    string
+	Size        int64
+	ContentType string
+	ETag        string
+	UserMeta    string
+	Current     bool
+	CreatedAt   time.Time
+}
+
+const objectVersionColumns = `v.business_id, v.path, v.version, v.upload_id, u.size, u.content_type, v.etag, v.user_meta,
+	v.version = o.current_version, v.created_at`
+
+const objectVersionJoin = ` FROM object_versions v
+	JOIN objects o ON o.business_id = v.business_id AND o.path = v.path
+	JOIN uploads u ON u.id = v.upload_id`
+
+func scanObjectVersion(row interface{ Scan(...interface{}) error }) (*ObjectVersion, error) {
+	v := &ObjectVersion{}
+	var created string
+	if err := row.Scan(&v.BusinessID, &v.Path, &v.Version, &v.UploadID, &v.Size, &v.ContentType, &v.ETag, &v.UserMeta,
+		&v.Current, &created); err != nil {
+		return nil, err
+	}
+	v.CreatedAt = parseTime(created)
+	return v, nil
+}
+
+func queryObjectVersions(query string, args ...interface{}) ([]ObjectVersion, error) {
+	rows, err := SQLDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []ObjectVersion{}
+	for rows.Next() {
+		v, err := scanObjectVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *v)
+	}
+	return versions, rows.Err()
+}
+
+// AddObjectVersion stores a finished upload as the next version of a path
+// and makes it current. It fills in and returns the version number. Numbers
+// come from a counter on the path that only goes up, so a number is never
+// given out again, even once its version is removed.
+func AddObjectVersion(v *ObjectVersion) (int, error) {
+	tx, err := SQLDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if v.UserMeta == "" {
+		v.UserMeta = "{}"
+	}
+	// taking the number writes first, so the transaction holds the write
+	// lock before it reads, rather than upgrading a read lock another
+	// writer holds
+	_, err = tx.Exec(`INSERT INTO objects (business_id, path, current_version, next_version) VALUES (?, ?, 0, 2)
+		ON CONFLICT (business_id, path) DO UPDATE SET next_version = next_version + 1`,
+		v.BusinessID, v.Path)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow("SELECT next_version - 1 FROM objects WHERE business_id = ? AND path = ?", v.BusinessID, v.Path).Scan(&v.Version)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`INSERT INTO object_versions (business_id, path, version, upload_id, etag, user_meta, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		v.BusinessID, v.Path, v.Version, v.UploadID, v.ETag, v.UserMeta, v.CreatedAt.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE objects SET current_version = ? WHERE business_id = ? AND path = ?", v.Version, v.BusinessID, v.Path)
+	if err != nil {
+		return 0, err
+	}
+	v.Current = true
+	return v.Version, tx.Commit()
+}
+
+// GetObjectVersion fetches a version of a path, the current one when
+// version is 0, or sql.ErrNoRows
+func GetObjectVersion(businessID int, path string, version int) (*ObjectVersion, error) {
+	query := "SELECT " + objectVersionColumns + objectVersionJoin + " WHERE v.business_id = ? AND v.path = ? AND "
+	if version == 0 {
+		return scanObjectVersion(SQLDB.QueryRow(query+"v.version = o.current_version", businessID, path))
+	}
+	return scanObjectVersion(SQLDB.QueryRow(query+"v.version = ?", businessID, path, version))
+}
+
+// GetObjectVersionByUpload fetches the version an upload backs, or
+// sql.ErrNoRows
+func GetObjectVersionByUpload(uploadID string) (*ObjectVersion, error) {
+	return scanObjectVersion(SQLDB.QueryRow("SELECT "+objectVersionColumns+objectVersionJoin+" WHERE v.upload_id = ?", uploadID))
+}
+
+// ListObjectVersions returns every version of a path, newest first
+func ListObjectVersions(businessID int, path string) ([]ObjectVersion, error) {
+	return queryObjectVersions("SELECT "+objectVersionColumns+objectVersionJoin+`
+		WHERE v.business_id = ? AND v.path = ? ORDER BY v.version DESC`, businessID, path)
+}
+
+// SetCurrentVersion makes an existing version of a path current, or returns
+// sql.ErrNoRows
+func SetCurrentVersion(businessID int, path string, version int) error {
+	res, err := SQLDB.Exec(`UPDATE objects SET current_version = ? WHERE business_id = ? AND path = ?
+		AND EXISTS (SELECT 1 FROM object_versions WHERE business_id = ? AND path = ? AND version = ?)`,
+		version, businessID, path, businessID, path, version)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AddDeleteMarker hides a path behind a delete marker: its versions are
+// kept, but it has no current version until one is restored or a new one is
+// added. It returns sql.ErrNoRows if the path does not exist.
+func AddDeleteMarker(businessID int, path string) error {
+	res, err := SQLDB.Exec("UPDATE objects SET current_version = 0 WHERE business_id = ? AND path = ?", businessID, path)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RemoveObjectVersion drops the version an upload backs. If it was current,
+// the newest remaining version becomes current; a path behind a delete
+// marker stays hidden, and a path left with no versions is hidden too but
+// keeps its counter.
+func RemoveObjectVersion(uploadID string) error {
+	tx, err := SQLDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var businessID int
+	var path string
+	err = tx.QueryRow("SELECT business_id, path FROM object_versions WHERE upload_id = ?", uploadID).Scan(&businessID, &path)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM object_versions WHERE upload_id = ?", uploadID); err != nil {
+		return err
+	}
+
+	var latest sql.NullInt64
+	err = tx.QueryRow("SELECT MAX(version) FROM object_versions WHERE business_id = ? AND path = ?", businessID, path).Scan(&latest)
+	if err != nil {
+		return err
+	}
+	if latest.Valid {
+		_, err = tx.Exec(`UPDATE objects SET current_version = ? WHERE business_id = ? AND path = ?
+			AND current_version != 0 AND current_version NOT IN (SELECT version FROM object_versions WHERE business_id = ? AND path = ?)`,
+			latest.Int64, businessID, path, businessID, path)
+	} else {
+		_, err = tx.Exec("UPDATE objects SET current_version = 0 WHERE business_id = ? AND path = ?", businessID, path)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListObjects walks the current versions of a business's paths in lexical
+// order, starting after the given path and restricted to the prefix, until
+// fn returns false
+func ListObjects(businessID int, prefix, after string, fn func(*ObjectVersion) bool) error {
+	rows, err := SQLDB.Query("SELECT "+objectVersionColumns+objectVersionJoin+`
+		WHERE v.business_id = ? AND v.version = o.current_version AND v.path > ? AND instr(v.path, ?) = 1
+		ORDER BY v.path`, businessID, after, prefix)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		v, err := scanObjectVersion(rows)
+		if err != nil {
+			return err
+		}
+		if !fn(v) {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+// UploadsUnderPrefix lists the uploads behind every version of the paths of
+// a business starting with prefix
+func UploadsUnderPrefix(businessID int, prefix string) ([]string, error) {
+	return queryStrings("SELECT upload_id FROM object_versions WHERE business_id = ? AND instr(path, ?) = 1",
+		businessID, prefix)
+}
+
+func queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := SQLDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
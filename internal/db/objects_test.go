@@ -0,0 +1,153 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func openTestDB(t *testing.T) {
+	t.Helper()
+	if err := OpenSQLite(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SQLDB.Close() })
+}
+
+// addVersion records an upload and adds it as the next version of a path
+func addVersion(t *testing.T, path, uploadID string) int {
+	t.Helper()
+	_, err := SQLDB.Exec("INSERT INTO uploads (id, business_id, size, blob_sha256) VALUES (?, 1, 1, '')", uploadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := AddObjectVersion(&ObjectVersion{BusinessID: 1, Path: path, UploadID: uploadID, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func currentVersion(t *testing.T, path string) int {
+	t.Helper()
+	v, err := GetObjectVersion(1, path, 0)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return v.Version
+}
+
+func TestVersionsAreNumberedPerPath(t *testing.T) {
+	openTestDB(t)
+	for i, want := range []int{1, 2, 3} {
+		if got := addVersion(t, "a.txt", fmt.Sprintf("a%d", i)); got != want {
+			t.Errorf("version %d of a.txt numbered %d", want, got)
+		}
+	}
+	if got := addVersion(t, "b.txt", "b0"); got != 1 {
+		t.Errorf("first version of b.txt numbered %d", got)
+	}
+	if got := currentVersion(t, "a.txt"); got != 3 {
+		t.Errorf("current version of a.txt is %d, want 3", got)
+	}
+
+	// removing the current version makes the newest remaining one current,
+	// and its number is not given out again
+	if err := RemoveObjectVersion("a2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentVersion(t, "a.txt"); got != 2 {
+		t.Errorf("current version after removing 3 is %d, want 2", got)
+	}
+	if got := addVersion(t, "a.txt", "a3"); got != 4 {
+		t.Errorf("version after removing the newest numbered %d, want 4", got)
+	}
+
+	// nor once every version of the path is gone
+	for _, id := range []string{"a0", "a1", "a3"} {
+		if err := RemoveObjectVersion(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := currentVersion(t, "a.txt"); got != 0 {
+		t.Errorf("path without versions reads version %d", got)
+	}
+	if got := addVersion(t, "a.txt", "a4"); got != 5 {
+		t.Errorf("version of an emptied path numbered %d, want 5", got)
+	}
+}
+
+func TestDeleteMarkerHidesPathUntilNextVersion(t *testing.T) {
+	openTestDB(t)
+	addVersion(t, "a.txt", "a0")
+	addVersion(t, "a.txt", "a1")
+
+	if err := AddDeleteMarker(1, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentVersion(t, "a.txt"); got != 0 {
+		t.Errorf("path behind a delete marker reads version %d", got)
+	}
+	if versions, _ := ListObjectVersions(1, "a.txt"); len(versions) != 2 {
+		t.Errorf("delete marker left %d versions, want 2", len(versions))
+	}
+	// removing an old version does not bring the path back
+	if err := RemoveObjectVersion("a0"); err != nil {
+		t.Fatal(err)
+	}
+	if got := currentVersion(t, "a.txt"); got != 0 {
+		t.Errorf("path came back as version %d when an old version was removed", got)
+	}
+	if got := addVersion(t, "a.txt", "a2"); got != 3 || currentVersion(t, "a.txt") != 3 {
+		t.Errorf("version added after a delete marker numbered %d", got)
+	}
+	if err := AddDeleteMarker(1, "missing.txt"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("delete marker on a missing path: %v", err)
+	}
+}
+
+func TestConcurrentVersionsGetDistinctNumbers(t *testing.T) {
+	openTestDB(t)
+	const writers = 10
+	for i := 0; i < writers; i++ {
+		_, err := SQLDB.Exec("INSERT INTO uploads (id, business_id, size, blob_sha256) VALUES (?, 1, 1, '')", fmt.Sprintf("u%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	versions := make([]int, writers)
+	errs := make([]error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			versions[i], errs[i] = AddObjectVersion(&ObjectVersion{
+				BusinessID: 1, Path: "a.txt", UploadID: fmt.Sprintf("u%d", i), CreatedAt: time.Now(),
+			})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("writer %d: %v", i, err)
+		}
+	}
+	sort.Ints(versions)
+	for i, v := range versions {
+		if v != i+1 {
+			t.Fatalf("concurrent versions numbered %v", versions)
+		}
+	}
+	if got := currentVersion(t, "a.txt"); got < 1 || got > writers {
+		t.Errorf("current version is %d", got)
+	}
+}
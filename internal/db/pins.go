@@ -0,0 +1,104 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Pin keeps the blob of an upload in the CDN tier until it expires
+type Pin struct {
+	UploadID    string
+	BusinessID  int
+	BlobSHA256  string
+	Size        int64
+	PinnedUntil time.Time
+	CreatedAt   time.Time
+}
+
+// PinUploads pins uploads, replacing the expiry of those already pinned
+func PinUploads(pins []Pin) error {
+	tx, err := SQLDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, p := range pins {
+		_, err := tx.Exec(`INSERT INTO upload_pins (upload_id, business_id, blob_sha256, size, pinned_until, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (upload_id) DO UPDATE SET pinned_until = excluded.pinned_until`,
+			p.UploadID, p.BusinessID, p.BlobSHA256, p.Size, p.PinnedUntil.UTC().Format("2006-01-02 15:04:05"), now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ActivePins lists the pins of a business that have not expired, soonest
+// expiring first
+func ActivePins(businessID int) ([]Pin, error) {
+	rows, err := SQLDB.Query(`SELECT upload_id, business_id, blob_sha256, size, pinned_until, created_at
+		FROM upload_pins WHERE business_id = ? AND pinned_until > ? ORDER BY pinned_until`,
+		businessID, time.Now().UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pins []Pin
+	for rows.Next() {
+		var p Pin
+		var until, created string
+		if err := rows.Scan(&p.UploadID, &p.BusinessID, &p.BlobSHA256, &p.Size, &until, &created); err != nil {
+			return nil, err
+		}
+		p.PinnedUntil = parseTime(until)
+		p.CreatedAt = parseTime(created)
+		pins = append(pins, p)
+	}
+	return pins, rows.Err()
+}
+
+// Unpin removes the pin of an upload of a business, or returns
+// sql.ErrNoRows
+func Unpin(businessID int, uploadID string) error {
+	res, err := SQLDB.Exec("DELETE FROM upload_pins WHERE business_id = ? AND upload_id = ?", businessID, uploadID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteExpiredPins removes pins that expired before the cutoff
+func DeleteExpiredPins(cutoff time.Time) (int64, error) {
+	res, err := SQLDB.Exec("DELETE FROM upload_pins WHERE pinned_until <= ?", cutoff.UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetPinQuota returns the pin quota set for a business, zero if none is set
+func GetPinQuota(businessID int) (int64, error) {
+	var quota int64
+	err := SQLDB.QueryRow("SELECT pin_bytes FROM business_quotas WHERE business_id = ?", businessID).Scan(&quota)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return quota, err
+}
+
+// SetPinQuota sets the pin quota of a business; zero falls back to the
+// configured default
+func SetPinQuota(businessID int, quota int64) error {
+	_, err := SQLDB.Exec(`INSERT INTO business_quotas (business_id, pin_bytes, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (business_id) DO UPDATE SET pin_bytes = excluded.pin_bytes, updated_at = excluded.updated_at`,
+		businessID, quota, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
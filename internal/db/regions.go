@@ -0,0 +1,55 @@
+package db
+
+import "time"
+
+// RegionViolation records an attempt to move a business's data out of its
+// region, which was refused
+type RegionViolation struct {
+	ID           int64
+	BusinessID   int
+	Region       string
+	TargetRegion string
+	Action       string
+	Detail       string
+	CreatedAt    time.Time
+}
+
+// AssignDefaultRegion puts businesses and storage roots registered before
+// there were regions in region
+func AssignDefaultRegion(region string) error {
+	if _, err := SQLDB.Exec("UPDATE business SET region = ? WHERE region = ''", region); err != nil {
+		return err
+	}
+	_, err := SQLDB.Exec("UPDATE storage_roots SET region = ? WHERE region = ''", region)
+	return err
+}
+
+// CreateRegionViolation stores a refused cross-region move
+func CreateRegionViolation(v *RegionViolation) error {
+	_, err := SQLDB.Exec(`INSERT INTO region_violations (business_id, region, target_region, action, detail, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		v.BusinessID, v.Region, v.TargetRegion, v.Action, v.Detail, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// ListRegionViolations returns the most recent refused cross-region moves
+func ListRegionViolations(limit int) ([]RegionViolation, error) {
+	rows, err := SQLDB.Query(`SELECT id, business_id, region, target_region, action, detail, created_at
+		FROM region_violations ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	violations := []RegionViolation{}
+	for rows.Next() {
+		var v RegionViolation
+		var created string
+		if err := rows.Scan(&v.ID, &v.BusinessID, &v.Region, &v.TargetRegion, &v.Action, &v.Detail, &created); err != nil {
+			return nil, err
+		}
+		v.CreatedAt = parseTime(created)
+		violations = append(violations, v)
+	}
+	return violations, rows.Err()
+}
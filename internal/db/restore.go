@@ -0,0 +1,31 @@
+package db
+
+import "time"
+
+// SetBlobRestore records the restore state of an archived blob; root is
+// the directory holding its restored copy and until is when that copy
+// expires, both ignored for other states
+func SetBlobRestore(businessID int, sha, status, root string, until time.Time) error {
+	var restoredUntil interface{}
+	if !until.IsZero() {
+		restoredUntil = until.UTC().Format("2006-01-02 15:04:05")
+	}
+	_, err := SQLDB.Exec("UPDATE blobs SET restore_status = ?, restore_root = ?, restored_until = ? WHERE business_id = ? AND sha256 = ?",
+		status, root, restoredUntil, businessID, sha)
+	return err
+}
+
+// ExpiredRestores lists blobs in a tier whose restored copies expired
+// before the cutoff
+func ExpiredRestores(tier, status string, cutoff time.Time, limit int) ([]Blob, error) {
+	return queryBlobs(`SELECT `+blobColumns+` FROM blobs
+		WHERE tier = ? AND restore_status = ? AND restored_until < ? LIMIT ?`,
+		tier, status, cutoff.UTC().Format("2006-01-02 15:04:05"), limit)
+}
+
+// ResetRestores clears every restore left in a status, such as restores
+// that were in progress when the server stopped
+func ResetRestores(status string) error {
+	_, err := SQLDB.Exec("UPDATE blobs SET restore_status = '', restore_root = '', restored_until = NULL WHERE restore_status = ?", status)
+	return err
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// StorageRoot is a directory, usually a mount point, that holds part of a
+// storage tier in a region
+type StorageRoot struct {
+	ID        int
+	Region    string
+	Tier      string
+	Path      string
+	State     string
+	CreatedAt time.Time
+}
+
+// RootUsage is what the blobs of a root take up
+type RootUsage struct {
+	Blobs          int64
+	StoredBytes    int64
+	RestoredCopies int64
+}
+
+const rootColumns = "id, region, tier, path, state, created_at"
+
+func scanStorageRoot(row interface{ Scan(...interface{}) error }) (*StorageRoot, error) {
+	r := &StorageRoot{}
+	var created string
+	if err := row.Scan(&r.ID, &r.Region, &r.Tier, &r.Path, &r.State, &created); err != nil {
+		return nil, err
+	}
+	r.CreatedAt = parseTime(created)
+	return r, nil
+}
+
+// AddStorageRoot registers a root of a tier of a region in the given state.
+// A root that is already registered keeps its state and region and is
+// returned as it is.
+func AddStorageRoot(region, tier, path, state string) (*StorageRoot, bool, error) {
+	res, err := SQLDB.Exec(`INSERT INTO storage_roots (region, tier, path, state) VALUES (?, ?, ?, ?)
+		ON CONFLICT (tier, path) DO NOTHING`, region, tier, path, state)
+	if err != nil {
+		return nil, false, err
+	}
+	added, _ := res.RowsAffected()
+	r, err := GetStorageRootByPath(tier, path)
+	return r, added > 0, err
+}
+
+// GetStorageRoot fetches a root by ID, or sql.ErrNoRows
+func GetStorageRoot(id int) (*StorageRoot, error) {
+	return scanStorageRoot(SQLDB.QueryRow("SELECT "+rootColumns+" FROM storage_roots WHERE id = ?", id))
+}
+
+// GetStorageRootByPath fetches the root of a tier at path, or sql.ErrNoRows
+func GetStorageRootByPath(tier, path string) (*StorageRoot, error) {
+	return scanStorageRoot(SQLDB.QueryRow("SELECT "+rootColumns+" FROM storage_roots WHERE tier = ? AND path = ?", tier, path))
+}
+
+// ListStorageRoots lists the roots of a tier in a region, oldest first. An
+// empty region or tier matches every region or tier.
+func ListStorageRoots(region, tier string) ([]StorageRoot, error) {
+	rows, err := SQLDB.Query(`SELECT `+rootColumns+` FROM storage_roots
+		WHERE (? = '' OR region = ?) AND (? = '' OR tier = ?) ORDER BY id`, region, region, tier, tier)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roots []StorageRoot
+	for rows.Next() {
+		r, err := scanStorageRoot(rows)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, *r)
+	}
+	return roots, rows.Err()
+}
+
+// SetStorageRootState changes the state of a root. It reports false if the
+// root was no longer in the expected state.
+func SetStorageRootState(id int, from, to string) (bool, error) {
+	res, err := SQLDB.Exec("UPDATE storage_roots SET state = ? WHERE id = ? AND state = ?", to, id, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteStorageRoot forgets a root, or returns sql.ErrNoRows
+func DeleteStorageRoot(id int) error {
+	res, err := SQLDB.Exec("DELETE FROM storage_roots WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AssignBlobRoots records root as the directory of the blobs of a tier
+// stored before the tier had several roots, and of their restored copies
+func AssignBlobRoots(tier, root string) error {
+	if _, err := SQLDB.Exec("UPDATE blobs SET root = ? WHERE tier = ? AND root = ''", root, tier); err != nil {
+		return err
+	}
+	_, err := SQLDB.Exec(`UPDATE blobs SET restore_root = ?
+		WHERE restore_status != '' AND restore_root = '' AND ? = 's3'`, root, tier)
+	return err
+}
+
+// StorageRootUsage returns how many blobs and restored copies a root holds
+func StorageRootUsage(tier, root string) (*RootUsage, error) {
+	u := &RootUsage{}
+	err := SQLDB.QueryRow("SELECT COUNT(*), COALESCE(SUM(stored_size), 0) FROM blobs WHERE tier = ? AND root = ?",
+		tier, root).Scan(&u.Blobs, &u.StoredBytes)
+	if err != nil {
+		return nil, err
+	}
+	if tier == "s3" {
+		err = SQLDB.QueryRow("SELECT COUNT(*) FROM blobs WHERE restore_status != '' AND restore_root = ?",
+			root).Scan(&u.RestoredCopies)
+	}
+	return u, err
+}
+
+// BlobsInTier lists the blobs of a tier, only those in root unless it is
+// empty, after the given business and SHA-256 in that order, for walking a
+// tier in pages
+func BlobsInTier(tier, root string, afterBusiness int, afterSHA string, limit int) ([]Blob, error) {
+	return queryBlobs(`SELECT `+blobColumns+` FROM blobs
+		WHERE tier = ? AND (? = '' OR root = ?) AND (business_id > ? OR (business_id = ? AND sha256 > ?))
+		ORDER BY business_id, sha256 LIMIT ?`, tier, root, root, afterBusiness, afterBusiness, afterSHA, limit)
+}
+
+// RestoredCopiesOnRoot lists blobs whose restored copies are kept in root
+func RestoredCopiesOnRoot(root string, limit int) ([]Blob, error) {
+	return queryBlobs(`SELECT `+blobColumns+` FROM blobs
+		WHERE restore_status != '' AND restore_root = ? LIMIT ?`, root, limit)
+}
+
+// SetBlobRoot records that a blob moved to another root of its tier. It
+// reports false if the blob was no longer in the expected tier and root.
+func SetBlobRoot(businessID int, sha, tier, fromRoot, toRoot string) (bool, error) {
+	res, err := SQLDB.Exec("UPDATE blobs SET root = ? WHERE business_id = ? AND sha256 = ? AND tier = ? AND root = ?",
+		toRoot, businessID, sha, tier, fromRoot)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetBlobRestoreRoot records that the restored copy of a blob moved to
+// another root. It reports false if the copy was no longer in fromRoot.
+func SetBlobRestoreRoot(businessID int, sha, fromRoot, toRoot string) (bool, error) {
+	res, err := SQLDB.Exec(`UPDATE blobs SET restore_root = ?
+		WHERE business_id = ? AND sha256 = ? AND restore_status != '' AND restore_root = ?`,
+		toRoot, businessID, sha, fromRoot)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
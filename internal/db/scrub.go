@@ -0,0 +1,79 @@
+package db
+
+import "time"
+
+// ScrubFinding records a blob the scrubber found damaged
+type ScrubFinding struct {
+	ID         int64
+	BusinessID int
+	SHA256     string
+	Tier       string
+	Outcome    string
+	Detail     string
+	CreatedAt  time.Time
+}
+
+// BlobsToVerify lists referenced blobs not verified since the cutoff, those
+// never verified first
+func BlobsToVerify(cutoff time.Time, limit int) ([]Blob, error) {
+	return queryBlobs(`SELECT `+blobColumns+` FROM blobs
+		WHERE refs > 0 AND (verified_at IS NULL OR verified_at < ?)
+		ORDER BY COALESCE(verified_at, '') LIMIT ?`,
+		cutoff.UTC().Format("2006-01-02 15:04:05"), limit)
+}
+
+// MarkBlobVerified records that a blob read back intact
+func MarkBlobVerified(businessID int, sha string) error {
+	_, err := SQLDB.Exec("UPDATE blobs SET verified_at = ?, corrupt = 0 WHERE business_id = ? AND sha256 = ?",
+		time.Now().UTC().Format("2006-01-02 15:04:05"), businessID, sha)
+	return err
+}
+
+// MarkBlobCorrupt flags a blob that failed verification
+func MarkBlobCorrupt(businessID int, sha string) error {
+	_, err := SQLDB.Exec("UPDATE blobs SET verified_at = ?, corrupt = 1 WHERE business_id = ? AND sha256 = ?",
+		time.Now().UTC().Format("2006-01-02 15:04:05"), businessID, sha)
+	return err
+}
+
+// CorruptBlobs lists blobs currently flagged corrupt
+func CorruptBlobs(limit int) ([]Blob, error) {
+	return queryBlobs("SELECT "+blobColumns+" FROM blobs WHERE corrupt = 1 LIMIT ?", limit)
+}
+
+// CountCorruptBlobs returns how many blobs are flagged corrupt
+func CountCorruptBlobs() (int, error) {
+	var n int
+	err := SQLDB.QueryRow("SELECT COUNT(*) FROM blobs WHERE corrupt = 1").Scan(&n)
+	return n, err
+}
+
+// CreateScrubFinding stores a scrubber finding
+func CreateScrubFinding(f *ScrubFinding) error {
+	_, err := SQLDB.Exec(`INSERT INTO scrub_findings (business_id, sha256, tier, outcome, detail, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		f.BusinessID, f.SHA256, f.Tier, f.Outcome, f.Detail, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// ListScrubFindings returns the most recent scrubber findings
+func ListScrubFindings(limit int) ([]ScrubFinding, error) {
+	rows, err := SQLDB.Query(`SELECT id, business_id, sha256, tier, outcome, detail, created_at
+		FROM scrub_findings ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	findings := []ScrubFinding{}
+	for rows.Next() {
+		var f ScrubFinding
+		var created string
+		if err := rows.Scan(&f.ID, &f.BusinessID, &f.SHA256, &f.Tier, &f.Outcome, &f.Detail, &created); err != nil {
+			return nil, err
+		}
+		f.CreatedAt = parseTime(created)
+		findings = append(findings, f)
+	}
+	return findings, rows.Err()
+}
@@ -2,21 +2,21 @@ package db
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 var SQLDB *sql.DB
 
-func InitSQLite() {
-	var err error
-	SQLDB, err = sql.Open("sqlite3", "./mediapipeline.db")
-	if err != nil {
-		log.Fatalf("Failed to open SQLite DB: %v", err)
-	}
-
-	createTable := `
+// schema lists the tables created at startup, in dependency order
+var schema = []struct {
+	name string
+	ddl  string
+}{
+	{"business", `
 	CREATE TABLE IF NOT EXISTS business (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		name TEXT NOT NULL,
@@ -24,11 +24,207 @@ func InitSQLite() {
 		api_key TEXT NOT NULL UNIQUE,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
-	`
-	if _, err := SQLDB.Exec(createTable); err != nil {
-		log.Fatalf("Failed to create business table: %v", err)
-	}
+	`},
+	{"objects", `
+	CREATE TABLE IF NOT EXISTS objects (
+		business_id INTEGER NOT NULL,
+		path TEXT NOT NULL,
+		current_version INTEGER NOT NULL,
+		next_version INTEGER NOT NULL DEFAULT 1,
+		PRIMARY KEY (business_id, path)
+	);
+	`},
+	{"object_versions", `
+	CREATE TABLE IF NOT EXISTS object_versions (
+		business_id INTEGER NOT NULL,
+		path TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		upload_id TEXT NOT NULL UNIQUE,
+		etag TEXT NOT NULL DEFAULT '',
+		user_meta TEXT NOT NULL DEFAULT '{}',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (business_id, path, version)
+	);
+	`},
+	{"blobs", `
+	CREATE TABLE IF NOT EXISTS blobs (
+		business_id INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		refs INTEGER NOT NULL DEFAULT 0,
+		tier TEXT NOT NULL DEFAULT 'cdn',
+		root TEXT NOT NULL DEFAULT '',
+		content_type TEXT NOT NULL DEFAULT '',
+		stored_size INTEGER NOT NULL DEFAULT 0,
+		compressed INTEGER NOT NULL DEFAULT 0,
+		encrypted INTEGER NOT NULL DEFAULT 0,
+		key_id TEXT NOT NULL DEFAULT '',
+		access_count INTEGER NOT NULL DEFAULT 0,
+		last_accessed_at DATETIME,
+		verified_at DATETIME,
+		corrupt INTEGER NOT NULL DEFAULT 0,
+		restore_status TEXT NOT NULL DEFAULT '',
+		restored_until DATETIME,
+		restore_root TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		unreferenced_at DATETIME,
+		PRIMARY KEY (business_id, sha256)
+	);
+	`},
+	{"uploads", `
+	CREATE TABLE IF NOT EXISTS uploads (
+		id TEXT PRIMARY KEY,
+		business_id INTEGER NOT NULL,
+		username TEXT NOT NULL DEFAULT '',
+		filename TEXT NOT NULL DEFAULT '',
+		content_type TEXT NOT NULL DEFAULT '',
+		size INTEGER NOT NULL,
+		blob_sha256 TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`},
+	{"business_keys", `
+	CREATE TABLE IF NOT EXISTS business_keys (
+		business_id INTEGER PRIMARY KEY,
+		wrapped_key BLOB NOT NULL,
+		master_key_id TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		rotated_at DATETIME
+	);
+	`},
+	{"business_quotas", `
+	CREATE TABLE IF NOT EXISTS business_quotas (
+		business_id INTEGER PRIMARY KEY,
+		soft_bytes INTEGER NOT NULL DEFAULT 0,
+		hard_bytes INTEGER NOT NULL DEFAULT 0,
+		pin_bytes INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`},
+	{"upload_tags", `
+	CREATE TABLE IF NOT EXISTS upload_tags (
+		upload_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (upload_id, key)
+	);
+	`},
+	{"lifecycle_rules", `
+	CREATE TABLE IF NOT EXISTS lifecycle_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		business_id INTEGER NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		action TEXT NOT NULL,
+		target_tier TEXT NOT NULL DEFAULT '',
+		tags TEXT NOT NULL DEFAULT '{}',
+		username TEXT NOT NULL DEFAULT '',
+		content_type TEXT NOT NULL DEFAULT '',
+		age_days INTEGER NOT NULL DEFAULT 0,
+		idle_days INTEGER NOT NULL DEFAULT 0,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`},
+	{"upload_pins", `
+	CREATE TABLE IF NOT EXISTS upload_pins (
+		upload_id TEXT PRIMARY KEY,
+		business_id INTEGER NOT NULL,
+		blob_sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		pinned_until DATETIME NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`},
+	{"storage_roots", `
+	CREATE TABLE IF NOT EXISTS storage_roots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tier TEXT NOT NULL,
+		path TEXT NOT NULL,
+		state TEXT NOT NULL DEFAULT 'active',
+		region TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (tier, path)
+	);
+	`},
+	{"usage_monthly", `
+	CREATE TABLE IF NOT EXISTS usage_monthly (
+		business_id INTEGER NOT NULL,
+		month TEXT NOT NULL,
+		tier TEXT NOT NULL,
+		byte_hours REAL NOT NULL DEFAULT 0,
+		logical_byte_hours REAL NOT NULL DEFAULT 0,
+		requests INTEGER NOT NULL DEFAULT 0,
+		egress_bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (business_id, month, tier)
+	);
+	`},
+	{"region_violations", `
+	CREATE TABLE IF NOT EXISTS region_violations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		business_id INTEGER NOT NULL,
+		region TEXT NOT NULL,
+		target_region TEXT NOT NULL,
+		action TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`},
+	{"scrub_findings", `
+	CREATE TABLE IF NOT EXISTS scrub_findings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		business_id INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		tier TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`},
+	{"upload_settings", `
+	CREATE TABLE IF NOT EXISTS upload_settings (
+		business_id INTEGER PRIMARY KEY,
+		expire_seconds INTEGER NOT NULL DEFAULT 0,
+		max_bytes INTEGER NOT NULL DEFAULT 0,
+		allowed_types TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`},
+}
 
-	log.Println("SQLite initialized and business table ready")
+// columns added to tables that existed before the schema list
+var columns = []struct {
+	table  string
+	column string
+}{
+	{"business", "region TEXT NOT NULL DEFAULT ''"},
 }
 
+func InitSQLite() {
+	if err := OpenSQLite("./mediapipeline.db"); err != nil {
+		log.Fatalf("Failed to open SQLite DB: %v", err)
+	}
+	log.Println("SQLite initialized and tables ready")
+}
+
+// OpenSQLite opens the database file at path as SQLDB and brings its schema
+// up to date
+func OpenSQLite(path string) error {
+	var err error
+	SQLDB, err = sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return err
+	}
+
+	for _, table := range schema {
+		if _, err := SQLDB.Exec(table.ddl); err != nil {
+			return fmt.Errorf("create %s table: %w", table.name, err)
+		}
+	}
+	for _, col := range columns {
+		_, err := SQLDB.Exec("ALTER TABLE " + col.table + " ADD COLUMN " + col.column)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return fmt.Errorf("add column to %s table: %w", col.table, err)
+		}
+	}
+	return nil
+}
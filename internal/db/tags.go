@@ -0,0 +1,64 @@
+package db
+
+// SetUploadTags replaces the tags of an upload
+func SetUploadTags(uploadID string, tags map[string]string) error {
+	tx, err := SQLDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM upload_tags WHERE upload_id = ?", uploadID); err != nil {
+		return err
+	}
+	for key, value := range tags {
+		if _, err := tx.Exec("INSERT INTO upload_tags (upload_id, key, value) VALUES (?, ?, ?)", uploadID, key, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetUploadTags returns the tags of an upload
+func GetUploadTags(uploadID string) (map[string]string, error) {
+	rows, err := SQLDB.Query("SELECT key, value FROM upload_tags WHERE upload_id = ?", uploadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		tags[key] = value
+	}
+	return tags, rows.Err()
+}
+
+// UploadsWithTags lists the uploads of a business carrying all of the tags;
+// an empty value only requires the tag to be present
+func UploadsWithTags(businessID int, tags map[string]string) ([]string, error) {
+	conditions, args := tagConditions(tags)
+	return queryStrings("SELECT id FROM uploads u WHERE business_id = ?"+conditions,
+		append([]interface{}{businessID}, args...)...)
+}
+
+// tagConditions builds the conditions requiring an upload aliased u to
+// carry all of the tags
+func tagConditions(tags map[string]string) (string, []interface{}) {
+	var conditions string
+	var args []interface{}
+	for key, value := range tags {
+		if value == "" {
+			conditions += " AND EXISTS (SELECT 1 FROM upload_tags t WHERE t.upload_id = u.id AND t.key = ?)"
+			args = append(args, key)
+		} else {
+			conditions += " AND EXISTS (SELECT 1 FROM upload_tags t WHERE t.upload_id = u.id AND t.key = ? AND t.value = ?)"
+			args = append(args, key, value)
+		}
+	}
+	return conditions, args
+}
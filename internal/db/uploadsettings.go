@@ -0,0 +1,64 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// GetUploadExpiry returns how long unfinished uploads of a business may sit
+// idle before they expire, zero if the business has no expiry of its own
+func GetUploadExpiry(businessID int) (time.Duration, error) {
+	var seconds int64
+	err := SQLDB.QueryRow("SELECT expire_seconds FROM upload_settings WHERE business_id = ?", businessID).Scan(&seconds)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return time.Duration(seconds) * time.Second, err
+}
+
+// SetUploadExpiry sets the upload expiry of a business; zero falls back to
+// the configured default
+func SetUploadExpiry(businessID int, expiry time.Duration) error {
+	_, err := SQLDB.Exec(`INSERT INTO upload_settings (business_id, expire_seconds, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (business_id) DO UPDATE SET expire_seconds = excluded.expire_seconds, updated_at = excluded.updated_at`,
+		businessID, int64(expiry/time.Second), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// UploadConstraints limit the uploads a business accepts
+type UploadConstraints struct {
+	// MaxBytes is the largest upload allowed, zero for any size
+	MaxBytes int64
+	// AllowedTypes are MIME types such as video/mp4, or video/* for all of a
+	// type. Empty allows any type.
+	AllowedTypes []string
+}
+
+// GetUploadConstraints returns the upload constraints of a business, none
+// if it has not set any
+func GetUploadConstraints(businessID int) (*UploadConstraints, error) {
+	c := &UploadConstraints{}
+	var types string
+	err := SQLDB.QueryRow("SELECT max_bytes, allowed_types FROM upload_settings WHERE business_id = ?", businessID).
+		Scan(&c.MaxBytes, &types)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if types != "" {
+		c.AllowedTypes = strings.Split(types, ",")
+	}
+	return c, nil
+}
+
+// SetUploadConstraints replaces the upload constraints of a business
+func SetUploadConstraints(businessID int, c *UploadConstraints) error {
+	_, err := SQLDB.Exec(`INSERT INTO upload_settings (business_id, max_bytes, allowed_types, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (business_id) DO UPDATE SET max_bytes = excluded.max_bytes, allowed_types = excluded.allowed_types,
+		updated_at = excluded.updated_at`,
+		businessID, c.MaxBytes, strings.Join(c.AllowedTypes, ","), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// TierUsage is what a business keeps in one storage tier
+type TierUsage struct {
+	Blobs       int64
+	StoredBytes int64
+}
+
+// Usage is what a business stores: its objects and their logical size, and
+// the deduplicated blobs behind them by tier
+type Usage struct {
+	Objects int64
+	Bytes   int64
+	Tiers   map[string]TierUsage
+}
+
+// GetUsage adds up what a business stores
+func GetUsage(businessID int) (*Usage, error) {
+	u := &Usage{Tiers: make(map[string]TierUsage)}
+	err := SQLDB.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM uploads WHERE business_id = ?", businessID).
+		Scan(&u.Objects, &u.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := SQLDB.Query(`SELECT tier, COUNT(*), COALESCE(SUM(stored_size), 0) FROM blobs
+		WHERE business_id = ? AND refs > 0 GROUP BY tier`, businessID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tier string
+		var t TierUsage
+		if err := rows.Scan(&tier, &t.Blobs, &t.StoredBytes); err != nil {
+			return nil, err
+		}
+		u.Tiers[tier] = t
+	}
+	return u, rows.Err()
+}
+
+// GetBusinessQuota returns the quotas set for a business, zero where none is
+// set
+func GetBusinessQuota(businessID int) (soft, hard int64, err error) {
+	err = SQLDB.QueryRow("SELECT soft_bytes, hard_bytes FROM business_quotas WHERE business_id = ?", businessID).
+		Scan(&soft, &hard)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, nil
+	}
+	return soft, hard, err
+}
+
+// SetBusinessQuota sets the quotas of a business; zero falls back to the
+// configured default
+func SetBusinessQuota(businessID int, soft, hard int64) error {
+	_, err := SQLDB.Exec(`INSERT INTO business_quotas (business_id, soft_bytes, hard_bytes, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (business_id) DO UPDATE SET soft_bytes = excluded.soft_bytes, hard_bytes = excluded.hard_bytes,
+		updated_at = excluded.updated_at`,
+		businessID, soft, hard, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+)
+
+// Storage tiers, hottest first. Finished uploads land in the CDN tier and
+// are demoted as they go unread.
+const (
+	TierCDN = "cdn"
+	TierS3  = "s3"
+	TierR2  = "r2"
+)
+
+// stripes serialise ingest and garbage collection of the same blob
+var stripes [64]sync.Mutex
+
+func lockBlob(sha string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(sha))
+	m := &stripes[h.Sum32()%uint32(len(stripes))]
+	m.Lock()
+	return m.Unlock
+}
+
+// Init prepares the blob store under the storage paths of every region and
+// loads the master keys used for encryption at rest. Each path is a list of
+// root directories, separated like PATH.
+func Init(cfg *config.Config) error {
+	defaultRegion, instanceRegion = cfg.Storage.DefaultRegion, cfg.Storage.InstanceRegion
+	regions = map[string]config.RegionPaths{
+		defaultRegion: {CDNPath: cfg.Storage.CDNPath, S3Path: cfg.Storage.S3Path, R2Path: cfg.Storage.R2Path},
+	}
+	for name, paths := range cfg.Storage.Regions {
+		if name != defaultRegion {
+			regions[name] = paths
+		}
+	}
+	businessRegions = sync.Map{}
+	if !ValidRegion(instanceRegion) {
+		return fmt.Errorf("instance region %q: %w", instanceRegion, ErrUnknownRegion)
+	}
+	if err := db.AssignDefaultRegion(defaultRegion); err != nil {
+		return fmt.Errorf("assign default region: %w", err)
+	}
+
+	configured = map[string][]string{}
+	for _, region := range Regions() {
+		paths := regions[region]
+		for _, tier := range []struct{ name, list string }{
+			{TierCDN, paths.CDNPath}, {TierS3, paths.S3Path}, {TierR2, paths.R2Path},
+		} {
+			roots := rootPaths(tier.list)
+			if err := registerRoots(region, tier.name, roots); err != nil {
+				return fmt.Errorf("create %s tier of region %s: %w", tier.name, region, err)
+			}
+			configured[tier.name] = append(configured[tier.name], roots...)
+		}
+	}
+	configureHotCache(cfg.Storage.HotCacheBytes, cfg.Storage.HotCacheObjectBytes)
+	return initKeyring(cfg.Encryption, cfg.Environment)
+}
+
+func rootPaths(list string) []string {
+	var paths []string
+	for _, p := range filepath.SplitList(list) {
+		if p != "" {
+			paths = append(paths, filepath.Clean(p))
+		}
+	}
+	return paths
+}
+
+// BlobPath returns where the blob of a business with the given SHA-256 lives
+// under a storage root
+func BlobPath(root string, businessID int, sha string) string {
+	return filepath.Join(root, strconv.Itoa(businessID), sha[:2], sha)
+}
+
+// storedPath returns where a blob is stored
+func storedPath(b *db.Blob) string {
+	return BlobPath(b.Root, b.BusinessID, b.SHA256)
+}
+
+// blobFormat is how the content of a blob file is encoded. It is recorded
+// in the blob row and never guessed from the file.
+type blobFormat struct {
+	encrypted  bool
+	keyID      string
+	compressed bool
+}
+
+// storedFormat is the format of the file a blob is stored in
+func storedFormat(b *db.Blob) blobFormat {
+	return blobFormat{encrypted: b.Encrypted, keyID: b.KeyID, compressed: b.Compressed}
+}
+
+// newFormat is the format new files of a business's blobs are written in:
+// encrypted with its data key when encryption at rest is enabled
+func newFormat(businessID int, compressed bool) (blobFormat, error) {
+	f := blobFormat{compressed: compressed}
+	if !EncryptionEnabled() {
+		return f, nil
+	}
+	key, err := dataKey(businessID)
+	if err != nil {
+		return f, err
+	}
+	f.encrypted, f.keyID = true, dataKeyID(key)
+	return f, nil
+}
+
+// HashFile returns the hex SHA-256 of a file and its size
+func HashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// Ingest moves the data of a finished upload into the blob store and records
+// the upload against its blob. If the business already stores identical
+// content the source file is dropped and the existing blob gains a
+// reference, unless the stored copy is damaged or gone, which the source
+// then replaces.
+// A SHA-256 already in rec, computed while the data came in, saves reading
+// the file to hash it.
+func Ingest(src string, rec *db.UploadRecord) error {
+	if rec.BlobSHA256 == "" {
+		sha, size, err := HashFile(src)
+		if err != nil {
+			return err
+		}
+		rec.BlobSHA256, rec.Size = sha, size
+	} else {
+		stat, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		rec.Size = stat.Size()
+	}
+	sha := rec.BlobSHA256
+
+	unlock := lockBlob(sha)
+	defer unlock()
+
+	placed := &db.Blob{Tier: TierCDN, ContentType: rec.ContentType}
+	existing, err := db.GetBlob(rec.BusinessID, sha)
+	switch {
+	case err == nil && healthy(existing):
+		os.Remove(src)
+	case err == nil || errors.Is(err, sql.ErrNoRows):
+		// a new blob, or one whose stored file is damaged or gone, which the
+		// fresh copy replaces
+		if existing != nil {
+			if _, err := quarantineBlob(existing); err != nil {
+				return err
+			}
+		}
+		if placed.Root, err = placeRoot(TierCDN, rec.BusinessID, sha); err != nil {
+			return err
+		}
+		dst := BlobPath(placed.Root, rec.BusinessID, sha)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		format, err := placeBlob(src, dst, rec.BusinessID)
+		if err != nil {
+			return err
+		}
+		placed.Encrypted, placed.KeyID = format.encrypted, format.keyID
+		stat, err := os.Stat(dst)
+		if err != nil {
+			return err
+		}
+		placed.StoredSize = stat.Size()
+		if existing != nil {
+			if err := replaceBlob(existing, placed); err != nil {
+				return err
+			}
+			log.Printf("Upload %s repaired blob %s of business %d", rec.ID, sha, rec.BusinessID)
+		}
+	default:
+		return err
+	}
+
+	refs, err := db.CreateUploadRecord(rec, placed)
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		log.Printf("Upload %s deduplicated onto blob %s (%d references)", rec.ID, sha, refs)
+	}
+	return nil
+}
+
+// healthy reports whether a blob's stored file can still be served: it is
+// not flagged corrupt and has not gone missing
+func healthy(b *db.Blob) bool {
+	if b.Corrupt {
+		return false
+	}
+	_, err := os.Stat(storedPath(b))
+	return !os.IsNotExist(err)
+}
+
+// replaceBlob points a blob whose stored file is damaged or gone at a fresh
+// copy placed in the CDN tier, and clears its corrupt flag. The caller holds
+// the blob lock.
+func replaceBlob(b, placed *db.Blob) error {
+	if _, err := db.SetBlobPlacement(b.BusinessID, b.SHA256, b.Tier, placed.Tier, placed.Root, placed.StoredSize,
+		false, placed.Encrypted, placed.KeyID); err != nil {
+		return err
+	}
+	if err := db.MarkBlobVerified(b.BusinessID, b.SHA256); err != nil {
+		return err
+	}
+	Evict(b.BusinessID, b.SHA256)
+	if b.Tier == TierR2 {
+		if b.RestoreRoot != "" {
+			os.Remove(restoredPath(b))
+		}
+		setUploadStates(b.BusinessID, b.SHA256, uploadstate.Completed)
+	}
+	return nil
+}
+
+// placeBlob stores src as the blob at dst, encrypted with the business data
+// key when encryption at rest is enabled, and returns its format
+func placeBlob(src, dst string, businessID int) (blobFormat, error) {
+	format, err := newFormat(businessID, false)
+	if err != nil {
+		return format, err
+	}
+	if !format.encrypted {
+		return format, moveFile(src, dst)
+	}
+	key, err := dataKey(businessID)
+	if err != nil {
+		return format, err
+	}
+	if err := encryptFile(src, dst, key); err != nil {
+		return format, err
+	}
+	return format, os.Remove(src)
+}
+
+// Open returns a seekable reader over the original content of a blob,
+// wherever it is stored. Encrypted blobs are decrypted chunk by chunk and
+// compressed ones inflated frame by frame as they are read. Archived blobs
+// return ErrArchived unless they have been restored.
+func Open(businessID int, sha string) (io.ReadSeekCloser, error) {
+	b, err := db.GetBlob(businessID, sha)
+	if err != nil {
+		return nil, err
+	}
+	switch state, _ := RestoreState(b); state {
+	case RestoreRestored:
+		return openFile(restoredPath(b), businessID, restoredFormat(b))
+	case RestoreArchived, RestoreInProgress:
+		return nil, ErrArchived
+	}
+	if b.Tier == TierCDN && cache.cacheable(b.Size) && cachedHere(businessID) {
+		return openCached(businessID, sha, func() (io.ReadSeekCloser, error) { return openStored(b) })
+	}
+	return openStored(b)
+}
+
+func openStored(b *db.Blob) (io.ReadSeekCloser, error) {
+	return openFile(storedPath(b), b.BusinessID, storedFormat(b))
+}
+
+func openFile(path string, businessID int, format blobFormat) (io.ReadSeekCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var r io.ReadSeekCloser = f
+	if format.encrypted {
+		key, err := blobKey(businessID, format.keyID)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if r, err = newDecryptingReader(f, key); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if format.compressed {
+		z, err := newInflatingReader(r, r)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return z, nil
+	}
+	return r, nil
+}
+
+// Release drops the reference an upload holds on its blob. The blob itself
+// is reclaimed by the garbage collector once nothing references it.
+func Release(uploadID string) (*db.UploadRecord, error) {
+	return db.DeleteUploadRecord(uploadID)
+}
+
+// CollectGarbage deletes blobs that have been unreferenced for longer than
+// the grace period and returns how many were reclaimed
+func CollectGarbage(grace time.Duration) (int, error) {
+	blobs, err := db.UnreferencedBlobs(time.Now().Add(-grace), 500)
+	if err != nil {
+		return 0, err
+	}
+
+	reclaimed := 0
+	for _, b := range blobs {
+		unlock := lockBlob(b.SHA256)
+		removed, err := db.DeleteBlobIfUnreferenced(b.BusinessID, b.SHA256)
+		if err == nil && removed {
+			if err := os.Remove(storedPath(&b)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to remove blob %s: %v", b.SHA256, err)
+			}
+			if b.Tier == TierR2 && b.RestoreRoot != "" {
+				os.Remove(restoredPath(&b))
+			}
+			Evict(b.BusinessID, b.SHA256)
+			reclaimed++
+		}
+		unlock()
+	}
+	return reclaimed, nil
+}
+
+// RunGC periodically reclaims unreferenced blobs
+func RunGC(interval, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := CollectGarbage(grace)
+		if err != nil {
+			log.Printf("Blob garbage collection failed: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Blob garbage collection reclaimed %d blobs", n)
+		}
+	}
+}
+
+// moveFile renames src to dst, copying when they sit on different devices
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
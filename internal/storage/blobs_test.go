@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestStore sets up the blob store on a fresh database and temporary
+// tier roots, encrypting blobs when enc has a master key, and registers a
+// business to store blobs for
+func newTestStore(t *testing.T, enc config.EncryptionConfig) *db.Business {
+	t.Helper()
+	dir := t.TempDir()
+	if err := db.OpenSQLite(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.SQLDB.Close() })
+
+	mr := miniredis.RunT(t)
+	db.RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.RDB.Close() })
+
+	cfg := &config.Config{
+		Environment: "test",
+		Storage: config.StorageConfig{
+			CDNPath:        filepath.Join(dir, "cdn"),
+			S3Path:         filepath.Join(dir, "s3"),
+			R2Path:         filepath.Join(dir, "r2"),
+			DefaultRegion:  "default",
+			InstanceRegion: "default",
+		},
+		Encryption: enc,
+	}
+	if err := Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	business, err := db.CreateBusiness("test", "test@example.com", "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return business
+}
+
+// ingestContent stores content as a finished upload with the given ID
+func ingestContent(t *testing.T, business *db.Business, id, content string) *db.UploadRecord {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), id)
+	if err := os.WriteFile(src, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rec := &db.UploadRecord{ID: id, BusinessID: business.ID, ContentType: "text/plain", CreatedAt: time.Now()}
+	if err := Ingest(src, rec); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source of upload %s was left behind", id)
+	}
+	return rec
+}
+
+func readBlob(t *testing.T, businessID int, sha string) string {
+	t.Helper()
+	r, err := Open(businessID, sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// unreferenceSince backdates when a blob lost its last reference
+func unreferenceSince(t *testing.T, business *db.Business, sha string, ago time.Duration) {
+	t.Helper()
+	_, err := db.SQLDB.Exec("UPDATE blobs SET unreferenced_at = ? WHERE business_id = ? AND sha256 = ? AND refs <= 0",
+		time.Now().Add(-ago).UTC().Format(time.RFC3339), business.ID, sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdenticalUploadsShareBlob(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	a := ingestContent(t, business, "a", "same content")
+	b := ingestContent(t, business, "b", "same content")
+	c := ingestContent(t, business, "c", "other content")
+
+	if a.BlobSHA256 != b.BlobSHA256 || a.BlobSHA256 == c.BlobSHA256 {
+		t.Fatalf("blobs: a=%s b=%s c=%s", a.BlobSHA256, b.BlobSHA256, c.BlobSHA256)
+	}
+	blob, err := db.GetBlob(business.ID, a.BlobSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blob.Refs != 2 || blob.Size != int64(len("same content")) {
+		t.Errorf("shared blob has %d references and %d bytes, want 2 and %d", blob.Refs, blob.Size, len("same content"))
+	}
+	if got := readBlob(t, business.ID, a.BlobSHA256); got != "same content" {
+		t.Errorf("shared blob reads %q", got)
+	}
+}
+
+func TestGarbageCollectorKeepsReferencedBlobs(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	a := ingestContent(t, business, "a", "shared")
+	ingestContent(t, business, "b", "shared")
+	blob, _ := db.GetBlob(business.ID, a.BlobSHA256)
+	path := storedPath(blob)
+
+	// dropping one of two references leaves the blob alone
+	if _, err := Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := CollectGarbage(0); err != nil || n != 0 {
+		t.Fatalf("CollectGarbage = %d, %v with a reference left", n, err)
+	}
+	if got := readBlob(t, business.ID, a.BlobSHA256); got != "shared" {
+		t.Errorf("blob reads %q after one reference was dropped", got)
+	}
+
+	// the last one makes it garbage, but only after the grace period
+	if _, err := Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	unreferenceSince(t, business, a.BlobSHA256, 30*time.Minute)
+	if n, err := CollectGarbage(time.Hour); err != nil || n != 0 {
+		t.Fatalf("CollectGarbage = %d, %v within the grace period", n, err)
+	}
+	unreferenceSince(t, business, a.BlobSHA256, 2*time.Hour)
+	if n, err := CollectGarbage(time.Hour); err != nil || n != 1 {
+		t.Fatalf("CollectGarbage = %d, %v after the grace period, want 1", n, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("blob file still exists after collection: %v", err)
+	}
+	if _, err := db.GetBlob(business.ID, a.BlobSHA256); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("blob row still exists after collection: %v", err)
+	}
+}
+
+func TestReingestRevivesUnreferencedBlob(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	a := ingestContent(t, business, "a", "comes back")
+	if _, err := Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	unreferenceSince(t, business, a.BlobSHA256, 2*time.Hour)
+
+	ingestContent(t, business, "b", "comes back")
+	if n, err := CollectGarbage(time.Hour); err != nil || n != 0 {
+		t.Fatalf("CollectGarbage = %d, %v on a blob referenced again", n, err)
+	}
+	blob, err := db.GetBlob(business.ID, a.BlobSHA256)
+	if err != nil || blob.Refs != 1 {
+		t.Fatalf("revived blob: %+v, %v", blob, err)
+	}
+	if got := readBlob(t, business.ID, a.BlobSHA256); got != "comes back" {
+		t.Errorf("revived blob reads %q", got)
+	}
+}
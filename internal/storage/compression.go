@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// Compressed blobs use a seekable framed format: the plaintext is cut into
+// fixed-size frames that are deflated independently, followed by an index of
+// frame offsets, so a Range read only inflates the frames it touches.
+//
+//	header:  magic(8) | frame size(4) | reserved(4) | original size(8)
+//	frames:  raw deflate streams
+//	index:   offset(8) of each frame, relative to the start of the stream
+//	trailer: index offset(8) | magic(8)
+const (
+	zMagic      = "MPZSEEK1"
+	zHeaderSize = 24
+	zFrameSize  = 256 << 10
+)
+
+var errCorruptCompression = errors.New("compressed blob is corrupt")
+
+// compressible reports whether content of this type is worth compressing
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		return true
+	case mediaType == "application/csv", mediaType == "image/svg+xml":
+		return true
+	case mediaType == "application/xml", strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	return false
+}
+
+// compressTo writes size bytes from src to w in the framed format and
+// returns the number of bytes written
+func compressTo(w io.Writer, src io.Reader, size int64) (int64, error) {
+	var header [zHeaderSize]byte
+	copy(header[:8], zMagic)
+	binary.BigEndian.PutUint32(header[8:12], zFrameSize)
+	binary.BigEndian.PutUint64(header[16:24], uint64(size))
+	if _, err := w.Write(header[:]); err != nil {
+		return 0, err
+	}
+
+	written := int64(zHeaderSize)
+	var offsets []int64
+	var frame bytes.Buffer
+	fw, _ := flate.NewWriter(&frame, flate.BestCompression)
+	buf := make([]byte, zFrameSize)
+	for remaining := size; remaining > 0; {
+		n := int64(zFrameSize)
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := io.ReadFull(src, buf[:n]); err != nil {
+			return written, err
+		}
+		frame.Reset()
+		fw.Reset(&frame)
+		fw.Write(buf[:n])
+		if err := fw.Close(); err != nil {
+			return written, err
+		}
+		offsets = append(offsets, written)
+		if _, err := w.Write(frame.Bytes()); err != nil {
+			return written, err
+		}
+		written += int64(frame.Len())
+		remaining -= n
+	}
+
+	index := make([]byte, 8*len(offsets)+16)
+	for i, off := range offsets {
+		binary.BigEndian.PutUint64(index[8*i:], uint64(off))
+	}
+	binary.BigEndian.PutUint64(index[8*len(offsets):], uint64(written))
+	copy(index[8*len(offsets)+8:], zMagic)
+	if _, err := w.Write(index); err != nil {
+		return written, err
+	}
+	return written + int64(len(index)), nil
+}
+
+// inflatingReader exposes the original content of a compressed stream as a
+// seekable stream, inflating one frame at a time
+type inflatingReader struct {
+	src       io.ReadSeeker
+	closer    io.Closer
+	frameSize int64
+	size      int64
+	offsets   []int64
+	end       int64
+	pos       int64
+	index     int64
+	frame     []byte
+}
+
+func newInflatingReader(src io.ReadSeeker, closer io.Closer) (*inflatingReader, error) {
+	var header [zHeaderSize]byte
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(src, header[:]); err != nil || string(header[:8]) != zMagic {
+		return nil, errCorruptCompression
+	}
+	r := &inflatingReader{
+		src:       src,
+		closer:    closer,
+		frameSize: int64(binary.BigEndian.Uint32(header[8:12])),
+		size:      int64(binary.BigEndian.Uint64(header[16:24])),
+		index:     -1,
+	}
+	if r.frameSize <= 0 || r.size < 0 {
+		return nil, errCorruptCompression
+	}
+
+	var trailer [16]byte
+	total, err := src.Seek(-16, io.SeekEnd)
+	if err != nil {
+		return nil, errCorruptCompression
+	}
+	if _, err := io.ReadFull(src, trailer[:]); err != nil || string(trailer[8:]) != zMagic {
+		return nil, errCorruptCompression
+	}
+	r.end = int64(binary.BigEndian.Uint64(trailer[:8]))
+	frames := (r.size + r.frameSize - 1) / r.frameSize
+	if r.end < zHeaderSize || total-r.end != 8*frames {
+		return nil, errCorruptCompression
+	}
+
+	index := make([]byte, 8*frames)
+	if _, err := src.Seek(r.end, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(src, index); err != nil {
+		return nil, errCorruptCompression
+	}
+	r.offsets = make([]int64, frames)
+	for i := range r.offsets {
+		r.offsets[i] = int64(binary.BigEndian.Uint64(index[8*i:]))
+	}
+	return r, nil
+}
+
+// Size is the original length
+func (r *inflatingReader) Size() int64 {
+	return r.size
+}
+
+func (r *inflatingReader) load(index int64) error {
+	if index == r.index {
+		return nil
+	}
+	start, stop := r.offsets[index], r.end
+	if index+1 < int64(len(r.offsets)) {
+		stop = r.offsets[index+1]
+	}
+	if stop < start {
+		return errCorruptCompression
+	}
+	compressed := make([]byte, stop-start)
+	if _, err := r.src.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r.src, compressed); err != nil {
+		return err
+	}
+
+	want := r.frameSize
+	if rest := r.size - index*r.frameSize; rest < want {
+		want = rest
+	}
+	frame, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), want+1))
+	if err != nil || int64(len(frame)) != want {
+		return fmt.Errorf("%w: frame %d", errCorruptCompression, index)
+	}
+	r.frame, r.index = frame, index
+	return nil
+}
+
+func (r *inflatingReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / r.frameSize
+	if err := r.load(index); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.frame[r.pos-index*r.frameSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *inflatingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *inflatingReader) Close() error {
+	return r.closer.Close()
+}
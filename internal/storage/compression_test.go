@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+)
+
+// compressibleContent is text spanning several compression frames
+func compressibleContent() string {
+	var sb strings.Builder
+	for i := 0; sb.Len() < 3*zFrameSize+1234; i++ {
+		sb.WriteString("record ")
+		sb.WriteString(strconv.Itoa(i))
+		sb.WriteString(": the same words over and over\n")
+	}
+	return sb.String()
+}
+
+func testSeekCompressed(t *testing.T, enc config.EncryptionConfig) {
+	business := newTestStore(t, enc)
+	content := compressibleContent()
+	rec := ingestContent(t, business, "a", content)
+
+	if err := Transition(business.ID, rec.BlobSHA256, TierR2); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := db.GetBlob(business.ID, rec.BlobSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blob.Compressed || blob.StoredSize >= blob.Size {
+		t.Fatalf("cold blob compressed=%v with %d of %d bytes stored", blob.Compressed, blob.StoredSize, blob.Size)
+	}
+	if blob.Encrypted != (enc.MasterKey != "") {
+		t.Errorf("cold blob encrypted=%v", blob.Encrypted)
+	}
+
+	r, err := openStored(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	size := int64(len(content))
+	for _, seek := range []struct {
+		offset int64
+		whence int
+		pos    int64
+	}{
+		{zFrameSize - 7, io.SeekStart, zFrameSize - 7},
+		{2*zFrameSize + 3, io.SeekStart, 2*zFrameSize + 3},
+		{-100, io.SeekCurrent, 2*zFrameSize + 3 + 40 - 100},
+		{-40, io.SeekEnd, size - 40},
+		{0, io.SeekStart, 0},
+	} {
+		pos, err := r.Seek(seek.offset, seek.whence)
+		if err != nil || pos != seek.pos {
+			t.Fatalf("Seek(%d, %d) = %d, %v, want %d", seek.offset, seek.whence, pos, err, seek.pos)
+		}
+		got := make([]byte, 40)
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("read at %d: %v", pos, err)
+		}
+		if string(got) != content[pos:pos+40] {
+			t.Errorf("read at %d got %q, want %q", pos, got, content[pos:pos+40])
+		}
+	}
+	if _, err := r.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("read past the end = %d, %v, want EOF", n, err)
+	}
+
+	// leaving the cold tier inflates the blob again
+	if err := Transition(business.ID, rec.BlobSHA256, TierS3); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, business.ID, rec.BlobSHA256); got != content {
+		t.Errorf("blob back from the cold tier reads %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestSeekIntoCompressedColdBlob(t *testing.T) {
+	testSeekCompressed(t, config.EncryptionConfig{})
+}
+
+func TestSeekIntoCompressedEncryptedColdBlob(t *testing.T) {
+	testSeekCompressed(t, config.EncryptionConfig{MasterKeyID: "k1", MasterKey: testMasterKey(1)})
+}
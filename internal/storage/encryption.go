@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted blobs are split into fixed-size chunks, each sealed with
+// AES-GCM on its own so a Range read only decrypts the chunks it touches.
+//
+//	header: magic(8) | chunk size(4) | reserved(4) | plaintext size(8) | nonce prefix(8)
+//	chunks: ciphertext || tag, one per chunk, the last one possibly short
+//
+// Each chunk nonce is the file's nonce prefix followed by the chunk index,
+// and the additional data binds the header, the index and whether it is the
+// final chunk so chunks cannot be reordered, swapped between files or cut off.
+const (
+	encMagic      = "MPENC001"
+	encHeaderSize = 32
+	encChunkSize  = 64 << 10
+)
+
+var errCorruptBlob = errors.New("encrypted blob is corrupt")
+
+type encHeader struct {
+	raw       [encHeaderSize]byte
+	chunkSize int64
+	size      int64
+}
+
+func (h *encHeader) chunks() int64 {
+	if h.size == 0 {
+		return 1
+	}
+	return (h.size + h.chunkSize - 1) / h.chunkSize
+}
+
+func (h *encHeader) nonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, h.raw[24:32])
+	binary.BigEndian.PutUint32(nonce[8:], uint32(index))
+	return nonce
+}
+
+func (h *encHeader) aad(index int64) []byte {
+	aad := make([]byte, encHeaderSize+9)
+	copy(aad, h.raw[:])
+	binary.BigEndian.PutUint64(aad[encHeaderSize:], uint64(index))
+	if index == h.chunks()-1 {
+		aad[encHeaderSize+8] = 1
+	}
+	return aad
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptTo writes size bytes from src to w in the chunked format
+func encryptTo(w io.Writer, src io.Reader, size int64, key []byte) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	h := &encHeader{chunkSize: encChunkSize, size: size}
+	copy(h.raw[:8], encMagic)
+	binary.BigEndian.PutUint32(h.raw[8:12], encChunkSize)
+	binary.BigEndian.PutUint64(h.raw[16:24], uint64(size))
+	if _, err := rand.Read(h.raw[24:32]); err != nil {
+		return err
+	}
+	if _, err := w.Write(h.raw[:]); err != nil {
+		return err
+	}
+
+	buf := make([]byte, encChunkSize)
+	sealed := make([]byte, 0, encChunkSize+gcm.Overhead())
+	remaining := size
+	for i := int64(0); i < h.chunks(); i++ {
+		n := int64(encChunkSize)
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := io.ReadFull(src, buf[:n]); err != nil {
+			return err
+		}
+		sealed = gcm.Seal(sealed[:0], h.nonce(i), buf[:n], h.aad(i))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	return nil
+}
+
+// encryptFile writes an encrypted copy of src to dst atomically
+func encryptFile(src, dst string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := encryptTo(out, in, stat.Size(), key); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// decryptingReader exposes the plaintext of an encrypted blob as a seekable
+// stream, decrypting one chunk at a time
+type decryptingReader struct {
+	f      *os.File
+	gcm    cipher.AEAD
+	header encHeader
+	pos    int64
+	index  int64
+	plain  []byte
+	sealed []byte
+}
+
+func newDecryptingReader(f *os.File, key []byte) (*decryptingReader, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	r := &decryptingReader{f: f, gcm: gcm, index: -1}
+	if _, err := f.ReadAt(r.header.raw[:], 0); err != nil {
+		return nil, errCorruptBlob
+	}
+	if string(r.header.raw[:8]) != encMagic {
+		return nil, errCorruptBlob
+	}
+	r.header.chunkSize = int64(binary.BigEndian.Uint32(r.header.raw[8:12]))
+	r.header.size = int64(binary.BigEndian.Uint64(r.header.raw[16:24]))
+	if r.header.chunkSize <= 0 || r.header.size < 0 {
+		return nil, errCorruptBlob
+	}
+	r.sealed = make([]byte, r.header.chunkSize+int64(gcm.Overhead()))
+	return r, nil
+}
+
+// Size is the plaintext length
+func (r *decryptingReader) Size() int64 {
+	return r.header.size
+}
+
+func (r *decryptingReader) load(index int64) error {
+	if index == r.index {
+		return nil
+	}
+	n := r.header.chunkSize
+	if rest := r.header.size - index*r.header.chunkSize; rest < n {
+		n = rest
+	}
+	sealedLen := n + int64(r.gcm.Overhead())
+	offset := encHeaderSize + index*(r.header.chunkSize+int64(r.gcm.Overhead()))
+	if _, err := r.f.ReadAt(r.sealed[:sealedLen], offset); err != nil {
+		return errCorruptBlob
+	}
+	plain, err := r.gcm.Open(r.plain[:0], r.header.nonce(index), r.sealed[:sealedLen], r.header.aad(index))
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d failed authentication", errCorruptBlob, index)
+	}
+	r.plain, r.index = plain, index
+	return nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.pos >= r.header.size {
+		return 0, io.EOF
+	}
+	index := r.pos / r.header.chunkSize
+	if err := r.load(index); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.plain[r.pos-index*r.header.chunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.header.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.f.Close()
+}
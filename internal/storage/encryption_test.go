@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+)
+
+func testMasterKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// spanning content crosses several encryption chunks
+func spanningContent() string {
+	var sb strings.Builder
+	for i := 0; sb.Len() < 3*encChunkSize+1000; i++ {
+		sb.WriteString("line ")
+		sb.WriteString(strings.Repeat("x", i%50))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func TestEncryptedBlobRoundTrip(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{MasterKeyID: "k1", MasterKey: testMasterKey(1)})
+	content := spanningContent()
+	rec := ingestContent(t, business, "a", content)
+
+	blob, err := db.GetBlob(business.ID, rec.BlobSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blob.Encrypted || blob.KeyID == "" {
+		t.Fatalf("blob row records encrypted=%v key=%q", blob.Encrypted, blob.KeyID)
+	}
+	stored, err := os.ReadFile(storedPath(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte(content[:100])) {
+		t.Error("stored file contains plaintext")
+	}
+	if got := readBlob(t, business.ID, rec.BlobSHA256); got != content {
+		t.Fatalf("decrypted %d bytes, want %d", len(got), len(content))
+	}
+
+	// a range read only decrypts the chunks it touches
+	r, err := Open(business.ID, rec.BlobSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	offset := int64(2*encChunkSize - 10)
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	part := make([]byte, 20)
+	if _, err := io.ReadFull(r, part); err != nil {
+		t.Fatal(err)
+	}
+	if string(part) != content[offset:offset+20] {
+		t.Errorf("range read across a chunk boundary got %q, want %q", part, content[offset:offset+20])
+	}
+}
+
+func TestPlaintextWithEncryptionHeaderStaysReadable(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	content := encMagic + strings.Repeat("\x00", 40) + "looks encrypted, is not"
+	rec := ingestContent(t, business, "a", content)
+	if got := readBlob(t, business.ID, rec.BlobSHA256); got != content {
+		t.Errorf("plaintext blob reads %q", got)
+	}
+
+	// enabling encryption later does not change how the stored blob is read
+	if err := initKeyring(config.EncryptionConfig{MasterKeyID: "k1", MasterKey: testMasterKey(1)}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, business.ID, rec.BlobSHA256); got != content {
+		t.Errorf("plaintext blob reads %q once encryption is enabled", got)
+	}
+}
+
+func TestMasterKeyRotation(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{MasterKeyID: "k1", MasterKey: testMasterKey(1)})
+	rec := ingestContent(t, business, "a", "rotate me")
+	before, _ := db.GetBlob(business.ID, rec.BlobSHA256)
+
+	err := initKeyring(config.EncryptionConfig{
+		MasterKeyID:  "k2",
+		MasterKey:    testMasterKey(2),
+		PreviousKeys: map[string]string{"k1": testMasterKey(1)},
+	}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := RotateMasterKey(); err != nil || n != 1 {
+		t.Fatalf("RotateMasterKey = %d, %v, want 1", n, err)
+	}
+	if n, err := RotateMasterKey(); err != nil || n != 0 {
+		t.Fatalf("second RotateMasterKey = %d, %v, want 0", n, err)
+	}
+	stored, err := db.GetBusinessKey(business.ID)
+	if err != nil || stored.MasterKeyID != "k2" {
+		t.Fatalf("data key wrapped by %+v, %v, want k2", stored, err)
+	}
+
+	// the old master key is no longer needed, and the data key is the same
+	if err := initKeyring(config.EncryptionConfig{MasterKeyID: "k2", MasterKey: testMasterKey(2)}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, business.ID, rec.BlobSHA256); got != "rotate me" {
+		t.Errorf("blob reads %q after rotation", got)
+	}
+	after := ingestContent(t, business, "b", "written after rotation")
+	blob, _ := db.GetBlob(business.ID, after.BlobSHA256)
+	if blob.KeyID != before.KeyID {
+		t.Errorf("data key changed with the master key: %s, was %s", blob.KeyID, before.KeyID)
+	}
+
+	// a master key that is not configured cannot unwrap the data key
+	if err := initKeyring(config.EncryptionConfig{MasterKeyID: "k3", MasterKey: testMasterKey(3)}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(business.ID, rec.BlobSHA256); err == nil {
+		t.Error("blob opened without the master key that wraps its data key")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package storage
+
+import "errors"
+
+// freeSpace is not available here, so every root weighs the same
+func freeSpace(path string) (int64, error) {
+	return 0, errors.New("free space is not available on this platform")
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// hotCache keeps the decoded content of small, recently read CDN tier blobs
+// in memory, least recently used evicted first
+type hotCache struct {
+	mu        sync.Mutex
+	maxBytes  int64
+	maxObject int64
+	size      int64
+	order     *list.List
+	items     map[hotKey]*list.Element
+
+	hits, misses, evictions atomic.Int64
+}
+
+type hotKey struct {
+	businessID int
+	sha        string
+}
+
+type hotEntry struct {
+	key  hotKey
+	data []byte
+}
+
+// HotCacheStats are the counters of this instance's hot cache
+type HotCacheStats struct {
+	Bytes     int64
+	Objects   int64
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+var cache = &hotCache{order: list.New(), items: make(map[hotKey]*list.Element)}
+
+// configureHotCache sizes the hot cache; a zero maxBytes disables it
+func configureHotCache(maxBytes, maxObject int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.maxBytes, cache.maxObject = maxBytes, maxObject
+	cache.shrink()
+}
+
+// cacheable reports whether a blob of this size goes in the hot cache
+func (h *hotCache) cacheable(size int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.maxBytes > 0 && size <= h.maxObject && size <= h.maxBytes
+}
+
+func (h *hotCache) get(businessID int, sha string) ([]byte, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	el, ok := h.items[hotKey{businessID, sha}]
+	if !ok {
+		h.misses.Add(1)
+		return nil, false
+	}
+	h.hits.Add(1)
+	h.order.MoveToFront(el)
+	return el.Value.(*hotEntry).data, true
+}
+
+func (h *hotCache) put(businessID int, sha string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := hotKey{businessID, sha}
+	if _, ok := h.items[key]; ok || h.maxBytes <= 0 {
+		return
+	}
+	h.items[key] = h.order.PushFront(&hotEntry{key: key, data: data})
+	h.size += int64(len(data))
+	h.shrink()
+}
+
+// shrink evicts entries until the cache fits; the caller holds the lock
+func (h *hotCache) shrink() {
+	for h.size > h.maxBytes && h.order.Len() > 0 {
+		h.remove(h.order.Back())
+	}
+}
+
+func (h *hotCache) remove(el *list.Element) {
+	entry := h.order.Remove(el).(*hotEntry)
+	delete(h.items, entry.key)
+	h.size -= int64(len(entry.data))
+	h.evictions.Add(1)
+}
+
+// Evict drops a blob from this instance's hot cache and reports whether it
+// was there
+func Evict(businessID int, sha string) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	el, ok := cache.items[hotKey{businessID, sha}]
+	if ok {
+		cache.remove(el)
+	}
+	return ok
+}
+
+// GetHotCacheStats returns a snapshot of the hot cache counters
+func GetHotCacheStats() HotCacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return HotCacheStats{
+		Bytes:     cache.size,
+		Objects:   int64(cache.order.Len()),
+		Hits:      cache.hits.Load(),
+		Misses:    cache.misses.Load(),
+		Evictions: cache.evictions.Load(),
+	}
+}
+
+// openCached serves a small CDN tier blob from the hot cache, filling the
+// cache on a miss
+func openCached(businessID int, sha string, open func() (io.ReadSeekCloser, error)) (io.ReadSeekCloser, error) {
+	if data, ok := cache.get(businessID, sha); ok {
+		return nopCloser{bytes.NewReader(data)}, nil
+	}
+	r, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	cache.put(businessID, sha, data)
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error { return nil }
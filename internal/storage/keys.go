@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+)
+
+// keyring holds the master keys; only the current one wraps new data keys
+var keyring struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+// unwrapped data keys by business ID
+var dataKeys sync.Map
+
+func initKeyring(cfg config.EncryptionConfig, environment string) error {
+	keyring.keys = make(map[string][]byte)
+	keyring.currentID = ""
+	dataKeys.Range(func(id, _ interface{}) bool {
+		dataKeys.Delete(id)
+		return true
+	})
+
+	if cfg.MasterKey == "" {
+		if environment == "production" {
+			return errors.New("MASTER_KEY is required in production")
+		}
+		log.Println("MASTER_KEY not set, stored objects will not be encrypted")
+		return nil
+	}
+
+	for id, encoded := range cfg.PreviousKeys {
+		key, err := decodeMasterKey(encoded)
+		if err != nil {
+			return fmt.Errorf("previous master key %q: %w", id, err)
+		}
+		keyring.keys[id] = key
+	}
+	key, err := decodeMasterKey(cfg.MasterKey)
+	if err != nil {
+		return fmt.Errorf("master key: %w", err)
+	}
+	keyring.keys[cfg.MasterKeyID] = key
+	keyring.currentID = cfg.MasterKeyID
+	return nil
+}
+
+func decodeMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("must be 32 bytes")
+	}
+	return key, nil
+}
+
+// EncryptionEnabled reports whether new blobs are encrypted at rest
+func EncryptionEnabled() bool {
+	return keyring.currentID != ""
+}
+
+// wrapKey seals a data key under a master key, bound to its business
+func wrapKey(master, key []byte, businessID int) ([]byte, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, key, []byte("business:"+strconv.Itoa(businessID))), nil
+}
+
+func unwrapKey(master, wrapped []byte, businessID int) ([]byte, error) {
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	nonce, sealed := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, []byte("business:"+strconv.Itoa(businessID)))
+}
+
+// dataKey returns the data key of a business, generating and storing a
+// wrapped one the first time the business writes an object
+func dataKey(businessID int) ([]byte, error) {
+	if key, ok := dataKeys.Load(businessID); ok {
+		return key.([]byte), nil
+	}
+
+	stored, err := db.GetBusinessKey(businessID)
+	if errors.Is(err, sql.ErrNoRows) {
+		if !EncryptionEnabled() {
+			return nil, errors.New("encryption is not configured")
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		wrapped, err := wrapKey(keyring.keys[keyring.currentID], key, businessID)
+		if err != nil {
+			return nil, err
+		}
+		stored, err = db.CreateBusinessKey(&db.BusinessKey{BusinessID: businessID, WrappedKey: wrapped, MasterKeyID: keyring.currentID})
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	master, ok := keyring.keys[stored.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q for business %d is not configured", stored.MasterKeyID, businessID)
+	}
+	key, err := unwrapKey(master, stored.WrappedKey, businessID)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key of business %d: %w", businessID, err)
+	}
+	dataKeys.Store(businessID, key)
+	return key, nil
+}
+
+// dataKeyID identifies a data key without revealing it, so blob rows can
+// record which key their file is encrypted with
+func dataKeyID(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("mediapipeline data key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// blobKey returns the data key a blob file is encrypted with, after checking
+// it is the key the blob row names. Rows without a key ID are not checked.
+func blobKey(businessID int, keyID string) ([]byte, error) {
+	key, err := dataKey(businessID)
+	if err != nil {
+		return nil, err
+	}
+	if id := dataKeyID(key); keyID != "" && id != keyID {
+		return nil, fmt.Errorf("blob is encrypted with data key %s but business %d has data key %s", keyID, businessID, id)
+	}
+	return key, nil
+}
+
+// RotateMasterKey rewraps every data key still wrapped by a previous master
+// key under the current one. Objects are untouched since their data keys do
+// not change. It returns how many keys were rewrapped.
+func RotateMasterKey() (int, error) {
+	if !EncryptionEnabled() {
+		return 0, errors.New("encryption is not configured")
+	}
+	keys, err := db.BusinessKeysNotWrappedWith(keyring.currentID)
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for _, k := range keys {
+		master, ok := keyring.keys[k.MasterKeyID]
+		if !ok {
+			return rewrapped, fmt.Errorf("master key %q for business %d is not configured", k.MasterKeyID, k.BusinessID)
+		}
+		key, err := unwrapKey(master, k.WrappedKey, k.BusinessID)
+		if err != nil {
+			return rewrapped, fmt.Errorf("unwrap data key of business %d: %w", k.BusinessID, err)
+		}
+		wrapped, err := wrapKey(keyring.keys[keyring.currentID], key, k.BusinessID)
+		if err != nil {
+			return rewrapped, err
+		}
+		if err := db.RewrapBusinessKey(k.BusinessID, k.MasterKeyID, wrapped, keyring.currentID); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
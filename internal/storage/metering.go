@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"io"
+	"log"
+	"time"
+
+	"mediapipeline/internal/db"
+)
+
+// meteredReader counts the bytes read from a blob being downloaded
+type meteredReader struct {
+	io.ReadSeekCloser
+	businessID int
+	tier       string
+	read       int64
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.ReadSeekCloser.Read(p)
+	m.read += int64(n)
+	return n, err
+}
+
+// Close meters the download as one request to the tier and the bytes read
+// as its egress
+func (m *meteredReader) Close() error {
+	if err := db.RecordRequest(m.businessID, time.Now().UTC().Format("2006-01"), m.tier, m.read); err != nil {
+		log.Printf("Failed to meter a download from the %s tier: %v", m.tier, err)
+	}
+	return m.ReadSeekCloser.Close()
+}
+
+// Meter wraps the content of a blob being downloaded so the download is
+// metered against the tier serving it once the content is closed. Archived
+// blobs are metered against the R2 tier even when read from a restored copy.
+func Meter(businessID int, sha string, content io.ReadSeekCloser) io.ReadSeekCloser {
+	tier := TierCDN
+	if b, err := db.GetBlob(businessID, sha); err == nil {
+		tier = b.Tier
+	}
+	return &meteredReader{ReadSeekCloser: content, businessID: businessID, tier: tier}
+}
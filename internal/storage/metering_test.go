@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+)
+
+// tierUsage returns what a business used of a tier this month
+func tierUsage(t *testing.T, businessID int, tier string) db.MeteredUsage {
+	t.Helper()
+	month := time.Now().UTC().Format("2006-01")
+	usage, err := db.MonthlyUsage(businessID, month, month)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range usage {
+		if u.Tier == tier {
+			return u
+		}
+	}
+	return db.MeteredUsage{}
+}
+
+// download reads a blob through the meter, as the download handler does
+func download(t *testing.T, businessID int, sha string) {
+	t.Helper()
+	r, err := Open(businessID, sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metered := Meter(businessID, sha, r)
+	if _, err := io.Copy(io.Discard, metered); err != nil {
+		t.Fatal(err)
+	}
+	metered.Close()
+}
+
+func TestDownloadsAreMeteredAgainstTheirTier(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	content := compressibleContent()
+	rec := ingestContent(t, business, "a", content)
+
+	download(t, business.ID, rec.BlobSHA256)
+	download(t, business.ID, rec.BlobSHA256)
+	if u := tierUsage(t, business.ID, TierCDN); u.Requests != 2 || u.EgressBytes != 2*int64(len(content)) {
+		t.Fatalf("CDN tier metered %d requests and %d bytes, want 2 and %d", u.Requests, u.EgressBytes, 2*len(content))
+	}
+
+	// archived blobs count against the archive, restored copy or not
+	if err := Transition(business.ID, rec.BlobSHA256, TierR2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := StartRestore(business.ID, rec.BlobSHA256, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Thaw(business.ID, rec.BlobSHA256, 1); err != nil {
+		t.Fatal(err)
+	}
+	download(t, business.ID, rec.BlobSHA256)
+	if u := tierUsage(t, business.ID, TierR2); u.Requests != 2 || u.EgressBytes != int64(len(content)) {
+		t.Fatalf("R2 tier metered %d requests and %d bytes, want the thaw and the download of %d", u.Requests, u.EgressBytes, len(content))
+	}
+	if u := tierUsage(t, business.ID, TierS3); u.Requests != 0 {
+		t.Fatalf("S3 tier metered %d requests for a restored copy", u.Requests)
+	}
+}
+
+func TestStorageAccruesByteHours(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	content := compressibleContent()
+	rec := ingestContent(t, business, "a", content)
+	month := time.Now().UTC().Format("2006-01")
+
+	if err := db.AccrueStorage(month, 2); err != nil {
+		t.Fatal(err)
+	}
+	if u := tierUsage(t, business.ID, TierCDN); u.ByteHours != 2*float64(len(content)) {
+		t.Fatalf("CDN tier accrued %v byte hours, want %d", u.ByteHours, 2*len(content))
+	}
+
+	// compressed blobs accrue what they store, and what they hold
+	if err := Transition(business.ID, rec.BlobSHA256, TierR2); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := db.GetBlob(business.ID, rec.BlobSHA256)
+	if !b.Compressed {
+		t.Fatal("archived blob was not compressed")
+	}
+	if err := db.AccrueStorage(month, 3); err != nil {
+		t.Fatal(err)
+	}
+	u := tierUsage(t, business.ID, TierR2)
+	if u.ByteHours != 3*float64(b.StoredSize) || u.LogicalByteHours != 3*float64(len(content)) {
+		t.Fatalf("R2 tier accrued %v and %v logical byte hours, want %d and %d",
+			u.ByteHours, u.LogicalByteHours, 3*b.StoredSize, 3*len(content))
+	}
+
+	// a restored copy is kept in the S3 tier
+	if _, _, err := StartRestore(business.ID, rec.BlobSHA256, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Thaw(business.ID, rec.BlobSHA256, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AccrueStorage(month, 1); err != nil {
+		t.Fatal(err)
+	}
+	if u := tierUsage(t, business.ID, TierS3); u.ByteHours != float64(len(content)) {
+		t.Fatalf("S3 tier accrued %v byte hours for the restored copy, want %d", u.ByteHours, len(content))
+	}
+}
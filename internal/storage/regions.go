@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+)
+
+var (
+	// ErrUnknownRegion means a region is not in the region settings
+	ErrUnknownRegion = errors.New("unknown region")
+	// ErrCrossRegion means data would leave the region it is pinned to
+	ErrCrossRegion = errors.New("data cannot leave its region")
+)
+
+var (
+	defaultRegion  string
+	instanceRegion string
+	regions        map[string]config.RegionPaths
+)
+
+// regions of businesses, which never change once they are registered
+var businessRegions sync.Map
+
+// DefaultRegion is the region of businesses that do not pick one
+func DefaultRegion() string {
+	return defaultRegion
+}
+
+// Regions lists the configured regions by name
+func Regions() []string {
+	names := make([]string, 0, len(regions))
+	for name := range regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidRegion reports whether a region is configured
+func ValidRegion(region string) bool {
+	_, ok := regions[region]
+	return ok
+}
+
+// businessRegion returns the region a business's data lives in
+func businessRegion(businessID int) (string, error) {
+	if region, ok := businessRegions.Load(businessID); ok {
+		return region.(string), nil
+	}
+	business, err := db.GetBusinessByID(businessID)
+	if err != nil {
+		return "", fmt.Errorf("look up region of business %d: %w", businessID, err)
+	}
+	businessRegions.Store(businessID, business.Region)
+	return business.Region, nil
+}
+
+// refuseCrossRegion audits an attempt to move data of a business from its
+// region to another and returns ErrCrossRegion
+func refuseCrossRegion(businessID int, region, target, action, detail string) error {
+	log.Printf("Refused to %s from region %s to %s (business %d, %s)", action, region, target, businessID, detail)
+	err := db.CreateRegionViolation(&db.RegionViolation{
+		BusinessID:   businessID,
+		Region:       region,
+		TargetRegion: target,
+		Action:       action,
+		Detail:       detail,
+	})
+	if err != nil {
+		log.Printf("Failed to record region violation: %v", err)
+	}
+	return ErrCrossRegion
+}
+
+// checkRootRegion refuses, and audits, writing a blob of a business to a
+// root outside the business's region
+func checkRootRegion(businessID int, tier, root, action string) error {
+	region, err := businessRegion(businessID)
+	if err != nil {
+		return err
+	}
+	r, err := db.GetStorageRootByPath(tier, root)
+	if err != nil {
+		return fmt.Errorf("look up storage root %s: %w", root, err)
+	}
+	if r.Region != region {
+		return refuseCrossRegion(businessID, region, r.Region, action, root)
+	}
+	return nil
+}
+
+// ChangeRegion refuses to move a business to another region. Data is pinned
+// to the region it was registered in, so the attempt is only audited.
+func ChangeRegion(business *db.Business, region string) error {
+	if !ValidRegion(region) {
+		return ErrUnknownRegion
+	}
+	if region == business.Region {
+		return nil
+	}
+	return refuseCrossRegion(business.ID, business.Region, region, "change region", "")
+}
+
+// cachedHere reports whether this instance may keep blobs of a business in
+// its hot cache, which only holds data of its own region
+func cachedHere(businessID int) bool {
+	region, err := businessRegion(businessID)
+	return err == nil && region == instanceRegion
+}
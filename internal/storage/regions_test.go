@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newRegionStore sets up the blob store with a second region, eu, next to
+// the default one this instance runs in, and registers a business in each
+func newRegionStore(t *testing.T) (dir string, home, eu *db.Business) {
+	t.Helper()
+	dir = t.TempDir()
+	if err := db.OpenSQLite(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.SQLDB.Close() })
+	mr := miniredis.RunT(t)
+	db.RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.RDB.Close() })
+
+	cfg := &config.Config{
+		Environment: "test",
+		Storage: config.StorageConfig{
+			CDNPath:        filepath.Join(dir, "cdn"),
+			S3Path:         filepath.Join(dir, "s3"),
+			R2Path:         filepath.Join(dir, "r2"),
+			DefaultRegion:  "default",
+			InstanceRegion: "default",
+			Regions: map[string]config.RegionPaths{
+				"eu": {CDNPath: filepath.Join(dir, "eu-cdn"), S3Path: filepath.Join(dir, "eu-s3"), R2Path: filepath.Join(dir, "eu-r2")},
+			},
+			HotCacheBytes:       1 << 20,
+			HotCacheObjectBytes: 1 << 16,
+		},
+	}
+	if err := Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if home, err = db.CreateBusiness("home", "home@example.com", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if eu, err = db.CreateBusiness("eu", "eu@example.com", "eu"); err != nil {
+		t.Fatal(err)
+	}
+	return dir, home, eu
+}
+
+func violations(t *testing.T) []db.RegionViolation {
+	t.Helper()
+	v, err := db.ListRegionViolations(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestBlobsStayInTheirRegion(t *testing.T) {
+	dir, home, eu := newRegionStore(t)
+	rec := ingestContent(t, eu, "a", compressibleContent())
+	within := func(region string) {
+		t.Helper()
+		b, _ := db.GetBlob(eu.ID, rec.BlobSHA256)
+		if !strings.HasPrefix(b.Root, filepath.Join(dir, region+"-")) {
+			t.Fatalf("blob in the %s tier is on %s, outside region %s", b.Tier, b.Root, region)
+		}
+	}
+	within("eu")
+	for _, tier := range []string{TierS3, TierR2, TierCDN} {
+		if err := Transition(eu.ID, rec.BlobSHA256, tier); err != nil {
+			t.Fatal(err)
+		}
+		within("eu")
+	}
+
+	// a root added to the default region takes none of the eu blobs
+	root, _, err := AddRoot("default", TierCDN, filepath.Join(dir, "cdn2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Rebalance(root.ID); err != nil {
+		t.Fatal(err)
+	}
+	within("eu")
+
+	// nor can a blob be moved there by hand, which is audited
+	b, _ := db.GetBlob(eu.ID, rec.BlobSHA256)
+	if err := relocate(b, root.Path); !errors.Is(err, ErrCrossRegion) {
+		t.Fatalf("relocate to a root of another region: %v, want ErrCrossRegion", err)
+	}
+	within("eu")
+	v := violations(t)
+	if len(v) != 1 || v[0].BusinessID != eu.ID || v[0].Region != "eu" || v[0].TargetRegion != "default" {
+		t.Fatalf("violations = %+v, want the refused move", v)
+	}
+
+	// businesses of this instance's region are cached here, others not
+	if !cachedHere(home.ID) || cachedHere(eu.ID) {
+		t.Fatalf("cached here: home %v, eu %v", cachedHere(home.ID), cachedHere(eu.ID))
+	}
+}
+
+func TestRegionsCannotBeChanged(t *testing.T) {
+	dir, home, eu := newRegionStore(t)
+	if err := ChangeRegion(eu, "eu"); err != nil {
+		t.Fatalf("ChangeRegion to the same region: %v", err)
+	}
+	if err := ChangeRegion(eu, "mars"); !errors.Is(err, ErrUnknownRegion) {
+		t.Fatalf("ChangeRegion to an unknown region: %v, want ErrUnknownRegion", err)
+	}
+	if err := ChangeRegion(home, "eu"); !errors.Is(err, ErrCrossRegion) {
+		t.Fatalf("ChangeRegion to another region: %v, want ErrCrossRegion", err)
+	}
+	// a root belongs to the region it was first added to
+	if _, _, err := AddRoot("default", TierS3, filepath.Join(dir, "eu-s3")); !errors.Is(err, ErrCrossRegion) {
+		t.Fatalf("AddRoot of an eu root to the default region: %v, want ErrCrossRegion", err)
+	}
+	if _, _, err := AddRoot("mars", TierS3, filepath.Join(dir, "mars-s3")); !errors.Is(err, ErrUnknownRegion) {
+		t.Fatalf("AddRoot to an unknown region: %v, want ErrUnknownRegion", err)
+	}
+	if v := violations(t); len(v) != 2 {
+		t.Fatalf("violations = %+v, want the region change and the root move", v)
+	}
+	if b, _ := db.GetBusinessByID(home.ID); b.Region != "default" {
+		t.Fatalf("business moved to region %s", b.Region)
+	}
+}
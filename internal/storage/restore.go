@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+)
+
+// Restore states of a blob as seen by readers. Blobs in the R2 tier are
+// archived: they can only be read while a restored copy of them exists in
+// the S3 tier.
+const (
+	RestoreAvailable  = "available"
+	RestoreArchived   = "archived"
+	RestoreInProgress = "in_progress"
+	RestoreRestored   = "restored"
+)
+
+var (
+	// ErrArchived means a blob has to be restored before it can be read
+	ErrArchived = errors.New("blob is archived in the cold tier")
+	// ErrNotArchived means a restore was asked for a blob that is readable
+	ErrNotArchived = errors.New("blob is not in the cold tier")
+)
+
+// RestoreState returns whether a blob can be read, and until when if only
+// through a restored copy
+func RestoreState(b *db.Blob) (string, time.Time) {
+	switch {
+	case b.Tier != TierR2:
+		return RestoreAvailable, time.Time{}
+	case b.RestoreStatus == RestoreRestored && time.Now().Before(b.RestoredUntil):
+		return RestoreRestored, b.RestoredUntil
+	case b.RestoreStatus == RestoreInProgress:
+		return RestoreInProgress, time.Time{}
+	}
+	return RestoreArchived, time.Time{}
+}
+
+// restoredPath is where the restored copy of an archived blob is kept
+func restoredPath(b *db.Blob) string {
+	return BlobPath(b.RestoreRoot, b.BusinessID, b.SHA256)
+}
+
+// restoredFormat is the format of the restored copy of an archived blob:
+// never compressed, and encrypted like the blob itself
+func restoredFormat(b *db.Blob) blobFormat {
+	return blobFormat{encrypted: b.Encrypted, keyID: b.KeyID}
+}
+
+// StartRestore asks for an archived blob to be readable for days. It reports
+// whether a thaw has to be started; a blob already restored has its copy
+// kept for days from now instead, if that is longer.
+func StartRestore(businessID int, sha string, days int) (*db.Blob, bool, error) {
+	unlock := lockBlob(sha)
+	defer unlock()
+
+	b, err := db.GetBlob(businessID, sha)
+	if err != nil {
+		return nil, false, err
+	}
+	switch state, until := RestoreState(b); state {
+	case RestoreAvailable:
+		return b, false, ErrNotArchived
+	case RestoreInProgress:
+		return b, false, nil
+	case RestoreRestored:
+		if extended := time.Now().AddDate(0, 0, days); extended.After(until) {
+			b.RestoredUntil = extended
+			return b, false, db.SetBlobRestore(businessID, sha, RestoreRestored, b.RestoreRoot, extended)
+		}
+		return b, false, nil
+	}
+	b.RestoreStatus = RestoreInProgress
+	if err := db.SetBlobRestore(businessID, sha, RestoreInProgress, "", time.Time{}); err != nil {
+		return b, false, err
+	}
+	setUploadStates(businessID, sha, uploadstate.Restoring)
+	return b, true, nil
+}
+
+// Thaw writes a readable copy of an archived blob to the S3 tier, inflated
+// and encrypted again if encryption is enabled, and keeps it for days. The
+// blob itself stays in the R2 tier. Like Transition, it only holds the
+// blob's lock to put the finished copy in place.
+func Thaw(businessID int, sha string, days int) (*db.Blob, error) {
+	b, err := db.GetBlob(businessID, sha)
+	if err != nil {
+		return nil, err
+	}
+	if b.Tier != TierR2 || b.RestoreStatus != RestoreInProgress {
+		return b, nil
+	}
+
+	var tmp string
+	b.RestoreRoot, err = placeRoot(TierS3, businessID, sha)
+	dst := restoredPath(b)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(dst), 0o755)
+	}
+	if err == nil {
+		tmp, _, err = stageBlob(b, dst, restoredFormat(b), b.Size)
+	}
+
+	unlock := lockBlob(sha)
+	defer unlock()
+	current, cerr := db.GetBlob(businessID, sha)
+	if cerr != nil || current.Tier != TierR2 || current.RestoreStatus != RestoreInProgress || !samePlacement(b, current) {
+		// the blob was removed, moved or its restore reset meanwhile
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		return current, cerr
+	}
+	if err == nil {
+		if err = os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		if rerr := db.SetBlobRestore(businessID, sha, "", "", time.Time{}); rerr != nil {
+			log.Printf("Failed to reset restore of blob %s: %v", sha, rerr)
+		}
+		setUploadStates(businessID, sha, uploadstate.Archived)
+		return nil, err
+	}
+
+	current.RestoreRoot = b.RestoreRoot
+	b = current
+	b.RestoreStatus = RestoreRestored
+	b.RestoredUntil = time.Now().AddDate(0, 0, days)
+	if err := db.SetBlobRestore(businessID, sha, RestoreRestored, b.RestoreRoot, b.RestoredUntil); err != nil {
+		return nil, err
+	}
+	setUploadStates(businessID, sha, uploadstate.Restored)
+	// a thaw is a retrieval request to the archive
+	if err := db.RecordRequest(businessID, time.Now().UTC().Format("2006-01"), TierR2, 0); err != nil {
+		log.Printf("Failed to meter the restore of blob %s: %v", sha, err)
+	}
+	log.Printf("Blob %s of business %d restored until %s", sha, businessID, b.RestoredUntil.Format(time.RFC3339))
+	return b, nil
+}
+
+// ExpireRestores removes restored copies of archived blobs once they expire
+// and returns how many it removed
+func ExpireRestores() (int, error) {
+	blobs, err := db.ExpiredRestores(TierR2, RestoreRestored, time.Now(), 500)
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, b := range blobs {
+		unlock := lockBlob(b.SHA256)
+		// the blob may have been restored again or moved since it was listed
+		current, err := db.GetBlob(b.BusinessID, b.SHA256)
+		if err == nil && current.Tier == TierR2 && current.RestoreStatus == RestoreRestored &&
+			!time.Now().Before(current.RestoredUntil) {
+			if err := os.Remove(restoredPath(current)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to remove restored copy of blob %s: %v", b.SHA256, err)
+			} else if err := db.SetBlobRestore(b.BusinessID, b.SHA256, "", "", time.Time{}); err == nil {
+				setUploadStates(b.BusinessID, b.SHA256, uploadstate.Archived)
+				expired++
+			}
+		}
+		unlock()
+	}
+	return expired, nil
+}
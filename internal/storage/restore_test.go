@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+)
+
+// archiveContent stores content as a completed upload and moves its blob to
+// the R2 tier
+func archiveContent(t *testing.T, business *db.Business, id, content string) *db.UploadRecord {
+	t.Helper()
+	rec := ingestContent(t, business, id, content)
+	if err := db.RDB.HSet(db.Ctx, uploadstate.Key(id), "status", string(uploadstate.Completed)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Transition(business.ID, rec.BlobSHA256, TierR2); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func uploadState(t *testing.T, id string) uploadstate.State {
+	t.Helper()
+	state, err := uploadstate.Current(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestRestoreMakesArchivedBlobReadable(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{MasterKeyID: "k1", MasterKey: testMasterKey(1)})
+	content := compressibleContent()
+	rec := archiveContent(t, business, "a", content)
+	sha := rec.BlobSHA256
+	if state := uploadState(t, "a"); state != uploadstate.Archived {
+		t.Fatalf("upload is %s after its blob was archived", state)
+	}
+	if _, err := Open(business.ID, sha); !errors.Is(err, ErrArchived) {
+		t.Fatalf("Open of an archived blob: %v, want ErrArchived", err)
+	}
+
+	b, thaw, err := StartRestore(business.ID, sha, 1)
+	if err != nil || !thaw {
+		t.Fatalf("StartRestore = %v, %v, want a thaw started", thaw, err)
+	}
+	if state, _ := RestoreState(b); state != RestoreInProgress || uploadState(t, "a") != uploadstate.Restoring {
+		t.Fatalf("restore is %s, upload %s, want in progress", state, uploadState(t, "a"))
+	}
+	// asking again while the thaw runs starts no second one
+	if _, thaw, err := StartRestore(business.ID, sha, 1); err != nil || thaw {
+		t.Fatalf("second StartRestore = %v, %v, want no thaw", thaw, err)
+	}
+
+	b, err = Thaw(business.ID, sha, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, until := RestoreState(b)
+	if state != RestoreRestored || until.Before(time.Now().Add(23*time.Hour)) {
+		t.Fatalf("restore is %s until %v, want restored for a day", state, until)
+	}
+	if got := readBlob(t, business.ID, sha); got != content {
+		t.Fatal("restored blob reads other content")
+	}
+	if uploadState(t, "a") != uploadstate.Restored {
+		t.Fatalf("upload is %s after the restore", uploadState(t, "a"))
+	}
+
+	// a longer restore keeps the copy longer, without thawing it again
+	b, thaw, err = StartRestore(business.ID, sha, 7)
+	if err != nil || thaw {
+		t.Fatalf("StartRestore of a restored blob = %v, %v, want no thaw", thaw, err)
+	}
+	if _, extended := RestoreState(b); !extended.After(until.Add(5 * 24 * time.Hour)) {
+		t.Fatalf("restore extended to %v, want a week", extended)
+	}
+}
+
+func TestStartRestoreOfReadableBlob(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	rec := ingestContent(t, business, "a", "hot content")
+	if _, _, err := StartRestore(business.ID, rec.BlobSHA256, 1); !errors.Is(err, ErrNotArchived) {
+		t.Fatalf("StartRestore of a hot blob: %v, want ErrNotArchived", err)
+	}
+}
+
+func TestExpiredRestoreIsRemoved(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	rec := archiveContent(t, business, "a", compressibleContent())
+	sha := rec.BlobSHA256
+	if _, _, err := StartRestore(business.ID, sha, 1); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Thaw(business.ID, sha, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyPath := restoredPath(b)
+
+	if n, err := ExpireRestores(); err != nil || n != 0 {
+		t.Fatalf("ExpireRestores = %d, %v before the restore expired", n, err)
+	}
+	if err := db.SetBlobRestore(business.ID, sha, RestoreRestored, b.RestoreRoot, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ExpireRestores(); err != nil || n != 1 {
+		t.Fatalf("ExpireRestores = %d, %v, want the restore removed", n, err)
+	}
+	if _, err := os.Stat(copyPath); !os.IsNotExist(err) {
+		t.Errorf("restored copy is still in place: %v", err)
+	}
+	if _, err := Open(business.ID, sha); !errors.Is(err, ErrArchived) {
+		t.Fatalf("Open after the restore expired: %v, want ErrArchived", err)
+	}
+	if state := uploadState(t, "a"); state != uploadstate.Archived {
+		t.Fatalf("upload is %s after the restore expired", state)
+	}
+}
@@ -0,0 +1,552 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"mediapipeline/internal/db"
+
+	"github.com/dgryski/go-rendezvous"
+)
+
+// Root states. New blobs are placed on active and rebalancing roots only. A
+// rebalancing root is still taking its share of the blobs already in its
+// tier; a draining one is being emptied so it can be removed.
+const (
+	RootActive      = "active"
+	RootRebalancing = "rebalancing"
+	RootDraining    = "draining"
+	RootDrained     = "drained"
+)
+
+var (
+	// ErrLastRoot means draining a root would leave its tier nowhere in its
+	// region to place blobs
+	ErrLastRoot = errors.New("tier has no other root in its region to move blobs to")
+	// ErrRootDraining means a root cannot be added back while it drains
+	ErrRootDraining = errors.New("storage root is draining")
+	// ErrRootNotDrained means a root still holds blobs
+	ErrRootNotDrained = errors.New("storage root has not been drained")
+	// ErrRootConfigured means a root is still in the storage path settings
+	// and would be registered again at startup
+	ErrRootConfigured = errors.New("storage root is still configured")
+)
+
+// most virtual nodes a root gets on a placement ring
+const maxRootWeight = 64
+
+// roots of each tier, in every region, from the storage path settings
+var configured = map[string][]string{}
+
+// RootInfo describes a storage root for operators. FreeBytes is -1 when the
+// free space of its filesystem is unknown.
+type RootInfo struct {
+	db.StorageRoot
+	db.RootUsage
+	FreeBytes  int64
+	Configured bool
+}
+
+func validTier(tier string) bool {
+	return tier == TierCDN || tier == TierS3 || tier == TierR2
+}
+
+// registerRoots records the configured roots of a tier of a region. Blobs
+// stored before the tier had several roots are in the first one of the
+// default region.
+func registerRoots(region, tier string, paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("no root directory configured")
+	}
+	for i, path := range paths {
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			return err
+		}
+		root, _, err := db.AddStorageRoot(region, tier, path, RootActive)
+		if err != nil {
+			return err
+		}
+		if root.Region != region {
+			return fmt.Errorf("%s is already a root of region %s", path, root.Region)
+		}
+		if root.State == RootDraining || root.State == RootDrained {
+			log.Printf("Storage root %s of the %s tier is %s but still configured", path, tier, root.State)
+		}
+		if i == 0 && region == defaultRegion {
+			if err := db.AssignBlobRoots(tier, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isConfigured(tier, path string) bool {
+	for _, p := range configured[tier] {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// ring places blobs on the roots of a tier by rendezvous hashing. Each root
+// gets virtual nodes in proportion to its free space, so emptier disks take
+// a bigger share of blobs.
+type ring struct {
+	hash  *rendezvous.Rendezvous
+	roots map[string]string
+}
+
+func newRing(roots []db.StorageRoot) *ring {
+	free := make([]int64, len(roots))
+	var most int64
+	for i, r := range roots {
+		if n, err := freeSpace(r.Path); err == nil {
+			free[i] = n
+		}
+		most = max(most, free[i])
+	}
+
+	rg := &ring{roots: make(map[string]string)}
+	var nodes []string
+	for i, r := range roots {
+		weight := 1
+		if most > 0 {
+			weight = max(1, int(free[i]*maxRootWeight/most))
+		}
+		for v := 0; v < weight; v++ {
+			node := r.Path + "#" + strconv.Itoa(v)
+			rg.roots[node] = r.Path
+			nodes = append(nodes, node)
+		}
+	}
+	rg.hash = rendezvous.New(nodes, hashString)
+	return rg
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// lookup returns the root a blob belongs on
+func (r *ring) lookup(businessID int, sha string) string {
+	return r.roots[r.hash.Lookup(strconv.Itoa(businessID)+"/"+sha)]
+}
+
+// placementRing builds the ring of the roots of a tier of a region that take
+// new blobs
+func placementRing(region, tier string) (*ring, error) {
+	roots, err := db.ListStorageRoots(region, tier)
+	if err != nil {
+		return nil, err
+	}
+	open := roots[:0]
+	for _, r := range roots {
+		if r.State == RootActive || r.State == RootRebalancing {
+			open = append(open, r)
+		}
+	}
+	if len(open) == 0 {
+		return nil, fmt.Errorf("%s tier of region %s has no root to place blobs on", tier, region)
+	}
+	return newRing(open), nil
+}
+
+// placeRoot picks the root of a tier a blob is written to, always in the
+// region of its business
+func placeRoot(tier string, businessID int, sha string) (string, error) {
+	region, err := businessRegion(businessID)
+	if err != nil {
+		return "", err
+	}
+	rg, err := placementRing(region, tier)
+	if err != nil {
+		return "", err
+	}
+	return rg.lookup(businessID, sha), nil
+}
+
+// ListRoots describes the roots of every tier in every region
+func ListRoots() ([]RootInfo, error) {
+	roots, err := db.ListStorageRoots("", "")
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]RootInfo, 0, len(roots))
+	for _, r := range roots {
+		usage, err := db.StorageRootUsage(r.Tier, r.Path)
+		if err != nil {
+			return nil, err
+		}
+		free, err := freeSpace(r.Path)
+		if err != nil {
+			free = -1
+		}
+		infos = append(infos, RootInfo{StorageRoot: r, RootUsage: *usage, FreeBytes: free, Configured: isConfigured(r.Tier, r.Path)})
+	}
+	return infos, nil
+}
+
+// AddRoot adds a root directory to a tier of a region, or puts a drained one
+// back in use. It reports whether the root is new to the tier's placement;
+// such a root takes new blobs right away and gets its share of the existing
+// ones from Rebalance. A root keeps the region it was first added to, and
+// adding it to another one is refused and audited.
+func AddRoot(region, tier, path string) (*db.StorageRoot, bool, error) {
+	if !validTier(tier) {
+		return nil, false, fmt.Errorf("unknown tier %q", tier)
+	}
+	if !ValidRegion(region) {
+		return nil, false, ErrUnknownRegion
+	}
+	path = filepath.Clean(path)
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, false, err
+	}
+	root, added, err := db.AddStorageRoot(region, tier, path, RootRebalancing)
+	if err != nil || added {
+		return root, added, err
+	}
+	if root.Region != region {
+		return root, false, refuseCrossRegion(0, root.Region, region, "move storage root", path)
+	}
+	switch root.State {
+	case RootDraining:
+		return root, false, ErrRootDraining
+	case RootDrained:
+		if ok, err := db.SetStorageRootState(root.ID, RootDrained, RootRebalancing); err != nil || !ok {
+			return root, false, err
+		}
+		root.State = RootRebalancing
+		return root, true, nil
+	}
+	return root, false, nil
+}
+
+// StartDrain stops placing blobs on a root so Drain can empty it
+func StartDrain(id int) (*db.StorageRoot, error) {
+	root, err := db.GetStorageRoot(id)
+	if err != nil {
+		return nil, err
+	}
+	if root.State == RootDraining || root.State == RootDrained {
+		return root, nil
+	}
+
+	roots, err := db.ListStorageRoots(root.Region, root.Tier)
+	if err != nil {
+		return nil, err
+	}
+	others := 0
+	for _, r := range roots {
+		if r.ID != root.ID && (r.State == RootActive || r.State == RootRebalancing) {
+			others++
+		}
+	}
+	if others == 0 {
+		return root, ErrLastRoot
+	}
+	if _, err := db.SetStorageRootState(id, root.State, RootDraining); err != nil {
+		return nil, err
+	}
+	root.State = RootDraining
+	return root, nil
+}
+
+// RemoveRoot forgets a drained root. Its directory is left as it is.
+func RemoveRoot(id int) error {
+	root, err := db.GetStorageRoot(id)
+	if err != nil {
+		return err
+	}
+	if root.State != RootDrained {
+		return ErrRootNotDrained
+	}
+	if isConfigured(root.Tier, root.Path) {
+		return ErrRootConfigured
+	}
+	usage, err := db.StorageRootUsage(root.Tier, root.Path)
+	if err != nil {
+		return err
+	}
+	if usage.Blobs > 0 || usage.RestoredCopies > 0 {
+		return ErrRootNotDrained
+	}
+	return db.DeleteStorageRoot(id)
+}
+
+// roots with a rebalance or drain running in this process
+var rootMoves = struct {
+	sync.Mutex
+	running map[int]bool
+}{running: make(map[int]bool)}
+
+func startRootMove(id int) bool {
+	rootMoves.Lock()
+	defer rootMoves.Unlock()
+	if rootMoves.running[id] {
+		return false
+	}
+	rootMoves.running[id] = true
+	return true
+}
+
+func finishRootMove(id int) {
+	rootMoves.Lock()
+	defer rootMoves.Unlock()
+	delete(rootMoves.running, id)
+}
+
+// walkBlobs calls fn for every blob of a tier, only those in root unless it
+// is empty
+func walkBlobs(tier, root string, fn func(*db.Blob)) error {
+	afterBusiness, afterSHA := 0, ""
+	for {
+		blobs, err := db.BlobsInTier(tier, root, afterBusiness, afterSHA, 200)
+		if err != nil {
+			return err
+		}
+		for i := range blobs {
+			fn(&blobs[i])
+		}
+		if len(blobs) < 200 {
+			return nil
+		}
+		last := blobs[len(blobs)-1]
+		afterBusiness, afterSHA = last.BusinessID, last.SHA256
+	}
+}
+
+// Rebalance moves the blobs of its tier and region that now belong on a
+// rebalancing root there, then makes the root active. Only blobs placed on
+// the new root move; the others stay where they are.
+func Rebalance(id int) error {
+	if !startRootMove(id) {
+		return nil
+	}
+	defer finishRootMove(id)
+
+	root, err := db.GetStorageRoot(id)
+	if err != nil || root.State != RootRebalancing {
+		return err
+	}
+	rg, err := placementRing(root.Region, root.Tier)
+	if err != nil {
+		return err
+	}
+
+	moved, failed := 0, 0
+	err = walkBlobs(root.Tier, "", func(b *db.Blob) {
+		if b.Root == root.Path || rg.lookup(b.BusinessID, b.SHA256) != root.Path {
+			return
+		}
+		if region, err := businessRegion(b.BusinessID); err != nil || region != root.Region {
+			return
+		}
+		if err := relocate(b, root.Path); err != nil {
+			log.Printf("Failed to move blob %s to %s: %v", b.SHA256, root.Path, err)
+			failed++
+			return
+		}
+		moved++
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebalancing moved %d blobs of the %s tier to %s", moved, root.Tier, root.Path)
+	if failed > 0 {
+		return fmt.Errorf("%d blobs could not be moved to %s", failed, root.Path)
+	}
+	_, err = db.SetStorageRootState(id, RootRebalancing, RootActive)
+	return err
+}
+
+// Drain moves every blob off a draining root, and every restored copy kept
+// there, onto the other roots of its tier in its region, then marks the
+// root drained
+func Drain(id int) error {
+	if !startRootMove(id) {
+		return nil
+	}
+	defer finishRootMove(id)
+
+	root, err := db.GetStorageRoot(id)
+	if err != nil || root.State != RootDraining {
+		return err
+	}
+	rg, err := placementRing(root.Region, root.Tier)
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	err = walkBlobs(root.Tier, root.Path, func(b *db.Blob) {
+		if err := relocate(b, rg.lookup(b.BusinessID, b.SHA256)); err != nil {
+			log.Printf("Failed to move blob %s off %s: %v", b.SHA256, root.Path, err)
+			return
+		}
+		moved++
+	})
+	if err != nil {
+		return err
+	}
+	for root.Tier == TierS3 {
+		copies, err := db.RestoredCopiesOnRoot(root.Path, 200)
+		if err != nil {
+			return err
+		}
+		progress := false
+		for i := range copies {
+			if err := relocateRestored(&copies[i], rg.lookup(copies[i].BusinessID, copies[i].SHA256)); err != nil {
+				log.Printf("Failed to move restored copy of blob %s off %s: %v", copies[i].SHA256, root.Path, err)
+				continue
+			}
+			progress = true
+			moved++
+		}
+		if len(copies) < 200 || !progress {
+			break
+		}
+	}
+	log.Printf("Draining moved %d blobs off %s", moved, root.Path)
+
+	usage, err := db.StorageRootUsage(root.Tier, root.Path)
+	if err != nil {
+		return err
+	}
+	if usage.Blobs > 0 || usage.RestoredCopies > 0 {
+		return fmt.Errorf("%s still holds %d blobs and %d restored copies", root.Path, usage.Blobs, usage.RestoredCopies)
+	}
+	_, err = db.SetStorageRootState(id, RootDraining, RootDrained)
+	return err
+}
+
+// ResumeRootMoves carries on with the rebalances and drains that were
+// running when the server stopped
+func ResumeRootMoves() {
+	roots, err := db.ListStorageRoots("", "")
+	if err != nil {
+		log.Printf("Failed to list storage roots: %v", err)
+		return
+	}
+	for _, r := range roots {
+		switch r.State {
+		case RootRebalancing:
+			err = Rebalance(r.ID)
+		case RootDraining:
+			err = Drain(r.ID)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("Storage root %s is still %s: %v", r.Path, r.State, err)
+		}
+	}
+}
+
+// relocate moves a blob to another root of its tier. The copy is in place
+// before the blob's row points at it, so readers always find the blob. A
+// root outside the blob's region is refused.
+func relocate(b *db.Blob, root string) error {
+	unlock := lockBlob(b.SHA256)
+	defer unlock()
+
+	current, err := db.GetBlob(b.BusinessID, b.SHA256)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if current.Tier != b.Tier || current.Root != b.Root || current.Root == root {
+		return nil
+	}
+	if err := checkRootRegion(current.BusinessID, current.Tier, root, "move blob"); err != nil {
+		return err
+	}
+
+	src, dst := storedPath(current), BlobPath(root, current.BusinessID, current.SHA256)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if _, err := copyStored(src, dst); err != nil {
+		return err
+	}
+	if moved, err := db.SetBlobRoot(current.BusinessID, current.SHA256, current.Tier, current.Root, root); err != nil || !moved {
+		os.Remove(dst)
+		return err
+	}
+	os.Remove(src)
+	return nil
+}
+
+// relocateRestored moves the restored copy of an archived blob to another
+// root of the S3 tier
+func relocateRestored(b *db.Blob, root string) error {
+	unlock := lockBlob(b.SHA256)
+	defer unlock()
+
+	current, err := db.GetBlob(b.BusinessID, b.SHA256)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if current.RestoreStatus != RestoreRestored || current.RestoreRoot != b.RestoreRoot || current.RestoreRoot == root {
+		return nil
+	}
+	if err := checkRootRegion(current.BusinessID, TierS3, root, "move restored copy"); err != nil {
+		return err
+	}
+
+	src, dst := restoredPath(current), BlobPath(root, current.BusinessID, current.SHA256)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if _, err := copyStored(src, dst); err != nil {
+		return err
+	}
+	if moved, err := db.SetBlobRestoreRoot(current.BusinessID, current.SHA256, current.RestoreRoot, root); err != nil || !moved {
+		os.Remove(dst)
+		return err
+	}
+	os.Remove(src)
+	return nil
+}
+
+// copyStored copies the stored bytes of a blob file atomically
+func copyStored(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("copy blob: %w", err)
+	}
+	return n, nil
+}
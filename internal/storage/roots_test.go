@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+)
+
+// testRoots returns roots in directories on one filesystem, so they get the
+// same weight on a ring
+func testRoots(t *testing.T, names ...string) []db.StorageRoot {
+	dir := t.TempDir()
+	roots := make([]db.StorageRoot, 0, len(names))
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, db.StorageRoot{Path: path})
+	}
+	return roots
+}
+
+func rootID(t *testing.T, path string) int {
+	t.Helper()
+	roots, err := db.ListStorageRoots("default", TierCDN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range roots {
+		if r.Path == path {
+			return r.ID
+		}
+	}
+	t.Fatalf("%s is no root", path)
+	return 0
+}
+
+func TestRendezvousPlacementIsStable(t *testing.T) {
+	roots := testRoots(t, "a", "b", "c", "d")
+	before := newRing(roots[:3])
+	placed := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		sha := fmt.Sprintf("%064x", i)
+		placed[sha] = before.lookup(1, sha)
+	}
+
+	// an added root only takes blobs, about its share of them
+	added := newRing(roots)
+	moved := 0
+	for sha, root := range placed {
+		now := added.lookup(1, sha)
+		if now != root {
+			if now != roots[3].Path {
+				t.Fatalf("blob %s moved from %s to %s, not to the added root", sha, root, now)
+			}
+			moved++
+		}
+	}
+	if moved < 300 || moved > 700 {
+		t.Errorf("adding a fourth root moved %d of 2000 blobs, want about 500", moved)
+	}
+
+	// a drained root only gives blobs away
+	drained := newRing([]db.StorageRoot{roots[0], roots[2]})
+	for sha, root := range placed {
+		now := drained.lookup(1, sha)
+		if root != roots[1].Path && now != root {
+			t.Fatalf("blob %s moved from %s to %s, though its root stayed", sha, root, now)
+		}
+		if now == roots[1].Path {
+			t.Fatalf("blob %s is still placed on the drained root", sha)
+		}
+	}
+}
+
+func TestRebalanceAndDrainMoveOnlyTheirShare(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	var recs []*db.UploadRecord
+	for i := 0; i < 40; i++ {
+		recs = append(recs, ingestContent(t, business, fmt.Sprintf("u%d", i), fmt.Sprintf("content %d", i)))
+	}
+	original, _ := db.GetBlob(business.ID, recs[0].BlobSHA256)
+	if _, err := StartDrain(rootID(t, original.Root)); !errors.Is(err, ErrLastRoot) {
+		t.Fatalf("StartDrain of the only root: %v, want ErrLastRoot", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cdn2")
+	root, added, err := AddRoot("default", TierCDN, path)
+	if err != nil || !added || root.State != RootRebalancing {
+		t.Fatalf("AddRoot = %+v, %v, %v", root, added, err)
+	}
+	if err := Rebalance(root.ID); err != nil {
+		t.Fatal(err)
+	}
+	rg, err := placementRing("default", TierCDN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for _, rec := range recs {
+		b, _ := db.GetBlob(business.ID, rec.BlobSHA256)
+		want := original.Root
+		if rg.lookup(business.ID, rec.BlobSHA256) == path {
+			want = path
+			moved++
+		}
+		if b.Root != want {
+			t.Errorf("blob of upload %s is on %s, want %s", rec.ID, b.Root, want)
+		}
+		if readBlob(t, business.ID, rec.BlobSHA256) != fmt.Sprintf("content %s", rec.ID[1:]) {
+			t.Errorf("blob of upload %s reads other content after the rebalance", rec.ID)
+		}
+	}
+	if moved == 0 || moved == len(recs) {
+		t.Fatalf("rebalance moved %d of %d blobs", moved, len(recs))
+	}
+	if root, _ = db.GetStorageRoot(root.ID); root.State != RootActive {
+		t.Fatalf("rebalanced root is %s", root.State)
+	}
+
+	if _, err := StartDrain(root.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := Drain(root.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if b, _ := db.GetBlob(business.ID, rec.BlobSHA256); b.Root != original.Root {
+			t.Errorf("blob of upload %s is on %s after the drain", rec.ID, b.Root)
+		}
+		if readBlob(t, business.ID, rec.BlobSHA256) != fmt.Sprintf("content %s", rec.ID[1:]) {
+			t.Errorf("blob of upload %s reads other content after the drain", rec.ID)
+		}
+	}
+	if err := RemoveRoot(root.ID); err != nil {
+		t.Fatalf("RemoveRoot of the drained root: %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mediapipeline/internal/db"
+)
+
+// Scrub outcomes
+const (
+	ScrubVerified = "verified"
+	ScrubRepaired = "repaired"
+	ScrubCorrupt  = "corrupt"
+)
+
+// ScrubStats are cumulative counters of the scrubber since startup
+type ScrubStats struct {
+	Scanned    int64
+	BytesRead  int64
+	Verified   int64
+	Repaired   int64
+	Corrupt    int64
+	Errors     int64
+	LastPassAt time.Time
+}
+
+var scrubStats struct {
+	scanned, bytesRead, verified, repaired, corrupt, errors atomic.Int64
+
+	mu         sync.Mutex
+	lastPassAt time.Time
+}
+
+// GetScrubStats returns a snapshot of the scrubber counters
+func GetScrubStats() ScrubStats {
+	scrubStats.mu.Lock()
+	defer scrubStats.mu.Unlock()
+	return ScrubStats{
+		Scanned:    scrubStats.scanned.Load(),
+		BytesRead:  scrubStats.bytesRead.Load(),
+		Verified:   scrubStats.verified.Load(),
+		Repaired:   scrubStats.repaired.Load(),
+		Corrupt:    scrubStats.corrupt.Load(),
+		Errors:     scrubStats.errors.Load(),
+		LastPassAt: scrubStats.lastPassAt,
+	}
+}
+
+// errMismatch means a blob decoded cleanly but not to its recorded content
+var errMismatch = errors.New("content does not match recorded SHA-256")
+
+// throttledReader limits reads to rate bytes per second
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if t.rate > 0 && int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	scrubStats.bytesRead.Add(int64(n))
+	if t.rate > 0 {
+		due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
+
+// checkStored reads a stored blob file back and compares it with the
+// recorded size and SHA-256. Damage to the file shows up as errMismatch or
+// a corrupt-format error; anything else is returned as is.
+func checkStored(path string, b *db.Blob, format blobFormat, rate int64) error {
+	r, err := openFile(path, b.BusinessID, format)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, &throttledReader{r: r, rate: rate, start: time.Now()})
+	if err != nil {
+		return err
+	}
+	if n != b.Size || hex.EncodeToString(h.Sum(nil)) != b.SHA256 {
+		return errMismatch
+	}
+	return nil
+}
+
+// damaged reports whether a verification error means the stored bytes are bad
+func damaged(err error) bool {
+	return errors.Is(err, errMismatch) || errors.Is(err, errCorruptBlob) ||
+		errors.Is(err, errCorruptCompression) || os.IsNotExist(err) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// ScrubBlob verifies one blob and returns the outcome. A damaged blob is
+// repaired from an intact replica if there is one, and otherwise
+// quarantined; either way it is reported.
+func ScrubBlob(b *db.Blob, rate int64) (string, error) {
+	scrubStats.scanned.Add(1)
+	err := checkStored(storedPath(b), b, storedFormat(b), rate)
+	if err == nil {
+		scrubStats.verified.Add(1)
+		return ScrubVerified, db.MarkBlobVerified(b.BusinessID, b.SHA256)
+	}
+	if !damaged(err) {
+		scrubStats.errors.Add(1)
+		return "", err
+	}
+
+	// look again under the lock, without throttling, before acting: the blob
+	// may have moved tiers while it was being read
+	unlock := lockBlob(b.SHA256)
+	defer unlock()
+	current, err := db.GetBlob(b.BusinessID, b.SHA256)
+	if err != nil {
+		return "", err
+	}
+	err = checkStored(storedPath(current), current, storedFormat(current), 0)
+	if err == nil {
+		scrubStats.verified.Add(1)
+		return ScrubVerified, db.MarkBlobVerified(current.BusinessID, current.SHA256)
+	}
+	if !damaged(err) {
+		scrubStats.errors.Add(1)
+		return "", err
+	}
+
+	detail := err.Error()
+	if replica, format := findReplica(current); replica != "" {
+		if err := repairBlob(current, replica, format); err != nil {
+			return "", err
+		}
+		detail += "; repaired from " + replica
+		scrubStats.repaired.Add(1)
+		log.Printf("Scrubber repaired blob %s of business %d: %s", current.SHA256, current.BusinessID, detail)
+		if err := db.MarkBlobVerified(current.BusinessID, current.SHA256); err != nil {
+			return "", err
+		}
+		return ScrubRepaired, db.CreateScrubFinding(&db.ScrubFinding{
+			BusinessID: current.BusinessID,
+			SHA256:     current.SHA256,
+			Tier:       current.Tier,
+			Outcome:    ScrubRepaired,
+			Detail:     detail,
+		})
+	}
+
+	// a blob already flagged corrupt was quarantined and reported when it
+	// was first found damaged
+	if current.Corrupt {
+		scrubStats.corrupt.Add(1)
+		return ScrubCorrupt, db.MarkBlobCorrupt(current.BusinessID, current.SHA256)
+	}
+	if moved, err := quarantineBlob(current); err != nil {
+		return "", err
+	} else if moved != "" {
+		detail += "; moved to " + moved
+	}
+	scrubStats.corrupt.Add(1)
+	log.Printf("Scrubber found blob %s of business %d corrupt: %s", current.SHA256, current.BusinessID, detail)
+	if err := db.MarkBlobCorrupt(current.BusinessID, current.SHA256); err != nil {
+		return "", err
+	}
+	return ScrubCorrupt, db.CreateScrubFinding(&db.ScrubFinding{
+		BusinessID: current.BusinessID,
+		SHA256:     current.SHA256,
+		Tier:       current.Tier,
+		Outcome:    ScrubCorrupt,
+		Detail:     detail,
+	})
+}
+
+// QuarantinePath returns where the scrubber moves a damaged blob file found
+// under root
+func QuarantinePath(root string, businessID int, sha string) string {
+	return filepath.Join(root, ".quarantine", strconv.Itoa(businessID), sha)
+}
+
+// quarantineBlob moves a damaged blob file aside, where it is kept for
+// inspection but never served, and returns where it went, or "" if there
+// was no file left to move. The caller holds the blob lock.
+func quarantineBlob(b *db.Blob) (string, error) {
+	dst := QuarantinePath(b.Root, b.BusinessID, b.SHA256)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(storedPath(b), dst); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("quarantine blob: %w", err)
+	}
+	return dst, nil
+}
+
+// findReplica looks for an intact copy of a damaged blob: the restored copy
+// of an archived blob, or a copy left under another root of its region, such
+// as one on a drained root or in the tier it was in before. It returns the
+// path and format of the first copy that reads back to the blob's content,
+// or "" if none does.
+func findReplica(b *db.Blob) (string, blobFormat) {
+	type replica struct {
+		path   string
+		format blobFormat
+	}
+	var replicas []replica
+	if b.Tier == TierR2 && b.RestoreRoot != "" {
+		replicas = append(replicas, replica{restoredPath(b), restoredFormat(b)})
+	}
+	region, err := businessRegion(b.BusinessID)
+	if err == nil {
+		var roots []db.StorageRoot
+		if roots, err = db.ListStorageRoots(region, ""); err == nil {
+			// copies outside the blob's tier may be stored either way
+			plain := blobFormat{encrypted: b.Encrypted, keyID: b.KeyID}
+			compressed := plain
+			compressed.compressed = true
+			for _, r := range roots {
+				if r.Path == b.Root {
+					continue
+				}
+				path := BlobPath(r.Path, b.BusinessID, b.SHA256)
+				replicas = append(replicas, replica{path, plain}, replica{path, compressed})
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Scrubber could not list replicas of blob %s: %v", b.SHA256, err)
+	}
+
+	for _, r := range replicas {
+		if checkStored(r.path, b, r.format, 0) == nil {
+			return r.path, r.format
+		}
+	}
+	return "", blobFormat{}
+}
+
+// repairBlob copies an intact replica over a damaged blob, after moving the
+// damaged file aside, and records the replica's format if it differs. The
+// caller holds the blob lock.
+func repairBlob(b *db.Blob, replica string, format blobFormat) error {
+	if _, err := quarantineBlob(b); err != nil {
+		return err
+	}
+	dst := storedPath(b)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	storedSize, err := copyStored(replica, dst)
+	if err != nil {
+		return err
+	}
+	if b.Tier == TierCDN {
+		Evict(b.BusinessID, b.SHA256)
+	}
+	_, err = db.SetBlobPlacement(b.BusinessID, b.SHA256, b.Tier, b.Tier, b.Root, storedSize,
+		format.compressed, format.encrypted, format.keyID)
+	return err
+}
+
+// Scrub verifies up to limit blobs that are due for verification and
+// returns how many it checked
+func Scrub(interval time.Duration, rate int64, limit int) (int, error) {
+	blobs, err := db.BlobsToVerify(time.Now().Add(-interval), limit)
+	if err != nil {
+		return 0, err
+	}
+	for i := range blobs {
+		if _, err := ScrubBlob(&blobs[i], rate); err != nil {
+			log.Printf("Scrubber could not verify blob %s: %v", blobs[i].SHA256, err)
+		}
+	}
+	return len(blobs), nil
+}
+
+// RunScrubber continuously re-verifies blobs so each is read back about once
+// per interval, never reading faster than rate bytes per second
+func RunScrubber(interval time.Duration, rate int64) {
+	for {
+		n, err := Scrub(interval, rate, 100)
+		if err != nil {
+			log.Printf("Scrubber failed: %v", err)
+			time.Sleep(time.Minute)
+			continue
+		}
+		if n < 100 {
+			scrubStats.mu.Lock()
+			scrubStats.lastPassAt = time.Now()
+			scrubStats.mu.Unlock()
+			time.Sleep(time.Minute)
+		}
+	}
+}
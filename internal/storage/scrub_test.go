@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+)
+
+func TestScrubQuarantinesDamagedBlob(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	rec := ingestContent(t, business, "a", "intact content")
+	blob, _ := db.GetBlob(business.ID, rec.BlobSHA256)
+
+	if outcome, err := ScrubBlob(blob, 0); err != nil || outcome != ScrubVerified {
+		t.Fatalf("ScrubBlob = %q, %v on an intact blob", outcome, err)
+	}
+
+	path := storedPath(blob)
+	if err := os.WriteFile(path, []byte("damaged content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if outcome, err := ScrubBlob(blob, 0); err != nil || outcome != ScrubCorrupt {
+		t.Fatalf("ScrubBlob = %q, %v on a damaged blob", outcome, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("damaged blob file is still in place: %v", err)
+	}
+	quarantined, err := os.ReadFile(QuarantinePath(blob.Root, business.ID, blob.SHA256))
+	if err != nil || string(quarantined) != "damaged content" {
+		t.Errorf("quarantined file reads %q, %v", quarantined, err)
+	}
+	blob, _ = db.GetBlob(business.ID, rec.BlobSHA256)
+	if !blob.Corrupt {
+		t.Error("damaged blob is not flagged corrupt")
+	}
+
+	// a later pass over the flagged blob does not report it again
+	if outcome, err := ScrubBlob(blob, 0); err != nil || outcome != ScrubCorrupt {
+		t.Fatalf("second ScrubBlob = %q, %v", outcome, err)
+	}
+	findings, err := db.ListScrubFindings(10)
+	if err != nil || len(findings) != 1 || findings[0].SHA256 != blob.SHA256 {
+		t.Fatalf("findings = %+v, %v, want one for the damaged blob", findings, err)
+	}
+
+	// putting an intact copy back clears the flag
+	if err := os.WriteFile(path, []byte("intact content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if outcome, err := ScrubBlob(blob, 0); err != nil || outcome != ScrubVerified {
+		t.Fatalf("ScrubBlob = %q, %v once the blob is intact again", outcome, err)
+	}
+	if blob, _ = db.GetBlob(business.ID, rec.BlobSHA256); blob.Corrupt {
+		t.Error("restored blob is still flagged corrupt")
+	}
+}
+
+func TestScrubRepairsBlobFromReplica(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	rec := ingestContent(t, business, "a", "replicated content")
+	blob, _ := db.GetBlob(business.ID, rec.BlobSHA256)
+
+	// a copy left under the S3 tier, as a move that was cut short leaves it
+	root, err := placeRoot(TierS3, business.ID, blob.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica := BlobPath(root, business.ID, blob.SHA256)
+	if err := os.MkdirAll(filepath.Dir(replica), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copyStored(storedPath(blob), replica); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(storedPath(blob), []byte("damaged content!!!"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if outcome, err := ScrubBlob(blob, 0); err != nil || outcome != ScrubRepaired {
+		t.Fatalf("ScrubBlob = %q, %v, want the blob repaired", outcome, err)
+	}
+	if got := readBlob(t, business.ID, blob.SHA256); got != "replicated content" {
+		t.Errorf("repaired blob reads %q", got)
+	}
+	if blob, _ = db.GetBlob(business.ID, rec.BlobSHA256); blob.Corrupt {
+		t.Error("repaired blob is flagged corrupt")
+	}
+	quarantined, err := os.ReadFile(QuarantinePath(blob.Root, business.ID, blob.SHA256))
+	if err != nil || string(quarantined) != "damaged content!!!" {
+		t.Errorf("damaged file was not kept aside: %q, %v", quarantined, err)
+	}
+	findings, _ := db.ListScrubFindings(10)
+	if len(findings) != 1 || findings[0].Outcome != ScrubRepaired {
+		t.Errorf("findings = %+v, want the repair", findings)
+	}
+}
+
+func TestScrubRepairsArchivedBlobFromRestoredCopy(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{MasterKeyID: "k1", MasterKey: testMasterKey(1)})
+	rec := ingestContent(t, business, "a", compressibleContent())
+	if err := Transition(business.ID, rec.BlobSHA256, TierR2); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := StartRestore(business.ID, rec.BlobSHA256, 1); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := Thaw(business.ID, rec.BlobSHA256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blob.Compressed {
+		t.Fatal("archived blob was not compressed")
+	}
+	if err := os.WriteFile(storedPath(blob), []byte("damaged"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if outcome, err := ScrubBlob(blob, 0); err != nil || outcome != ScrubRepaired {
+		t.Fatalf("ScrubBlob = %q, %v, want the blob repaired", outcome, err)
+	}
+	// the archive now holds the restored copy's format
+	blob, _ = db.GetBlob(business.ID, rec.BlobSHA256)
+	if blob.Compressed || !blob.Encrypted {
+		t.Errorf("repaired blob recorded compressed=%v encrypted=%v", blob.Compressed, blob.Encrypted)
+	}
+	if err := checkStored(storedPath(blob), blob, storedFormat(blob), 0); err != nil {
+		t.Errorf("repaired archive does not verify: %v", err)
+	}
+}
+
+func TestIngestRepairsDamagedBlob(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	rec := ingestContent(t, business, "a", "uploaded twice")
+	blob, _ := db.GetBlob(business.ID, rec.BlobSHA256)
+	if err := os.WriteFile(storedPath(blob), []byte("damaged"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if outcome, _ := ScrubBlob(blob, 0); outcome != ScrubCorrupt {
+		t.Fatalf("ScrubBlob = %q on a blob without a replica", outcome)
+	}
+
+	// the same content uploaded again replaces the quarantined file
+	ingestContent(t, business, "b", "uploaded twice")
+	blob, _ = db.GetBlob(business.ID, rec.BlobSHA256)
+	if blob.Corrupt || blob.Refs != 2 {
+		t.Errorf("blob after a second upload: corrupt=%v refs=%d", blob.Corrupt, blob.Refs)
+	}
+	if got := readBlob(t, business.ID, blob.SHA256); got != "uploaded twice" {
+		t.Errorf("repaired blob reads %q", got)
+	}
+
+	// as does one uploaded after the file went missing
+	if err := os.Remove(storedPath(blob)); err != nil {
+		t.Fatal(err)
+	}
+	ingestContent(t, business, "c", "uploaded twice")
+	if got := readBlob(t, business.ID, blob.SHA256); got != "uploaded twice" {
+		t.Errorf("blob whose file went missing reads %q", got)
+	}
+}
@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"mediapipeline/internal/db"
+	"mediapipeline/internal/uploadstate"
+)
+
+// Transition moves a blob to another tier. Compressible content moving into
+// the R2 tier is compressed on the way and inflated again when it leaves, so
+// the blob's size and SHA-256 never change. The new copy is written without
+// holding the blob's lock; the lock is only taken to put it in place, and the
+// copy is dropped if the blob changed meanwhile.
+func Transition(businessID int, sha, target string) error {
+	b, err := db.GetBlob(businessID, sha)
+	if err != nil {
+		return err
+	}
+	if b.Tier == target {
+		return nil
+	}
+	if !validTier(target) {
+		return fmt.Errorf("unknown tier %q", target)
+	}
+	root, err := placeRoot(target, businessID, sha)
+	if err != nil {
+		return err
+	}
+
+	src := storedPath(b)
+	dst := BlobPath(root, businessID, sha)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	// encryption needs the exact length up front, so size the compressed
+	// stream with a dry run first, which also tells whether it is worth it
+	compress, length := false, b.Size
+	if target == TierR2 {
+		if compress, err = worthCompressing(b); err != nil {
+			return err
+		}
+		if compress {
+			if length, err = compressedSize(b); err != nil {
+				return err
+			}
+			compress = length < b.Size
+		}
+	}
+
+	var tmp string
+	var storedSize int64
+	format := storedFormat(b)
+	if !compress && !b.Compressed {
+		// nothing about the stored bytes changes, only where they live
+		tmp, storedSize, err = stageFile(src, dst)
+	} else if format, err = newFormat(businessID, compress); err == nil {
+		tmp, storedSize, err = stageBlob(b, dst, format, length)
+	}
+	if err != nil {
+		return err
+	}
+
+	unlock := lockBlob(sha)
+	defer unlock()
+	current, err := db.GetBlob(businessID, sha)
+	if err != nil || !samePlacement(b, current) {
+		os.Remove(tmp)
+		if err == nil && current.Tier != target {
+			err = fmt.Errorf("blob %s changed while it was moved to %s", sha, target)
+		}
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := db.SetBlobPlacement(businessID, sha, current.Tier, target, root, storedSize,
+		format.compressed, format.encrypted, format.keyID); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	os.Remove(src)
+	// a restored copy is no longer needed once the blob leaves the archive
+	if current.Tier == TierR2 && current.RestoreRoot != "" && restoredPath(current) != dst {
+		os.Remove(restoredPath(current))
+	}
+	if current.Tier == TierCDN {
+		Evict(businessID, sha)
+	}
+	switch {
+	case target == TierR2:
+		setUploadStates(businessID, sha, uploadstate.Archived)
+	case current.Tier == TierR2:
+		setUploadStates(businessID, sha, uploadstate.Completed)
+	}
+	log.Printf("Blob %s of business %d moved from %s to %s (%d bytes stored)", sha, businessID, current.Tier, target, storedSize)
+	return nil
+}
+
+// samePlacement reports whether a blob still has the stored file it had
+// when it was read earlier
+func samePlacement(before, after *db.Blob) bool {
+	return before.Tier == after.Tier && before.Root == after.Root && before.Compressed == after.Compressed &&
+		before.Encrypted == after.Encrypted && before.KeyID == after.KeyID && before.Corrupt == after.Corrupt
+}
+
+// setUploadStates moves the uploads sharing a blob to the state the blob's
+// tier puts them in. Uploads that cannot move, such as those still being
+// moderated, keep their state.
+func setUploadStates(businessID int, sha string, state uploadstate.State) {
+	ids, err := db.UploadsOfBlob(businessID, sha)
+	if err != nil {
+		log.Printf("Failed to list uploads of blob %s: %v", sha, err)
+		return
+	}
+	for _, id := range ids {
+		if _, err := uploadstate.Transition(id, state, nil); err != nil && !errors.Is(err, uploadstate.ErrIllegal) {
+			log.Printf("Failed to move upload %s to %s: %v", id, state, err)
+		}
+	}
+}
+
+// worthCompressing reports whether a blob's content type compresses well,
+// sniffing the content when the upload did not declare one
+func worthCompressing(b *db.Blob) (bool, error) {
+	if b.ContentType != "" {
+		return compressible(b.ContentType), nil
+	}
+	r, err := openStored(b)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return compressible(http.DetectContentType(head[:n])), nil
+}
+
+// stageBlob writes the content of b in the given format to a temporary file
+// next to dst and checks it reads back to the same SHA-256, returning its
+// path for the caller to rename into place. Plaintext of an encrypted blob
+// never touches disk.
+func stageBlob(b *db.Blob, dst string, format blobFormat, length int64) (string, int64, error) {
+	tmp, err := stagingPath(dst)
+	if err != nil {
+		return "", 0, err
+	}
+	storedSize, err := writeBlob(b, tmp, format, length)
+	if err == nil {
+		err = verifyBlob(tmp, b, format)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", 0, err
+	}
+	return tmp, storedSize, nil
+}
+
+// stageFile puts the stored bytes of src in a temporary file next to dst,
+// linking them when both sit on the same device
+func stageFile(src, dst string) (string, int64, error) {
+	tmp, err := stagingPath(dst)
+	if err != nil {
+		return "", 0, err
+	}
+	os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		var n int64
+		if n, err = copyStored(src, tmp); err != nil {
+			return "", 0, err
+		}
+		return tmp, n, nil
+	}
+	stat, err := os.Stat(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", 0, err
+	}
+	return tmp, stat.Size(), nil
+}
+
+// stagingPath creates an empty temporary file next to dst, unique so that
+// concurrent moves of the same blob do not write over each other
+func stagingPath(dst string) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+func compressedSize(b *db.Blob) (int64, error) {
+	plain, err := openStored(b)
+	if err != nil {
+		return 0, err
+	}
+	defer plain.Close()
+	return compressTo(io.Discard, plain, b.Size)
+}
+
+// writeBlob writes length bytes of stored content for b to path
+func writeBlob(b *db.Blob, path string, format blobFormat, length int64) (int64, error) {
+	plain, err := openStored(b)
+	if err != nil {
+		return 0, err
+	}
+	defer plain.Close()
+
+	var content io.Reader = plain
+	if format.compressed {
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := compressTo(pw, plain, b.Size)
+			pw.CloseWithError(err)
+		}()
+		defer pr.Close()
+		content = pr
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	if format.encrypted {
+		var key []byte
+		if key, err = blobKey(b.BusinessID, format.keyID); err == nil {
+			err = encryptTo(out, content, length, key)
+		}
+	} else {
+		_, err = io.CopyN(out, content, length)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+func verifyBlob(path string, b *db.Blob, format blobFormat) error {
+	r, err := openFile(path, b.BusinessID, format)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if n != b.Size || hex.EncodeToString(h.Sum(nil)) != b.SHA256 {
+		return fmt.Errorf("blob %s did not read back intact after rewrite", b.SHA256)
+	}
+	return nil
+}
+
+// Prewarm promotes a blob to the CDN tier and reads it through once so the
+// first requests for it are served from cache
+func Prewarm(businessID int, sha string) error {
+	if err := Transition(businessID, sha, TierCDN); err != nil {
+		return err
+	}
+	r, err := Open(businessID, sha)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
+	}
+	Touch(businessID, sha)
+	return nil
+}
+
+// Touch records that a blob was read so it stays in a hot tier
+func Touch(businessID int, sha string) {
+	if err := db.TouchBlob(businessID, sha); err != nil {
+		log.Printf("Failed to record access to blob %s: %v", sha, err)
+	}
+}
+
+// Demote moves blobs that have gone unread down a tier: CDN to S3 after
+// warmAfter and S3 to R2 after coldAfter. It returns how many were moved.
+func Demote(warmAfter, coldAfter time.Duration) (int, error) {
+	steps := []struct {
+		from, to string
+		after    time.Duration
+	}{
+		{TierS3, TierR2, coldAfter},
+		{TierCDN, TierS3, warmAfter},
+	}
+
+	moved := 0
+	for _, step := range steps {
+		blobs, err := db.IdleBlobs(step.from, time.Now().Add(-step.after), 100)
+		if err != nil {
+			return moved, err
+		}
+		for _, b := range blobs {
+			if err := Transition(b.BusinessID, b.SHA256, step.to); err != nil {
+				log.Printf("Failed to move blob %s to %s: %v", b.SHA256, step.to, err)
+				continue
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// RunTiering periodically demotes idle blobs, removes expired restored
+// copies of archived ones and forgets expired pins
+func RunTiering(interval, warmAfter, coldAfter time.Duration) {
+	// thaws run in this process, so any left in progress will never finish
+	if err := db.ResetRestores(RestoreInProgress); err != nil {
+		log.Printf("Failed to reset interrupted restores: %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := Demote(warmAfter, coldAfter); err != nil {
+			log.Printf("Tiering failed: %v", err)
+		}
+		if _, err := ExpireRestores(); err != nil {
+			log.Printf("Expiring restored blobs failed: %v", err)
+		}
+		if _, err := db.DeleteExpiredPins(time.Now()); err != nil {
+			log.Printf("Removing expired pins failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mediapipeline/internal/config"
+	"mediapipeline/internal/db"
+)
+
+// stagedCopies lists the temporary copies of a blob waiting to be put in
+// place under a root
+func stagedCopies(t *testing.T, root string, b *db.Blob) []string {
+	t.Helper()
+	staged, err := filepath.Glob(BlobPath(root, b.BusinessID, b.SHA256) + ".*.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return staged
+}
+
+// waitStaged waits until a copy of a blob is staged under a root
+func waitStaged(t *testing.T, root string, b *db.Blob) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); len(stagedCopies(t, root, b)) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("no copy was staged while the blob was locked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTransitionCopiesWithoutHoldingBlobLock(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	rec := ingestContent(t, business, "a", compressibleContent())
+	blob, _ := db.GetBlob(business.ID, rec.BlobSHA256)
+	root, err := placeRoot(TierR2, business.ID, blob.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the compressed copy is written while someone else holds the lock
+	unlock := lockBlob(blob.SHA256)
+	done := make(chan error, 1)
+	go func() { done <- Transition(business.ID, blob.SHA256, TierR2) }()
+	waitStaged(t, root, blob)
+	if current, _ := db.GetBlob(business.ID, blob.SHA256); current.Tier != TierCDN {
+		t.Errorf("blob moved to %s before the lock was released", current.Tier)
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	moved, _ := db.GetBlob(business.ID, blob.SHA256)
+	if moved.Tier != TierR2 || !moved.Compressed {
+		t.Errorf("blob is in %s, compressed=%v, want compressed in r2", moved.Tier, moved.Compressed)
+	}
+	if err := verifyBlob(storedPath(moved), moved, storedFormat(moved)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTransitionDropsCopyOfBlobChangedMeanwhile(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	rec := ingestContent(t, business, "a", "moved twice at once")
+	blob, _ := db.GetBlob(business.ID, rec.BlobSHA256)
+	root, err := placeRoot(TierS3, business.ID, blob.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := lockBlob(blob.SHA256)
+	done := make(chan error, 1)
+	go func() { done <- Transition(business.ID, blob.SHA256, TierS3) }()
+	waitStaged(t, root, blob)
+	// the blob is flagged corrupt while the copy is being made
+	if err := db.MarkBlobCorrupt(business.ID, blob.SHA256); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if err := <-done; err == nil {
+		t.Error("copy of a blob that changed meanwhile was put in place")
+	}
+	if current, _ := db.GetBlob(business.ID, blob.SHA256); current.Tier != TierCDN {
+		t.Errorf("blob that changed meanwhile moved to %s", current.Tier)
+	}
+	if staged := stagedCopies(t, root, blob); len(staged) != 0 {
+		t.Errorf("staged copies left behind: %v", staged)
+	}
+}
+
+// idleSince backdates when a blob was last read
+func idleSince(t *testing.T, business *db.Business, sha string, ago time.Duration) {
+	t.Helper()
+	_, err := db.SQLDB.Exec("UPDATE blobs SET last_accessed_at = ?, created_at = ? WHERE business_id = ? AND sha256 = ?",
+		time.Now().Add(-ago).UTC().Format("2006-01-02 15:04:05"), time.Now().Add(-ago).UTC().Format("2006-01-02 15:04:05"),
+		business.ID, sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDemoteKeepsPinnedBlobs(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	pinned := ingestContent(t, business, "pinned", "pinned content")
+	expired := ingestContent(t, business, "expired", "content of an expired pin")
+	unpinned := ingestContent(t, business, "unpinned", "unpinned content")
+	err := db.PinUploads([]db.Pin{
+		{UploadID: "pinned", BusinessID: business.ID, BlobSHA256: pinned.BlobSHA256, Size: pinned.Size, PinnedUntil: time.Now().Add(time.Hour)},
+		{UploadID: "expired", BusinessID: business.ID, BlobSHA256: expired.BlobSHA256, Size: expired.Size, PinnedUntil: time.Now().Add(-time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range []*db.UploadRecord{pinned, expired, unpinned} {
+		idleSince(t, business, rec.BlobSHA256, 2*time.Hour)
+	}
+
+	if _, err := Demote(time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for rec, want := range map[*db.UploadRecord]string{pinned: TierCDN, expired: TierS3, unpinned: TierS3} {
+		if b, _ := db.GetBlob(business.ID, rec.BlobSHA256); b.Tier != want {
+			t.Errorf("blob of upload %s is in %s, want %s", rec.ID, b.Tier, want)
+		}
+	}
+}
+
+func TestPrewarmPromotesToCDN(t *testing.T) {
+	business := newTestStore(t, config.EncryptionConfig{})
+	rec := ingestContent(t, business, "a", compressibleContent())
+	for _, tier := range []string{TierS3, TierR2} {
+		if err := Transition(business.ID, rec.BlobSHA256, tier); err != nil {
+			t.Fatal(err)
+		}
+		if err := Prewarm(business.ID, rec.BlobSHA256); err != nil {
+			t.Fatalf("prewarm from %s: %v", tier, err)
+		}
+		b, _ := db.GetBlob(business.ID, rec.BlobSHA256)
+		if b.Tier != TierCDN || b.AccessCount == 0 {
+			t.Fatalf("prewarmed blob from %s is in %s, read %d times", tier, b.Tier, b.AccessCount)
+		}
+		if readBlob(t, business.ID, rec.BlobSHA256) != compressibleContent() {
+			t.Fatalf("prewarmed blob from %s reads other content", tier)
+		}
+	}
+}
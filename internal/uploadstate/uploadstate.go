@@ -0,0 +1,199 @@
+package uploadstate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"mediapipeline/internal/db"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// State is where an upload is on its way through the pipeline. It is kept
+// as the status of the upload's record in Redis.
+type State string
+
+const (
+	// None is the state of an upload nothing was recorded for yet
+	None State = ""
+
+	// ingest
+	Created   State = "created"
+	Uploading State = "uploading"
+	Uploaded  State = "uploaded"
+	Completed State = "completed"
+
+	// tiering: the upload's blob is in the cold tier, and readable only
+	// while a restored copy of it exists
+	Archived  State = "archived"
+	Restoring State = "restoring"
+	Restored  State = "restored"
+
+	// unfinished uploads that were given up on
+	Failed  State = "failed"
+	Expired State = "expired"
+)
+
+// transitions lists the states each state may move on to. An upload may
+// also stay in its state, which only updates its record.
+var transitions = map[State][]State{
+	None:      {Created, Uploaded, Failed},
+	Created:   {Uploading, Uploaded, Failed, Expired},
+	Uploading: {Uploaded, Failed, Expired},
+	Uploaded:  {Completed},
+	Completed: {Archived},
+	Archived:  {Restoring, Completed},
+	Restoring: {Restored, Archived},
+	Restored:  {Archived, Completed},
+}
+
+// how long the records of uploads that were given up on are kept
+const givenUpTTL = 24 * time.Hour
+
+// ErrIllegal means an upload cannot move to a state from the one it is in,
+// usually because a newer change got to it first
+var ErrIllegal = errors.New("illegal upload state transition")
+
+// Key is the Redis hash holding an upload's state and progress
+func Key(id string) string { return "upload:" + id }
+
+// HistoryKey is the Redis list of an upload's state changes, oldest first
+func HistoryKey(id string) string { return "upload_history:" + id }
+
+// transition moves an upload to ARGV[1] at time ARGV[2] if it is in one of
+// the ARGV[4] states that follow, setting the field/value pairs after them
+// along with it. Records of uploads that were given up on expire after
+// ARGV[3] milliseconds. It returns whether the upload moved, and the state
+// it was in.
+var transition = redis.NewScript(`
+local from = redis.call('HGET', KEYS[1], 'status') or ''
+local n = tonumber(ARGV[4])
+local legal = from == ARGV[1]
+for i = 5, 4 + n do
+	if ARGV[i] == from then legal = true end
+end
+if not legal then return {0, from} end
+
+local fields = {'status', ARGV[1]}
+for i = 5 + n, #ARGV do fields[#fields + 1] = ARGV[i] end
+redis.call('HSET', KEYS[1], unpack(fields))
+redis.call('HSETNX', KEYS[1], 'created_at', ARGV[2])
+if from ~= ARGV[1] then
+	redis.call('RPUSH', KEYS[2], cjson.encode({from = from, to = ARGV[1], at = ARGV[2]}))
+end
+local ttl = tonumber(ARGV[3])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+return {1, from}`)
+
+// Transition moves an upload to state to and sets fields on its record
+// along with it, in one step. Fields are only written if the upload may
+// move, so a late writer cannot undo a newer change. It returns the state
+// the upload was in, wrapping ErrIllegal if it could not move.
+func Transition(id string, to State, fields map[string]interface{}) (State, error) {
+	q := &Queued{id: id, to: to}
+	q.cmd = transition.Run(db.Ctx, db.RDB, []string{Key(id), HistoryKey(id)}, transitionArgs(to, fields)...)
+	return q.Result()
+}
+
+// Queued is a transition queued on a Redis pipeline, whose outcome is known
+// once the pipeline has run
+type Queued struct {
+	id  string
+	to  State
+	cmd *redis.Cmd
+}
+
+// Queue queues a transition on a pipeline, so transitions of many uploads
+// take one round trip to Redis
+func Queue(pipe redis.Pipeliner, id string, to State, fields map[string]interface{}) *Queued {
+	// the script may not be cached yet, and a pipeline cannot fall back to
+	// sending it after the fact
+	cmd := transition.Eval(db.Ctx, pipe, []string{Key(id), HistoryKey(id)}, transitionArgs(to, fields)...)
+	return &Queued{id: id, to: to, cmd: cmd}
+}
+
+// Result returns the state the upload was in, wrapping ErrIllegal if it
+// could not move
+func (q *Queued) Result() (State, error) {
+	res, err := q.cmd.Slice()
+	if err != nil {
+		return None, err
+	}
+	current := State(res[1].(string))
+	if res[0].(int64) == 0 {
+		return current, fmt.Errorf("%w: upload %s is %s, not moving to %s", ErrIllegal, q.id, describe(current), q.to)
+	}
+	return current, nil
+}
+
+func transitionArgs(to State, fields map[string]interface{}) []interface{} {
+	var from []interface{}
+	for state, next := range transitions {
+		for _, s := range next {
+			if s == to {
+				from = append(from, string(state))
+			}
+		}
+	}
+	var ttl int64
+	if to == Failed || to == Expired {
+		ttl = givenUpTTL.Milliseconds()
+	}
+
+	args := []interface{}{string(to), time.Now().UTC().Format(time.RFC3339), ttl, len(from)}
+	args = append(args, from...)
+	for field, value := range fields {
+		args = append(args, field, value)
+	}
+	return args
+}
+
+func describe(s State) string {
+	if s == None {
+		return "unknown"
+	}
+	return string(s)
+}
+
+// Current returns the state an upload is in
+func Current(id string) (State, error) {
+	state, err := db.RDB.HGet(db.Ctx, Key(id), "status").Result()
+	if errors.Is(err, redis.Nil) {
+		return None, nil
+	}
+	return State(state), err
+}
+
+// Change is one move of an upload from one state to another
+type Change struct {
+	From State  `json:"from"`
+	To   State  `json:"to"`
+	At   string `json:"at"`
+}
+
+// History returns the state changes of an upload, oldest first
+func History(id string) ([]Change, error) {
+	entries, err := db.RDB.LRange(db.Ctx, HistoryKey(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	history := make([]Change, 0, len(entries))
+	for _, entry := range entries {
+		var change Change
+		if err := json.Unmarshal([]byte(entry), &change); err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+	return history, nil
+}
+
+// Forget removes the record and history of an upload that is gone
+func Forget(id string) error {
+	return db.RDB.Del(db.Ctx, Key(id), HistoryKey(id)).Err()
+}
@@ -0,0 +1,202 @@
+package uploadstate
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"mediapipeline/internal/db"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) *miniredis.Miniredis {
+	mr := miniredis.RunT(t)
+	db.RDB = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.RDB.Close() })
+	return mr
+}
+
+// putIn records an upload as being in a state, without a transition
+func putIn(t *testing.T, id string, state State) {
+	t.Helper()
+	if err := db.RDB.Del(db.Ctx, Key(id), HistoryKey(id)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if state == None {
+		return
+	}
+	if err := db.RDB.HSet(db.Ctx, Key(id), "status", string(state), "marker", "before").Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	newTestRedis(t)
+	tests := []struct {
+		from, to State
+		legal    bool
+	}{
+		{None, Created, true},
+		{None, Uploaded, true},
+		{None, Failed, true},
+		{None, Uploading, false},
+		{None, Completed, false},
+		{Created, Uploading, true},
+		{Created, Uploaded, true},
+		{Created, Expired, true},
+		{Created, Completed, false},
+		{Uploading, Uploading, true},
+		{Uploading, Uploaded, true},
+		{Uploading, Failed, true},
+		{Uploading, Created, false},
+		{Uploaded, Completed, true},
+		{Uploaded, Uploading, false},
+		{Uploaded, Expired, false},
+		{Completed, Archived, true},
+		{Completed, Uploading, false},
+		{Completed, Restoring, false},
+		{Archived, Restoring, true},
+		{Archived, Completed, true},
+		{Archived, Restored, false},
+		{Restoring, Restored, true},
+		{Restoring, Archived, true},
+		{Restoring, Completed, false},
+		{Restored, Archived, true},
+		{Restored, Completed, true},
+		{Failed, Uploading, false},
+		{Failed, Uploaded, false},
+		{Expired, Created, false},
+		{Expired, Uploaded, false},
+	}
+	for _, tt := range tests {
+		id := "upload"
+		putIn(t, id, tt.from)
+		was, err := Transition(id, tt.to, map[string]interface{}{"marker": "after"})
+		if was != tt.from {
+			t.Errorf("%s -> %s: was %q, want %q", describe(tt.from), tt.to, was, tt.from)
+		}
+		current, _ := Current(id)
+		marker, _ := db.RDB.HGet(db.Ctx, Key(id), "marker").Result()
+		if tt.legal {
+			if err != nil || current != tt.to || marker != "after" {
+				t.Errorf("%s -> %s: %v, now %q with marker %q, want it moved", describe(tt.from), tt.to, err, current, marker)
+			}
+			continue
+		}
+		// an illegal transition writes nothing
+		if !errors.Is(err, ErrIllegal) || current != tt.from || marker == "after" {
+			t.Errorf("%s -> %s: %v, now %q with marker %q, want ErrIllegal", describe(tt.from), tt.to, err, current, marker)
+		}
+	}
+}
+
+func TestTransitionRecordsHistory(t *testing.T) {
+	newTestRedis(t)
+	for _, to := range []State{Created, Uploading, Uploading, Uploaded, Completed} {
+		if _, err := Transition("upload", to, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Transition("upload", Expired, nil); !errors.Is(err, ErrIllegal) {
+		t.Fatalf("completed -> expired: %v, want ErrIllegal", err)
+	}
+
+	history, err := History("upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// staying in a state is no change
+	want := []Change{{None, Created, ""}, {Created, Uploading, ""}, {Uploading, Uploaded, ""}, {Uploaded, Completed, ""}}
+	if len(history) != len(want) {
+		t.Fatalf("history = %v, want %v", history, want)
+	}
+	for i, change := range history {
+		if change.From != want[i].From || change.To != want[i].To || change.At == "" {
+			t.Errorf("change %d = %v, want %v", i, change, want[i])
+		}
+	}
+}
+
+func TestGivenUpRecordsExpire(t *testing.T) {
+	mr := newTestRedis(t)
+	for _, to := range []State{Created, Expired} {
+		if _, err := Transition("upload", to, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ttl := mr.TTL(Key("upload")); ttl != givenUpTTL {
+		t.Fatalf("record of an expired upload lives %v, want %v", ttl, givenUpTTL)
+	}
+	mr.FastForward(givenUpTTL)
+	if mr.Exists(Key("upload")) || mr.Exists(HistoryKey("upload")) {
+		t.Fatal("record of an expired upload was kept")
+	}
+}
+
+func TestQueuedTransitions(t *testing.T) {
+	newTestRedis(t)
+	putIn(t, "finished", Completed)
+	pipe := db.RDB.Pipeline()
+	created := Queue(pipe, "new", Created, map[string]interface{}{"size": 10})
+	late := Queue(pipe, "finished", Uploading, map[string]interface{}{"offset": 5})
+	if _, err := pipe.Exec(db.Ctx); err != nil && !errors.Is(err, redis.Nil) {
+		t.Fatal(err)
+	}
+	if _, err := created.Result(); err != nil {
+		t.Fatalf("queued None -> created: %v", err)
+	}
+	if was, err := late.Result(); was != Completed || !errors.Is(err, ErrIllegal) {
+		t.Fatalf("queued completed -> uploading = %q, %v, want ErrIllegal", was, err)
+	}
+	if offset, _ := db.RDB.HGet(db.Ctx, Key("finished"), "offset").Result(); offset != "" {
+		t.Fatalf("late progress wrote offset %s", offset)
+	}
+}
+
+// Of racing transitions to states that exclude each other, exactly one
+// kind wins, however they interleave
+func TestConcurrentTransitionsCompareAndSet(t *testing.T) {
+	newTestRedis(t)
+	for round := 0; round < 20; round++ {
+		putIn(t, "upload", Uploading)
+		results := make(map[State][]error)
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			to := []State{Uploaded, Expired, Failed}[i%3]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := Transition("upload", to, map[string]interface{}{"by": string(to)})
+				mu.Lock()
+				results[to] = append(results[to], err)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		final, err := Current("upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for to, errs := range results {
+			for _, err := range errs {
+				if to == final && err != nil {
+					t.Fatalf("round %d: move to %s, the final state, failed: %v", round, to, err)
+				}
+				if to != final && !errors.Is(err, ErrIllegal) {
+					t.Fatalf("round %d: move to %s after the upload became %s: %v, want ErrIllegal", round, to, final, err)
+				}
+			}
+		}
+		if by, _ := db.RDB.HGet(db.Ctx, Key("upload"), "by").Result(); by != string(final) {
+			t.Fatalf("round %d: upload is %s but was last written by a move to %s", round, final, by)
+		}
+		history, err := History("upload")
+		if err != nil || len(history) != 1 || history[0].To != final {
+			t.Fatalf("round %d: history = %v, %v, want the one move to %s", round, history, err, final)
+		}
+	}
+}
@@ -3,10 +3,12 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"mediapipeline/internal/api"
 	"mediapipeline/internal/config"
 	"mediapipeline/internal/db"
+	"mediapipeline/internal/storage"
 
 	"github.com/gin-gonic/gin"
 )
@@ -17,9 +19,31 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Maintenance commands only need SQLite and the storage keys
+	if len(os.Args) > 1 {
+		db.InitSQLite()
+		if err := storage.Init(cfg); err != nil {
+			log.Fatalf("Failed to initialize storage: %v", err)
+		}
+		runCommand(os.Args[1:])
+		return
+	}
+
 	// Init Redis and SQLite
 	db.InitRedis()
 	db.InitSQLite()
+	if err := storage.Init(cfg); err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	go storage.RunGC(10*time.Minute, time.Hour)
+	go storage.RunTiering(time.Hour, cfg.Storage.WarmAfter, cfg.Storage.ColdAfter)
+	go storage.RunScrubber(cfg.Storage.ScrubInterval, cfg.Storage.ScrubRate)
+	go storage.ResumeRootMoves()
+	go api.RunLifecycle(cfg.Storage.LifecycleInterval)
+	go api.RunPurgeListener()
+	go api.RunMetering(cfg.Costs.MeteringInterval)
+	go api.RunUploadJanitor(cfg.Uploads.JanitorInterval)
+
 	if cfg.Environment == "production" {
 		gin.SetMode(gin.ReleaseMode)
 	}
@@ -28,6 +52,17 @@ func main() {
 
 	api.SetupRoutes(r, cfg)
 
+	if cfg.S3Gateway.Port != "" {
+		s3 := gin.Default()
+		api.SetupS3Routes(s3)
+		go func() {
+			log.Printf("Starting S3-compatible gateway on port %s", cfg.S3Gateway.Port)
+			if err := s3.Run(":" + cfg.S3Gateway.Port); err != nil {
+				log.Fatalf("Failed to start S3 gateway: %v", err)
+			}
+		}()
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"